@@ -9,27 +9,21 @@ import (
 	"log"
 	"os"
 
+	"github.com/bingoohuang/httpdump/util"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // 打印 pcap 中的 TCP 包, pcap 文件采集示例: `tcpdump -i any -s0 port 9200 -C1 -w 9200.pcap`
 func main() {
-	// Open file instead of device
-	handle, err := pcap.OpenOffline(os.Args[1])
+	// Open file instead of device, filtered by tcp, without libpcap
+	filter := &util.PacketFilter{}
+	packets, err := util.OpenPcapFiles([]string{os.Args[1]}, filter)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer handle.Close()
 
-	// Set filter
-	if err := handle.SetBPFFilter("tcp"); err != nil {
-		log.Fatal(err)
-	}
-
-	packetSrc := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range packetSrc.Packets() {
+	for packet := range packets {
 		printPacketInfo(packet)
 	}
 }
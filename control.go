@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/flagparse"
+	"github.com/bingoohuang/httpdump/handler"
+	"github.com/bingoohuang/httpdump/util"
+	"go.uber.org/multierr"
+)
+
+// outputs is a handler.Sender whose outputs can be added, removed, paused and resumed at runtime.
+type outputs struct {
+	lock    sync.RWMutex
+	names   []string
+	senders map[string]handler.Sender
+	paused  atomic.Bool
+	create  func(out string) (handler.Sender, error)
+}
+
+func newOutputs(create func(out string) (handler.Sender, error)) *outputs {
+	return &outputs{senders: make(map[string]handler.Sender), create: create}
+}
+
+func (s *outputs) Send(msg string, countDiscards bool) {
+	if s.paused.Load() {
+		return
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, name := range s.names {
+		s.senders[name].Send(msg, countDiscards)
+	}
+}
+
+// Add creates a new output, like the -output flag.
+func (s *outputs) Add(out string) error {
+	return s.Change(nil, []string{out})
+}
+
+// Change removes and adds the outputs all at once, nothing is changed if any of them fails,
+// like an output to remove is not found, or an output to add already exists or fails to be created.
+// The failures to close the outputs removed are only logged, for they are removed anyway.
+func (s *outputs) Change(remove, add []string) error {
+	s.lock.Lock()
+
+	var err error
+	removing := make(map[string]bool)
+	for _, out := range remove {
+		if _, ok := s.senders[out]; !ok || removing[out] {
+			err = multierr.Append(err, fmt.Errorf("output %s not found", out))
+		}
+		removing[out] = true
+	}
+	created := make(map[string]handler.Sender)
+	for _, out := range add {
+		if _, ok := s.senders[out]; (ok && !removing[out]) || created[out] != nil {
+			err = multierr.Append(err, fmt.Errorf("output %s already exists", out))
+			continue
+		}
+		if err != nil {
+			continue // not to create the outputs which would be closed at once
+		}
+		sender, e := s.create(out)
+		if e != nil {
+			err = multierr.Append(err, fmt.Errorf("create output %s: %w", out, e))
+			continue
+		}
+		created[out] = sender
+	}
+	if err != nil {
+		s.lock.Unlock()
+		for _, sender := range created {
+			_ = sender.Close()
+		}
+		return err
+	}
+
+	removed := make(map[string]handler.Sender)
+	for _, out := range remove {
+		removed[out] = s.senders[out]
+		delete(s.senders, out)
+		for i, name := range s.names {
+			if name == out {
+				s.names = append(s.names[:i], s.names[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, out := range add {
+		s.senders[out] = created[out]
+		s.names = append(s.names, out)
+	}
+	s.lock.Unlock()
+
+	for _, out := range remove {
+		log.Printf("output %s removed", out)
+		if err := removed[out].Close(); err != nil {
+			log.Printf("E! close output %s failed: %v", out, err)
+		}
+	}
+	for _, out := range add {
+		log.Printf("output %s added", out)
+	}
+	return nil
+}
+
+// Names returns the names of outputs in the order they were added.
+func (s *outputs) Names() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]string(nil), s.names...)
+}
+
+// SQLiteStore returns the first sqlite output, nil if there is none.
+func (s *outputs) SQLiteStore() ExchangeStore {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, name := range s.names {
+		if store, ok := s.senders[name].(*SQLiteStore); ok {
+			return store
+		}
+	}
+	return nil
+}
+
+func (s *outputs) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, name := range s.names {
+		err = multierr.Append(err, s.senders[name].Close())
+	}
+	s.names = nil
+	s.senders = map[string]handler.Sender{}
+	return err
+}
+
+var _ handler.Sender = (*outputs)(nil)
+
+// ControlConf is the runtime adjustable part of the options, nil fields are left unchanged.
+// It is decoded from the control API request body, or from the yaml config file when it changes.
+type ControlConf struct {
+	Interface *string
+	Tunnel    *string
+	Host      *string
+	URI       *string
+	Method    *string
+	Status    *string
+	Anomaly   *string
+	Auth      *string
+	SrcRatio  *float64
+	Rate      *float64
+	Paused    *bool
+
+	Output       []string // replace the outputs with exactly these ones, used by the yaml config file
+	AddOutput    []string
+	RemoveOutput []string
+}
+
+// ControlState is the current runtime state returned by the control API.
+type ControlState struct {
+	Interface string
+	Tunnel    string
+	Host      string
+	URI       string
+	Method    string
+	Status    string
+	Anomaly   string
+	Auth      string
+	SrcRatio  float64
+	Rate      float64
+	Paused    bool
+	Output    []string
+	Budget    handler.BudgetStats // the usage of the memory budget for the reassembly
+	TCP       handler.StreamStats // the gaps and retransmissions of the reassembly
+}
+
+// Controller applies ControlConf to the running capture without losing the tcp connections state.
+type Controller struct {
+	lock    sync.Mutex
+	app     *App
+	outputs *outputs
+	token   string
+}
+
+// State returns the current runtime state.
+func (c *Controller) State() ControlState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f := c.app.handlerOption.Filter()
+	return ControlState{
+		Interface: f.Interface,
+		Tunnel:    f.Tunnel,
+		Host:      f.Host,
+		URI:       f.Uri,
+		Method:    f.Method,
+		Status:    f.Status.String(),
+		Anomaly:   f.Anomaly.String(),
+		Auth:      f.Auth.String(),
+		SrcRatio:  f.SrcRatio,
+		Rate:      c.app.Rate,
+		Paused:    c.outputs.paused.Load(),
+		Output:    c.outputs.Names(),
+		Budget:    c.app.handlerOption.Budget.Stats(),
+		TCP:       handler.TCPStats(),
+	}
+}
+
+// Apply validates the conf and applies it, the filters are swapped all at once.
+// Nothing is applied if any part of the conf is invalid.
+func (c *Controller) Apply(conf *ControlConf) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	opt := c.app.handlerOption
+	f := *opt.Filter()
+	if conf.Interface != nil {
+		f.Interface = *conf.Interface
+	}
+	if conf.Tunnel != nil {
+		f.Tunnel = *conf.Tunnel
+	}
+	if conf.Host != nil {
+		f.Host = *conf.Host
+	}
+	if conf.URI != nil {
+		f.Uri = *conf.URI
+	}
+	if conf.Method != nil {
+		f.Method = *conf.Method
+	}
+	if conf.Status != nil {
+		if f.Status, err = parseStatus(*conf.Status); err != nil {
+			return fmt.Errorf("invalid status %q: %w", *conf.Status, err)
+		}
+	}
+	if conf.Anomaly != nil {
+		if f.Anomaly, err = handler.ParseAnomalyFilter(*conf.Anomaly); err != nil {
+			return fmt.Errorf("invalid anomaly %q: %w", *conf.Anomaly, err)
+		}
+	}
+	if conf.Auth != nil {
+		if f.Auth, err = handler.ParseAuthFilter(*conf.Auth); err != nil {
+			return fmt.Errorf("invalid auth %q: %w", *conf.Auth, err)
+		}
+	}
+	if conf.SrcRatio != nil {
+		if r := *conf.SrcRatio; r <= 0 || r > 1 {
+			return fmt.Errorf("SrcRatio %f is invalid, should be (0,1]", r)
+		}
+		f.SrcRatio = *conf.SrcRatio
+	}
+	if conf.Rate != nil {
+		if r := *conf.Rate; math.IsNaN(r) || math.IsInf(r, 0) {
+			return fmt.Errorf("Rate %f is invalid, should be a number, non-positive for no limit", r)
+		}
+	}
+
+	var remove, add []string
+	if conf.Output != nil {
+		current := c.outputs.Names()
+		for _, out := range current {
+			if !contains(conf.Output, out) {
+				remove = append(remove, out)
+			}
+		}
+		for _, out := range conf.Output {
+			if !contains(current, out) && !contains(add, out) {
+				add = append(add, out)
+			}
+		}
+	}
+	remove = append(remove, conf.RemoveOutput...)
+	add = append(add, conf.AddOutput...)
+	// the outputs are changed first, for they are the only part which may fail when it is applied
+	if len(remove) > 0 || len(add) > 0 {
+		if err := c.outputs.Change(remove, add); err != nil {
+			return err
+		}
+	}
+
+	opt.SetFilter(&f)
+	if conf.Rate != nil {
+		c.app.Rate = *conf.Rate
+		opt.RateLimiter.SetLimit(rateLimit(c.app.Rate))
+	}
+	if conf.Paused != nil {
+		c.outputs.paused.Store(*conf.Paused)
+	}
+
+	return nil
+}
+
+func contains(items []string, item string) bool {
+	for _, s := range items {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+func parseStatus(s string) (util.IntSetFlag, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return util.IntSetFlag{}, nil
+	}
+
+	var status util.IntSetFlag
+	err := status.Set(s)
+	return status, err
+}
+
+// ServeHTTP serves the control API, GET returns the current state, POST/PUT applies a ControlConf.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var conf ControlConf
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.Apply(&conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("control API applied from %s", r.RemoteAddr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, c.State())
+}
+
+// WatchConfig re-applies the yaml config file when it is modified.
+func (c *Controller) WatchConfig(ctx context.Context, file string) {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	if s, err := os.Stat(file); err == nil {
+		lastMod = s.ModTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s, err := os.Stat(file)
+			if err != nil || !s.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = s.ModTime()
+
+			var conf ControlConf
+			if err := flagparse.LoadConfFile(file, "", &conf); err != nil {
+				log.Printf("E! reload %s failed: %v", file, err)
+				continue
+			}
+			if err := c.Apply(&conf); err != nil {
+				log.Printf("E! apply %s failed: %v", file, err)
+				continue
+			}
+			log.Printf("config %s reloaded", file)
+		}
+	}
+}
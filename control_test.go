@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingoohuang/httpdump/handler"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+type closedSender struct{ closed bool }
+
+func (s *closedSender) Send(string, bool) {}
+func (s *closedSender) Close() error      { s.closed = true; return nil }
+
+func newTestController(t *testing.T) (*Controller, map[string]*closedSender) {
+	created := make(map[string]*closedSender)
+	outputs := newOutputs(func(out string) (handler.Sender, error) {
+		if strings.HasPrefix(out, "bad") {
+			return nil, errors.New("bad output")
+		}
+		s := &closedSender{}
+		created[out] = s
+		return s, nil
+	})
+	assert.Nil(t, outputs.Add("stdout"))
+
+	app := &App{handlerOption: &handler.Option{RateLimiter: rate.NewLimiter(rate.Inf, 1)}}
+	app.handlerOption.SetFilter(&handler.Filter{Method: "GET", SrcRatio: 1})
+	return &Controller{app: app, outputs: outputs, token: "secret"}, created
+}
+
+func TestControllerApply(t *testing.T) {
+	c, created := newTestController(t)
+
+	method, rt := "POST", 10.0
+	assert.Nil(t, c.Apply(&ControlConf{Method: &method, Rate: &rt, AddOutput: []string{"a.log"}}))
+	state := c.State()
+	assert.Equal(t, "POST", state.Method)
+	assert.Equal(t, 10.0, state.Rate)
+	assert.Equal(t, []string{"stdout", "a.log"}, state.Output)
+
+	// nothing is applied when any part fails
+	method, status := "PUT", "200"
+	for _, conf := range []*ControlConf{
+		{Method: &method, AddOutput: []string{"b.log", "bad.log"}},
+		{Method: &method, RemoveOutput: []string{"no.log"}, AddOutput: []string{"c.log"}},
+		{Method: &method, AddOutput: []string{"a.log"}},
+		{Method: &method, Status: &status, Rate: func() *float64 { r := math.NaN(); return &r }()},
+	} {
+		assert.NotNil(t, c.Apply(conf))
+		state = c.State()
+		assert.Equal(t, "POST", state.Method)
+		assert.Equal(t, "", state.Status)
+		assert.Equal(t, 10.0, state.Rate)
+		assert.Equal(t, []string{"stdout", "a.log"}, state.Output)
+	}
+	assert.True(t, created["b.log"].closed) // created before bad.log failed, and closed
+	assert.Nil(t, created["c.log"])
+
+	assert.Nil(t, c.Apply(&ControlConf{Output: []string{"a.log", "d.log"}}))
+	assert.Equal(t, []string{"a.log", "d.log"}, c.State().Output)
+	assert.True(t, created["stdout"].closed)
+	assert.False(t, created["a.log"].closed)
+}
+
+func TestControllerServeHTTP(t *testing.T) {
+	c, _ := newTestController(t)
+
+	serve := func(method, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/control", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "wrong", "").Code)
+
+	// the token must be in the Bearer scheme, which is case-insensitive
+	for auth, code := range map[string]int{"secret": http.StatusUnauthorized, "Basic secret": http.StatusUnauthorized,
+		"bearer secret": http.StatusOK, "Bearer": http.StatusUnauthorized} {
+		r := httptest.NewRequest(http.MethodGet, "/api/control", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, auth)
+	}
+
+	w := serve(http.MethodGet, "secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Method":"GET"`)
+
+	w = serve(http.MethodPost, "secret", `{"Method":"DELETE","Paused":true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Method":"DELETE"`)
+	assert.Contains(t, w.Body.String(), `"Paused":true`)
+
+	w = serve(http.MethodPut, "secret", `{"Method":"HEAD","SrcRatio":2}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "DELETE", c.State().Method)
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "secret", `{`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodDelete, "secret", "").Code)
+}
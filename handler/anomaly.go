@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bingoohuang/httpdump/util"
+)
+
+// Severity is how severe an Anomaly is.
+type Severity string
+
+const (
+	SeverityWarn  Severity = "warn"  // violates the spec, but is handled by most of the implementations
+	SeverityError Severity = "error" // parsed differently by different implementations, like the request smuggling
+)
+
+// Anomaly is a protocol level problem found in a message or a connection.
+type Anomaly struct {
+	Kind     string // like cl-te-conflict
+	Severity Severity
+	Detail   string
+}
+
+// String returns the anomaly like error cl-te-conflict: both Content-Length and Transfer-Encoding are sent.
+func (a Anomaly) String() string { return string(a.Severity) + " " + a.Kind + ": " + a.Detail }
+
+// The kinds of the anomalies.
+const (
+	AnomalyCLTEConflict   = "cl-te-conflict"
+	AnomalyDuplicateCL    = "duplicate-content-length"
+	AnomalyInvalidCL      = "invalid-content-length"
+	AnomalyObsFold        = "obs-fold"
+	AnomalyBareLF         = "bare-lf"
+	AnomalyInvalidChunk   = "invalid-chunk-size"
+	AnomalyLengthOverrun  = "length-overrun"
+	AnomalyCountMismatch  = "count-mismatch"
+	anomalyKindsSeparator = ","
+)
+
+// analyzeMessage finds the anomalies of the raw message, which starts with the start line,
+// and may be followed by the bytes of the next one.
+func analyzeMessage(raw []byte, request bool) (anomalies []Anomaly) {
+	add := func(kind string, severity Severity, format string, a ...interface{}) {
+		anomalies = append(anomalies, Anomaly{Kind: kind, Severity: severity, Detail: fmt.Sprintf(format, a...)})
+	}
+
+	head, body := raw, []byte(nil)
+	crlf, lf := bytes.Index(raw, []byte("\n\r\n")), bytes.Index(raw, []byte("\n\n"))
+	if crlf >= 0 && (lf < 0 || crlf < lf) {
+		head, body = raw[:crlf+3], raw[crlf+3:]
+	} else if lf >= 0 {
+		head, body = raw[:lf+2], raw[lf+2:]
+	}
+
+	var cls, tes []string
+	var name string
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	for n, line := range lines {
+		if bytes.HasSuffix(line, []byte("\n")) && !bytes.HasSuffix(line, []byte("\r\n")) {
+			add(AnomalyBareLF, SeverityWarn, "line %d ends with a bare LF", n+1)
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if n == 0 || len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			add(AnomalyObsFold, SeverityWarn, "header %s is folded at line %d", name, n+1)
+			continue
+		}
+
+		k, v, _ := strings.Cut(string(line), ":")
+		name, v = k, strings.TrimSpace(v)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "content-length":
+			cls = append(cls, v)
+		case "transfer-encoding":
+			tes = append(tes, v)
+		}
+	}
+
+	if len(cls) > 0 && len(tes) > 0 {
+		add(AnomalyCLTEConflict, SeverityError, "both Content-Length %s and Transfer-Encoding %s are sent",
+			strings.Join(cls, ","), strings.Join(tes, ","))
+	}
+	if len(cls) > 1 {
+		severity := SeverityWarn
+		for _, v := range cls[1:] {
+			if v != cls[0] {
+				severity = SeverityError
+			}
+		}
+		add(AnomalyDuplicateCL, severity, "%d Content-Length headers %s", len(cls), strings.Join(cls, ","))
+	}
+	length := int64(-1)
+	for _, v := range cls {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || v[0] == '+' {
+			add(AnomalyInvalidCL, SeverityError, "invalid Content-Length %q", v)
+			length = -1
+			break
+		}
+		length = n
+	}
+
+	if len(tes) > 0 {
+		te := tes[len(tes)-1]
+		if i := strings.LastIndexByte(te, ','); i >= 0 {
+			te = te[i+1:]
+		}
+		if strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			if err := checkChunks(body); err != nil {
+				add(AnomalyInvalidChunk, SeverityError, "%v", err)
+			}
+		}
+	} else if length >= 0 && int64(len(body)) > length {
+		// the bytes after the body are allowed to be the next message only
+		next := body[length:]
+		index := util.IndexResponseTitle
+		if request {
+			index = util.IndexRequestTitle
+		}
+		if index(next) != 0 {
+			add(AnomalyLengthOverrun, SeverityError, "%d bytes sent after the body of Content-Length %d", len(next), length)
+		}
+	}
+
+	return anomalies
+}
+
+// checkChunks checks the chunk sizes of the chunked body, which may be incomplete.
+func checkChunks(body []byte) error {
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '\n')
+		if i < 0 {
+			return nil
+		}
+		line := string(bytes.TrimRight(body[:i], "\r"))
+		size, _, _ := strings.Cut(line, ";") // the chunk extensions
+		n, err := strconv.ParseUint(strings.TrimSpace(size), 16, 63)
+		if err != nil {
+			return fmt.Errorf("invalid chunk size %q", line)
+		}
+		if body = body[i+1:]; n == 0 {
+			return nil // the trailers follow
+		}
+		if uint64(len(body)) < n+2 {
+			return nil
+		}
+		if body = body[n:]; !bytes.HasPrefix(body, []byte("\r\n")) {
+			return fmt.Errorf("chunk of %d bytes is not followed by CRLF", n)
+		}
+		body = body[2:]
+	}
+	return nil
+}
+
+// AnomalyFilter selects the anomalies by their kinds or severities, like error, or cl-te-conflict,bare-lf,
+// a severity selects the ones of it or more severe, * selects all.
+type AnomalyFilter []string
+
+// ParseAnomalyFilter parses the comma separated kinds or severities, empty for no filter.
+func ParseAnomalyFilter(s string) (AnomalyFilter, error) {
+	var f AnomalyFilter
+	for _, v := range strings.Split(s, anomalyKindsSeparator) {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		switch v {
+		case "*", string(SeverityWarn), string(SeverityError), AnomalyCLTEConflict, AnomalyDuplicateCL, AnomalyInvalidCL,
+			AnomalyObsFold, AnomalyBareLF, AnomalyInvalidChunk, AnomalyLengthOverrun, AnomalyCountMismatch:
+			f = append(f, v)
+		default:
+			return nil, fmt.Errorf("unknown anomaly kind or severity %q", v)
+		}
+	}
+	return f, nil
+}
+
+// String returns the comma separated kinds or severities.
+func (f AnomalyFilter) String() string { return strings.Join(f, anomalyKindsSeparator) }
+
+// Permits tells whether any of the anomalies is selected, an empty filter permits everything.
+func (f AnomalyFilter) Permits(anomalies []Anomaly) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, a := range anomalies {
+		for _, v := range f {
+			if v == "*" || v == a.Kind || v == string(a.Severity) || v == string(SeverityWarn) && a.Severity == SeverityError {
+				return true
+			}
+		}
+	}
+	return false
+}
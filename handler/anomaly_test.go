@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeMessage(t *testing.T) {
+	kinds := func(raw string, request bool) (s []string) {
+		for _, a := range analyzeMessage([]byte(raw), request) {
+			s = append(s, string(a.Severity)+" "+a.Kind)
+		}
+		return s
+	}
+
+	assert.Nil(t, kinds("GET / HTTP/1.1\r\nHost: a\r\n\r\n", true))
+	assert.Nil(t, kinds("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 204 No Content\r\n\r\n", false))
+	assert.Nil(t, kinds("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2;x=1\r\nok\r\n0\r\n\r\n", false))
+	assert.Equal(t, []string{"error cl-te-conflict"},
+		kinds("POST / HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true))
+	assert.Equal(t, []string{"warn duplicate-content-length"},
+		kinds("POST / HTTP/1.1\r\nContent-Length: 2\r\ncontent-length: 2\r\n\r\nok", true))
+	assert.Equal(t, []string{"error duplicate-content-length"},
+		kinds("POST / HTTP/1.1\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok", true))
+	assert.Equal(t, []string{"error invalid-content-length"}, kinds("POST / HTTP/1.1\r\nContent-Length: +2\r\n\r\nok", true))
+	assert.Equal(t, []string{"warn obs-fold"}, kinds("GET / HTTP/1.1\r\nX-A: a\r\n b\r\n\r\n", true))
+	assert.Equal(t, []string{"warn bare-lf", "warn bare-lf"}, kinds("GET / HTTP/1.1\nHost: a\r\n\n", true))
+	assert.Equal(t, []string{"error invalid-chunk-size"},
+		kinds("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nok\r\n0\r\n\r\n", false))
+	assert.Equal(t, []string{"error length-overrun"}, kinds("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokay", false))
+
+	f, err := ParseAnomalyFilter("warn")
+	assert.Nil(t, err)
+	assert.True(t, f.Permits([]Anomaly{{Kind: AnomalyCLTEConflict, Severity: SeverityError}}))
+	assert.False(t, f.Permits(nil))
+	f, _ = ParseAnomalyFilter("bare-lf")
+	assert.False(t, f.Permits([]Anomaly{{Kind: AnomalyCLTEConflict, Severity: SeverityError}}))
+	_, err = ParseAnomalyFilter("smuggling")
+	assert.NotNil(t, err)
+}
+
+// assembleAnomalies assembles a request with cl-te-conflict, a clean one and a response of the first.
+func assembleAnomalies() string {
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{SrcRatio: 1, Anomaly: AnomalyFilter{"error", AnomalyCountMismatch}})
+	r, sender := newTestAssembler(option)
+
+	req := "POST /a HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	next := "GET /b HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	rsp := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(req)+len(next)), 5000+uint32(len(rsp))
+	assembleTest(r, true, &layers.TCP{SYN: true, Seq: 999}, "", time.Time{})
+	assembleTest(r, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000}, req, time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000 + uint32(len(req)), Ack: 5000}, next, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000, Ack: reqEnd}, rsp, time.Time{})
+	assembleTest(r, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd + 1}, "", time.Time{})
+	r.FinishAll()
+	return sender.String()
+}
+
+func TestAnomalies(t *testing.T) {
+	out := assembleAnomalies()
+	assert.Contains(t, out, "POST /a HTTP/1.1")
+	assert.Contains(t, out, "// anomaly: error cl-te-conflict: both Content-Length 5 and Transfer-Encoding chunked are sent")
+	assert.NotContains(t, out, "GET /b HTTP/1.1")
+	assert.Contains(t, out, "HTTP/1.1 200 OK") // the response of the flagged request is output with it
+	assert.Contains(t, out, "### ANOMALY#2 TCP 10.0.0.1:5001-10.0.0.2:80")
+	assert.Contains(t, out, "warn count-mismatch: 2 requests, 1 responses")
+
+	t.Setenv("PRINT_JSON", "y")
+	out = assembleAnomalies()
+	assert.Contains(t, out, `"anomalies":[{"kind":"count-mismatch","severity":"warn","detail":"2 requests, 1 responses"}],"event":"ANOMALY","tag":"TCP"`)
+}
+
+func TestAnomaliesAfterDropped(t *testing.T) {
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{Method: "POST", SrcRatio: 1, Anomaly: AnomalyFilter{"error"}})
+	r, sender := newTestAssembler(option)
+
+	// the clean GET is dropped by the method filter, the flagged POST after it is kept
+	get := "GET /a HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	post := "POST /b HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	created := "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(get)+len(post)), 5000+uint32(len(ok)+len(created))
+	start := time.Now()
+	assembleTest(r, true, &layers.TCP{SYN: true, Seq: 999}, "", time.Time{})
+	assembleTest(r, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000}, get, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000, Ack: 1000 + uint32(len(get))}, ok, time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000 + uint32(len(get)), Ack: 5000 + uint32(len(ok))}, post, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000 + uint32(len(ok)), Ack: reqEnd}, created, time.Time{})
+	assembleTest(r, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd + 1}, "", time.Time{})
+	r.FinishAll()
+
+	out := sender.String()
+	assert.Contains(t, out, "POST /b HTTP/1.1")
+	assert.Contains(t, out, "HTTP/1.1 201 Created") // paired with the flagged request, not the dropped one
+	assert.NotContains(t, out, "GET /a HTTP/1.1")
+	assert.NotContains(t, out, "HTTP/1.1 200 OK")
+	assert.Less(t, time.Since(start), verdictWait) // no response waits for the verdict of the dropped request
+}
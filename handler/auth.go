@@ -0,0 +1,396 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/httpdump/httpport"
+)
+
+// maskedPassword replaces the passwords of the Basic credentials, whose length is not leaked either.
+const maskedPassword = "******"
+
+// Auth is the authentication material in the headers of a message, decoded by -inspect-auth.
+type Auth struct {
+	Basic   *BasicAuth   `json:",omitempty"`
+	JWTs    []JWT        `json:",omitempty"`
+	Cookies []AuthCookie `json:",omitempty"`
+}
+
+// BasicAuth is the credentials of the Basic authorization.
+type BasicAuth struct {
+	User     string
+	Password string // masked unless -show-password
+}
+
+// JWT is the json web token sent by the Authorization Bearer or a cookie, whose signature is not verified.
+type JWT struct {
+	Source  string // the header like Authorization, or the cookie like cookie:token
+	Header  map[string]any
+	Claims  map[string]any
+	Expires *time.Time `json:",omitempty"` // by the exp claim
+	Expired bool       `json:",omitempty"` // when the message is captured
+}
+
+// AuthCookie is the cookie sent by the Cookie, or set by the Set-Cookie with its attributes.
+type AuthCookie struct {
+	Set      bool `json:",omitempty"` // by the Set-Cookie
+	Name     string
+	Value    string
+	Path     string     `json:",omitempty"`
+	Domain   string     `json:",omitempty"`
+	Expires  *time.Time `json:",omitempty"` // by the Expires, or the positive Max-Age from when it is captured
+	MaxAge   int        `json:",omitempty"` // -1 for Max-Age=0, which deletes the cookie
+	Secure   bool       `json:",omitempty"`
+	HttpOnly bool       `json:",omitempty"`
+	SameSite string     `json:",omitempty"`
+	Expired  bool       `json:",omitempty"` // deleted by Max-Age=0, or the past Expires without a positive Max-Age
+}
+
+// inspectAuth decodes the Authorization, Proxy-Authorization, Cookie and Set-Cookie headers, t is when the message
+// is captured to tell the expired ones. It returns nil if there is none of them.
+func inspectAuth(header http.Header, t time.Time, showPassword bool) *Auth {
+	a := &Auth{}
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, v := range header.Values(name) {
+			scheme, credentials, _ := strings.Cut(strings.TrimSpace(v), " ")
+			credentials = strings.TrimSpace(credentials)
+			switch strings.ToLower(scheme) {
+			case "basic":
+				if b := parseBasicAuth(credentials); b != nil {
+					if !showPassword {
+						b.Password = maskedPassword
+					}
+					a.Basic = b
+				}
+			case "bearer":
+				if j := parseJWT(credentials, t); j != nil {
+					j.Source = name
+					a.JWTs = append(a.JWTs, *j)
+				}
+			}
+		}
+	}
+
+	for _, c := range httpport.ReadCookies(httpport.Header(header)) {
+		a.addCookie(AuthCookie{Name: c.Name, Value: c.Value}, t)
+	}
+	for _, c := range httpport.ReadSetCookies(httpport.Header(header)) {
+		ac := AuthCookie{
+			Set: true, Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain,
+			MaxAge: c.MaxAge, Secure: c.Secure, HttpOnly: c.HttpOnly, SameSite: c.SameSite,
+		}
+		// the positive Max-Age takes precedence over the Expires
+		if c.MaxAge > 0 {
+			expires := t.Add(time.Duration(c.MaxAge) * time.Second).UTC()
+			ac.Expires = &expires
+		} else if !c.Expires.IsZero() {
+			expires := c.Expires
+			ac.Expires = &expires
+		}
+		ac.Expired = c.MaxAge < 0 || ac.Expires != nil && ac.Expires.Before(t)
+		a.addCookie(ac, t)
+	}
+
+	if a.Basic == nil && len(a.JWTs) == 0 && len(a.Cookies) == 0 {
+		return nil
+	}
+	return a
+}
+
+// addCookie adds the cookie, and the JWT of its value if it is.
+func (a *Auth) addCookie(c AuthCookie, t time.Time) {
+	a.Cookies = append(a.Cookies, c)
+	if j := parseJWT(c.Value, t); j != nil {
+		j.Source = "cookie:" + c.Name
+		a.JWTs = append(a.JWTs, *j)
+	}
+}
+
+// maskedReq is the request whose Basic credentials are masked in its headers, like the decoded ones.
+type maskedReq struct {
+	Req
+	header http.Header
+	raw    []httpport.RawHeader
+}
+
+func (r maskedReq) GetHeader() http.Header              { return r.header }
+func (r maskedReq) GetRawHeaders() []httpport.RawHeader { return r.raw }
+
+// maskBasicAuth masks the credentials of the Basic Authorization and Proxy-Authorization of the request,
+// like Authorization: Basic ******, it returns the request as it is if there are none.
+func maskBasicAuth(r Req) Req {
+	mask := func(name, value string) (string, bool) {
+		if !strings.EqualFold(name, "Authorization") && !strings.EqualFold(name, "Proxy-Authorization") {
+			return value, false
+		}
+		scheme, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(scheme, "basic") {
+			return value, false
+		}
+		return scheme + " " + maskedPassword, true
+	}
+
+	m := maskedReq{Req: r, header: r.GetHeader().Clone()}
+	masked := false
+	for name, values := range m.header {
+		for i, v := range values {
+			if values[i], _ = mask(name, v); values[i] != v {
+				masked = true
+			}
+		}
+	}
+	for _, f := range r.GetRawHeaders() {
+		if v, ok := mask(f.Name, f.Value); ok {
+			f.Value, f.Raw = v, ""
+		}
+		m.raw = append(m.raw, f)
+	}
+	if !masked {
+		return r
+	}
+	return m
+}
+
+func parseBasicAuth(credentials string) *BasicAuth {
+	data, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil
+	}
+	user, password, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil
+	}
+	return &BasicAuth{User: user, Password: password}
+}
+
+// parseJWT decodes the header and the claims of the JWT in the compact serialization, nil if it is not a JWT.
+func parseJWT(token string, t time.Time) *JWT {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	j := &JWT{}
+	if decodeJWTPart(parts[0], &j.Header) != nil || j.Header["alg"] == nil || decodeJWTPart(parts[1], &j.Claims) != nil {
+		return nil
+	}
+	if exp, ok := j.Claims["exp"].(json.Number); ok {
+		if sec, err := exp.Float64(); err == nil {
+			expires := time.Unix(int64(sec), 0).UTC()
+			j.Expires, j.Expired = &expires, expires.Before(t)
+		}
+	}
+	return j
+}
+
+func decodeJWTPart(part string, v *map[string]any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// values returns the values of the field of the auth filter, like basic.user, jwt.sub, jwt.expired or cookie.session.
+func (a *Auth) values(field string) (values []string) {
+	if a == nil {
+		return nil
+	}
+	kind, name, _ := strings.Cut(field, ".")
+	switch kind {
+	case "basic":
+		if a.Basic != nil && (name == "" || name == "user") {
+			values = append(values, a.Basic.User)
+		}
+	case "jwt":
+		for _, j := range a.JWTs {
+			switch name {
+			case "":
+				values = append(values, j.Source)
+			case "expired":
+				values = append(values, fmt.Sprint(j.Expired))
+			default:
+				values = append(values, claimValues(j.Claims[name])...)
+			}
+		}
+	case "cookie":
+		for _, c := range a.Cookies {
+			if name == "" || c.Name == name {
+				values = append(values, c.Value)
+			}
+		}
+	}
+	return values
+}
+
+// claimValues returns the claim like sub, or each of the claim of an array like aud.
+func claimValues(claim any) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case []any:
+		var values []string
+		for _, e := range v {
+			values = append(values, claimValues(e)...)
+		}
+		return values
+	case string:
+		return []string{v}
+	case json.Number:
+		return []string{v.String()}
+	default:
+		data, _ := json.Marshal(v)
+		return []string{string(data)}
+	}
+}
+
+// authFilterSeparator separates the conditions of the AuthFilter.
+const authFilterSeparator = ","
+
+// AuthFilter selects the messages by their decoded authentication material, all of its conditions should be met.
+type AuthFilter []authCondition
+
+// authCondition is field=pattern of the wildcard match(*, ?), or just the field to be present.
+type authCondition struct {
+	Field   string
+	Pattern string
+}
+
+// ParseAuthFilter parses the comma separated conditions like jwt.sub=alice,jwt.expired=false, empty for no filter.
+// The fields are basic.user, jwt.expired, jwt.<claim> like jwt.sub or jwt.iss, and cookie.<name>,
+// or just basic, jwt and cookie for any of them.
+func ParseAuthFilter(s string) (AuthFilter, error) {
+	var f AuthFilter
+	for _, v := range strings.Split(s, authFilterSeparator) {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		field, pattern, _ := strings.Cut(v, "=")
+		field = strings.TrimSpace(field)
+		switch kind, name, _ := strings.Cut(field, "."); {
+		case kind == "basic" && (name == "" || name == "user"), kind == "jwt", kind == "cookie":
+			f = append(f, authCondition{Field: field, Pattern: strings.TrimSpace(pattern)})
+		default:
+			return nil, fmt.Errorf("unknown auth field %q", field)
+		}
+	}
+	return f, nil
+}
+
+// String returns the comma separated conditions.
+func (f AuthFilter) String() string {
+	conditions := make([]string, len(f))
+	for i, c := range f {
+		conditions[i] = c.Field
+		if c.Pattern != "" {
+			conditions[i] += "=" + c.Pattern
+		}
+	}
+	return strings.Join(conditions, authFilterSeparator)
+}
+
+// Permits tells whether the auth meets all the conditions, an empty filter permits everything.
+func (f AuthFilter) Permits(a *Auth) bool {
+	for _, c := range f {
+		values := a.values(c.Field)
+		if len(values) == 0 {
+			return false
+		}
+		if c.Pattern == "" {
+			continue
+		}
+		matched := false
+		for _, v := range values {
+			if matched = wildcardMatch(v, c.Pattern); matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// printAuth prints the auth material like // auth: jwt Authorization iss=https://idp sub=alice exp=... expired,
+// the issuers and the expiries are highlighted if colored.
+func printAuth(b *bytes.Buffer, a *Auth, color bool) {
+	if a == nil {
+		return
+	}
+	paint := func(c, s string) string {
+		if color {
+			return c + s + colorReset
+		}
+		return s
+	}
+
+	var lines []string
+	if a.Basic != nil {
+		lines = append(lines, "basic user="+a.Basic.User+" password="+a.Basic.Password)
+	}
+	for _, j := range a.JWTs {
+		s := "jwt " + j.Source
+		for _, k := range []string{"iss", "sub", "aud"} {
+			if v := claimValues(j.Claims[k]); len(v) > 0 {
+				value := strings.Join(v, ",")
+				if k == "iss" {
+					value = paint(colorKey, value)
+				}
+				s += " " + k + "=" + value
+			}
+		}
+		if j.Expires != nil {
+			s += " exp=" + paint(colorNumber, j.Expires.Format(time.RFC3339))
+		}
+		if j.Expired {
+			s += " " + paint(colorAlert, "expired")
+		}
+		header, _ := json.Marshal(j.Header)
+		claims, _ := json.Marshal(j.Claims)
+		lines = append(lines, s+" header="+string(header)+" claims="+string(claims))
+	}
+	for _, c := range a.Cookies {
+		if !c.Set {
+			lines = append(lines, "cookie "+c.Name+"="+c.Value)
+			continue
+		}
+		attrs := []string{c.Name + "=" + c.Value}
+		if c.Path != "" {
+			attrs = append(attrs, "Path="+c.Path)
+		}
+		if c.Domain != "" {
+			attrs = append(attrs, "Domain="+c.Domain)
+		}
+		if c.Expires != nil {
+			attrs = append(attrs, "Expires="+paint(colorNumber, c.Expires.Format(time.RFC3339)))
+		}
+		if c.MaxAge != 0 {
+			attrs = append(attrs, fmt.Sprintf("Max-Age=%d", max(c.MaxAge, 0)))
+		}
+		for _, f := range []struct {
+			name string
+			on   bool
+		}{{"Secure", c.Secure}, {"HttpOnly", c.HttpOnly}, {"SameSite=" + c.SameSite, c.SameSite != ""}} {
+			if f.on {
+				attrs = append(attrs, f.name)
+			}
+		}
+		if c.Expired {
+			attrs = append(attrs, paint(colorAlert, "expired"))
+		}
+		lines = append(lines, "set-cookie "+strings.Join(attrs, " "))
+	}
+
+	writeLine(b)
+	for _, l := range lines {
+		writeLine(b, "// auth: ", l)
+	}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func testJWT(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestInspectAuth(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	token := testJWT(`{"sub":"alice","iss":"https://idp.example.com","aud":["api","web"],"exp":1700000000}`)
+	header := http.Header{
+		"Authorization": {"Bearer " + token},
+		"Cookie":        {"session=abc; id_token=" + testJWT(`{"sub":"bob","exp":1800000000}`)},
+	}
+
+	a := inspectAuth(header, now, false)
+	if assert.Len(t, a.JWTs, 2) {
+		assert.Equal(t, "Authorization", a.JWTs[0].Source)
+		assert.Equal(t, "alice", a.JWTs[0].Claims["sub"])
+		assert.True(t, a.JWTs[0].Expired)
+		assert.Equal(t, "cookie:id_token", a.JWTs[1].Source)
+		assert.False(t, a.JWTs[1].Expired)
+	}
+	assert.Len(t, a.Cookies, 2)
+
+	var b bytes.Buffer
+	printAuth(&b, a, false)
+	assert.Contains(t, b.String(), "\r\n// auth: jwt Authorization iss=https://idp.example.com sub=alice aud=api,web "+
+		"exp=2023-11-14T22:13:20Z expired header={\"alg\":\"HS256\",\"typ\":\"JWT\"} claims={")
+	assert.Contains(t, b.String(), "// auth: cookie session=abc\r\n")
+
+	basic := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("test:secret"))}}
+	assert.Equal(t, &BasicAuth{User: "test", Password: maskedPassword}, inspectAuth(basic, now, false).Basic)
+	assert.Equal(t, &BasicAuth{User: "test", Password: "secret"}, inspectAuth(basic, now, true).Basic)
+
+	set := http.Header{"Set-Cookie": {
+		"sid=xyz; Path=/; Domain=example.com; Max-Age=3600; Secure; HttpOnly; SameSite=Lax",
+		"old=; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+		"renewed=1; Max-Age=60; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+	}}
+	a = inspectAuth(set, now, false)
+	if assert.Len(t, a.Cookies, 3) {
+		c := a.Cookies[0]
+		assert.True(t, c.Set && c.Secure && c.HttpOnly)
+		assert.Equal(t, "Lax", c.SameSite)
+		assert.False(t, c.Expired)
+		assert.True(t, a.Cookies[1].Expired)
+		assert.False(t, a.Cookies[2].Expired) // the positive Max-Age takes precedence over the past Expires
+	}
+	b.Reset()
+	printAuth(&b, a, false)
+	assert.Equal(t, "\r\n// auth: set-cookie sid=xyz Path=/ Domain=example.com Expires=2024-01-01T01:00:00Z Max-Age=3600 Secure HttpOnly SameSite=Lax\r\n"+
+		"// auth: set-cookie old= Expires=1970-01-01T00:00:00Z expired\r\n"+
+		"// auth: set-cookie renewed=1 Expires=2024-01-01T00:01:00Z Max-Age=60\r\n", b.String())
+
+	assert.Nil(t, inspectAuth(http.Header{"Authorization": {"Bearer opaque"}}, now, false))
+}
+
+func TestAuthFilter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := inspectAuth(http.Header{"Authorization": {"Bearer " + testJWT(`{"sub":"alice","aud":["api","web"]}`)}}, now, false)
+
+	_, err := ParseAuthFilter("basic.password=x")
+	assert.NotNil(t, err)
+
+	for _, c := range []struct {
+		filter string
+		permit bool
+	}{
+		{"", true},
+		{"jwt", true},
+		{"jwt.sub=alice", true},
+		{"jwt.sub=ali*, jwt.aud=web", true},
+		{"jwt.sub=bob", false},
+		{"jwt.sub=alice,jwt.expired=true", false},
+		{"cookie.session", false},
+		{"basic", false},
+	} {
+		f, err := ParseAuthFilter(c.filter)
+		assert.Nil(t, err)
+		assert.Equal(t, c.permit, f.Permits(a), c.filter)
+	}
+
+	f, _ := ParseAuthFilter("jwt.sub=alice, cookie.session")
+	assert.Equal(t, "jwt.sub=alice,cookie.session", f.String())
+	assert.False(t, f.Permits(nil))
+}
+
+func TestAuthExchange(t *testing.T) {
+	option := &Option{Level: "all", Resp: 1, InspectAuth: true}
+	f, _ := ParseAuthFilter("basic.user=test")
+	option.SetFilter(&Filter{SrcRatio: 1, Auth: f})
+	r, sender := newTestAssembler(option)
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("test:secret"))
+	req := "GET /a HTTP/1.1\r\nHost: a.com\r\nAuthorization: Basic " + credentials + "\r\n\r\n"
+	rsp := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(req)), 5000+uint32(len(rsp))
+	assembleTest(r, true, &layers.TCP{SYN: true, Seq: 999}, "", time.Time{})
+	assembleTest(r, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000}, req, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000, Ack: reqEnd}, rsp, time.Time{})
+	assembleTest(r, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd + 1}, "", time.Time{})
+	r.FinishAll()
+
+	out := sender.String()
+	assert.Contains(t, out, "Authorization: Basic ******\r\n")
+	assert.NotContains(t, out, credentials)
+	assert.Contains(t, out, "// auth: basic user=test password=******")
+	assert.Contains(t, out, "HTTP/1.1 200 OK") // the response of the request kept is output with it
+}
@@ -0,0 +1,407 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// BinaryDecoder decodes the binary body into json, params are the ones of its Content-Type, like proto=pkg.Message.
+type BinaryDecoder struct {
+	Name   string // shown in the output, like protobuf
+	Decode func(body []byte, params map[string]string) ([]byte, error)
+}
+
+// binaryDecoders are the decoders of the binary bodies by their media types.
+var binaryDecoders = map[string]BinaryDecoder{}
+
+// RegisterBinaryDecoder registers the decoder of the binary bodies of the media types, like application/x-protobuf.
+func RegisterBinaryDecoder(d BinaryDecoder, mediaTypes ...string) {
+	for _, t := range mediaTypes {
+		binaryDecoders[strings.ToLower(t)] = d
+	}
+}
+
+func init() {
+	RegisterBinaryDecoder(BinaryDecoder{Name: "protobuf", Decode: decodeProtobuf},
+		"application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf", "application/x-google-protobuf")
+	RegisterBinaryDecoder(BinaryDecoder{Name: "msgpack", Decode: decodeMsgpack},
+		"application/msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	RegisterBinaryDecoder(BinaryDecoder{Name: "cbor", Decode: decodeCBOR}, "application/cbor")
+	RegisterBinaryDecoder(BinaryDecoder{Name: "thrift", Decode: decodeThrift},
+		"application/x-thrift", "application/vnd.apache.thrift.binary")
+}
+
+// findBinaryDecoder finds the decoder of the Content-Type, and the parameters of it.
+func findBinaryDecoder(contentType string) (*BinaryDecoder, map[string]string) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+	if d, ok := binaryDecoders[mt]; ok {
+		return &d, params
+	}
+	return nil, nil
+}
+
+// hexdump returns the hexdump -C like preview of the bytes, ends with the line of the offset after them.
+func hexdump(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return hex.Dump(data) + fmt.Sprintf("%08x", len(data))
+}
+
+// jsonField is a field of the jsonObject.
+type jsonField struct {
+	Key   string
+	Value any
+}
+
+// jsonObject is a json object keeping the order of its fields, like the protobuf fields in the order they are sent.
+type jsonObject []jsonField
+
+// MarshalJSON marshals the object with the fields in order.
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.Key)
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// add adds the value of the key, the values of the repeated key are gathered into an array.
+func (o jsonObject) add(key string, value any) jsonObject {
+	for i, f := range o {
+		if f.Key != key {
+			continue
+		}
+		if arr, ok := f.Value.(repeated); ok {
+			o[i].Value = append(arr, value)
+		} else {
+			o[i].Value = repeated{f.Value, value}
+		}
+		return o
+	}
+	return append(o, jsonField{Key: key, Value: value})
+}
+
+// repeated is the values of a repeated key of the jsonObject.
+type repeated []any
+
+// jsonValue converts the decoded value into the one can be marshaled into json,
+// like the maps of the non-string keys, and the NaN floats.
+func jsonValue(v any) any {
+	switch t := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(jsonValue(k))] = jsonValue(e)
+		}
+		return m
+	case map[string]any:
+		for k, e := range t {
+			t[k] = jsonValue(e)
+		}
+		return t
+	case []any:
+		for i, e := range t {
+			t[i] = jsonValue(e)
+		}
+		return t
+	case jsonObject:
+		for i, f := range t {
+			t[i].Value = jsonValue(f.Value)
+		}
+		return t
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return fmt.Sprint(t)
+		}
+	case float32:
+		return jsonValue(float64(t))
+	case cbor.Tag:
+		return jsonObject{{"tag", t.Number}, {"value", jsonValue(t.Content)}}
+	}
+	return v
+}
+
+func decodeMsgpack(body []byte, _ map[string]string) ([]byte, error) {
+	r := bytes.NewReader(body)
+	v, err := decodeMsgpackValue(msgpack.NewDecoder(r), r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, errors.New("extra data after the msgpack value")
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// decodeMsgpackValue decodes the maps into the jsonObject in order. The lengths in the body are checked against
+// the bytes left, which the msgpack decoder allocates ahead.
+func decodeMsgpackValue(d *msgpack.Decoder, r *bytes.Reader) (any, error) {
+	c, err := d.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32:
+		n, err := d.DecodeMapLen()
+		if err != nil {
+			return nil, err
+		}
+		o := make(jsonObject, 0, min(n, r.Len()/2))
+		for i := 0; i < n; i++ {
+			k, err := decodeMsgpackValue(d, r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeMsgpackValue(d, r)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, jsonField{Key: fmt.Sprint(jsonValue(k)), Value: v})
+		}
+		return o, nil
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		n, err := d.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]any, 0, min(n, r.Len()))
+		for i := 0; i < n; i++ {
+			v, err := decodeMsgpackValue(d, r)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	}
+	if size, ok := msgpackLenSizes[c]; ok {
+		// the length of the string, the binary or the extension follows its code
+		l := make([]byte, size)
+		if _, err := r.ReadAt(l, r.Size()-int64(r.Len())+1); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var n uint64
+		for _, b := range l {
+			n = n<<8 | uint64(b)
+		}
+		if n > uint64(r.Len()) {
+			return nil, fmt.Errorf("msgpack: %d bytes exceed the body", n)
+		}
+	}
+	return d.DecodeInterface()
+}
+
+// msgpackLenSizes are the sizes of the lengths after the codes of the strings, the binaries and the extensions,
+// which the msgpack decoder allocates ahead.
+var msgpackLenSizes = map[byte]int{
+	msgpcode.Str8: 1, msgpcode.Str16: 2, msgpcode.Str32: 4,
+	msgpcode.Bin8: 1, msgpcode.Bin16: 2, msgpcode.Bin32: 4,
+	msgpcode.Ext8: 1, msgpcode.Ext16: 2, msgpcode.Ext32: 4,
+}
+
+func decodeCBOR(body []byte, _ map[string]string) ([]byte, error) {
+	var v any
+	if err := cbor.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// The protobuf types loaded from the descriptor sets by LoadProtoTypes.
+var (
+	protoFiles       *protoregistry.Files
+	protoDefaultType string
+)
+
+// LoadProtoTypes loads the descriptor sets, generated by protoc --include_imports --descriptor_set_out,
+// to decode the protobuf bodies typed. The message type is the proto or messageType parameter of the Content-Type,
+// or the defaultType if there is none.
+func LoadProtoTypes(files []string, defaultType string) error {
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		s := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(data, s); err != nil {
+			return fmt.Errorf("parse descriptor set %s: %w", f, err)
+		}
+		set.File = append(set.File, s.File...)
+	}
+	pf, err := protodesc.NewFiles(set)
+	if err != nil {
+		return err
+	}
+	if defaultType != "" {
+		if _, err := pf.FindDescriptorByName(protoreflect.FullName(defaultType)); err != nil {
+			return fmt.Errorf("find message %s: %w", defaultType, err)
+		}
+	}
+	protoFiles, protoDefaultType = pf, defaultType
+	return nil
+}
+
+// decodeProtobuf decodes the body by its message type if it is loaded, or the wire format without the schema,
+// whose fields are keyed by their numbers.
+func decodeProtobuf(body []byte, params map[string]string) ([]byte, error) {
+	typ := params["proto"]
+	if typ == "" {
+		typ = params["messagetype"]
+	}
+	if typ == "" {
+		typ = protoDefaultType
+	}
+	if typ != "" && protoFiles != nil {
+		typ = strings.TrimPrefix(typ, ".")
+		d, err := protoFiles.FindDescriptorByName(protoreflect.FullName(typ))
+		if err != nil {
+			return nil, err
+		}
+		md, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a message", typ)
+		}
+		m := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(body, m); err != nil {
+			return nil, err
+		}
+		return protojson.MarshalOptions{Resolver: dynamicpb.NewTypes(protoFiles)}.Marshal(m)
+	}
+
+	o, err := decodeProtoWire(body, 0)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(o)
+}
+
+// maxProtoDepth limits the nested messages guessed in the schemaless decoding.
+const maxProtoDepth = 64
+
+// decodeProtoWire decodes the protobuf wire format without the schema, the length delimited fields are guessed
+// as the printable strings first, then the nested messages, and the bytes in hex at last.
+func decodeProtoWire(b []byte, depth int) (jsonObject, error) {
+	var o jsonObject
+	for len(b) > 0 {
+		key, n := protoVarint(b)
+		if n == 0 {
+			return nil, errors.New("invalid field key")
+		}
+		b = b[n:]
+		num, wire := key>>3, key&7
+		if num == 0 {
+			return nil, errors.New("invalid field number 0")
+		}
+
+		var v any
+		switch wire {
+		case 0: // varint
+			x, n := protoVarint(b)
+			if n == 0 {
+				return nil, errors.New("invalid varint")
+			}
+			v, b = x, b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return nil, errors.New("truncated fixed64")
+			}
+			v, b = leUint(b[:8]), b[8:]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return nil, errors.New("truncated fixed32")
+			}
+			v, b = leUint(b[:4]), b[4:]
+		case 2: // length delimited
+			l, n := protoVarint(b)
+			if n == 0 || l > uint64(len(b)-n) {
+				return nil, errors.New("invalid length")
+			}
+			data := b[n : n+int(l)]
+			b = b[n+int(l):]
+			if utf8.Valid(data) && isPrintable(data) {
+				v = string(data)
+			} else if m, err := decodeNestedProto(data, depth+1); err == nil && len(m) > 0 {
+				v = m
+			} else {
+				v = hex.EncodeToString(data)
+			}
+		default: // the deprecated groups are not supported
+			return nil, fmt.Errorf("unsupported wire type %d", wire)
+		}
+		o = o.add(fmt.Sprint(num), v)
+	}
+	return o, nil
+}
+
+func decodeNestedProto(data []byte, depth int) (jsonObject, error) {
+	if depth > maxProtoDepth {
+		return nil, errors.New("protobuf nested too deep")
+	}
+	return decodeProtoWire(data, depth)
+}
+
+// protoVarint decodes the varint, n is 0 if it is invalid.
+func protoVarint(b []byte) (x uint64, n int) {
+	for shift := uint(0); n < len(b) && shift < 64; shift += 7 {
+		c := b[n]
+		n++
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x, n
+		}
+	}
+	return 0, 0
+}
+
+func leUint(b []byte) (x uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		x = x<<8 | uint64(b[i])
+	}
+	return x
+}
+
+func isPrintable(data []byte) bool {
+	for _, r := range string(data) {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
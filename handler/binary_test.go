@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func decodeBinary(t *testing.T, contentType string, body []byte) string {
+	d, params := findBinaryDecoder(contentType)
+	if !assert.NotNil(t, d) {
+		return ""
+	}
+	js, err := d.Decode(body, params)
+	assert.Nil(t, err)
+	return string(js)
+}
+
+func TestBinaryDecoders(t *testing.T) {
+	// field 1 varint 150, field 2 string "hi", field 3 nested {1: 1}, field 1 again, field 4 fixed32 1
+	pb := []byte{0x08, 0x96, 0x01, 0x12, 0x02, 'h', 'i', 0x1a, 0x02, 0x08, 0x01, 0x08, 0x02, 0x25, 1, 0, 0, 0}
+	assert.Equal(t, `{"1":[150,2],"2":"hi","3":{"1":1},"4":1}`, decodeBinary(t, "application/x-protobuf", pb))
+
+	mp, _ := msgpack.Marshal(map[string]any{"a": 1, "b": []any{"x", true}})
+	assert.JSONEq(t, `{"a":1,"b":["x",true]}`, decodeBinary(t, "application/msgpack", mp))
+
+	cb, _ := cbor.Marshal(map[any]any{1: "one", "f": 1.5})
+	assert.JSONEq(t, `{"1":"one","f":1.5}`, decodeBinary(t, "application/cbor", cb))
+
+	// strict call "ping" seqid 7, {1: i32 42, 2: list<string> ["a"]}
+	th := []byte{0x80, 0x01, 0x00, 0x01, 0, 0, 0, 4, 'p', 'i', 'n', 'g', 0, 0, 0, 7,
+		8, 0, 1, 0, 0, 0, 42,
+		15, 0, 2, 11, 0, 0, 0, 1, 0, 0, 0, 1, 'a',
+		0}
+	assert.Equal(t, `{"method":"ping","type":"call","seqid":7,"struct":{"1":42,"2":["a"]}}`,
+		decodeBinary(t, "application/x-thrift", th))
+
+	d, _ := findBinaryDecoder("application/x-thrift")
+	_, err := d.Decode(th[:len(th)-1], nil)
+	assert.NotNil(t, err)
+
+	// the map32, the array32 and the bin32 of 0x5cc36d9c elements in 5 bytes are not allocated ahead
+	d, _ = findBinaryDecoder("application/msgpack")
+	for _, b := range [][]byte{{0xdf, 0x5c, 0xc3, 0x6d, 0x9c}, {0xdd, 0x5c, 0xc3, 0x6d, 0x9c},
+		{0x91, 0xdf, 0x5c, 0xc3, 0x6d, 0x9c}, {0xc6, 0x5c, 0xc3, 0x6d, 0x9c}, {0xdb, 0x5c}} {
+		_, err = d.Decode(b, nil)
+		assert.NotNil(t, err)
+	}
+
+	d, _ = findBinaryDecoder("image/png")
+	assert.Nil(t, d)
+}
+
+func TestProtobufTyped(t *testing.T) {
+	defer func() { protoFiles, protoDefaultType = nil, "" }()
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(durationpb.File_google_protobuf_duration_proto),
+	}}
+	data, _ := proto.Marshal(set)
+	file := filepath.Join(t.TempDir(), "set.pb")
+	assert.Nil(t, os.WriteFile(file, data, 0o644))
+	assert.NotNil(t, LoadProtoTypes([]string{file}, "google.protobuf.Missing"))
+	assert.Nil(t, LoadProtoTypes([]string{file}, ""))
+
+	body, _ := proto.Marshal(durationpb.New(1500000000))
+	assert.Equal(t, `"1.500s"`, decodeBinary(t, "application/x-protobuf; proto=google.protobuf.Duration", body))
+	assert.Equal(t, `{"1":1,"2":500000000}`, decodeBinary(t, "application/x-protobuf", body))
+}
+
+func TestHexdump(t *testing.T) {
+	assert.Equal(t, "00000000  68 65 6c 6c 6f 00                                 |hello.|\n00000006", hexdump([]byte("hello\x00")))
+
+	h := &Base{option: &Option{Hexdump: 4}}
+	var b bytes.Buffer
+	assert.Nil(t, h.printNonTextTypeBody(&b, bytes.NewReader([]byte("\x89PNG\r\n")), "image/png", true))
+	assert.Equal(t, "00000000  89 50 4e 47                                       |.PNG|\n00000004\r\n"+
+		"{Non-text body, content-type:image/png, len:6}\r\n", b.String())
+
+	b.Reset()
+	assert.Nil(t, h.printNonTextTypeBody(&b, bytes.NewReader([]byte{0xc1}), "application/msgpack", false))
+	assert.Contains(t, b.String(), "// msgpack: decode failed")
+	assert.Contains(t, b.String(), "|.|")
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BodyStore stores the bodies content-addressed by their sha256, like -body-store bodies, a body is stored once
+// at dir/ab/ab12...ef.json no matter how many times it is sent. The bodies are stored as they are transferred,
+// with the Content-Encoding kept, like ab12...ef.json.gz. When the total size exceeds the max size,
+// the least recently stored bodies are removed.
+type BodyStore struct {
+	dir     string
+	maxSize int64 // 0 for no limit
+
+	lock  sync.Mutex
+	size  int64
+	files *list.List               // of *storedFile, the least recently stored at the front
+	index map[string]*list.Element // by the sha256
+}
+
+// StoredBody is where the body is stored in the BodyStore.
+type StoredBody struct {
+	SHA256 string
+	Size   int64
+	Path   string `json:",omitempty"` // empty if the body is not stored, like it exceeds the max size of the store
+	Dedup  bool   `json:",omitempty"` // the same body is already stored
+}
+
+type storedFile struct {
+	sha256 string
+	path   string
+	size   int64
+}
+
+// bodyStoreTemp is the prefix of the temp files which the bodies are written to before they are hashed.
+const bodyStoreTemp = ".tmp-"
+
+// storedNameRe matches the names of the stored files, the sha256 with the extensions.
+var storedNameRe = regexp.MustCompile(`^([0-9a-f]{64})(\.[\w.+-]+)?$`)
+
+// NewBodyStore creates the BodyStore in dir, the bodies stored before are loaded to be deduplicated and retained.
+func NewBodyStore(dir string, maxSize uint64) (*BodyStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	type loaded struct {
+		storedFile
+		modTime time.Time
+	}
+	var files []loaded
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), bodyStoreTemp) { // left by the last run
+			return os.Remove(path)
+		}
+		m := storedNameRe.FindStringSubmatch(d.Name())
+		if m == nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, loaded{storedFile{sha256: m[1], path: path, size: info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	s := &BodyStore{dir: dir, maxSize: int64(maxSize), files: list.New(), index: make(map[string]*list.Element)}
+	for _, f := range files {
+		if _, ok := s.index[f.sha256]; !ok {
+			f := f.storedFile
+			s.index[f.sha256] = s.files.PushBack(&f)
+			s.size += f.size
+		}
+	}
+	s.lock.Lock()
+	s.evict(nil)
+	s.lock.Unlock()
+	return s, nil
+}
+
+// Size returns the total size of the stored bodies.
+func (s *BodyStore) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// evict removes the least recently stored bodies until the total size does not exceed the max size, except keep.
+func (s *BodyStore) evict(keep *list.Element) {
+	for e := s.files.Front(); e != nil && s.maxSize > 0 && s.size > s.maxSize; {
+		next := e.Next()
+		if e != keep {
+			f := e.Value.(*storedFile)
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("remove stored body %s failed: %v", f.path, err)
+			}
+			_ = os.Remove(filepath.Dir(f.path)) // only if it is empty
+			s.files.Remove(e)
+			delete(s.index, f.sha256)
+			s.size -= f.size
+		}
+		e = next
+	}
+}
+
+// commit moves the temp file of the body into its content address, or removes it if the body is already stored.
+func (s *BodyStore) commit(tmp, sum, ext string, size int64) (*StoredBody, error) {
+	stored := &StoredBody{SHA256: sum, Size: size}
+	if s.maxSize > 0 && size > s.maxSize {
+		_ = os.Remove(tmp)
+		return stored, fmt.Errorf("%d bytes exceeds the max size %d of the store", size, s.maxSize)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.index[sum]; ok {
+		_ = os.Remove(tmp)
+		f := e.Value.(*storedFile)
+		now := time.Now()
+		_ = os.Chtimes(f.path, now, now) // to be retained as the recently stored after a restart
+		s.files.MoveToBack(e)
+		stored.Path, stored.Dedup = f.path, true
+		return stored, nil
+	}
+
+	path := filepath.Join(s.dir, sum[:2], sum+ext)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		_ = os.Remove(tmp)
+		return stored, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return stored, err
+	}
+	e := s.files.PushBack(&storedFile{sha256: sum, path: path, size: size})
+	s.index[sum] = e
+	s.size += size
+	s.evict(e)
+	stored.Path = path
+	return stored, nil
+}
+
+// bodyWriter writes the body to a temp file of the store while hashing it, the temp file is created on the first
+// write, so nothing is created for the empty bodies.
+type bodyWriter struct {
+	store *BodyStore
+	ext   string
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+	err   error
+}
+
+// Write never fails, so the body is still read when it fails to be stored, the error is returned by commit.
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	if w.err != nil || len(p) == 0 {
+		return len(p), nil
+	}
+	if w.file == nil {
+		if w.file, w.err = os.CreateTemp(w.store.dir, bodyStoreTemp+"*"); w.err != nil {
+			return len(p), nil
+		}
+	}
+	if _, w.err = w.file.Write(p); w.err == nil {
+		w.hash.Write(p)
+		w.size += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// commit stores the body written, returns nil for the empty body.
+func (w *bodyWriter) commit() (*StoredBody, error) {
+	if w.file == nil {
+		return nil, w.err
+	}
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		_ = os.Remove(w.file.Name())
+		return nil, w.err
+	}
+	return w.store.commit(w.file.Name(), hex.EncodeToString(w.hash.Sum(nil)), w.ext, w.size)
+}
+
+// storingBody stores the body as it is read, the rest not read is stored by finish.
+type storingBody struct {
+	io.ReadCloser
+	tee io.Reader
+	w   *bodyWriter
+
+	once   sync.Once
+	stored *StoredBody
+	err    error
+}
+
+// writer returns the writer of the body of the header into the store.
+func (s *BodyStore) writer(header http.Header) *bodyWriter {
+	return &bodyWriter{store: s, ext: bodyExtension(header), hash: sha256.New()}
+}
+
+// wrap returns the body which stores itself into the store as it is read.
+func (s *BodyStore) wrap(body io.ReadCloser, header http.Header) *storingBody {
+	w := s.writer(header)
+	return &storingBody{ReadCloser: body, tee: io.TeeReader(body, w), w: w}
+}
+
+func (b *storingBody) Read(p []byte) (int, error) { return b.tee.Read(p) }
+
+// finish reads the rest of the body, and stores it, the stored is nil for the empty body.
+func (b *storingBody) finish() (*StoredBody, error) {
+	b.once.Do(func() {
+		discardAll(b.tee)
+		b.stored, b.err = b.w.commit()
+	})
+	return b.stored, b.err
+}
+
+// storedReq is the request whose body is stored as it is read.
+type storedReq struct {
+	Req
+	body *storingBody
+}
+
+func (r storedReq) GetBody() io.ReadCloser { return r.body }
+
+// storedRsp is the response whose body is stored as it is read.
+type storedRsp struct {
+	Rsp
+	body *storingBody
+}
+
+func (r storedRsp) GetBody() io.ReadCloser { return r.body }
+
+// storedBodyOf finishes storing the body if it is stored by the BodyStore.
+func storedBodyOf(body io.Reader) (*StoredBody, error) {
+	if b, ok := body.(*storingBody); ok {
+		return b.finish()
+	}
+	return nil, nil
+}
+
+// printStoredBody prints where the body is stored like // body: sha256 ab12...ef size 1024 stored bodies/ab/ab12...ef.json.
+func printStoredBody(b *bytes.Buffer, body io.Reader) {
+	stored, err := storedBodyOf(body)
+	printStored(b, stored, err)
+}
+
+// printStored prints where the body is stored, or why it is not, nothing for the empty body.
+func printStored(b *bytes.Buffer, stored *StoredBody, err error) {
+	if stored == nil && err == nil {
+		return
+	}
+	var s string
+	if stored != nil {
+		s = fmt.Sprintf("sha256 %s size %d ", stored.SHA256, stored.Size)
+		if stored.Dedup {
+			s += "deduplicated " + stored.Path
+		} else if stored.Path != "" {
+			s += "stored " + stored.Path
+		}
+	}
+	if err != nil {
+		s += "not stored: " + err.Error()
+	}
+	writeLine(b, "\n// body: ", s)
+}
+
+// bodyExtensions are the extensions of the common content types, preferred to mime.ExtensionsByType,
+// which returns the alternatives sorted like .jfif for image/jpeg.
+var bodyExtensions = map[string]string{
+	"application/json":                  ".json",
+	"application/javascript":            ".js",
+	"text/javascript":                   ".js",
+	"application/xml":                   ".xml",
+	"text/xml":                          ".xml",
+	"text/html":                         ".html",
+	"text/plain":                        ".txt",
+	"text/css":                          ".css",
+	"text/csv":                          ".csv",
+	"application/x-www-form-urlencoded": ".form",
+	"application/yaml":                  ".yaml",
+	"application/x-yaml":                ".yaml",
+	"application/pdf":                   ".pdf",
+	"application/zip":                   ".zip",
+	"application/gzip":                  ".gz",
+	"application/wasm":                  ".wasm",
+	"application/x-protobuf":            ".pb",
+	"application/protobuf":              ".pb",
+	"application/grpc":                  ".grpc",
+	"application/msgpack":               ".msgpack",
+	"application/x-msgpack":             ".msgpack",
+	"application/cbor":                  ".cbor",
+	"application/x-thrift":              ".thrift",
+	"application/octet-stream":          ".bin",
+	"image/png":                         ".png",
+	"image/jpeg":                        ".jpg",
+	"image/gif":                         ".gif",
+	"image/webp":                        ".webp",
+	"image/svg+xml":                     ".svg",
+	"image/x-icon":                      ".ico",
+	"audio/mpeg":                        ".mp3",
+	"video/mp4":                         ".mp4",
+}
+
+// encodingExtensions are the extensions of the Content-Encoding kept in the stored bodies.
+var encodingExtensions = map[string]string{
+	"gzip": ".gz", "x-gzip": ".gz", "deflate": ".zz", "br": ".br", "zstd": ".zst", "compress": ".Z",
+}
+
+// bodyExtension returns the file extension of the body by its Content-Type and Content-Encoding, like .json.gz,
+// .bin for the unknown.
+func bodyExtension(header http.Header) string {
+	ext := ".bin"
+	if mt, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		if e, ok := bodyExtensions[mt]; ok {
+			ext = e
+		} else if strings.HasSuffix(mt, "+json") {
+			ext = ".json"
+		} else if strings.HasSuffix(mt, "+xml") {
+			ext = ".xml"
+		} else if exts, _ := mime.ExtensionsByType(mt); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	for _, v := range header.Values("Content-Encoding") {
+		for _, ce := range strings.Split(v, ",") {
+			if e, ok := encodingExtensions[strings.ToLower(strings.TrimSpace(ce))]; ok {
+				ext += e
+			}
+		}
+	}
+	return ext
+}
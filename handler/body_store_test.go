@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeBody(s *BodyStore, body, contentType string) (*StoredBody, error) {
+	b := s.wrap(io.NopCloser(strings.NewReader(body)), http.Header{"Content-Type": {contentType}})
+	_, _ = io.ReadAll(io.LimitReader(b, 2)) // partly read, like the body printed is limited
+	return storedBodyOf(b)
+}
+
+func TestBodyStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBodyStore(dir, 10)
+	assert.Nil(t, err)
+
+	a, err := storeBody(s, `{"a":1}`, "application/json; charset=utf-8")
+	assert.Nil(t, err)
+	assert.Equal(t, "015abd7f5cc57a2dd94b7590f04ad8084273905ee33ec5cebeae62276a97f862", a.SHA256)
+	assert.Equal(t, filepath.Join(dir, "01", a.SHA256+".json"), a.Path)
+	assert.False(t, a.Dedup)
+	data, _ := os.ReadFile(a.Path)
+	assert.Equal(t, `{"a":1}`, string(data))
+
+	again, err := storeBody(s, `{"a":1}`, "text/plain")
+	assert.Nil(t, err)
+	assert.Equal(t, a.Path, again.Path)
+	assert.True(t, again.Dedup)
+
+	empty, err := storeBody(s, "", "text/plain")
+	assert.Nil(t, empty)
+	assert.Nil(t, err)
+
+	_, err = storeBody(s, "0123456789+", "text/plain")
+	assert.NotNil(t, err)
+
+	b, err := storeBody(s, "hello", "image/png")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(b.Path, ".png"))
+	assert.NoFileExists(t, a.Path) // the least recently stored is removed for the size 7+5 > 10
+	assert.Equal(t, int64(5), s.Size())
+
+	s, err = NewBodyStore(dir, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), s.Size())
+	b, _ = storeBody(s, "hello", "image/png")
+	assert.True(t, b.Dedup)
+
+	var out bytes.Buffer
+	printStoredBody(&out, s.wrap(io.NopCloser(strings.NewReader("hi")), http.Header{}))
+	assert.Contains(t, out.String(), "\n// body: sha256 8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4 size 2 stored ")
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), bodyStoreTemp), e.Name())
+	}
+}
+
+func TestBodyExtension(t *testing.T) {
+	for _, c := range []struct {
+		contentType, encoding, ext string
+	}{
+		{"application/json", "", ".json"},
+		{"application/problem+json", "", ".json"},
+		{"image/jpeg", "", ".jpg"},
+		{"text/html; charset=utf-8", "gzip", ".html.gz"},
+		{"", "br", ".bin.br"},
+		{"no/such-type", "", ".bin"},
+	} {
+		header := http.Header{"Content-Type": {c.contentType}}
+		if c.encoding != "" {
+			header.Set("Content-Encoding", c.encoding)
+		}
+		assert.Equal(t, c.ext, bodyExtension(header), c.contentType)
+	}
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryBudget limits the payload bytes buffered for the reassembly, in the receive windows, the stream channels
+// and the message buffers. When a stream buffers more than Stream bytes, its buffered bytes are truncated,
+// and when all connections buffer more than Total bytes, the connections buffering the most are evicted.
+// The budget is shared by the assemblers of all shards, the connections are evicted from any of them.
+// A nil budget has no limit.
+type MemoryBudget struct {
+	Total  int64 // max bytes of all connections, 0 for no limit
+	Stream int64 // max bytes of each direction of a connection, 0 for no limit
+
+	used      atomic.Int64
+	truncated atomic.Uint64
+	evicted   atomic.Uint64
+
+	lock       sync.Mutex
+	assemblers []*TCPAssembler // the assemblers of the shards sharing the budget
+}
+
+// BudgetStats is the usage of the MemoryBudget.
+type BudgetStats struct {
+	Used      int64  // bytes buffered now
+	Truncated uint64 // times of the streams or messages truncated by the Stream limit
+	Evicted   uint64 // connections evicted by the Total limit
+}
+
+// NewMemoryBudget creates a MemoryBudget, returns nil if neither is limited.
+func NewMemoryBudget(total, stream uint64) *MemoryBudget {
+	if total == 0 && stream == 0 {
+		return nil
+	}
+	return &MemoryBudget{Total: int64(total), Stream: int64(stream)}
+}
+
+// Stats returns the usage of the budget.
+func (b *MemoryBudget) Stats() BudgetStats {
+	if b == nil {
+		return BudgetStats{}
+	}
+	return BudgetStats{Used: b.used.Load(), Truncated: b.truncated.Load(), Evicted: b.evicted.Load()}
+}
+
+func (b *MemoryBudget) add(n int64) {
+	if b != nil {
+		b.used.Add(n)
+	}
+}
+
+// exceeded tells whether all connections buffer more than the Total.
+func (b *MemoryBudget) exceeded() bool {
+	return b != nil && b.Total > 0 && b.used.Load() > b.Total
+}
+
+// exceedsStream tells whether the bytes buffered for a stream are more than the Stream.
+func (b *MemoryBudget) exceedsStream(n int) bool {
+	return b != nil && b.Stream > 0 && int64(n) > b.Stream
+}
+
+func (b *MemoryBudget) truncate() {
+	if b != nil {
+		b.truncated.Add(1)
+	}
+}
+
+// register shares the budget with the assembler of a shard.
+func (b *MemoryBudget) register(r *TCPAssembler) {
+	if b != nil {
+		b.lock.Lock()
+		b.assemblers = append(b.assemblers, r)
+		b.lock.Unlock()
+	}
+}
+
+// largest returns the connection buffering the most of all shards, which is not evicted yet, and its assembler.
+func (b *MemoryBudget) largest() (largest *TCPConnection, owner *TCPAssembler) {
+	b.lock.Lock()
+	assemblers := b.assemblers
+	b.lock.Unlock()
+
+	var size int
+	for _, r := range assemblers {
+		r.lock.Lock()
+		for _, c := range r.connections {
+			if n := c.buffered(); n > size && !c.evicted.Load() {
+				largest, owner, size = c, r, n
+			}
+		}
+		r.lock.Unlock()
+	}
+	return largest, owner
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// The sources of the charset of the body.
+const (
+	CharsetDeclared = "declared" // by the charset parameter of the Content-Type
+	CharsetBOM      = "bom"      // by the byte order mark
+	CharsetMeta     = "meta"     // by the html meta or the xml declaration
+	CharsetDetected = "detected" // by the statistics of the bytes
+)
+
+// Charset is the charset of the text body, and how it is known.
+type Charset struct {
+	Name       string
+	Source     string
+	Confidence int `json:",omitempty"` // 1-100 of the detected one
+}
+
+// String returns the charset like GB18030 detected 100%.
+func (c Charset) String() string {
+	if c.Source == CharsetDetected {
+		return fmt.Sprintf("%s %s %d%%", c.Name, c.Source, c.Confidence)
+	}
+	return c.Name + " " + c.Source
+}
+
+var (
+	// metaCharsetRe matches <meta charset="gbk"> and <meta http-equiv="Content-Type" content="text/html; charset=gbk">.
+	metaCharsetRe = regexp.MustCompile(`(?i)<meta\s[^>]*charset\s*=\s*["']?\s*([\w.:-]+)`)
+	// xmlEncodingRe matches <?xml version="1.0" encoding="GBK"?>.
+	xmlEncodingRe = regexp.MustCompile(`^\s*<\?xml\s[^>]*encoding\s*=\s*["']([\w.:-]+)["']`)
+
+	// detectedPreferred breaks the ties of the detected charsets, the same confidences are common for the short bodies.
+	detectedPreferred = []string{"GB18030", "Big5", "Shift_JIS", "EUC-KR", "EUC-JP"}
+)
+
+// metaSniffSize is the bytes at the head of the body to find the charset declared in it, as the html5 prescan does.
+const metaSniffSize = 1024
+
+// charsetSniffSize is the bytes at the head of the body to detect its charset by, the statistics of more change little.
+const charsetSniffSize = 64 << 10
+
+// detectCharset finds the charset of the body, declared by the Content-Type, or by the BOM, or declared in the html meta
+// or the xml declaration, or detected by the statistics of the non UTF-8 bytes in its head of charsetSniffSize.
+// It returns the zero Charset for the ASCII or UTF-8 body without any of them, which needs no conversion.
+func detectCharset(body []byte, declared string) Charset {
+	if declared = strings.Trim(declared, `"' `); declared != "" {
+		if _, err := htmlindex.Get(declared); err == nil {
+			return Charset{Name: declared, Source: CharsetDeclared}
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return Charset{Name: "UTF-8", Source: CharsetBOM}
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return Charset{Name: "UTF-16BE", Source: CharsetBOM}
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return Charset{Name: "UTF-16LE", Source: CharsetBOM}
+	}
+
+	head := body
+	if len(head) > metaSniffSize {
+		head = head[:metaSniffSize]
+	}
+	for _, re := range []*regexp.Regexp{xmlEncodingRe, metaCharsetRe} {
+		if m := re.FindSubmatch(head); m != nil {
+			if _, err := htmlindex.Get(string(m[1])); err == nil {
+				return Charset{Name: string(m[1]), Source: CharsetMeta}
+			}
+		}
+	}
+
+	if len(body) > charsetSniffSize {
+		body = body[:charsetSniffSize]
+	}
+	if validUTF8(body) {
+		return Charset{}
+	}
+
+	results, err := chardet.NewTextDetector().DetectAll(body)
+	if err != nil {
+		return Charset{}
+	}
+	best := results[0]
+	for _, p := range detectedPreferred {
+		if r, ok := findDetected(results, p); ok && r.Confidence == best.Confidence {
+			best = r
+			break
+		}
+	}
+	name := best.Charset
+	if name == "GB-18030" {
+		name = "GB18030"
+	}
+	if _, err := htmlindex.Get(name); err != nil {
+		return Charset{}
+	}
+	return Charset{Name: name, Source: CharsetDetected, Confidence: best.Confidence}
+}
+
+func findDetected(results []chardet.Result, name string) (chardet.Result, bool) {
+	for _, r := range results {
+		if r.Charset == name || name == "GB18030" && r.Charset == "GB-18030" {
+			return r, true
+		}
+	}
+	return chardet.Result{}, false
+}
+
+// validUTF8 tells whether the body is UTF-8, whose last rune may be cut by the limit of the body read.
+func validUTF8(body []byte) bool {
+	i := len(body) - 1
+	for i > 0 && len(body)-i < utf8.UTFMax && !utf8.RuneStart(body[i]) {
+		i--
+	}
+	if i >= 0 && !utf8.FullRune(body[i:]) {
+		body = body[:i]
+	}
+	return utf8.Valid(body)
+}
+
+// charsetEncoding returns the encoding of the charset name, GBK and GB2312 are decoded as their superset GB18030,
+// and the BOMs of the unicode ones are removed.
+func charsetEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToUpper(name) {
+	case "UTF-8", "UTF8":
+		return unicode.UTF8BOM, nil
+	case "UTF-16BE":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	case "UTF-16LE":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case "GBK", "GB2312":
+		name = "GB18030"
+	}
+	return htmlindex.Get(name)
+}
+
+// decodeText converts the text body into UTF-8 by its charset, declared or found by detectCharset. The charset is
+// returned if it is not declared by the Content-Type, which is already in the header, and the body is converted.
+func decodeText(body []byte, declared string) ([]byte, *Charset) {
+	cs := detectCharset(body, declared)
+	if cs.Name == "" {
+		return body, nil
+	}
+	e, err := charsetEncoding(cs.Name)
+	if err != nil {
+		return body, nil
+	}
+	decoded, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		return body, nil
+	}
+	if cs.Source == CharsetDeclared {
+		return decoded, nil
+	}
+	return decoded, &cs
+}
+
+// textReader returns the reader of the text body converted into UTF-8 as decodeText does, whose charset is found
+// in the head of the body buffered, so the body is converted as it is read.
+func textReader(r io.Reader, declared string) (io.Reader, *Charset) {
+	br := bufio.NewReaderSize(r, charsetSniffSize)
+	head, _ := br.Peek(charsetSniffSize)
+	cs := detectCharset(head, declared)
+	if cs.Name == "" {
+		return br, nil
+	}
+	e, err := charsetEncoding(cs.Name)
+	if err != nil {
+		return br, nil
+	}
+	tr := transform.NewReader(br, e.NewDecoder())
+	if cs.Source == CharsetDeclared {
+		return tr, nil
+	}
+	return tr, &cs
+}
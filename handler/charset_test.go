@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestDetectCharset(t *testing.T) {
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String("中华人民共和国，欢迎你！这是一个测试的文本内容，包含了常用的汉字。")
+	sjis, _ := japanese.ShiftJIS.NewEncoder().String("これは日本語のテキストです。ひらがなとカタカナと漢字が含まれています。")
+	utf16, _ := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("hi")
+
+	for _, c := range []struct {
+		body, declared string
+		name, source   string
+	}{
+		{"hello", "", "", ""},
+		{"中文", "", "", ""},
+		{"中文"[:4], "", "", ""}, // the last rune cut
+		{gbk, "gbk", "gbk", CharsetDeclared},
+		{gbk, "no-such-charset", "GB18030", CharsetDetected},
+		{gbk, "", "GB18030", CharsetDetected},
+		{sjis, "", "Shift_JIS", CharsetDetected},
+		{"\xEF\xBB\xBFhi", "", "UTF-8", CharsetBOM},
+		{utf16, "", "UTF-16LE", CharsetBOM},
+		{`<html><head><meta http-equiv="Content-Type" content="text/html; charset=big5"></head>`, "", "big5", CharsetMeta},
+		{`<?xml version="1.0" encoding="GBK"?><a/>`, "", "GBK", CharsetMeta},
+	} {
+		cs := detectCharset([]byte(c.body), c.declared)
+		assert.Equal(t, c.name, cs.Name, c.body)
+		assert.Equal(t, c.source, cs.Source, c.body)
+	}
+
+	body, cs := decodeText([]byte(utf16), "")
+	assert.Equal(t, "hi", string(body))
+	assert.Equal(t, "UTF-16LE bom", cs.String())
+}
+
+func TestReadTextBody(t *testing.T) {
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String(`{"name":"张三","city":"北京市海淀区中关村大街"}`)
+	header := http.Header{"Content-Type": {"application/json"}}
+	_, body, cs, _, truncated := ReadTextBody(header, io.NopCloser(strings.NewReader(gbk)), 0)
+	assert.Equal(t, `{"name":"张三","city":"北京市海淀区中关村大街"}`, string(body))
+	assert.Equal(t, "GB18030", cs.Name)
+	assert.Equal(t, CharsetDetected, cs.Source)
+	assert.False(t, truncated)
+
+	header = http.Header{"Content-Type": {"application/json; charset=GBK"}}
+	_, body, cs, _, truncated = ReadTextBody(header, io.NopCloser(strings.NewReader(gbk)), 11)
+	assert.Equal(t, `{"name":"张`, string(body))
+	assert.Nil(t, cs)
+	assert.True(t, truncated)
+
+	// the body of an unsupported encoding is read as it is, and the empty encoded one is empty
+	header = http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"compress"}}
+	_, body, _, _, _ = ReadTextBody(header, io.NopCloser(strings.NewReader("raw")), 0)
+	assert.Equal(t, "raw", string(body))
+	header = http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}
+	_, body, _, _, _ = ReadTextBody(header, io.NopCloser(strings.NewReader("")), 0)
+	assert.Empty(t, body)
+}
+
+func TestReadWithCharset(t *testing.T) {
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String("北京市海淀区")
+	body, err := ReadWithCharset(strings.NewReader(gbk), "gbk")
+	assert.Nil(t, err)
+	assert.Equal(t, "北京市海淀区", string(body))
+
+	_, err = ReadWithCharset(strings.NewReader(gbk), "no-such-charset")
+	assert.NotNil(t, err)
+
+	// the charset is detected in the head of the body only
+	cs := detectCharset([]byte(strings.Repeat("a", charsetSniffSize)+gbk), "")
+	assert.Equal(t, "", cs.Name)
+}
@@ -7,11 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -87,6 +87,21 @@ type Base struct {
 
 	usingJSON bool
 	cache     *rrCache
+	verdicts  *exchangeVerdicts // of the requests, inherited by their responses
+
+	iface  string // the capture interface name, empty if unknown
+	tunnel string // the outermost tunnel like vxlan:100, empty if not encapsulated
+
+	reqGap, rspGap int // bytes lost in the message being processed
+
+	reqAnomalies, rspAnomalies []Anomaly // of the message being processed
+	reqStarts, rspStarts       int       // start lines seen of the streams, which number the verdicts of the exchanges
+	reqVerdicts                int       // requests whose verdicts are put
+
+	rspSeq    uint32          // the tcp seq of the first byte of the response being dealt
+	rspFirst  time.Time       // when the first byte of the response being assembled is captured
+	rspTiming *ExchangeTiming // the network timing of the response being processed, nil if not -timing
+	rspStream *responseStream // the response being emitted incrementally, nil if none
 }
 
 type rrCache struct {
@@ -95,7 +110,7 @@ type rrCache struct {
 }
 
 func NewBase(ctx context.Context, key Key, option *Option, sender Sender) *Base {
-	b := &Base{Context: ctx, key: key, option: option, sender: sender, usingJSON: IsUsingJSON()}
+	b := &Base{Context: ctx, key: key, option: option, sender: sender, usingJSON: IsUsingJSON(), verdicts: newExchangeVerdicts()}
 	if option.Resp > 1 {
 		b.cache = &rrCache{Cache: make(map[string]*SendArgs)}
 	}
@@ -109,11 +124,10 @@ func writeLine(b *bytes.Buffer, a ...interface{}) {
 	_, _ = fmt.Fprintf(b, "\r\n")
 }
 
-func printHeader(b *bytes.Buffer, header map[string][]string) {
-	for name, values := range header {
-		for _, value := range values {
-			writeFormat(b, "%s: %s\r\n", name, value)
-		}
+// printHeader prints the header fields as they are sent.
+func printHeader(b *bytes.Buffer, fields []httpport.RawHeader) {
+	for _, f := range fields {
+		writeLine(b, f.RawString())
 	}
 }
 
@@ -125,18 +139,43 @@ type Req interface {
 	GetMethod() string
 	GetProto() string
 	GetHeader() http.Header
+	GetRawHeaders() []httpport.RawHeader
 	GetContentLength() int64
 }
 
+// Capture is where and when a message is captured, and how it is assembled.
+type Capture struct {
+	Seq       int32
+	Src, Dest string
+	Interface string `json:",omitempty"`
+	Tunnel    string `json:",omitempty"`
+	Timestamp string
+	Gap       int `json:",omitempty"` // bytes lost in a gap of the stream, the message is incomplete
+
+	Timing    *ExchangeTiming `json:",omitempty"` // the network timing of the exchange, only for the responses
+	Anomalies []Anomaly       `json:",omitempty"` // the protocol level problems of the message
+	Auth      *Auth           `json:",omitempty"` // the auth material decoded by -inspect-auth
+}
+
 type ReqBean struct {
-	Seq        int32
-	Src, Dest  string
-	Timestamp  string
+	Capture
 	RequestURI string
 	Method     string
 	Host       string
+	Proto      string // like HTTP/1.1
 	Header     http.Header
-	Body       string `json:",clearQuotes"`
+	RawHeaders []httpport.RawHeader // the header fields as they are sent
+	BodyBean
+}
+
+// BodyBean is the body of the message in json.
+type BodyBean struct {
+	Body      string            `json:",clearQuotes"`
+	Truncated bool              `json:",omitempty"` // the body exceeds MAX_BODY_SIZE, and is cut, the json body is quoted then
+	Decoded   *util.BodyDecoder `json:",omitempty"` // the sizes of the body decoded by its Content-Encoding
+	Charset   *Charset          `json:",omitempty"` // of the text body converted into UTF-8, not declared by the Content-Type
+	Parts     []Part            `json:",omitempty"` // of the multipart body, instead of the Body
+	Stored    *StoredBody       `json:",omitempty"` // where the body is stored by -body-store
 }
 
 var MaxBodySize = osx.EnvSize("MAX_BODY_SIZE", 4096)
@@ -146,96 +185,173 @@ func ReadBody(h interface {
 	GetHeader() http.Header
 	GetContentLength() int64
 },
-) string {
-	_, data, _ := ReadTextBody(h.GetHeader(), h.GetBody(), int64(MaxBodySize))
-	return string(data)
+) (bean BodyBean) {
+	defer func() {
+		var err error
+		if bean.Stored, err = storedBodyOf(h.GetBody()); err != nil {
+			log.Printf("store body failed: %v", err)
+		}
+	}()
+
+	if boundary := multipartBoundary(h.GetHeader()); boundary != "" {
+		parts, err := readMultipart(h.GetHeader(), h.GetBody(), boundary, "", nil)
+		if err != nil {
+			log.Printf("read multipart body failed: %v", err)
+		}
+		bean.Parts = parts
+		return bean
+	}
+
+	_, data, cs, decoder, truncated := ReadTextBody(h.GetHeader(), h.GetBody(), int64(MaxBodySize))
+	bean.Body, bean.Charset, bean.Decoded = string(data), cs, decoder
+	bean.Truncated = truncated || decoder != nil && decoder.Truncated
+	return bean
 }
 
-func ReqToJSON(ctx context.Context, h Req, seq int32, src, dest, timestamp string) ([]byte, error) {
+func ReqToJSON(ctx context.Context, h Req, c Capture) ([]byte, error) {
 	bean := ReqBean{
-		Seq:        seq,
-		Src:        src,
-		Dest:       dest,
-		Timestamp:  timestamp,
+		Capture:    c,
 		Host:       h.GetHost(),
 		RequestURI: h.GetRequestURI(),
 		Method:     h.GetMethod(),
+		Proto:      h.GetProto(),
 		Header:     h.GetHeader(),
-		Body:       ReadBody(h),
+		RawHeaders: h.GetRawHeaders(),
 	}
+	bean.BodyBean = ReadBody(h)
 
 	return ginx.JsoniConfig.Marshal(ctx, bean)
 }
 
 type RspBean struct {
-	Seq       int32
-	Src, Dest string
-	Timestamp string
+	Capture
 
+	Proto      string `json:",omitempty"` // like HTTP/1.1, of the status line
 	Header     http.Header
-	Body       string `json:",clearQuotes"`
+	RawHeaders []httpport.RawHeader // the header fields as they are sent
+	BodyBean
 	StatusCode int
+	Streaming  bool `json:",omitempty"` // the body follows as the stream events
 }
 
-func RspToJSON(ctx context.Context, h Rsp, seq int32, src, dest, timestamp string) ([]byte, error) {
+// EventBean is the event of the stream or the connection in json, like the gap or the overflow.
+type EventBean struct {
+	Capture
+	Event  string // GAP, OVERFLOW, EOF, CONN or ANOMALY
+	Tag    Tag    // REQ or RSP of the stream, TCP of the connection
+	Detail string `json:",omitempty"` // like 1460 bytes lost
+
+	Connection *ConnSummary `json:",omitempty"` // the summary of the connection closed by -timing, of CONN
+}
+
+func RspToJSON(ctx context.Context, h Rsp, c Capture) ([]byte, error) {
 	bean := RspBean{
-		Seq:        seq,
-		Src:        src,
-		Dest:       dest,
-		Timestamp:  timestamp,
+		Capture:    c,
 		StatusCode: h.GetStatusCode(),
 		Header:     h.GetHeader(),
-		Body:       ReadBody(h),
+		RawHeaders: h.GetRawHeaders(),
 	}
+	if proto, _, _ := strings.Cut(h.GetStatusLine(), " "); strings.HasPrefix(proto, "HTTP/") {
+		bean.Proto = proto
+	}
+	_, bean.Streaming = h.(streamRsp)
+	bean.BodyBean = ReadBody(h)
 	return ginx.JsoniConfig.Marshal(ctx, bean)
 }
 
 type Rsp interface {
 	GetBody() io.ReadCloser
 	GetStatusLine() string
-	GetRawHeaders() []string
+	GetRawHeaders() []httpport.RawHeader
 	GetContentLength() int64
 	GetHeader() http.Header
 	GetStatusCode() int
 }
 
-// read http request/response stream, and do output
-func (h *Base) handleRequest(wg *sync.WaitGroup, c *TCPConnection) {
-	defer wg.Done()
-	defer iox.Close(c.requestStream)
+// messageBuffer buffers the payloads of a message, which are counted in the memory budget of the stream.
+type messageBuffer struct {
+	bytes.Buffer
+	stream Stream
+	n      int // bytes written since the last reset
+}
 
-	rb := &bytes.Buffer{}
-	var method string
+func (b *messageBuffer) write(p []byte) {
+	b.Write(p)
+	b.n += len(p)
+}
 
-	for p := range c.requestStream.Packets() {
-		// 请求开头行解析成功，是一个新的请求
-		m, yes := util.ParseRequestTitle(p.Payload)
-		// log.Printf("ParseRequestTitle: method: %s yes: %t payload: %q", m, yes, string(p.Payload))
-		if yes {
-			rb.Reset() // 清空缓冲
-			method = m // 记录请求方法
-		}
+// consume releases the first n bytes, which are emitted already.
+func (b *messageBuffer) consume(n int) {
+	b.Next(n)
+	b.stream.Release(n)
+	b.n -= n
+}
 
-		rb.Write(p.Payload)
+func (b *messageBuffer) reset() {
+	b.Reset()
+	b.stream.Release(b.n)
+	b.n = 0
+}
 
-		// permitsMethod := h.option.PermitsMethod(method)
-		// http1EndHint := util.Http1EndHint(rb.Bytes())
-		// log.Printf("rb.Len(): %d, permitsMethod: %t, http1EndHint: %t", rb.Len(), permitsMethod, http1EndHint)
-		if rb.Len() > 0 && h.option.PermitsMethod(method) && util.Http1EndHint(rb.Bytes()) && h.LimitAllow() {
-			h.dealRequest(rb, h.option, c)
-			rb.Reset()
-		}
+// messageStream is one direction of a connection to be assembled into messages.
+type messageStream struct {
+	stream       Stream
+	tag          Tag
+	skip         bool                      // skips until the first start line, as the connection is picked up in the middle
+	gap          *int                      // bytes lost in the message being dealt
+	starts       *int                      // start lines seen
+	seq          *uint32                   // the tcp seq of the first byte of the message being dealt, nil if not needed
+	first        *time.Time                // when the first byte of the message being assembled is captured, nil if not needed
+	timestamp    func() time.Time          // of the last packet
+	title        func(payload []byte) bool // tells whether the payload starts a new message, and records its start line
+	index        func(payload []byte) int  // returns the index of the first start line in the payload, -1 if none
+	permits      func() bool               // tells whether the message of the recorded start line passes the filters
+	deal         func(rb *bytes.Buffer)
+	drop         func()                                       // called for the message not dealt, nil if nothing to do
+	streaming    func(rb *messageBuffer, p StreamPacket) bool // emits the message incrementally, false if it is not a streaming one
+	endStreaming func(reason string, t time.Time) bool        // ends the message emitted incrementally, false if there is none
+}
 
-		if h.option.ReachedN() {
-			return
-		}
+// dealOrDrop deals the message if it passes the filters and is allowed, like by the rate limiter, or drops it.
+func (m messageStream) dealOrDrop(rb *bytes.Buffer, allow func() bool) {
+	if m.permits() && allow() {
+		m.deal(rb)
+	} else if m.drop != nil {
+		m.drop()
 	}
+}
 
-	if rb.Len() > 0 && h.option.PermitsMethod(method) && h.LimitAllow() {
-		h.dealRequest(rb, h.option, c)
-	}
+// end ends the message being emitted incrementally at t, returns false if there is none.
+func (m messageStream) end(reason string, t time.Time) bool {
+	return m.endStreaming != nil && m.endStreaming(reason, t)
+}
 
-	h.handleError(io.EOF, c.lastReqTimestamp, TagRequest)
+// read http request/response stream, and do output
+func (h *Base) handleRequest(wg *sync.WaitGroup, c *TCPConnection) {
+	defer wg.Done()
+	defer iox.Close(c.requestStream)
+
+	var method string
+	h.handleMessages(messageStream{
+		stream:    c.requestStream,
+		tag:       TagRequest,
+		skip:      c.midStream,
+		gap:       &h.reqGap,
+		starts:    &h.reqStarts,
+		timestamp: func() time.Time { return c.lastReqTimestamp },
+		title: func(payload []byte) bool {
+			// 请求开头行解析成功，是一个新的请求
+			m, yes := util.ParseRequestTitle(payload)
+			if yes {
+				method = m // 记录请求方法
+			}
+			return yes
+		},
+		index:   util.IndexRequestTitle,
+		permits: func() bool { return h.option.PermitsMethod(method) },
+		deal:    func(rb *bytes.Buffer) { h.dealRequest(rb, h.option, c) },
+		drop:    func() { h.putVerdict(exchangeVerdict{}) },
+	})
 }
 
 // read http request/response stream, and do output
@@ -243,38 +359,133 @@ func (h *Base) handleResponse(wg *sync.WaitGroup, c *TCPConnection) {
 	defer wg.Done()
 	defer iox.Close(c.responseStream)
 
-	rb := &bytes.Buffer{}
 	var lastCode int
-
-	for p := range c.responseStream.Packets() {
-		if code, yes := util.ParseResponseTitle(p.Payload); yes {
-			rb.Reset() // 清空缓冲
+	permits := func() bool { return h.option.PermitsCode(lastCode) }
+	title := func(payload []byte) bool {
+		code, yes := util.ParseResponseTitle(payload)
+		if yes {
 			lastCode = code
 		}
+		return yes
+	}
+	h.handleMessages(messageStream{
+		stream:       c.responseStream,
+		tag:          TagResponse,
+		skip:         c.midStream,
+		gap:          &h.rspGap,
+		starts:       &h.rspStarts,
+		seq:          &h.rspSeq,
+		first:        &h.rspFirst,
+		timestamp:    func() time.Time { return c.lastRspTimestamp },
+		title:        title,
+		index:        util.IndexResponseTitle,
+		permits:      permits,
+		deal:         func(rb *bytes.Buffer) { h.dealResponse(rb, h.option, c) },
+		streaming:    func(rb *messageBuffer, p StreamPacket) bool { return h.streamResponse(rb, p, c, permits, title) },
+		endStreaming: h.endStream,
+	})
+}
 
-		rb.Write(p.Payload)
+// handleMessages assembles the payloads of the stream into messages, until the stream is closed.
+// A message is dealt when its end is seen, or it is cut by a gap of the stream, or it exceeds the stream buffer,
+// the rest of the cut message is skipped until the start line of the next message, even in the middle of a payload.
+// The start line split over the packets is recorded when it is assembled.
+func (h *Base) handleMessages(m messageStream) {
+	rb := &messageBuffer{stream: m.stream}
+	defer rb.reset()
+	skip := m.skip  // skip the rest of the cut message, or the one the capture starts in the middle of
+	titled := false // the start line of the message being assembled is recorded
+
+	for p := range m.stream.Packets() {
+		if skip || p.Gap > 0 {
+			if off := m.index(p.Payload); off > 0 { // resynchronize at the start line
+				m.stream.Release(off)
+				t := *p.TCP
+				t.Payload, t.Seq = p.Payload[off:], p.Seq+uint32(off)
+				p.TCP = &t
+			}
+		}
+		yes := m.title(p.Payload)
+		if p.Gap > 0 {
+			if m.end(streamEndGap, p.Timestamp) {
+				// the streaming message is emitted as it is assembled
+			} else if rb.n > 0 { // the message is cut by the gap, deal what is assembled
+				*m.gap = p.Gap
+				m.dealOrDrop(&rb.Buffer, h.LimitAllow)
+				*m.gap = 0
+			}
+			rb.reset()
+			skip = !yes
+			h.handleGap(p.Gap, m.timestamp(), m.tag)
+		}
+		if yes {
+			m.end(streamEndNext, p.Timestamp)
+			if rb.n > 0 && m.drop != nil { // the message is cut by the next one before its end is seen
+				m.drop()
+			}
+			rb.reset() // 清空缓冲
+			skip = false
+			*m.starts++
+		}
+		if skip {
+			m.stream.Release(len(p.Payload))
+			continue
+		}
 
-		if rb.Len() > 0 && h.option.PermitsCode(lastCode) && util.Http1EndHint(rb.Bytes()) && h.LimitAllow() {
-			h.dealResponse(rb, h.option, c)
-			rb.Reset()
+		if rb.n == 0 && m.seq != nil {
+			*m.seq = p.Seq
+		}
+		if rb.n == 0 && m.first != nil {
+			*m.first = p.Timestamp
+		}
+		if rb.n == 0 {
+			titled = yes
+		}
+		rb.write(p.Payload)
+		if !titled && bytes.IndexByte(rb.Bytes(), '\n') >= 0 {
+			titled = true
+			if m.title(rb.Bytes()) {
+				*m.starts++
+			}
 		}
 
+		if m.streaming != nil && m.streaming(rb, p) {
+			// the streaming message is emitted as it is assembled
+		} else if rb.Len() > 0 && util.Http1EndHint(rb.Bytes()) {
+			m.dealOrDrop(&rb.Buffer, h.LimitAllow)
+			rb.reset()
+		} else if h.option.Budget.exceedsStream(rb.n) { // the end of the message is not seen
+			n := rb.n
+			m.dealOrDrop(&rb.Buffer, h.LimitAllow)
+			rb.reset()
+			skip = true
+			h.option.Budget.truncate()
+			h.handleOverflow(fmt.Sprintf("message exceeds %d bytes, truncated", n), m.timestamp(), m.tag)
+		}
+		h.handleOverflow(m.stream.Overflow(), m.timestamp(), m.tag)
+
 		if h.option.ReachedN() {
 			return
 		}
 	}
 
-	if rb.Len() > 0 && h.option.PermitsCode(lastCode) && h.LimitAllow() {
-		h.dealResponse(rb, h.option, c)
+	if m.end(streamEndClosed, m.timestamp()) {
+		// the streaming message is emitted as it is assembled
+	} else if rb.Len() > 0 {
+		m.dealOrDrop(&rb.Buffer, h.LimitAllow)
 	}
 
-	h.handleError(io.EOF, c.lastRspTimestamp, TagResponse)
+	h.handleOverflow(m.stream.Overflow(), m.timestamp(), m.tag)
+	h.handleEOF(m.stream.Stats(), m.timestamp(), m.tag)
 }
 
 func (h *Base) dealRequest(rb *bytes.Buffer, o *Option, c *TCPConnection) {
 	h.reqBuffer.Reset()
+	h.reqAnomalies = analyzeMessage(rb.Bytes(), true)
 	if r, err := httpport.ReadRequest(bufio.NewReader(rb)); err != nil {
+		h.putVerdict(exchangeVerdict{})
 		h.handleError(err, c.lastReqTimestamp, TagRequest)
+		h.handleAnomalies(h.reqAnomalies, c.lastReqTimestamp, TagRequest)
 	} else {
 		h.processRequest(false, r, o, c.lastReqTimestamp)
 	}
@@ -288,10 +499,16 @@ func (h *Base) dealResponse(rb *bytes.Buffer, o *Option, c *TCPConnection) {
 	}()
 
 	h.rspBuffer.Reset()
+	h.rspAnomalies = analyzeMessage(rb.Bytes(), false)
 	if r, err := httpport.ReadResponse(bufio.NewReader(rb), nil); err != nil {
 		h.handleError(err, c.lastRspTimestamp, TagResponse)
+		h.handleAnomalies(h.rspAnomalies, c.lastRspTimestamp, TagResponse)
 	} else {
+		if o.Timing {
+			h.rspTiming = c.timing.take(h.rspSeq)
+		}
 		h.processResponse(false, r, o, c.lastRspTimestamp)
+		h.rspTiming = nil
 	}
 }
 
@@ -329,6 +546,33 @@ func (r rrSender) Send(msg string, countDiscards bool) {
 
 func (r rrSender) Close() error { return r.OriginSender.Close() }
 
+// capture returns the Capture of the message.
+func (h *Base) capture(seq int32, t time.Time, gap int) Capture {
+	return Capture{
+		Seq: seq, Src: h.key.Src(), Dest: h.key.Dst(), Interface: h.iface, Tunnel: h.tunnel,
+		Timestamp: t.Format(time.RFC3339Nano), Gap: gap,
+	}
+}
+
+// permitsCapture tells whether where the connection is captured passes the filters.
+func (h *Base) permitsCapture(o *Option) bool {
+	return o.PermitsInterface(h.iface) && o.PermitsTunnel(h.tunnel) && o.PermitsIP(h.key)
+}
+
+// putVerdict records the verdict of the request being processed for its response, both numbered by the start lines
+// seen of their streams, and the zero verdicts of the requests before it not processed, like the ones dropped by the
+// method filter or the rate limiter, or not parsed, so the responses after them still take the verdicts of their own.
+func (h *Base) putVerdict(v exchangeVerdict) {
+	for h.reqVerdicts < h.reqStarts {
+		h.reqVerdicts++
+		if h.reqVerdicts < h.reqStarts {
+			h.verdicts.put(int32(h.reqVerdicts), exchangeVerdict{})
+		} else {
+			h.verdicts.put(int32(h.reqVerdicts), v)
+		}
+	}
+}
+
 func (h *Base) processRequest(discard bool, r Req, o *Option, startTime time.Time) {
 	seq := h.reqCounter.Incr()
 
@@ -336,9 +580,21 @@ func (h *Base) processRequest(discard bool, r Req, o *Option, startTime time.Tim
 		defer discardAll(r.GetBody())
 	}
 
-	if !o.PermitsReq(r) {
+	auth := o.inspectAuth(r.GetHeader(), startTime)
+	verdict := exchangeVerdict{anomalies: o.PermitsAnomalies(h.reqAnomalies), auth: o.PermitsAuth(auth), target: o.permitsTarget(r)}
+	h.putVerdict(verdict)
+	if !h.permitsCapture(o) || !verdict.anomalies || !verdict.auth || !o.PermitsReq(r) {
 		return
 	}
+	if !o.InspectAuth {
+		auth = nil
+	} else if !o.ShowSecret {
+		r = maskBasicAuth(r)
+	}
+	o.matched(h.tunnel, h.key)
+	if o.BodyStore != nil {
+		r = storedReq{Req: r, body: o.BodyStore.wrap(r.GetBody(), r.GetHeader())}
+	}
 
 	sender := h.sender
 	if h.cache != nil {
@@ -347,13 +603,19 @@ func (h *Base) processRequest(discard bool, r Req, o *Option, startTime time.Tim
 	}
 
 	if h.usingJSON {
-		data, err := ReqToJSON(h.Context, r, seq, h.key.Src(), h.key.Dst(), startTime.Format(time.RFC3339Nano))
+		c := h.capture(seq, startTime, h.reqGap)
+		c.Anomalies, c.Auth = h.reqAnomalies, auth
+		data, err := ReqToJSON(h.Context, r, c)
 		if err != nil {
 			log.Printf("req to JSON  failed: %v", err)
 		}
 		sender.Send(string(data)+"\n", true)
 	} else {
 		h.printRequest(r, startTime, seq)
+		printStoredBody(&h.reqBuffer, r.GetBody())
+		printGap(&h.reqBuffer, h.reqGap)
+		printAnomalies(&h.reqBuffer, h.reqAnomalies)
+		printAuth(&h.reqBuffer, auth, o.Color)
 		sender.Send(h.reqBuffer.String(), true)
 	}
 }
@@ -364,14 +626,29 @@ type SendArgs struct {
 	time.Time
 }
 
-func (h *Base) processResponse(discard bool, r Rsp, o *Option, endTime time.Time) {
+// processResponse outputs the response, returns false if it does not pass the filters.
+func (h *Base) processResponse(discard bool, r Rsp, o *Option, endTime time.Time) bool {
 	seq := h.rspCounter.Incr()
 	if discard {
 		defer discardAll(r.GetBody())
 	}
 
-	if !o.PermitRatio() {
-		return
+	auth := o.inspectAuth(r.GetHeader(), endTime)
+	if !h.permitsCapture(o) {
+		return false
+	}
+	permits, target := h.permitsRspVerdict(o, auth)
+	if !permits || !o.PermitRatio() {
+		return false
+	}
+	if !o.InspectAuth {
+		auth = nil
+	}
+	if target {
+		o.matched(h.tunnel, h.key)
+	}
+	if o.BodyStore != nil {
+		r = storedRsp{Rsp: r, body: o.BodyStore.wrap(r.GetBody(), r.GetHeader())}
 	}
 
 	sender := h.sender
@@ -381,7 +658,9 @@ func (h *Base) processResponse(discard bool, r Rsp, o *Option, endTime time.Time
 	}
 
 	if h.usingJSON {
-		data, err := RspToJSON(h.Context, r, seq, h.key.Src(), h.key.Dst(), endTime.Format(time.RFC3339Nano))
+		c := h.capture(seq, endTime, h.rspGap)
+		c.Timing, c.Anomalies, c.Auth = h.rspTiming, h.rspAnomalies, auth
+		data, err := RspToJSON(h.Context, r, c)
 		if err != nil {
 			log.Printf("req to JSON  failed: %v", err)
 		}
@@ -389,15 +668,33 @@ func (h *Base) processResponse(discard bool, r Rsp, o *Option, endTime time.Time
 		sender.Send(string(data)+"\n", true)
 	} else {
 		h.printResponse(r, endTime, seq)
+		printStoredBody(&h.rspBuffer, r.GetBody())
+		printGap(&h.rspBuffer, h.rspGap)
+		printAnomalies(&h.rspBuffer, h.rspAnomalies)
+		printAuth(&h.rspBuffer, auth, o.Color)
+		printTiming(&h.rspBuffer, h.rspTiming)
 		sender.Send(h.rspBuffer.String(), true)
 	}
+	return true
+}
+
+// permitsRspVerdict tells whether the response being processed passes the anomaly and the auth filters, by itself or by its request,
+// so the response of a request kept is output with it, and whether its request passes the host and the uri filters,
+// so its connection is matched, which is only known if the verdict of the request is taken.
+func (h *Base) permitsRspVerdict(o *Option, auth *Auth) (permits, target bool) {
+	anomalies, authed := o.PermitsAnomalies(h.rspAnomalies), o.PermitsAuth(auth)
+	if anomalies && authed && o.OnMatch == nil {
+		return true, false
+	}
+	v := h.verdicts.take(int32(h.rspStarts))
+	return (anomalies || v.anomalies) && (authed || v.auth), v.target
 }
 
 // print http request
 func (h *Base) printRequest(r Req, startTime time.Time, seq int32) {
 	b := &h.reqBuffer
-	writeLine(b, fmt.Sprintf("\n### #%d REQ %s-%s %s",
-		seq, h.key.Src(), h.key.Dst(), startTime.Format(time.RFC3339Nano)))
+	writeLine(b, fmt.Sprintf("\n### #%d REQ %s-%s %s%s",
+		seq, h.key.Src(), h.key.Dst(), startTime.Format(time.RFC3339Nano), h.captureSuffix()))
 
 	o := h.option
 	if ss.AnyOf(o.Level, LevelUrl) {
@@ -408,15 +705,17 @@ func (h *Base) printRequest(r Req, startTime time.Time, seq int32) {
 	writeFormat(b, "%s %s %s\r\n", r.GetMethod(), r.GetRequestURI(), r.GetProto())
 	header := r.GetHeader()
 	contentLength := parseContentLength(r.GetContentLength(), header)
-	header["Content-Length"] = []string{fmt.Sprintf("%d", contentLength)}
-	printHeader(b, header)
+	printHeader(b, r.GetRawHeaders())
 	writeBytes(b, []byte("\r\n"))
 
 	hasBody := contentLength != 0 && !ss.AnyOf(r.GetMethod(), "CONNECT", "GET", "HEAD", "TRACE", "OPTIONS")
 
-	if hasBody && o.CanDump() {
-		fn := bodyFileName(o.DumpBody, seq, "REQ", startTime)
-		if n, err := DumpBody(r.GetBody(), fn, &o.dumpNum); err != nil {
+	var dumpPrefix string
+	if o.CanDump() {
+		dumpPrefix = o.dumpPrefix(TagRequest, startTime)
+	}
+	if hasBody && dumpPrefix != "" && multipartBoundary(header) == "" { // the files of the multipart are dumped one by one
+		if fn, n, err := DumpBody(r.GetBody(), dumpPrefix, &o.dumpNum); err != nil {
 			writeLine(b, "dump to file failed:", err)
 		} else if n > 0 {
 			writeLine(b, "\n// dump body to file:", fn, "size:", n)
@@ -432,7 +731,7 @@ func (h *Base) printRequest(r Req, startTime time.Time, seq int32) {
 	}
 
 	if hasBody {
-		h.printBody(b, header, r.GetBody())
+		h.printBody(b, header, r.GetBody(), dumpPrefix)
 	}
 }
 
@@ -440,8 +739,8 @@ func (h *Base) printRequest(r Req, startTime time.Time, seq int32) {
 func (h *Base) printResponse(r Rsp, endTime time.Time, seq int32) {
 	b := &h.rspBuffer
 
-	writeLine(b, fmt.Sprintf("\n### #%d RSP %s-%s %s",
-		seq, h.key.Src(), h.key.Dst(), endTime.Format(time.RFC3339Nano)))
+	writeLine(b, fmt.Sprintf("\n### #%d RSP %s-%s %s%s",
+		seq, h.key.Src(), h.key.Dst(), endTime.Format(time.RFC3339Nano), h.captureSuffix()))
 
 	writeLine(b, r.GetStatusLine())
 	o := h.option
@@ -449,17 +748,18 @@ func (h *Base) printResponse(r Rsp, endTime time.Time, seq int32) {
 		return
 	}
 
-	for _, header := range r.GetRawHeaders() {
-		writeLine(b, header)
-	}
+	printHeader(b, r.GetRawHeaders())
 	writeBytes(b, []byte("\r\n"))
 
 	contentLength := parseContentLength(r.GetContentLength(), r.GetHeader())
 	hasBody := contentLength > 0 && r.GetStatusCode() != 304 && r.GetStatusCode() != 204
 
-	if hasBody && o.CanDump() {
-		fn := bodyFileName(o.DumpBody, seq, "RSP", endTime)
-		if n, err := DumpBody(r.GetBody(), fn, &o.dumpNum); err != nil {
+	var dumpPrefix string
+	if o.CanDump() {
+		dumpPrefix = o.dumpPrefix(TagResponse, endTime)
+	}
+	if hasBody && dumpPrefix != "" && multipartBoundary(r.GetHeader()) == "" {
+		if fn, n, err := DumpBody(r.GetBody(), dumpPrefix, &o.dumpNum); err != nil {
 			writeLine(b, "dump to file failed:", err)
 		} else if n > 0 {
 			writeLine(b, "\n// dump body to file:", fn, "size:", n)
@@ -475,7 +775,41 @@ func (h *Base) printResponse(r Rsp, endTime time.Time, seq int32) {
 	}
 
 	if hasBody {
-		h.printBody(b, r.GetHeader(), r.GetBody())
+		h.printBody(b, r.GetHeader(), r.GetBody(), dumpPrefix)
+	}
+}
+
+// printGap marks the message assembled across a gap of the stream.
+func printGap(b *bytes.Buffer, gap int) {
+	if gap > 0 {
+		writeLine(b, "\n// incomplete: ", gap, " bytes lost in a gap of the stream")
+	}
+}
+
+// printAnomalies prints the anomalies of the message, like // anomaly: error cl-te-conflict: both Content-Length ...
+func printAnomalies(b *bytes.Buffer, anomalies []Anomaly) {
+	for _, a := range anomalies {
+		writeLine(b, "\n// anomaly: ", a.String())
+	}
+}
+
+// printTiming prints the network timing of the exchange, if any.
+func printTiming(b *bytes.Buffer, t *ExchangeTiming) {
+	if t != nil {
+		writeLine(b, "\n// timing: ", t.String())
+	}
+}
+
+// captureSuffix returns the capture interface and the tunnel appended to the ### line, like " eth0" or " eth0 vxlan:100",
+// the interface is - if unknown but with a tunnel.
+func (h *Base) captureSuffix() string {
+	switch {
+	case h.tunnel != "":
+		return " " + ss.Or(h.iface, "-") + " " + h.tunnel
+	case h.iface != "":
+		return " " + h.iface
+	default:
+		return ""
 	}
 }
 
@@ -492,99 +826,183 @@ func parseContentLength(cl int64, header http.Header) int64 {
 	return contentLength
 }
 
-// ReadTextBody read http request/response body if it is text.
-func ReadTextBody(header http.Header, reader io.ReadCloser, limitSize int64) (MimeType, []byte, bool) {
-	// deal with content encoding such as gzip, deflate
-	nr, decompressed := util.TryDecompress(header, reader)
-	if decompressed {
-		defer iox.Close(nr)
+// decodeBody decodes the body by its Content-Encoding like gzip, br or the stacked gzip, br,
+// the decoded bytes are limited by MAX_BODY_SIZE. The decoder is nil if the body is not encoded.
+func decodeBody(header http.Header, reader io.ReadCloser) (io.ReadCloser, *util.BodyDecoder, error) {
+	d, err := util.NewBodyDecoder(header, reader, int64(MaxBodySize))
+	if err != nil || d == nil {
+		return reader, nil, err
+	}
+	return d, d, nil
+}
+
+// ReadTextBody read http request/response body if it is text, converted into UTF-8 by its charset, and the decoder if it is encoded.
+// The binary body of the registered BinaryDecoder is read as the json decoded, and the other binary ones as (binary).
+// The text body is cut at limitSize if it is positive, and truncated is true then.
+func ReadTextBody(header http.Header, reader io.ReadCloser, limitSize int64) (mt MimeType, body []byte, cs *Charset, decoder *util.BodyDecoder, truncated bool) {
+	// deal with content encoding such as gzip, deflate, br and zstd
+	nr, decoder, err := decodeBody(header, reader)
+	if err != nil {
+		log.Printf("decode body failed: %v", err)
+		return MimeType{}, []byte("(failed)"), nil, nil, false
+	}
+	if decoder != nil {
+		defer iox.Close(decoder)
 	}
 
 	// check mime type and charset
 	contentType := header.Get("Content-Type")
 	mimeTypeStr, charset := ParseContentType(contentType)
-	mt := ParseMimeType(mimeTypeStr)
-
-	if !mt.isTextContent() {
-		return mt, []byte("(binary)"), false
-	}
-
-	var (
-		err  error
-		body []byte
-	)
+	mt = ParseMimeType(mimeTypeStr)
 
 	if limitSize > 0 {
-		nr = io.NopCloser(io.LimitReader(nr, limitSize))
+		// one more byte to know whether it is truncated
+		nr = io.NopCloser(io.LimitReader(nr, limitSize+1))
 	}
-
-	if charset == "" {
-		body, err = io.ReadAll(nr)
-	} else {
-		body, err = ReadWithCharset(nr, charset)
+	if !mt.isTextContent() {
+		if d, params := findBinaryDecoder(contentType); d != nil {
+			data, err := io.ReadAll(nr)
+			if err == nil && (limitSize <= 0 || int64(len(data)) <= limitSize) {
+				if js, err := d.Decode(data, params); err == nil {
+					return mt, js, nil, decoder, false
+				}
+			}
+		}
+		return mt, []byte("(binary)"), nil, decoder, false
 	}
 
-	if err != nil {
+	body, err = io.ReadAll(nr)
+	// the bytes decoded before the bomb is found are kept
+	if err != nil && !errors.Is(err, util.ErrDecompressionBomb) {
 		log.Printf("read body failed: %v", err)
-		return mt, []byte("(failed)"), false
+		return mt, []byte("(failed)"), nil, decoder, false
+	}
+	if limitSize > 0 && int64(len(body)) > limitSize {
+		body, truncated = body[:limitSize], true
 	}
 
-	return mt, body, true
+	body, cs = decodeText(body, charset)
+	return mt, body, cs, decoder, truncated
 }
 
 // print http request/response body
-func (h *Base) printBody(b *bytes.Buffer, header http.Header, reader io.ReadCloser) {
-	// deal with content encoding such as gzip, deflate
-	nr, decompressed := util.TryDecompress(header, reader)
-	if decompressed {
-		defer iox.Close(nr)
+// the files of the multipart body are dumped to the files of the dumpPrefix if it is not empty.
+func (h *Base) printBody(b *bytes.Buffer, header http.Header, reader io.ReadCloser, dumpPrefix string) {
+	if boundary := multipartBoundary(header); boundary != "" {
+		parts, err := readMultipart(header, reader, boundary, dumpPrefix, &h.option.dumpNum)
+		printParts(b, boundary, parts, err)
+		return
+	}
+
+	// deal with content encoding such as gzip, deflate, br and zstd
+	nr, decoder, err := decodeBody(header, reader)
+	if err != nil {
+		writeLine(b, "{Decode body failed", err, ", len:", discardAll(reader), "}")
+		return
+	}
+	if decoder != nil {
+		defer func() {
+			iox.Close(decoder)
+			writeLine(b, "\n// decoded: ", decoder.String())
+		}()
 	}
 
 	// check mime type and charset
 	contentType := header.Get("Content-Type")
 	mimeTypeStr, charset := ParseContentType(contentType)
-	if mt := ParseMimeType(mimeTypeStr); !mt.isTextContent() {
+	mt := ParseMimeType(mimeTypeStr)
+	if !mt.isTextContent() {
 		if err := h.printNonTextTypeBody(b, nr, contentType, mt.isBinaryContent()); err != nil {
 			writeLine(b, "{Read content error", err, "}")
 		}
 		return
 	}
 
-	var (
-		err  error
-		body []byte
-	)
-
-	if charset == "" {
-		body, err = io.ReadAll(nr)
-	} else {
-		body, err = ReadWithCharset(nr, charset)
+	// the text is converted as it is read, and formatted as a whole only if it is not too large
+	tr, cs := textReader(nr, charset)
+	if h.option.Pretty {
+		head, err := io.ReadAll(io.LimitReader(tr, maxPrettySize+1))
+		if err == nil && len(head) <= maxPrettySize {
+			if pretty := prettyBody(mt, head, h.option.Color); pretty != nil {
+				head = pretty
+			}
+		}
+		writeBytes(b, head)
 	}
-	if err != nil {
+	if _, err := io.Copy(b, tr); err != nil && !errors.Is(err, util.ErrDecompressionBomb) {
 		writeLine(b, "{Read body failed", err, "}")
 		return
 	}
+	printCharset(b, cs)
+}
 
-	if l := len(body); l > 0 {
-		writeBytes(b, body)
+// printCharset prints the charset the body is converted from, if it is not declared by the Content-Type.
+func printCharset(b *bytes.Buffer, cs *Charset) {
+	if cs != nil {
+		writeLine(b, "\n// charset: ", cs)
 	}
 }
 
 func (h *Base) printNonTextTypeBody(b *bytes.Buffer, reader io.Reader, contentType string, isBinary bool) error {
+	if d, params := findBinaryDecoder(contentType); d != nil {
+		return h.printBinaryBody(b, reader, contentType, d, params)
+	}
 	if h.option.Force || !isBinary {
-		data, err := ioutil.ReadAll(reader)
+		data, err := io.ReadAll(reader)
 		if err != nil {
 			return err
 		}
-		// TODO: try to detect charset
+		_, charset := ParseContentType(contentType)
+		data, cs := decodeText(data, charset)
 		writeLine(b, string(data))
 		writeLine(b)
+		printCharset(b, cs)
 	} else {
-		writeLine(b, "{Non-text body, content-type:", contentType, ", len:", discardAll(reader), "}")
+		head, err := io.ReadAll(io.LimitReader(reader, int64(h.option.Hexdump)))
+		if err != nil {
+			return err
+		}
+		h.printHexdump(b, head, int64(len(head))+discardAll(reader), contentType)
+	}
+	return nil
+}
+
+// printBinaryBody prints the body decoded into json by the decoder,
+// or the hexdump of it if it fails, or exceeds MAX_BODY_SIZE.
+func (h *Base) printBinaryBody(b *bytes.Buffer, reader io.Reader, contentType string, d *BinaryDecoder, params map[string]string) error {
+	data, err := io.ReadAll(io.LimitReader(reader, int64(MaxBodySize)+1))
+	if err != nil && !errors.Is(err, util.ErrDecompressionBomb) {
+		return err
 	}
+	n := int64(len(data)) + discardAll(reader)
+	if n > int64(MaxBodySize) {
+		writeLine(b, "// ", d.Name, ": not decoded, ", n, " bytes exceed MAX_BODY_SIZE")
+	} else if js, err := d.Decode(data, params); err != nil {
+		writeLine(b, "// ", d.Name, ": decode failed, ", err)
+	} else if js, err = indentJSON(js); err == nil {
+		if h.option.Color {
+			js = colorJSON(js)
+		}
+		writeBytes(b, js)
+		writeLine(b, "// ", d.Name, ": ", n, " bytes")
+		return nil
+	}
+
+	if len(data) > h.option.Hexdump {
+		data = data[:h.option.Hexdump]
+	}
+	h.printHexdump(b, data, n, contentType)
 	return nil
 }
 
+// printHexdump prints the hexdump -C like preview of the head of the binary body.
+func (h *Base) printHexdump(b *bytes.Buffer, head []byte, n int64, contentType string) {
+	if dump := hexdump(head); dump != "" {
+		writeLine(b, dump)
+	}
+	writeLine(b, "{Non-text body, content-type:", contentType, ", len:", n, "}")
+}
+
 func discardAll(r io.Reader) int64 {
 	n, _ := io.Copy(io.Discard, r)
 	return n
@@ -597,8 +1015,9 @@ func bodyFileName(prefix string, seq int32, req string, t time.Time) string {
 type Tag string
 
 const (
-	TagRequest  Tag = "REQ"
-	TagResponse Tag = "RSP"
+	TagRequest    Tag = "REQ"
+	TagResponse   Tag = "RSP"
+	TagConnection Tag = "TCP"
 )
 
 func isEOF(e error) bool {
@@ -630,26 +1049,127 @@ func (h *Base) handleError(err error, t time.Time, tag Tag) {
 	}
 }
 
+// handleGap outputs that the bytes of the stream are lost, not captured.
+func (h *Base) handleGap(gap int, t time.Time, tag Tag) {
+	h.handleEvent("GAP", tag, t, fmt.Sprintf(", %d bytes lost", gap))
+}
+
+// handleEOF outputs the end of the stream with its loss and retransmission counts if -eof.
+func (h *Base) handleEOF(st StreamStats, t time.Time, tag Tag) {
+	if !h.option.Eof {
+		return
+	}
+	if st.IsZero() {
+		h.handleEvent("EOF", tag, t, "")
+	} else {
+		h.handleEvent("EOF", tag, t, ", "+st.String())
+	}
+}
+
+// handleEvent outputs the event of the stream, like ### GAP#1 REQ 127.0.0.1:5001-127.0.0.1:80 2024-04-01T10:00:00Z, 1460 bytes lost,
+// the number is the seq of the last message.
+// The EventBean is output instead in json.
+func (h *Base) handleEvent(event string, tag Tag, t time.Time, detail string) {
+	h.sendEvent(EventBean{Event: event, Tag: tag}, t, detail)
+}
+
+// sendEvent outputs the event, in json with its capture and detail filled, and the anomalies of e kept.
+func (h *Base) sendEvent(e EventBean, t time.Time, detail string) {
+	if h.usingJSON {
+		c := h.capture(h.eventSeq(e.Tag), t, 0)
+		c.Anomalies = e.Anomalies
+		e.Capture, e.Detail = c, strings.TrimPrefix(detail, ", ")
+		data, err := ginx.JsoniConfig.Marshal(h.Context, e)
+		if err != nil {
+			log.Printf("event to JSON failed: %v", err)
+			return
+		}
+		h.sender.Send(string(data)+"\n", false)
+		return
+	}
+
+	h.sender.Send(h.eventTitle(e.Event, e.Tag, t, detail), false)
+}
+
+// eventTitle returns the title line of the event like ### GAP#1 REQ 127.0.0.1:5001-127.0.0.1:80 2024-04-01T10:00:00Z.
+func (h *Base) eventTitle(event string, tag Tag, t time.Time, detail string) string {
+	return fmt.Sprintf("\n### %s#%d %s %s-%s %s%s", event, h.eventSeq(tag), tag, h.key.Src(), h.key.Dst(), t.Format(time.RFC3339Nano), detail)
+}
+
+// eventSeq is the seq of the last message of the stream, the last request for the connection.
+func (h *Base) eventSeq(tag Tag) int32 {
+	if tag == TagResponse {
+		return h.rspCounter.Get()
+	}
+	return h.reqCounter.Get()
+}
+
+// handleConnection outputs the summary of the connection closed, like
+// ### CONN#2 TCP 127.0.0.1:5001-127.0.0.1:80 2024-04-01T10:00:00Z, rtt 1.2ms, 2 exchanges, ... closed by client FIN.
+func (h *Base) handleConnection(s ConnSummary) {
+	h.sendEvent(EventBean{Event: "CONN", Tag: TagConnection, Connection: &s}, s.End, ", "+s.String())
+}
+
+// handleAnomalies outputs the anomalies of the message not output, like the one failed to parse,
+// or of the connection, like ### ANOMALY#2 TCP 127.0.0.1:5001-127.0.0.1:80 2024-04-01T10:00:00Z, warn count-mismatch: ...
+func (h *Base) handleAnomalies(anomalies []Anomaly, t time.Time, tag Tag) {
+	for _, a := range anomalies {
+		if h.option.PermitsAnomalies([]Anomaly{a}) {
+			e := EventBean{Event: "ANOMALY", Tag: tag, Capture: Capture{Anomalies: []Anomaly{a}}}
+			h.sendEvent(e, t, ", "+a.String())
+		}
+	}
+}
+
+// handleClose outputs the summary of the connection if -timing, and the mismatched numbers of its messages.
+func (h *Base) handleClose(c *TCPConnection) {
+	s := c.timing.Summary()
+	if h.option.Timing {
+		h.handleConnection(s)
+	}
+
+	// the last request may be still waiting for its response if the connection is not closed
+	if h.option.Resp > 0 && s.ClosedBy != "" && h.reqStarts != h.rspStarts {
+		h.handleAnomalies([]Anomaly{{
+			Kind: AnomalyCountMismatch, Severity: SeverityWarn,
+			Detail: fmt.Sprintf("%d requests, %d responses", h.reqStarts, h.rspStarts),
+		}}, s.End, TagConnection)
+	}
+}
+
+// handleOverflow outputs that the buffered bytes of the stream are dropped by the memory budget, if reason is not empty.
+func (h *Base) handleOverflow(reason string, t time.Time, tag Tag) {
+	if reason != "" {
+		h.handleEvent("OVERFLOW", tag, t, ", "+reason)
+	}
+}
+
 func (h *Base) LimitAllow() bool {
 	l := h.option.RateLimiter
 	return l == nil || l.Allow()
 }
 
-// DumpBody write all data from a reader, to a file.
-func DumpBody(r io.Reader, path string, u *uint32) (int64, error) {
-	f, err := os.Create(path)
+// DumpBody write all data from a reader, to a file of path, or path.1, path.2 and so on if it exists, like the one
+// dumped by the last run, and returns the file written.
+func DumpBody(r io.Reader, path string, u *uint32) (string, int64, error) {
+	name := path
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	for i := 1; os.IsExist(err); i++ {
+		name = fmt.Sprintf("%s.%d", path, i)
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	}
 	if err != nil {
-		return 0, err
+		return name, 0, err
 	}
 
 	n, err := io.Copy(f, r)
 	if n <= 0 { // nothing to write, remove file
-		_ = os.Remove(path)
+		_ = os.Remove(name)
 	} else {
 		atomic.AddUint32(u, 1)
 	}
 	iox.Close(f)
-	return n, err
+	return name, n, err
 }
 
 type Counter struct {
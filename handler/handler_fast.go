@@ -3,6 +3,8 @@ package handler
 import (
 	"context"
 	"sync"
+
+	"github.com/bingoohuang/httpdump/util"
 )
 
 // ConnectionHandlerFast impl ConnectionHandler
@@ -15,14 +17,29 @@ type ConnectionHandlerFast struct {
 
 func (h *ConnectionHandlerFast) handle(src Endpoint, dst Endpoint, c *TCPConnection) {
 	b := NewBase(h.Context, &ConnectionKey{src: src, dst: dst}, h.Option, h.Sender)
+	b.iface, b.tunnel = util.InterfaceName(c.iface), c.tunnel
+	if c.orphanResponse { // count the request not captured to pair the following ones
+		b.reqCounter.Incr()
+		b.reqStarts++
+		b.putVerdict(exchangeVerdict{})
+	}
 
-	h.wg.Add(1)
-	go b.handleRequest(&h.wg, c)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go b.handleRequest(&wg, c)
 
 	if h.Option.Resp > 0 {
-		h.wg.Add(1)
-		go b.handleResponse(&h.wg, c)
+		wg.Add(1)
+		go b.handleResponse(&wg, c)
 	}
+
+	// the summary and the mismatch are output after both streams of the connection are done
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		wg.Wait()
+		b.handleClose(c)
+	}()
 }
 
 func (h *ConnectionHandlerFast) finish() { h.wg.Wait() }
@@ -2,12 +2,16 @@ package handler
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"io"
-	"net/http"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/bingoohuang/httpdump/httpport"
+	"github.com/bingoohuang/httpdump/util"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/tcpassembly"
@@ -16,6 +20,7 @@ import (
 
 type TcpStdAssembler struct {
 	*tcpassembly.Assembler
+	Factory *Factory // to know where the packet creating a new stream is captured
 }
 
 func (r *TcpStdAssembler) FinishAll() {
@@ -23,8 +28,11 @@ func (r *TcpStdAssembler) FinishAll() {
 }
 func (r *TcpStdAssembler) FlushOlderThan(time time.Time) { r.Assembler.FlushOlderThan(time) }
 
-func (r *TcpStdAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
-	r.Assembler.AssembleWithTimestamp(flow, tcp, timestamp)
+func (r *TcpStdAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
+	if r.Factory != nil {
+		r.Factory.ci = ci
+	}
+	r.Assembler.AssembleWithTimestamp(flow, tcp, ci.Timestamp)
 }
 
 type Factory struct {
@@ -32,105 +40,219 @@ type Factory struct {
 
 	option *Option
 	sender Sender
+	ci     gopacket.CaptureInfo // of the packet being assembled, which creates the new streams
+
+	lock     sync.Mutex
+	verdicts map[string]*connVerdicts // shared by the two streams of a connection, by the key of the connection
+}
+
+// connVerdicts is the verdicts of the requests of a connection, referred by its streams.
+type connVerdicts struct {
+	*exchangeVerdicts
+	refs int
+}
+
+func NewFactory(ctx context.Context, option *Option, sender Sender) *Factory {
+	return &Factory{Context: ctx, option: option, sender: sender, verdicts: make(map[string]*connVerdicts)}
 }
 
-func NewFactory(ctx context.Context, option *Option, sender Sender) tcpassembly.StreamFactory {
-	return &Factory{Context: ctx, option: option, sender: sender}
+// connVerdicts returns the verdicts shared by the stream of the key and its reverse one, and the func to release them.
+func (f *Factory) connVerdicts(k streamKey) (*exchangeVerdicts, func()) {
+	id := k.String()
+	if r := (streamKey{net: k.net.Reverse(), tcp: k.tcp.Reverse()}).String(); r < id {
+		id = r
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v, ok := f.verdicts[id]
+	if !ok {
+		v = &connVerdicts{exchangeVerdicts: newExchangeVerdicts()}
+		f.verdicts[id] = v
+	}
+	v.refs++
+
+	return v.exchangeVerdicts, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if v.refs--; v.refs == 0 {
+			delete(f.verdicts, id)
+		}
+	}
 }
 
 type streamKey struct {
 	net, tcp gopacket.Flow
 }
 
-func (k streamKey) Src() string { return fmt.Sprintf("%v:%v", k.net.Src(), k.tcp.Src()) }
-func (k streamKey) Dst() string { return fmt.Sprintf("%v:%v", k.net.Dst(), k.tcp.Dst()) }
+func (k streamKey) Src() string { return net.JoinHostPort(k.net.Src().String(), k.tcp.Src().String()) }
+func (k streamKey) Dst() string { return net.JoinHostPort(k.net.Dst().String(), k.tcp.Dst().String()) }
 
-func (k streamKey) String() string { // like 192.168.217.54:53933-192.168.126.182:9090
-	return fmt.Sprintf("%v:%v-%v:%v", k.net.Src(), k.tcp.Src(), k.net.Dst(), k.tcp.Dst())
+func (k streamKey) String() string { // like 192.168.217.54:53933-192.168.126.182:9090, or [2001:db8::1]:53933-...
+	return k.Src() + "-" + k.Dst()
 }
 
 var _ Key = (*streamKey)(nil)
 
 func (f *Factory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
-	h := NewBase(f.Context, &streamKey{net: netFlow, tcp: tcpFlow}, f.option, f.sender)
-	reader := tcpreader.NewReaderStream()
-	reader.LossErrors = true
-	go f.run(h, &reader)
-	return &reader
+	key := streamKey{net: netFlow, tcp: tcpFlow}
+	h := NewBase(f.Context, &key, f.option, f.sender)
+	h.iface, h.tunnel = util.InterfaceName(f.ci.InterfaceIndex), util.TunnelOf(f.ci).String()
+	verdicts, release := f.connVerdicts(key)
+	h.verdicts = verdicts
+	s := &stdStream{ReaderStream: tcpreader.NewReaderStream(), h: h}
+	s.LossErrors = true
+	go func() {
+		defer release()
+		f.run(h, &s.ReaderStream)
+	}()
+	return s
 }
 
-func (f *Factory) run(b *Base, reader *tcpreader.ReaderStream) {
-	buf := bufio.NewReader(reader)
-	if peek, _ := buf.Peek(8); string(peek[:5]) == "HTTP/" {
-		if b.option.Resp > 0 {
-			f.runResponses(b, buf)
+// stdStream is the tcpreader.ReaderStream, which outputs the bytes skipped by the reassembly as the GAP events,
+// and skips the rest of the message cut by them until the next start line, like the fast mode, so the reader
+// gets tcpreader.DataLost once at the gap, and then the next message. The stream started in the middle,
+// whose start is not captured, is also skipped until its first start line.
+type stdStream struct {
+	tcpreader.ReaderStream
+	h    *Base
+	tag  Tag  // the direction, by the first bytes reassembled
+	skip bool // skipping until the next start line
+	lost bool // bytes are lost since skipping, to be told to the reader
+}
+
+func (s *stdStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for i := range reassembly {
+		r := &reassembly[i]
+		if r.Skip != 0 {
+			if r.Skip > 0 {
+				tag := s.tag
+				if tag == "" { // the bytes lost are the first ones, of the direction not known yet
+					tag = TagConnection
+				}
+				s.h.handleGap(r.Skip, r.Seen, tag)
+				s.lost = true
+			}
+			s.skip = true
+		}
+		if !s.skip {
+			s.setTag(r.Bytes)
+			continue
 		}
-	} else if isHTTPRequestData(peek) {
-		f.runRequests(b, buf)
-	}
 
-	_, _ = io.Copy(io.Discard, reader)
+		off := indexStartLine(r.Bytes)
+		if off < 0 {
+			r.Bytes = nil
+			continue
+		}
+		r.Bytes, s.skip = r.Bytes[off:], false
+		r.Skip = 0
+		if s.lost { // the reader gets DataLost before the next message
+			r.Skip, s.lost = 1, false
+		}
+		s.setTag(r.Bytes)
+	}
+	s.ReaderStream.Reassembled(reassembly)
 }
 
-type HttpRsp struct {
-	*http.Response
+// setTag sets the direction of the stream by its first bytes.
+func (s *stdStream) setTag(b []byte) {
+	if s.tag == "" && len(b) > 0 {
+		if s.tag = TagRequest; bytes.HasPrefix(b, []byte("HTTP/")) {
+			s.tag = TagResponse
+		}
+	}
 }
 
-func (h HttpRsp) GetBody() io.ReadCloser  { return h.Response.Body }
-func (h HttpRsp) GetStatusLine() string   { return h.Response.Status }
-func (h HttpRsp) GetRawHeaders() []string { return MapKeys(h.Response.Header) }
-func (h HttpRsp) GetContentLength() int64 { return h.Response.ContentLength }
-func (h HttpRsp) GetHeader() http.Header  { return h.Response.Header }
-func (h HttpRsp) GetStatusCode() int      { return h.Response.StatusCode }
-
-func MapKeys(header http.Header) []string {
-	keys := make([]string, 0, len(header))
-	for k, v := range header {
-		for _, w := range v {
-			keys = append(keys, k+": "+w)
-		}
+// indexStartLine returns the index of the first start line of a request or a response, -1 if none.
+func indexStartLine(b []byte) int {
+	req, rsp := util.IndexRequestTitle(b), util.IndexResponseTitle(b)
+	if req < 0 || rsp >= 0 && rsp < req {
+		return rsp
 	}
+	return req
+}
 
-	return keys
+// lossReader keeps returning tcpreader.DataLost since the gap, until it resumes for the next message,
+// so the message cut by the gap is not read on over the gap, like when its body is drained.
+type lossReader struct {
+	io.Reader
+	lost bool
+	n    int // bytes read
 }
 
-type HttpReq struct {
-	*http.Request
+func (r *lossReader) Read(p []byte) (int, error) {
+	if r.lost {
+		return 0, tcpreader.DataLost
+	}
+	n, err := r.Reader.Read(p)
+	r.n += n
+	r.lost = errors.Is(err, tcpreader.DataLost)
+	return n, err
 }
 
-func (h HttpReq) GetBody() io.ReadCloser  { return h.Body }
-func (h HttpReq) GetHost() string         { return h.Host }
-func (h HttpReq) GetRequestURI() string   { return h.RequestURI }
-func (h HttpReq) GetPath() string         { return h.URL.Path }
-func (h HttpReq) GetMethod() string       { return h.Method }
-func (h HttpReq) GetProto() string        { return h.Proto }
-func (h HttpReq) GetHeader() http.Header  { return h.Header }
-func (h HttpReq) GetContentLength() int64 { return h.ContentLength }
+func (r *lossReader) resume() { r.lost = false }
+
+// cut tells whether the message read since the offset from is cut by the gap, not lost with the gap as a whole.
+func (r *lossReader) cut(from int) bool { return r.n > from }
 
-func (f *Factory) runResponses(h *Base, buf *bufio.Reader) {
+func (f *Factory) run(b *Base, reader *tcpreader.ReaderStream) {
+	lr := &lossReader{Reader: reader}
+	buf := bufio.NewReader(lr)
+	if peek, _ := buf.Peek(8); string(peek[:5]) == "HTTP/" {
+		if b.option.Resp > 0 {
+			f.runResponses(b, buf, lr)
+		}
+	} else if isHTTPRequestData(peek) {
+		f.runRequests(b, buf, lr)
+	}
+
+	_, _ = io.Copy(io.Discard, reader)
+}
+
+func (f *Factory) runResponses(h *Base, buf *bufio.Reader, lr *lossReader) {
 	for {
+		lr.resume()
+		from := lr.n - buf.Buffered() // where the message starts
 		// 坑警告，这里返回的req，由于body没有读取，reader流位置可能没有移动到http请求的结束
-		r, err := http.ReadResponse(buf, nil)
+		r, err := httpport.ReadResponse(buf, nil)
 		now := time.Now()
+		if errors.Is(err, tcpreader.DataLost) { // the message is cut by a gap, and the next one follows
+			if lr.cut(from) { // still numbered, to pair the exchanges after it
+				h.rspStarts++
+			}
+			continue
+		}
 		if err != nil {
 			h.handleError(err, now, TagResponse)
 			return
 		}
 
-		h.processResponse(true, &HttpRsp{Response: r}, h.option, now)
+		h.rspStarts++
+		h.processResponse(true, r, h.option, now)
 	}
 }
 
-func (f *Factory) runRequests(h *Base, buf *bufio.Reader) {
+func (f *Factory) runRequests(h *Base, buf *bufio.Reader, lr *lossReader) {
 	for {
+		lr.resume()
+		from := lr.n - buf.Buffered() // where the message starts
 		// 坑警告，这里返回的req，由于body没有读取，reader流位置可能没有移动到http请求的结束
-		r, err := http.ReadRequest(buf)
+		r, err := httpport.ReadRequest(buf)
 		now := time.Now()
+		if errors.Is(err, tcpreader.DataLost) { // the message is cut by a gap, and the next one follows
+			if lr.cut(from) { // still numbered, to pair the exchanges after it
+				h.reqStarts++
+				h.putVerdict(exchangeVerdict{})
+			}
+			continue
+		}
 		if err != nil {
 			h.handleError(err, now, TagRequest)
 			return
 		}
 
-		h.processRequest(true, &HttpReq{Request: r}, h.option, now)
+		h.reqStarts++
+		h.processRequest(true, r, h.option, now)
 	}
 }
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// stdTCP serializes and decodes the tcp layer, as tcpassembly gets the ports by the decoded one.
+func stdTCP(tcp *layers.TCP, payload string) *layers.TCP {
+	buf := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, tcp, gopacket.Payload(payload))
+	decoded := &layers.TCP{}
+	_ = decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback)
+	return decoded
+}
+
+// assembleStd assembles the payloads sent by the client one by one in std mode, captured on the interface.
+func assembleStd(option *Option, iface int, payloads ...string) string {
+	sender := &recordSender{}
+	f := NewFactory(context.Background(), option, sender)
+	r := &TcpStdAssembler{Assembler: tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f)), Factory: f}
+
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), InterfaceIndex: iface}
+	seq := uint32(1000)
+	r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq - 1, SYN: true}, ""), ci)
+	for _, p := range payloads {
+		r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq, ACK: true}, p), ci)
+		seq += uint32(len(p))
+	}
+	r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq, FIN: true}, ""), ci)
+	r.FinishAll()
+
+	time.Sleep(100 * time.Millisecond) // the streams are read in their own goroutines
+	return sender.String()
+}
+
+func TestStdInterface(t *testing.T) {
+	eth0 := util.RegisterInterface(util.Interface{Name: "std-eth0", LinkType: layers.LinkTypeEthernet})
+
+	option := &Option{Level: "all"}
+	option.SetFilter(&Filter{Interface: "std-eth*", SrcRatio: 1})
+	out := assembleStd(option, eth0, "GET /a HTTP/1.1\r\nHost: a\r\n\r\n")
+	assert.Contains(t, out, "REQ 10.0.0.1:5001-10.0.0.2:80 ")
+	assert.Contains(t, out, " std-eth0\r\nGET /a HTTP/1.1\r\n")
+
+	option.SetFilter(&Filter{Interface: "std-lo", SrcRatio: 1})
+	assert.NotContains(t, assembleStd(option, eth0, "GET /a HTTP/1.1\r\nHost: a\r\n\r\n"), "GET /a")
+}
+
+func TestStdRawHeaders(t *testing.T) {
+	option := &Option{Level: "all"}
+	option.SetFilter(&Filter{SrcRatio: 1})
+	out := assembleStd(option, 0, "GET /a HTTP/1.1\r\nhost: a\r\nX-B: 1\r\nx-a: 2\r\nX-Fold: a\r\n  b\r\n\r\n")
+	assert.Contains(t, out, "GET /a HTTP/1.1\r\nhost: a\r\nX-B: 1\r\nx-a: 2\r\nX-Fold: a\r\n  b\r\n")
+}
+
+func TestStdGap(t *testing.T) {
+	option := &Option{Level: "all"}
+	option.SetFilter(&Filter{SrcRatio: 1})
+	sender := &recordSender{}
+	f := NewFactory(context.Background(), option, sender)
+	r := &TcpStdAssembler{Assembler: tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f)), Factory: f}
+
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	ci := gopacket.CaptureInfo{Timestamp: time.Now()}
+	post := "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\n01234"
+	get := "GET /b HTTP/1.1\r\nHost: b\r\n\r\n"
+	// 56789 of the post is lost
+	seq := uint32(1000)
+	r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq - 1, SYN: true}, ""), ci)
+	r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq, ACK: true}, post), ci)
+	seq += uint32(len(post) + 5)
+	r.Assemble(flow, stdTCP(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: seq, ACK: true}, get), ci)
+	r.FinishAll()
+
+	time.Sleep(100 * time.Millisecond) // the streams are read in their own goroutines
+	out := sender.String()
+	assert.Contains(t, out, "POST /a HTTP/1.1")
+	assert.Contains(t, out, "### GAP#1 REQ 10.0.0.1:5001-10.0.0.2:80")
+	assert.Contains(t, out, ", 5 bytes lost")
+	assert.Contains(t, out, "GET /b HTTP/1.1")
+	assert.NotContains(t, out, "### ERR")
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"github.com/bingoohuang/gg/pkg/iox"
+	"github.com/bingoohuang/httpdump/httpport"
+	"github.com/bingoohuang/httpdump/util"
+)
+
+// Part is a part of the multipart body, like a form field or an uploaded file.
+type Part struct {
+	Header     textproto.MIMEHeader
+	RawHeaders []httpport.RawHeader `json:",omitempty"` // the header fields as they are sent
+	Name       string               `json:",omitempty"` // the form field name
+	Filename   string               `json:",omitempty"`
+	Size       int64
+	Value      string   `json:",omitempty"` // of the text fields, limited by MAX_BODY_SIZE
+	Charset    *Charset `json:",omitempty"` // the value is converted from, if it is not declared by the Content-Type
+	Detected   string   `json:",omitempty"` // the content type detected of the files
+	SHA256     string   `json:",omitempty"` // of the files
+	DumpFile   string   `json:",omitempty"` // where the file is dumped by -dump-body
+}
+
+// multipartBoundary returns the boundary of the multipart content type, empty if it is not multipart.
+func multipartBoundary(header http.Header) string {
+	mt, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// readMultipart decodes the body by its Content-Encoding, and reads its parts,
+// the files are dumped to the files of the prefix if it is not empty,
+// then the decoding is not limited by MAX_BODY_SIZE, to dump the whole files.
+// The parts read before the error are returned with it.
+func readMultipart(header http.Header, body io.ReadCloser, boundary, dumpPrefix string, dumpNum *uint32) ([]Part, error) {
+	limit := int64(MaxBodySize)
+	if dumpPrefix != "" {
+		limit = 0
+	}
+	nr := io.Reader(body)
+	decoder, err := util.NewBodyDecoder(header, body, limit)
+	if err != nil {
+		return nil, err
+	}
+	if decoder != nil {
+		nr = decoder
+		defer iox.Close(decoder)
+	}
+
+	var parts []Part
+	r := httpport.NewPartReader(nr, boundary)
+	for i := 1; ; i++ {
+		p, err := r.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, err
+		}
+
+		part := Part{Header: p.Header, RawHeaders: p.RawHeaders, Name: p.FormName(), Filename: p.FileName()}
+		if isFilePart(p) {
+			err = readFilePart(&part, p, dumpPrefix, i, dumpNum)
+		} else {
+			var value bytes.Buffer
+			_, err = io.Copy(&value, io.LimitReader(p, int64(MaxBodySize)))
+			part.Size = int64(value.Len()) + discardAll(p)
+			_, charset := ParseContentType(p.Header.Get("Content-Type"))
+			v, cs := decodeText(value.Bytes(), charset)
+			part.Value, part.Charset = string(v), cs
+		}
+		parts = append(parts, part)
+		if err != nil {
+			return parts, err
+		}
+	}
+}
+
+// isFilePart tells whether the part is a file, which is summarised instead of shown inline.
+func isFilePart(p *httpport.Part) bool {
+	if p.FileName() != "" {
+		return true
+	}
+	ct := p.Header.Get("Content-Type")
+	if ct == "" {
+		return false
+	}
+	mt, _ := ParseContentType(ct)
+	return !ParseMimeType(mt).isTextContent()
+}
+
+// readFilePart reads the file to detect its type and hash it, and dumps it if the prefix is not empty.
+func readFilePart(part *Part, p *httpport.Part, dumpPrefix string, i int, dumpNum *uint32) (err error) {
+	r := bufio.NewReaderSize(p, 512)
+	head, _ := r.Peek(512) // http.DetectContentType considers at most 512 bytes
+	part.Detected = http.DetectContentType(head)
+
+	h := sha256.New()
+	if dumpPrefix == "" {
+		part.Size, err = io.Copy(h, r)
+	} else {
+		fn := fmt.Sprintf("%s.%d.%s", dumpPrefix, i, partFileName(part.Filename))
+		if fn, part.Size, err = DumpBody(io.TeeReader(r, h), fn, dumpNum); part.Size > 0 {
+			part.DumpFile = fn
+		}
+	}
+	part.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return err
+}
+
+// partFileName returns the base of the file name sent, which is safe to be a local file name.
+func partFileName(filename string) string {
+	name := filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return "part"
+	}
+	return name
+}
+
+// printParts prints the parts like they are sent, with the files summarised.
+func printParts(b *bytes.Buffer, boundary string, parts []Part, err error) {
+	for _, p := range parts {
+		writeLine(b, "--", boundary)
+		printHeader(b, p.RawHeaders)
+		writeLine(b)
+
+		if p.SHA256 == "" {
+			writeLine(b, p.Value)
+			if p.Charset != nil {
+				writeLine(b, "// charset: ", p.Charset)
+			}
+			if p.Size > int64(MaxBodySize) {
+				writeLine(b, "// value: ", p.Size, " bytes, truncated at ", MaxBodySize, " bytes")
+			}
+			continue
+		}
+		writeLine(b, fmt.Sprintf("// file: %d bytes, detected %s, sha256 %s", p.Size, p.Detected, p.SHA256))
+		if p.DumpFile != "" {
+			writeLine(b, "// dump part to file: ", p.DumpFile)
+		}
+	}
+
+	if err != nil {
+		writeLine(b, "// multipart: ", len(parts), " parts read, ", err)
+	} else {
+		writeLine(b, "--", boundary, "--")
+	}
+}
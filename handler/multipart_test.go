@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipart(t *testing.T) {
+	body := "--XYZ\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+		"hello\r\n" +
+		"--XYZ\r\n" +
+		"content-type: image/png\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"../a.png\"\r\n\r\n" +
+		"\x89PNG\r\n\x1a\n0000\r\n" +
+		"--XYZ--\r\n"
+	header := http.Header{"Content-Type": {"multipart/form-data; boundary=XYZ"}}
+	assert.Equal(t, "XYZ", multipartBoundary(header))
+	assert.Equal(t, "", multipartBoundary(http.Header{"Content-Type": {"text/plain"}}))
+
+	var dumpNum uint32
+	prefix := filepath.Join(t.TempDir(), "upload")
+	parts, err := readMultipart(header, io.NopCloser(strings.NewReader(body)), "XYZ", prefix, &dumpNum)
+	assert.Nil(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "title", parts[0].Name)
+	assert.Equal(t, "hello", parts[0].Value)
+	assert.Equal(t, "a.png", parts[1].Filename)
+	assert.Equal(t, int64(12), parts[1].Size)
+	assert.Equal(t, "image/png", parts[1].Detected)
+	assert.Equal(t, prefix+".2.a.png", parts[1].DumpFile)
+	assert.Equal(t, uint32(1), dumpNum)
+	dumped, _ := os.ReadFile(parts[1].DumpFile)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n0000", string(dumped))
+
+	var b bytes.Buffer
+	printParts(&b, "XYZ", parts, nil)
+	assert.Equal(t, "--XYZ\r\n"+
+		"Content-Disposition: form-data; name=\"title\"\r\n\r\n"+
+		"hello\r\n"+
+		"--XYZ\r\n"+
+		"content-type: image/png\r\n"+
+		"Content-Disposition: form-data; name=\"file\"; filename=\"../a.png\"\r\n\r\n"+
+		"// file: 12 bytes, detected image/png, sha256 "+parts[1].SHA256+"\r\n"+
+		"// dump part to file: "+prefix+".2.a.png\r\n"+
+		"--XYZ--\r\n", b.String())
+
+	parts, err = readMultipart(header, io.NopCloser(strings.NewReader(body[:60])), "XYZ", "", nil)
+	assert.NotNil(t, err)
+	assert.Len(t, parts, 1)
+
+	// the encoded body dumped is not cut by MAX_BODY_SIZE
+	defer func(size int) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 16
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(body))
+	_ = gw.Close()
+	header.Set("Content-Encoding", "gzip")
+	parts, err = readMultipart(header, io.NopCloser(&gz), "XYZ", prefix, &dumpNum)
+	assert.Nil(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, int64(12), parts[1].Size)
+	assert.Equal(t, prefix+".2.a.png.1", parts[1].DumpFile) // the file dumped before is not overwritten
+
+	o := &Option{DumpBody: prefix}
+	now := time.Now()
+	assert.NotEqual(t, o.dumpPrefix(TagRequest, now), o.dumpPrefix(TagRequest, now))
+}
@@ -3,8 +3,11 @@ package handler
 import (
 	"context"
 	"math/rand"
+	"net/http"
+	"net/netip"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/bingoohuang/httpdump/util"
 	"golang.org/x/time/rate"
@@ -15,30 +18,76 @@ const (
 	LevelHeader = "header"
 )
 
+// Filter holds the request/response filters, which can be swapped atomically at runtime.
+type Filter struct {
+	Interface string
+	Tunnel    string
+	IP        *util.IPFilter // applied in user space when the bpf does not apply the -ip
+	Host      string
+	Uri       string
+	Method    string
+	Status    util.IntSetFlag
+	SrcRatio  float64
+	Anomaly   AnomalyFilter // only the messages with the anomalies selected, empty for all
+	Auth      AuthFilter    // only the messages with the auth material matched, empty for all
+}
+
+// IsZero tells whether the filter permits everything.
+func (f *Filter) IsZero() bool {
+	return f.Interface == "" && f.Tunnel == "" && f.IP == nil && f.Host == "" && f.Uri == "" && f.Method == "" && f.Status.String() == "" && f.SrcRatio == 1 &&
+		len(f.Anomaly) == 0 && len(f.Auth) == 0
+}
+
 type Option struct {
-	Host        string
-	Uri         string
-	Method      string
-	Status      util.IntSetFlag
+	filter atomic.Pointer[Filter]
+
 	Level       string
 	DumpBody    string
-	dumpNum     uint32
+	dumpNum     uint32 // the files dumped
+	dumpSeq     uint32 // the last number of the dump file names, unique in all the connections
 	DumpMax     uint32
 	Resp        int
 	Force       bool
 	Curl        bool
 	Eof         bool
+	Timing      bool          // outputs the network timing of the responses and the summaries of the connections
+	Pretty      bool          // indents the json and xml bodies, and decodes the form bodies
+	Color       bool          // colors the pretty bodies
+	InspectAuth bool          // outputs the Basic credentials, JWTs and cookies decoded
+	ShowSecret  bool          // shows the passwords of the Basic credentials instead of masking them
+	Hexdump     int           // bytes of the binary bodies previewed in hexdump, 0 for none
+	StreamAfter time.Duration // the chunked responses not ended in it are emitted chunk by chunk, 0 for none
 	Debug       bool
 	RateLimiter *rate.Limiter
+	Budget      *MemoryBudget // limits the payload bytes buffered for the reassembly, nil for no limit
+	BodyStore   *BodyStore    // stores the bodies content-addressed, nil for no store
 
 	N   int32
 	Num int32
 
 	CtxCancel context.CancelFunc
 
-	SrcRatio float64
+	// OnMatch is called with the connection tunnel and endpoints when a request passes the filters, or a response of it.
+	OnMatch func(tunnel, src, dst string)
+}
+
+func (o *Option) matched(tunnel string, k Key) {
+	if o.OnMatch != nil {
+		o.OnMatch(tunnel, k.Src(), k.Dst())
+	}
+}
+
+// Filter returns the current filter.
+func (o *Option) Filter() *Filter {
+	if f := o.filter.Load(); f != nil {
+		return f
+	}
+	return &Filter{SrcRatio: 1}
 }
 
+// SetFilter replaces the current filter, the new one takes effect on the next message.
+func (o *Option) SetFilter(f *Filter) { o.filter.Store(f) }
+
 func (o *Option) CanDump() bool {
 	if o.DumpBody == "" {
 		return false
@@ -47,19 +96,72 @@ func (o *Option) CanDump() bool {
 	return o.DumpMax <= 0 || atomic.LoadUint32(&o.dumpNum) < o.DumpMax
 }
 
+// dumpPrefix returns the unique prefix of the files the body of the message is dumped to, like dump.20240101.12.REQ.
+func (o *Option) dumpPrefix(tag Tag, t time.Time) string {
+	return bodyFileName(o.DumpBody, int32(atomic.AddUint32(&o.dumpSeq, 1)), string(tag), t)
+}
+
 func (o *Option) PermitsMethod(method string) bool {
-	return o.Method == "" || strings.Contains(o.Method, method)
+	f := o.Filter()
+	return f.Method == "" || strings.Contains(f.Method, method)
 }
 
 func (o *Option) PermitsReq(r Req) bool {
-	return o.permitsHost(r.GetHost()) && o.permitsUri(r.GetRequestURI()) && o.permitN() && o.PermitRatio()
+	return o.permitsTarget(r) && o.permitN() && o.Filter().permitRatio()
+}
+
+// permitsTarget tells whether the host and the uri of the request pass the filters.
+func (o *Option) permitsTarget(r Req) bool {
+	f := o.Filter()
+	return f.permitsHost(r.GetHost()) && f.permitsUri(r.GetRequestURI())
 }
 
-func (o *Option) PermitsCode(code int) bool { return o.Status.Contains(code) }
+// PermitsAnomalies tells whether the anomalies of the message pass the anomaly filter.
+func (o *Option) PermitsAnomalies(anomalies []Anomaly) bool {
+	return o.Filter().Anomaly.Permits(anomalies)
+}
+
+// inspectAuth decodes the auth material of the header for -inspect-auth or the auth filter, nil if neither is set.
+func (o *Option) inspectAuth(header http.Header, t time.Time) *Auth {
+	if !o.InspectAuth && len(o.Filter().Auth) == 0 {
+		return nil
+	}
+	return inspectAuth(header, t, o.ShowSecret)
+}
+
+// PermitsAuth tells whether the auth material of the message passes the auth filter.
+func (o *Option) PermitsAuth(a *Auth) bool {
+	return o.Filter().Auth.Permits(a)
+}
+
+func (o *Option) PermitsCode(code int) bool { return o.Filter().Status.Contains(code) }
+
+// PermitsInterface tells whether the capture interface passes the filter, unknown interface only passes an empty filter.
+func (o *Option) PermitsInterface(iface string) bool {
+	f := o.Filter()
+	return f.Interface == "" || wildcardMatch(iface, f.Interface)
+}
+
+// PermitsTunnel tells whether the outermost tunnel like vxlan:100 passes the filter, like vxlan:* or vlan:20.
+func (o *Option) PermitsTunnel(tunnel string) bool {
+	f := o.Filter()
+	return f.Tunnel == "" || wildcardMatch(tunnel, f.Tunnel)
+}
+
+// PermitsIP tells whether the ips of the connection endpoints pass the ip filter.
+func (o *Option) PermitsIP(k Key) bool {
+	return o.Filter().IP.Permits(endpointAddr(k.Src()), endpointAddr(k.Dst()))
+}
+
+// endpointAddr parses the ip of the endpoint like 10.0.0.1:80 or [2001:db8::1]:80.
+func endpointAddr(endpoint string) netip.Addr {
+	ap, _ := netip.ParseAddrPort(endpoint)
+	return ap.Addr()
+}
 
-func (o *Option) permitsUri(uri string) bool { return o.Uri == "" || wildcardMatch(uri, o.Uri) }
+func (f *Filter) permitsUri(uri string) bool { return f.Uri == "" || wildcardMatch(uri, f.Uri) }
 
-func (o *Option) permitsHost(host string) bool { return o.Host == "" || wildcardMatch(host, o.Host) }
+func (f *Filter) permitsHost(host string) bool { return f.Host == "" || wildcardMatch(host, f.Host) }
 
 func (o *Option) ReachedN() bool {
 	reached := o.N > 0 && atomic.LoadInt32(&o.Num) <= 0
@@ -74,6 +176,8 @@ func (o *Option) permitN() bool {
 	return o.N <= 0 || atomic.AddInt32(&o.Num, -1) >= 0
 }
 
-func (o *Option) PermitRatio() bool {
-	return o.SrcRatio == 1 || rand.Float64() <= o.SrcRatio
+func (o *Option) PermitRatio() bool { return o.Filter().permitRatio() }
+
+func (f *Filter) permitRatio() bool {
+	return f.SrcRatio == 1 || rand.Float64() <= f.SrcRatio
 }
@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/man"
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"go.uber.org/multierr"
+)
+
+const (
+	// pcapLinger is how long the packets of a closed connection are kept waiting for its messages to be matched.
+	pcapLinger = 10 * time.Second
+	// pcapShards is the number of the shards of the connections, each locked on its own, so that the packets
+	// and the matches of the connections in the shards of the assembler do not wait for each other.
+	pcapShards = 64
+)
+
+// PcapWriter writes the raw packets of the matched connections to pcap files, like -output-pcap matched.pcap:100M.
+// The packets of a connection are buffered until one of its requests or responses passes the filters,
+// then the buffered and the following packets are written with their original timestamps.
+// When there is no filter, all packets are written directly.
+type PcapWriter struct {
+	util.Assembler
+
+	option     *Option
+	connBuffer int
+	seed       maphash.Seed
+	shards     [pcapShards]pcapShard
+	latest     atomic.Int64 // the latest unix nano timestamp of the packets, the clock of the pcap files read, like -r file.pcap
+
+	fileLock sync.Mutex
+	file     *pcapFile
+}
+
+// pcapShard is the connections whose keys hash to it.
+type pcapShard struct {
+	lock  sync.Mutex
+	conns map[string]*pcapConn
+}
+
+type pcapConn struct {
+	packets  []gopacket.Packet
+	size     int
+	dropped  int
+	matched  bool
+	closedAt time.Time // the timestamp of the first FIN or RST packet
+	lastSeen time.Time // the timestamp of the last packet
+}
+
+// NewPcapWriter creates a PcapWriter, which passes the packets to the assembler after buffering them.
+// out is the pcap file name, with an optional max size suffix like :100M to rotate the files,
+// connBuffer is the max bytes of packets buffered for each connection before it matches.
+func NewPcapWriter(out string, connBuffer uint64, option *Option, assembler util.Assembler) (*PcapWriter, error) {
+	file := &pcapFile{name: out}
+	if p := strings.LastIndex(out, ":"); p > 0 {
+		if size, err := man.ParseBytes(out[p+1:]); err == nil {
+			file.name, file.maxSize = out[:p], size
+		}
+	}
+
+	if err := file.open(layers.LinkTypeEthernet); err != nil {
+		return nil, fmt.Errorf("create pcap file %s: %w", file.name, err)
+	}
+
+	w := &PcapWriter{Assembler: assembler, option: option, file: file, connBuffer: int(connBuffer), seed: maphash.MakeSeed()}
+	for i := range w.shards {
+		w.shards[i].conns = make(map[string]*pcapConn)
+	}
+	return w, nil
+}
+
+// pcapConnKey is the connection key of both directions, formatted like Key.Src()-Key.Dst() in order,
+// prefixed by the tunnel like the key of the TCPAssembler, as the same endpoints may be reused in different tunnels.
+func pcapConnKey(tunnel, src, dst string) string {
+	key := dst + "-" + src
+	if src < dst {
+		key = src + "-" + dst
+	}
+	if tunnel != "" {
+		key = tunnel + "/" + key
+	}
+	return key
+}
+
+// shard returns the shard of the connection key, which is the same for both directions.
+func (w *PcapWriter) shard(key string) *pcapShard {
+	return &w.shards[maphash.String(w.seed, key)%pcapShards]
+}
+
+func (w *PcapWriter) AssemblePacket(p gopacket.Packet, flow gopacket.Flow, tcp *layers.TCP) {
+	w.writePacket(p, flow, tcp)
+	w.Assembler.Assemble(flow, tcp, p.Metadata().CaptureInfo)
+}
+
+func (w *PcapWriter) writePacket(p gopacket.Packet, flow gopacket.Flow, tcp *layers.TCP) {
+	if w.option.Filter().IsZero() {
+		w.write(p)
+		return
+	}
+
+	src := Endpoint{ip: flow.Src().String(), port: uint16(tcp.SrcPort)}
+	dst := Endpoint{ip: flow.Dst().String(), port: uint16(tcp.DstPort)}
+	key := pcapConnKey(util.TunnelOf(p.Metadata().CaptureInfo).String(), src.String(), dst.String())
+	s := w.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.conns[key]
+	if c == nil {
+		c = &pcapConn{}
+		s.conns[key] = c
+	}
+	c.lastSeen = p.Metadata().Timestamp
+	for latest := w.latest.Load(); c.lastSeen.UnixNano() > latest; latest = w.latest.Load() {
+		if w.latest.CompareAndSwap(latest, c.lastSeen.UnixNano()) {
+			break
+		}
+	}
+	if (tcp.FIN || tcp.RST) && c.closedAt.IsZero() {
+		c.closedAt = c.lastSeen
+	}
+
+	switch n := len(p.Data()); {
+	case c.matched:
+		w.write(p)
+	case c.size+n > w.connBuffer:
+		c.dropped++
+	default:
+		c.packets = append(c.packets, p)
+		c.size += n
+	}
+}
+
+// Match writes the buffered packets of the connection in the tunnel, and the following ones will be written directly.
+func (w *PcapWriter) Match(tunnel, src, dst string) {
+	key := pcapConnKey(tunnel, src, dst)
+	s := w.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.conns[key]
+	if c == nil || c.matched {
+		return
+	}
+
+	c.matched = true
+	w.write(c.packets...)
+	if c.dropped > 0 {
+		log.Printf("W! pcap %s dropped %d packets exceeding the connection buffer", key, c.dropped)
+	}
+	c.packets, c.size = nil, 0
+}
+
+// write writes the packets to the pcap file in order, the packets of a connection are written under the lock of its shard.
+func (w *PcapWriter) write(packets ...gopacket.Packet) {
+	w.fileLock.Lock()
+	defer w.fileLock.Unlock()
+
+	for _, p := range packets {
+		if err := w.file.write(p); err != nil {
+			log.Printf("E! write pcap %s failed: %v", w.file.name, err)
+		}
+	}
+}
+
+// FlushOlderThan forgets the connections idle since the time, or closed for a while, and flushes the pcap file.
+// The idle and the closed durations are measured by the timestamps of the packets, which are in the past when
+// the pcap files are read, so the connections are not forgotten before their messages are matched.
+func (w *PcapWriter) FlushOlderThan(t time.Time) {
+	latest := time.Unix(0, w.latest.Load())
+	idleSince := latest.Add(-time.Since(t))
+	for i := range w.shards {
+		s := &w.shards[i]
+		s.lock.Lock()
+		for key, c := range s.conns {
+			if c.lastSeen.Before(idleSince) || !c.closedAt.IsZero() && latest.Sub(c.closedAt) > pcapLinger {
+				delete(s.conns, key)
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	w.fileLock.Lock()
+	if err := w.file.flush(); err != nil {
+		log.Printf("E! flush pcap %s failed: %v", w.file.name, err)
+	}
+	w.fileLock.Unlock()
+
+	w.Assembler.FlushOlderThan(t)
+}
+
+// FinishAll waits the assembler to finish, so that the last messages are matched, and then closes the pcap file.
+func (w *PcapWriter) FinishAll() {
+	w.Assembler.FinishAll()
+
+	for i := range w.shards {
+		s := &w.shards[i]
+		s.lock.Lock()
+		s.conns = map[string]*pcapConn{}
+		s.lock.Unlock()
+	}
+
+	w.fileLock.Lock()
+	defer w.fileLock.Unlock()
+
+	if err := w.file.close(); err != nil {
+		log.Printf("E! close pcap %s failed: %v", w.file.name, err)
+	}
+}
+
+var _ util.PacketAssembler = (*PcapWriter)(nil)
+
+const (
+	pcapFileHeaderSize   = 24
+	pcapPacketHeaderSize = 16
+)
+
+// pcapFile is a pcap file rotated by size, like a.pcap, a-1.pcap, a-2.pcap,
+// a new file is also started when the link type of packets changes.
+type pcapFile struct {
+	name    string
+	maxSize uint64
+
+	f        *os.File
+	buf      *bufio.Writer
+	w        *pcapgo.Writer
+	size     uint64
+	index    int
+	linkType layers.LinkType
+}
+
+func (f *pcapFile) write(p gopacket.Packet) error {
+	linkType := packetLinkType(p)
+	if f.f != nil && (f.maxSize > 0 && f.size >= f.maxSize || linkType != f.linkType) {
+		if err := f.close(); err != nil {
+			return err
+		}
+		if f.size > pcapFileHeaderSize { // reuse the empty file
+			f.index++
+		}
+	}
+
+	if f.f == nil {
+		if err := f.open(linkType); err != nil {
+			return err
+		}
+	}
+
+	if err := f.w.WritePacket(p.Metadata().CaptureInfo, p.Data()); err != nil {
+		return err
+	}
+	f.size += pcapPacketHeaderSize + uint64(len(p.Data()))
+	return nil
+}
+
+func (f *pcapFile) open(linkType layers.LinkType) error {
+	name := f.name
+	if f.index > 0 {
+		ext := filepath.Ext(name)
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), f.index, ext)
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(file)
+	w := pcapgo.NewWriterNanos(buf)
+	if err := w.WriteFileHeader(65536, linkType); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.f, f.buf, f.w, f.size, f.linkType = file, buf, w, pcapFileHeaderSize, linkType
+	return nil
+}
+
+func (f *pcapFile) close() error {
+	if f.f == nil {
+		return nil
+	}
+
+	err := multierr.Append(f.buf.Flush(), f.f.Close())
+	f.f, f.buf, f.w = nil, nil, nil
+	return err
+}
+
+func (f *pcapFile) flush() error {
+	if f.buf == nil {
+		return nil
+	}
+	return f.buf.Flush()
+}
+
+// packetLinkType returns the link type of the packet, by its first layer.
+func packetLinkType(p gopacket.Packet) layers.LinkType {
+	if ls := p.Layers(); len(ls) > 0 {
+		switch ls[0].LayerType() {
+		case layers.LayerTypeLinuxSLL:
+			return layers.LinkTypeLinuxSLL
+		case layers.LayerTypeLoopback:
+			return layers.LinkTypeNull
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			return layers.LinkTypeRaw
+		}
+	}
+	return layers.LinkTypeEthernet
+}
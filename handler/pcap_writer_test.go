@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopAssembler struct{}
+
+func (nopAssembler) Assemble(gopacket.Flow, *layers.TCP, gopacket.CaptureInfo) {}
+func (nopAssembler) FlushOlderThan(time.Time)                                  {}
+func (nopAssembler) FinishAll()                                                {}
+
+func createTCPPacket(t *testing.T, srcPort, dstPort uint16, payload string) gopacket.Packet {
+	return createPacket(t, &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), ACK: true}, payload)
+}
+
+func createPacket(t *testing.T, tcp *layers.TCP, payload string) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		DstMAC:       net.HardwareAddr{6, 5, 4, 3, 2, 1},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{127, 0, 0, 1}, DstIP: net.IP{127, 0, 0, 1}}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	assert.Nil(t, gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)))
+
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	md := p.Metadata()
+	md.Timestamp = time.Now()
+	md.CaptureLength, md.Length = len(p.Data()), len(p.Data())
+	return p
+}
+
+func countPcapPackets(t *testing.T, file string) (n int) {
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	assert.Nil(t, err)
+	for {
+		if _, _, err := r.ReadPacketData(); err == io.EOF {
+			return n
+		}
+		n++
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{}
+	option.SetFilter(&Filter{Uri: "/a", SrcRatio: 1})
+	w, err := NewPcapWriter(file, 200, option, nopAssembler{})
+	assert.Nil(t, err)
+
+	assemble := func(p gopacket.Packet) {
+		w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+	}
+
+	assemble(createTCPPacket(t, 5001, 80, "GET /a HTTP/1.1\r\n\r\n"))
+	assemble(createTCPPacket(t, 80, 5001, "HTTP/1.1 200 OK\r\n\r\n"))
+	assemble(createTCPPacket(t, 5002, 80, "GET /b HTTP/1.1\r\n\r\n"))
+	assemble(createTCPPacket(t, 5001, 80, string(make([]byte, 200)))) // exceeds the connection buffer
+
+	w.Match("", "127.0.0.1:80", "127.0.0.1:5001")
+	assemble(createTCPPacket(t, 5001, 80, "GET /a HTTP/1.1\r\n\r\n"))
+	w.FinishAll()
+
+	assert.Equal(t, 3, countPcapPackets(t, file))
+}
+
+func TestPcapWriterConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{}
+	option.SetFilter(&Filter{Uri: "/a", SrcRatio: 1})
+	w, err := NewPcapWriter(file, 1000, option, nopAssembler{})
+	assert.Nil(t, err)
+
+	// the connections of the shards are buffered and matched at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(port uint16) {
+			defer wg.Done()
+			for j := uint16(0); j < 10; j++ {
+				p := createTCPPacket(t, port+j, 80, "GET /a HTTP/1.1\r\n\r\n")
+				w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+				w.Match("", "127.0.0.1:80", fmt.Sprintf("127.0.0.1:%d", port+j))
+				w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+			}
+		}(uint16(5000 + i*10))
+	}
+	wg.Wait()
+	w.FinishAll()
+
+	assert.Equal(t, 160, countPcapPackets(t, file))
+}
+
+func TestPcapWriterTunnel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{}
+	option.SetFilter(&Filter{Uri: "/a", SrcRatio: 1})
+	w, err := NewPcapWriter(file, 1000, option, nopAssembler{})
+	assert.Nil(t, err)
+
+	// the same endpoints in the vxlan tunnels of different VNIs are different connections
+	for _, vni := range []uint32{100, 200} {
+		p := createTCPPacket(t, 5001, 80, "GET /a HTTP/1.1\r\n\r\n")
+		p.Metadata().AncillaryData = append(p.Metadata().AncillaryData, util.Tunnel{Type: "vxlan", ID: vni})
+		w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+	}
+	w.Match("vxlan:100", "127.0.0.1:5001", "127.0.0.1:80")
+	w.Match("", "127.0.0.1:5001", "127.0.0.1:80")
+	w.FinishAll()
+
+	assert.Equal(t, 1, countPcapPackets(t, file))
+}
+
+func TestPcapWriterFileClock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{}
+	option.SetFilter(&Filter{Uri: "/a", SrcRatio: 1})
+	w, err := NewPcapWriter(file, 1000, option, nopAssembler{})
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) // read from an old pcap file
+	assemble := func(srcPort, dstPort uint16, payload string, d time.Duration) {
+		p := createTCPPacket(t, srcPort, dstPort, payload)
+		p.Metadata().Timestamp = start.Add(d)
+		w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+	}
+
+	assemble(5001, 80, "GET /a HTTP/1.1\r\n\r\n", 0)
+	assemble(5002, 80, "GET /b HTTP/1.1\r\n\r\n", 0)
+	assemble(5002, 80, "GET /b HTTP/1.1\r\n\r\n", 5*time.Minute)
+	w.FlushOlderThan(time.Now().Add(-4 * time.Minute)) // 5001 is idle for 5m by the packets, 5002 is not
+	w.Match("", "127.0.0.1:80", "127.0.0.1:5001")
+	w.Match("", "127.0.0.1:80", "127.0.0.1:5002")
+	w.FinishAll()
+
+	assert.Equal(t, 2, countPcapPackets(t, file))
+}
+
+func TestPcapWriterAssembled(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{Uri: "/a", SrcRatio: 1})
+	r, sender := newTestAssembler(option)
+	w, err := NewPcapWriter(file, 1000, option, r)
+	assert.Nil(t, err)
+	option.OnMatch = w.Match
+
+	assemble := func(tcp *layers.TCP, payload string) {
+		p := createPacket(t, tcp, payload)
+		w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+	}
+	rsp := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	for port, uri := range map[layers.TCPPort]string{5001: "/a", 5002: "/b"} {
+		req := "GET " + uri + " HTTP/1.1\r\n\r\n"
+		assemble(&layers.TCP{SrcPort: port, DstPort: 80, Seq: 1000, ACK: true, Ack: 7000}, req)
+		assemble(&layers.TCP{SrcPort: 80, DstPort: port, Seq: 7000, ACK: true, Ack: 1000 + uint32(len(req))}, rsp)
+		assemble(&layers.TCP{SrcPort: port, DstPort: 80, Seq: 1000 + uint32(len(req)), ACK: true, Ack: 7000 + uint32(len(rsp))}, "")
+	}
+	w.FinishAll()
+
+	// only the packets of the connection of GET /a are written, though the response of GET /b is output
+	assert.Equal(t, 3, countPcapPackets(t, file))
+	assert.NotContains(t, sender.String(), "GET /b")
+}
+
+func TestPcapWriterDropped(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "matched.pcap")
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{Method: "POST", SrcRatio: 1})
+	r, _ := newTestAssembler(option)
+	w, err := NewPcapWriter(file, 1000, option, r)
+	assert.Nil(t, err)
+	option.OnMatch = w.Match
+
+	assemble := func(tcp *layers.TCP, payload string) {
+		p := createPacket(t, tcp, payload)
+		w.AssemblePacket(p, p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP))
+	}
+	start := time.Now()
+	req, rsp := "GET /a HTTP/1.1\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	assemble(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: 1000, ACK: true, Ack: 7000}, req)
+	assemble(&layers.TCP{SrcPort: 80, DstPort: 5001, Seq: 7000, ACK: true, Ack: 1000 + uint32(len(req))}, rsp)
+	assemble(&layers.TCP{SrcPort: 5001, DstPort: 80, Seq: 1000 + uint32(len(req)), ACK: true, Ack: 7000 + uint32(len(rsp))}, "")
+	w.FinishAll()
+
+	// the response of the request dropped by the method filter does not wait for its verdict
+	assert.Equal(t, 0, countPcapPackets(t, file))
+	assert.Less(t, time.Since(start), verdictWait)
+}
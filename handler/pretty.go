@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// The ANSI colors of the pretty bodies, and the auth material.
+const (
+	colorKey     = "\x1b[34m" // json keys, form keys and xml tags
+	colorString  = "\x1b[32m"
+	colorNumber  = "\x1b[33m"
+	colorLiteral = "\x1b[35m" // true, false and null
+	colorAlert   = "\x1b[31m" // the expired tokens and cookies
+	colorReset   = "\x1b[0m"
+)
+
+// maxPrettySize is the max bytes of the body to be formatted as a whole, the larger ones are output as they are.
+const maxPrettySize = 1 << 20
+
+// prettyBody formats the text body by its mime type, json and xml are indented, and the form is decoded into key value lines.
+// It returns nil if the body is not formatted, like the one invalid or truncated, which should be output as it is.
+func prettyBody(mt MimeType, body []byte, color bool) []byte {
+	var pretty []byte
+	var err error
+	switch {
+	case mt.subType == "json" || strings.HasSuffix(mt.subType, "+json") || sniffsJSON(mt) && LikeJSON(string(body)):
+		if pretty, err = indentJSON(body); err == nil && color {
+			pretty = colorJSON(pretty)
+		}
+	case mt.subType == "xml" || strings.HasSuffix(mt.subType, "+xml"):
+		pretty, err = indentXML(body, color)
+	case mt.subType == "www-form-urlencoded":
+		pretty, err = decodeForm(body, color)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return nil
+	}
+	return pretty
+}
+
+// sniffsJSON tells if the body of the mime type is formatted as json when it looks like one,
+// only the plain text and the text of the unknown sub types are, not the xml or the form ones.
+func sniffsJSON(mt MimeType) bool {
+	return mt.subType == "plain" || !textSubTypes[mt.subType]
+}
+
+func indentJSON(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(body), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// colorJSON colors the tokens of the valid json.
+func colorJSON(b []byte) []byte {
+	var out bytes.Buffer
+	paint := func(color string, token []byte) {
+		out.WriteString(color)
+		out.Write(token)
+		out.WriteString(colorReset)
+	}
+
+	for i := 0; i < len(b); {
+		j := i + 1
+		switch c := b[i]; {
+		case c == '"':
+			for ; j < len(b) && b[j] != '"'; j++ {
+				if b[j] == '\\' {
+					j++
+				}
+			}
+			j++
+			color := colorString
+			if rest := bytes.TrimLeft(b[j:], " "); len(rest) > 0 && rest[0] == ':' {
+				color = colorKey
+			}
+			paint(color, b[i:j])
+		case c == '-' || c >= '0' && c <= '9':
+			for j < len(b) && strings.IndexByte("+-.eE0123456789", b[j]) >= 0 {
+				j++
+			}
+			paint(colorNumber, b[i:j])
+		case c >= 'a' && c <= 'z':
+			for j < len(b) && b[j] >= 'a' && b[j] <= 'z' {
+				j++
+			}
+			paint(colorLiteral, b[i:j])
+		default:
+			out.WriteByte(c)
+		}
+		i = j
+	}
+	return out.Bytes()
+}
+
+// indentXML indents the xml element by element, keeping the namespace prefixes as they are.
+func indentXML(body []byte, color bool) ([]byte, error) {
+	var tokens []xml.Token
+	var stack []xml.Name
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, e.Name)
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != e.Name {
+				return nil, fmt.Errorf("unexpected end element %s", xmlName(e.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(bytes.TrimSpace(e)) == 0 {
+				continue
+			}
+		}
+		tokens = append(tokens, xml.CopyToken(t))
+	}
+	if len(stack) > 0 {
+		return nil, errors.New("unclosed element " + xmlName(stack[len(stack)-1]))
+	}
+
+	var buf bytes.Buffer
+	tag := func(s string) {
+		if color {
+			s = colorKey + s + colorReset
+		}
+		buf.WriteString(s)
+	}
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		indent := strings.Repeat("  ", depth)
+		switch t := tokens[i].(type) {
+		case xml.StartElement:
+			start := "<" + xmlName(t.Name)
+			for _, a := range t.Attr {
+				start += " " + xmlName(a.Name) + `="` + escapeXML(a.Value) + `"`
+			}
+			buf.WriteString(indent)
+			if i+1 < len(tokens) && isEndElement(tokens[i+1]) { // <a/>
+				tag(start + "/>")
+				i++
+			} else if text, ok := tokens[i+1].(xml.CharData); ok && i+2 < len(tokens) && isEndElement(tokens[i+2]) { // <a>text</a>
+				tag(start + ">")
+				buf.WriteString(escapeXML(string(bytes.TrimSpace(text))))
+				tag("</" + xmlName(t.Name) + ">")
+				i += 2
+			} else {
+				tag(start + ">")
+				depth++
+			}
+		case xml.EndElement:
+			depth--
+			buf.WriteString(strings.Repeat("  ", depth))
+			tag("</" + xmlName(t.Name) + ">")
+		case xml.CharData:
+			buf.WriteString(indent + escapeXML(string(bytes.TrimSpace(t))))
+		case xml.Comment:
+			buf.WriteString(indent + "<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			buf.WriteString(indent + "<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			buf.WriteString(indent + "<!" + string(t) + ">")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func isEndElement(t xml.Token) bool {
+	_, ok := t.(xml.EndElement)
+	return ok
+}
+
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// decodeForm decodes the x-www-form-urlencoded body into the key: value lines in the order they are sent.
+func decodeForm(body []byte, color bool) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, kv := range strings.Split(strings.TrimSpace(string(body)), "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		k, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = url.QueryUnescape(v); err != nil {
+			return nil, err
+		}
+		if color {
+			k = colorKey + k + colorReset
+		}
+		buf.WriteString(k + ": " + v + "\n")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrettyBody(t *testing.T) {
+	pretty := func(contentType, body string, color bool) string {
+		return string(prettyBody(ParseMimeType(contentType), []byte(body), color))
+	}
+
+	assert.Equal(t, "{\n  \"a\": [\n    1,\n    true\n  ]\n}\n", pretty("application/json", `{"a":[1,true]}`, false))
+	assert.Equal(t, "{\n  \x1b[34m\"a\"\x1b[0m: \x1b[32m\"x\\\"y\"\x1b[0m,\n  \x1b[34m\"b\"\x1b[0m: \x1b[33m-1.5\x1b[0m,\n  \x1b[34m\"c\"\x1b[0m: \x1b[35mnull\x1b[0m\n}\n",
+		pretty("application/problem+json", `{"a":"x\"y","b":-1.5,"c":null}`, true))
+	assert.Equal(t, "", pretty("application/json", `{"a":[1,tr`, false), "truncated")
+
+	assert.Equal(t, "<?xml version=\"1.0\"?>\n<s:Envelope xmlns:s=\"urn:s\">\n  <s:Body>\n    <a id=\"1\">x &amp; y</a>\n    <b/>\n  </s:Body>\n</s:Envelope>\n",
+		pretty("text/xml", `<?xml version="1.0"?><s:Envelope xmlns:s="urn:s"><s:Body> <a id="1">x &amp; y</a><b></b></s:Body></s:Envelope>`, false))
+	assert.Equal(t, "", pretty("application/xml", `<a><b>x</b>`, false), "truncated")
+	assert.Equal(t, "", pretty("application/xml", `<a><b>x</a>`, false), "mismatched")
+
+	assert.Equal(t, "name: Tom & Jerry\nq: a=b\nempty: \n", pretty("application/x-www-form-urlencoded", "name=Tom+%26+Jerry&q=a%3Db&empty", false))
+	assert.Equal(t, "", pretty("text/plain", "hello", false))
+
+	// the json is sniffed only in the plain text and the unknown text
+	assert.Equal(t, "[\n  1\n]\n", pretty("text/plain", " [1] ", false))
+	assert.Equal(t, "{}\n", pretty("text/x-log", "{}", false))
+	assert.NotContains(t, pretty("application/xml", `{"a":1}`, false), "\n  \"a\": 1")
+	assert.Equal(t, "[1]: \n", pretty("application/x-www-form-urlencoded", "[1]", false))
+	for _, body := range []string{"", "  ", " \r\n", "{"} {
+		assert.Equal(t, "", pretty("text/plain", body, false))
+		assert.Equal(t, "", pretty("application/json", body, false))
+		assert.False(t, LikeJSON(body))
+	}
+}
+
+func TestPrettyRequestBody(t *testing.T) {
+	out := assembleExchange(&Option{Level: "all", Resp: 1, Pretty: true},
+		"POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\n  ",
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	assert.Contains(t, out, "POST / HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n")
+	assert.Contains(t, out, "HTTP/1.1 200 OK")
+}
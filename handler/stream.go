@@ -0,0 +1,425 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/ginx"
+	"github.com/bingoohuang/gg/pkg/ss"
+	"github.com/bingoohuang/httpdump/httpport"
+	"github.com/bingoohuang/httpdump/util"
+)
+
+// The reasons why a streaming response ends.
+const (
+	streamEndLast      = "last chunk"
+	streamEndClosed    = "closed"
+	streamEndGap       = "gap"
+	streamEndNext      = "next message"
+	streamEndMalformed = "malformed chunk"
+)
+
+// The kinds of the stream output.
+const (
+	StreamSSE   = "sse"   // a server-sent event
+	StreamChunk = "chunk" // a chunk of the chunked response
+	StreamEnd   = "end"   // the summary of the streaming response
+)
+
+const (
+	// maxChunkLine is the max length of the chunk size line with its extensions.
+	maxChunkLine = 4096
+	// maxPendingEvent is the max bytes of a server-sent event without its end, which is emitted as it is when exceeded.
+	maxPendingEvent = 1 << 20
+)
+
+// StreamEvent is a server-sent event, or a chunk of the chunked response, emitted as soon as it is reassembled.
+type StreamEvent struct {
+	Capture
+	Stream   string        // sse or chunk
+	Index    int           // of the events of the response, from 1
+	Interval time.Duration // since the previous event, or the response head for the first one
+	Size     int           // bytes of the event or the chunk
+	Event    string        `json:",omitempty"` // the event field of the server-sent event
+	ID       string        `json:",omitempty"` // the id field of the server-sent event
+	Data     string        `json:",omitempty"` // of the server-sent event, or the text chunk, limited by MAX_BODY_SIZE
+}
+
+// StreamSummary summarises the streaming response when it ends.
+type StreamSummary struct {
+	Capture
+	Stream      string // end
+	Events      int
+	Bytes       int64         // of the body without the chunk framing
+	Duration    time.Duration // from the response head to the end
+	MaxInterval time.Duration // the longest time between the events
+	End         string        // last chunk, closed, gap, next message or malformed chunk
+	Stored      *StoredBody   `json:",omitempty"` // where the body is stored by -body-store
+}
+
+// streamRsp is the head of the streaming response, whose body is emitted by the responseStream.
+type streamRsp struct{ Rsp }
+
+func (streamRsp) GetBody() io.ReadCloser  { return http.NoBody }
+func (streamRsp) GetContentLength() int64 { return 0 }
+
+// responseStream emits a streaming response incrementally, each server-sent event of the text/event-stream,
+// or each chunk of the chunked response, with the time since the previous one, and the summary when it ends.
+// The bytes emitted are consumed from the message buffer, so the stream is not buffered as a whole.
+type responseStream struct {
+	h        *Base
+	sse      bool        // the events are split from the body, otherwise the chunks are emitted
+	chunked  bool        // the body is chunked, otherwise it is ended by the close of the connection
+	showData bool        // the data of the chunks is text to be shown
+	quiet    bool        // the response does not pass the filters, the stream is consumed without output
+	store    *bodyWriter // of the body into -body-store, nil if not stored
+
+	state     int
+	chunkLeft int64
+	pending   []byte // of the server-sent event not ended yet
+	chunk     []byte // of the current chunk shown, limited by MAX_BODY_SIZE
+	chunkSize int
+
+	start, last time.Time
+	events      int
+	bytes       int64
+	maxInterval time.Duration
+	done        bool
+}
+
+// The states of reading the chunked body.
+const (
+	chunkStateSize = iota
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailer
+)
+
+// streamResponse emits the response in the buffer incrementally if it is a streaming one, which is a text/event-stream,
+// or a chunked response not ended in -stream-after. It returns false if the response is assembled as a whole,
+// or the next response follows the end of the streaming one in the buffer, whose start line is recorded by title.
+// p is the last packet in the buffer.
+func (h *Base) streamResponse(rb *messageBuffer, p StreamPacket, c *TCPConnection, permits func() bool,
+	title func(payload []byte) bool) bool {
+	t := p.Timestamp
+	s := h.rspStream
+	if s == nil {
+		if s = h.startStream(rb, t, c, permits); s == nil {
+			return false
+		}
+		h.rspStream = s
+	}
+
+	s.feed(rb, t)
+	if !s.done {
+		return true
+	}
+	h.rspStream = nil
+	if util.IndexResponseTitle(rb.Bytes()) != 0 {
+		rb.reset()
+		return true
+	}
+	// the next response follows in the buffer, recorded like the one starting a payload
+	title(rb.Bytes())
+	h.rspStarts++
+	h.rspSeq, h.rspFirst = p.Seq+uint32(len(p.Payload)-rb.Len()), t
+	return false
+}
+
+// endStream ends the streaming response for the reason, returns false if there is none.
+func (h *Base) endStream(reason string, t time.Time) bool {
+	s := h.rspStream
+	if s == nil {
+		return false
+	}
+	s.end(reason, t)
+	h.rspStream = nil
+	return true
+}
+
+// startStream outputs the head of the response and starts to stream its body, nil if it is not a streaming one.
+func (h *Base) startStream(rb *messageBuffer, t time.Time, c *TCPConnection, permits func() bool) *responseStream {
+	o := h.option
+	data := rb.Bytes()
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil
+	}
+	// the head is followed by the last chunk, for the chunked body is read when the response is read
+	head := append(data[:end+4:end+4], "0\r\n\r\n"...)
+	r, err := httpport.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return nil
+	}
+
+	header := r.GetHeader()
+	// the Transfer-Encoding is removed from the header when the chunked body is read
+	chunked, length := rawHeaderValue(r.RawHeaders, "Transfer-Encoding"), rawHeaderValue(r.RawHeaders, "Content-Length")
+	chunked = strings.ToLower(strings.TrimSpace(chunked[strings.LastIndex(chunked, ",")+1:]))
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	encoded := header.Get("Content-Encoding") != ""
+	sse := mt == "text/event-stream" && !encoded && (chunked == "chunked" || length == "")
+	// the body without Content-Length is ended by the close, not by the end hinted
+	if util.Http1EndHint(data) && !(sse && chunked == "") {
+		return nil
+	}
+	if !sse && !(chunked == "chunked" && o.StreamAfter > 0 && t.Sub(h.rspFirst) >= o.StreamAfter) {
+		return nil
+	}
+
+	s := &responseStream{
+		h: h, sse: sse, chunked: chunked == "chunked", start: t, last: t,
+		showData: !encoded && !ss.AnyOf(o.Level, LevelUrl, LevelHeader) && ParseMimeType(mt).isTextContent(),
+	}
+	s.quiet = !permits() || !h.LimitAllow()
+	if !s.quiet {
+		h.rspBuffer.Reset()
+		h.rspAnomalies = nil
+		if o.Timing {
+			h.rspTiming = c.timing.take(h.rspSeq)
+		}
+		s.quiet = !h.processResponse(false, streamRsp{Rsp: r}, o, t)
+		h.rspTiming = nil
+	}
+	if !s.quiet && o.BodyStore != nil {
+		s.store = o.BodyStore.writer(header)
+	}
+	rb.consume(end + 4)
+	return s
+}
+
+// rawHeaderValue returns the value of the header field as it is sent, empty if it is not sent.
+func rawHeaderValue(fields []httpport.RawHeader, name string) string {
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// feed consumes the bytes of the body in the buffer, and emits the events or the chunks ended.
+func (s *responseStream) feed(rb *messageBuffer, t time.Time) {
+	if !s.chunked {
+		s.write(rb.Bytes(), t)
+		rb.consume(rb.Len())
+		return
+	}
+
+	for !s.done {
+		data := rb.Bytes()
+		switch s.state {
+		case chunkStateSize:
+			i := bytes.Index(data, []byte("\r\n"))
+			if i < 0 {
+				if len(data) > maxChunkLine {
+					s.end(streamEndMalformed, t)
+				}
+				return
+			}
+			line, _, _ := bytes.Cut(data[:i], []byte(";"))
+			size, err := strconv.ParseInt(strings.TrimSpace(string(line)), 16, 64)
+			if err != nil || size < 0 {
+				s.end(streamEndMalformed, t)
+				return
+			}
+			rb.consume(i + 2)
+			if s.chunkLeft, s.state = size, chunkStateData; size == 0 {
+				s.state = chunkStateTrailer
+			}
+		case chunkStateData:
+			n := int(min(int64(len(data)), s.chunkLeft))
+			if n == 0 {
+				return
+			}
+			s.write(data[:n], t)
+			rb.consume(n)
+			if s.chunkLeft -= int64(n); s.chunkLeft == 0 {
+				s.state = chunkStateDataEnd
+			}
+		case chunkStateDataEnd:
+			if len(data) < 2 {
+				return
+			}
+			if !bytes.HasPrefix(data, []byte("\r\n")) {
+				s.end(streamEndMalformed, t)
+				return
+			}
+			rb.consume(2)
+			s.state = chunkStateSize
+			if !s.sse {
+				s.emitChunk(t)
+			}
+		case chunkStateTrailer:
+			n := 2
+			if !bytes.HasPrefix(data, []byte("\r\n")) {
+				if n = bytes.Index(data, []byte("\r\n\r\n")) + 4; n < 4 {
+					return
+				}
+			}
+			rb.consume(min(n, len(data)))
+			s.end(streamEndLast, t)
+		}
+	}
+}
+
+// write takes the bytes of the body, the server-sent events ended in them are emitted.
+func (s *responseStream) write(p []byte, t time.Time) {
+	s.bytes += int64(len(p))
+	if s.store != nil {
+		_, _ = s.store.Write(p)
+	}
+	if !s.sse {
+		s.chunkSize += len(p)
+		if s.showData {
+			s.chunk = append(s.chunk, p[:min(len(p), max(MaxBodySize-len(s.chunk), 0))]...)
+		}
+		return
+	}
+
+	s.pending = append(s.pending, p...)
+	for {
+		i, n := indexEventEnd(s.pending)
+		if i < 0 {
+			break
+		}
+		s.emitEvent(s.pending[:i], i+n, t)
+		s.pending = s.pending[i+n:]
+	}
+	if len(s.pending) > maxPendingEvent {
+		s.emitEvent(s.pending, len(s.pending), t)
+		s.pending = nil
+	}
+	if len(s.pending) == 0 {
+		s.pending = nil // not to hold the bytes of the events emitted
+	}
+}
+
+// indexEventEnd returns the index and the length of the blank line which ends the first server-sent event, -1 if none.
+func indexEventEnd(p []byte) (int, int) {
+	i, n := -1, 0
+	for _, sep := range []string{"\n\n", "\r\n\r\n", "\r\r"} {
+		if j := bytes.Index(p, []byte(sep)); j >= 0 && (i < 0 || j < i) {
+			i, n = j, len(sep)
+		}
+	}
+	return i, n
+}
+
+// end emits the rest of the server-sent events and the summary of the stream.
+func (s *responseStream) end(reason string, t time.Time) {
+	if s.done {
+		return
+	}
+	s.done = true
+	if len(s.pending) > 0 {
+		s.emitEvent(s.pending, len(s.pending), t)
+		s.pending = nil
+	}
+	if s.quiet {
+		return
+	}
+
+	h := s.h
+	summary := StreamSummary{
+		Capture: h.capture(h.rspCounter.Get(), t, 0), Stream: StreamEnd, Events: s.events, Bytes: s.bytes,
+		Duration: t.Sub(s.start), MaxInterval: s.maxInterval, End: reason,
+	}
+	var stored bytes.Buffer
+	if s.store != nil {
+		var err error
+		summary.Stored, err = s.store.commit()
+		if err != nil {
+			log.Printf("store body failed: %v", err)
+		}
+		printStored(&stored, summary.Stored, err)
+	}
+	s.send(summary, "STREAM", t, fmt.Sprintf(", %d events %d bytes in %s, max interval %s, ended by %s",
+		s.events, s.bytes, summary.Duration, s.maxInterval, reason), stored.Bytes())
+}
+
+// emitEvent emits the server-sent event, size is the bytes of it with its blank line.
+func (s *responseStream) emitEvent(p []byte, size int, t time.Time) {
+	e := s.next(StreamSSE, size, t)
+	var data []string
+	for _, line := range strings.FieldsFunc(string(p), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			e.Event = value
+		case "id":
+			e.ID = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	e.Data = strings.Join(data, "\n")
+	if len(e.Data) > MaxBodySize {
+		e.Data = e.Data[:MaxBodySize]
+	}
+	if len(p) > MaxBodySize {
+		p = p[:MaxBodySize]
+	}
+
+	var body []byte
+	if !ss.AnyOf(s.h.option.Level, LevelUrl, LevelHeader) {
+		body = p
+	}
+	s.emit(e, "SSE", t, body)
+}
+
+// emitChunk emits the chunk ended.
+func (s *responseStream) emitChunk(t time.Time) {
+	e := s.next(StreamChunk, s.chunkSize, t)
+	e.Data = string(s.chunk)
+	s.emit(e, "CHUNK", t, s.chunk)
+	s.chunk, s.chunkSize = nil, 0
+}
+
+// next counts the event, and returns it with the interval since the previous one.
+func (s *responseStream) next(kind string, size int, t time.Time) StreamEvent {
+	s.events++
+	interval := t.Sub(s.last)
+	s.last, s.maxInterval = t, max(s.maxInterval, interval)
+	return StreamEvent{
+		Capture: s.h.capture(s.h.rspCounter.Get(), t, 0), Stream: kind, Index: s.events, Interval: interval, Size: size,
+	}
+}
+
+func (s *responseStream) emit(e StreamEvent, event string, t time.Time, body []byte) {
+	if !s.quiet {
+		s.send(e, event, t, fmt.Sprintf(", #%d +%s %d bytes", e.Index, e.Interval, e.Size), body)
+	}
+}
+
+// send outputs the stream event like ### SSE#1 RSP 127.0.0.1:80-127.0.0.1:5001 2024-04-01T10:00:00Z, #3 +120ms 57 bytes
+// with the body lines, or the json of v.
+func (s *responseStream) send(v any, event string, t time.Time, detail string, body []byte) {
+	h := s.h
+	if h.usingJSON {
+		data, err := ginx.JsoniConfig.Marshal(h.Context, v)
+		if err != nil {
+			log.Printf("stream to JSON failed: %v", err)
+			return
+		}
+		h.sender.Send(string(data)+"\n", false)
+		return
+	}
+
+	var b bytes.Buffer
+	writeLine(&b, h.eventTitle(event, TagResponse, t, detail))
+	if body = bytes.TrimRight(body, "\r\n"); len(body) > 0 {
+		writeBytes(&b, body)
+		writeLine(&b)
+	}
+	h.sender.Send(b.String(), false)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// assembleExchange assembles the request and the payloads of the response sent one by one, each a second apart
+// and acknowledged at once.
+func assembleExchange(option *Option, req string, rsp ...string) string {
+	r, sender := newTestAssembler(option)
+	start := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	assembleTest(r, true, &layers.TCP{Seq: 1000}, req, start)
+	seq := uint32(7000)
+	for i, p := range rsp {
+		t := start.Add(time.Duration(i) * time.Second)
+		assembleTest(r, false, &layers.TCP{Seq: seq, ACK: true, Ack: 1000 + uint32(len(req))}, p, t)
+		seq += uint32(len(p))
+		assembleTest(r, true, &layers.TCP{Seq: 1000 + uint32(len(req)), ACK: true, Ack: seq}, "", t)
+	}
+	r.FinishAll()
+	return sender.String()
+}
+
+func TestStreamSSE(t *testing.T) {
+	out := assembleExchange(&Option{Level: "all", Resp: 1, StreamAfter: time.Hour}, "GET /chat HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"1b\r\nevent: delta\r\ndata: hello\n\n\r\n",
+		"8\r\ndata: wo\r\n",
+		"5\r\nrld\n\n\r\n2\r\nid\r\n",
+		"0\r\n\r\n")
+
+	assert.Contains(t, out, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n")
+	assert.Contains(t, out, "### SSE#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:01Z, #1 +1s 27 bytes\r\nevent: delta\r\ndata: hello\r\n")
+	assert.Contains(t, out, "### SSE#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:03Z, #2 +2s 13 bytes\r\ndata: world\r\n")
+	assert.Contains(t, out, "### SSE#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:04Z, #3 +1s 2 bytes\r\nid\r\n")
+	assert.Contains(t, out, "### STREAM#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:04Z, "+
+		"3 events 42 bytes in 4s, max interval 2s, ended by last chunk")
+	assert.True(t, strings.Index(out, "HTTP/1.1 200 OK") < strings.Index(out, "### SSE#1"))
+}
+
+func TestStreamChunked(t *testing.T) {
+	rsp := []string{
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n",
+		"2\r\nde\r\n",
+		"2\r\nfg\r\n",
+	}
+	out := assembleExchange(&Option{Level: "all", Resp: 1, StreamAfter: time.Second}, "GET /log HTTP/1.1\r\n\r\n", rsp...)
+	assert.Contains(t, out, "### CHUNK#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:01Z, #1 +0s 3 bytes\r\nabc\r\n")
+	assert.Contains(t, out, "#2 +0s 2 bytes\r\nde\r\n")
+	assert.Contains(t, out, "### CHUNK#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:02Z, #3 +1s 2 bytes\r\nfg\r\n")
+	assert.Contains(t, out, "3 events 7 bytes in 1s, max interval 1s, ended by closed")
+
+	// the streamed body is stored by -body-store
+	store, err := NewBodyStore(t.TempDir(), 0)
+	assert.Nil(t, err)
+	out = assembleExchange(&Option{Level: "all", Resp: 1, StreamAfter: time.Second, BodyStore: store},
+		"GET /log HTTP/1.1\r\n\r\n", rsp...)
+	assert.Contains(t, out, "ended by closed\r\n\n// body: sha256 "+
+		"7d1a54127b222502f5b79b5fb0803061152a44f92b37e23c6527baf665d4da9a size 7 stored ")
+	assert.Equal(t, int64(7), store.Size())
+
+	// the chunked responses are not streamed by default
+	out = assembleExchange(&Option{Level: "all", Resp: 1}, "GET /log HTTP/1.1\r\n\r\n", rsp...)
+	assert.NotContains(t, out, "### CHUNK#")
+
+	// the chunked response ended in -stream-after is output as a whole
+	out = assembleExchange(&Option{Level: "all", Resp: 1, StreamAfter: time.Hour}, "GET /log HTTP/1.1\r\n\r\n",
+		rsp[0], "0\r\n\r\n")
+	assert.NotContains(t, out, "### CHUNK#")
+	assert.Contains(t, out, "\r\n\r\nabc")
+}
+
+func TestStreamPipelined(t *testing.T) {
+	out := assembleExchange(&Option{Level: "all", Resp: 1}, "GET /chat HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n",
+		"data: a\n\ndata: b",
+		"\n\n")
+	assert.Contains(t, out, "### SSE#1 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:01Z, #1 +1s 9 bytes\r\ndata: a\r\n")
+	assert.Contains(t, out, "#2 +1s 9 bytes\r\ndata: b\r\n")
+	assert.Contains(t, out, "2 events 18 bytes in 2s, max interval 1s, ended by closed")
+
+	out = assembleExchange(&Option{Level: "all", Resp: 1}, "GET /chat HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"9\r\ndata: a\n\n\r\n0\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")
+	assert.Contains(t, out, "1 events 9 bytes in 1s, max interval 1s, ended by last chunk")
+	assert.Contains(t, out, "### #2 RSP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:01Z\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")
+
+	// the response after the stream in the same segment is filtered by its own status
+	filter := &Filter{SrcRatio: 1}
+	assert.Nil(t, filter.Status.Set("201"))
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(filter)
+	out = assembleExchange(option, "GET /chat HTTP/1.1\r\n\r\n"+
+		"POST /b HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"9\r\ndata: a\n\n\r\n0\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")
+	assert.NotContains(t, out, "### SSE#")
+	assert.Contains(t, out, "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")
+}
+
+func TestStreamNextResponseVerdict(t *testing.T) {
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{SrcRatio: 1, Anomaly: AnomalyFilter{"error"}})
+	r, sender := newTestAssembler(option)
+
+	// the clean GET is streamed, the response of the flagged POST follows the end of the stream in the same segment
+	get := "GET /chat HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	post := "POST /b HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	sse := "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+	next := "9\r\ndata: a\n\n\r\n0\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(get)+len(post)), 5000+uint32(len(sse)+len(next))
+	start := time.Now()
+	assembleTest(r, true, &layers.TCP{SYN: true, Seq: 999}, "", time.Time{})
+	assembleTest(r, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000}, get, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000, Ack: 1000 + uint32(len(get))}, sse, time.Time{})
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000 + uint32(len(get)), Ack: 5000 + uint32(len(sse))}, post, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000 + uint32(len(sse)), Ack: reqEnd}, next, time.Time{})
+	assembleTest(r, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd}, "", time.Time{})
+	assembleTest(r, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd + 1}, "", time.Time{})
+	r.FinishAll()
+
+	out := sender.String()
+	assert.Contains(t, out, "POST /b HTTP/1.1")
+	assert.Contains(t, out, "HTTP/1.1 201 Created") // paired with the flagged request, not the streamed one
+	assert.NotContains(t, out, "GET /chat HTTP/1.1")
+	assert.NotContains(t, out, "### SSE#")
+	assert.Less(t, time.Since(start), verdictWait)
+}
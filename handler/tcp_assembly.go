@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/handy"
@@ -31,34 +33,73 @@ type TCPAssembler struct {
 
 	chanSize    uint
 	processResp int
+	budget      *MemoryBudget
+	servers     map[uint16]bool // the listening ports learned from the handshakes and the messages
 }
 
-func NewTCPAssembler(handler ConnectionHandler, chanSize uint, processResp int) *TCPAssembler {
-	return &TCPAssembler{
+// NewTCPAssembler creates a TCPAssembler, the buffered payload bytes are limited by the budget if it is not nil.
+func NewTCPAssembler(handler ConnectionHandler, chanSize uint, processResp int, budget *MemoryBudget) *TCPAssembler {
+	r := &TCPAssembler{
 		connections: map[string]*TCPConnection{},
 		handler:     handler,
 		chanSize:    chanSize,
 		processResp: processResp,
+		budget:      budget,
+		servers:     map[uint16]bool{},
 	}
+	budget.register(r)
+	return r
 }
 
-func (r *TCPAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
+func (r *TCPAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
 	src := Endpoint{ip: flow.Src().String(), port: uint16(tcp.SrcPort)}
 	dst := Endpoint{ip: flow.Dst().String(), port: uint16(tcp.DstPort)}
 
 	key := r.createConnectionKey(src, dst)
-	createNewConn := tcp.SYN && !tcp.ACK || isHTTPRequestData(tcp.Payload)
-	c := r.retrieveConnection(src, dst, key, createNewConn)
+	tunnel := util.TunnelOf(ci).String()
+	if tunnel != "" { // the same endpoints may be reused in different tunnels
+		key = tunnel + "/" + key
+	}
+	c := r.retrieveConnection(src, dst, key, ci.InterfaceIndex, tunnel, tcp)
 	if c == nil {
 		return
 	}
+	if c.evicted.Load() { // evicted by the other shard, and closed here by its own shard
+		r.deleteConnection(key)
+		c.flushOlderThan()
+		return
+	}
 
-	c.onReceive(src, tcp, timestamp)
+	c.onReceive(src, tcp, ci.Timestamp)
 
 	if c.closed() {
 		r.deleteConnection(key)
 		c.finish()
 	}
+
+	if r.budget.exceeded() {
+		r.evict()
+	}
+}
+
+// evict evicts the connections buffering the most bytes of all shards until the budget is not exceeded.
+// The connections of the other shards are dropped from the budget here, and closed by their own shards,
+// when their next packets arrive or they are flushed.
+func (r *TCPAssembler) evict() {
+	for r.budget.exceeded() {
+		largest, owner := r.budget.largest()
+		if largest == nil { // the bytes are buffered by the closed connections
+			return
+		}
+		if !largest.evict() { // evicted by the other shard at the same time
+			continue
+		}
+		r.budget.evicted.Add(1)
+		if owner == r {
+			r.deleteConnection(largest.key)
+			largest.flushOlderThan()
+		}
+	}
 }
 
 func (r *TCPAssembler) createConnectionKey(src Endpoint, dst Endpoint) string {
@@ -70,19 +111,63 @@ func (r *TCPAssembler) createConnectionKey(src Endpoint, dst Endpoint) string {
 	return dstString + "-" + srcString
 }
 
-// retrieveConnection get connection this packet belongs to; create new one if is new connection.
-func (r *TCPAssembler) retrieveConnection(src, dst Endpoint, key string, init bool) *TCPConnection {
+// retrieveConnection get connection this packet belongs to; create new one if the packet starts a connection.
+func (r *TCPAssembler) retrieveConnection(src, dst Endpoint, key string, iface int, tunnel string, tcp *layers.TCP) *TCPConnection {
 	defer r.lock.LockDeferUnlock()()
 
 	c := r.connections[key]
-	if c == nil && init {
-		c = newTCPConnection(key, src, dst, r.chanSize, r.processResp)
-		r.connections[key] = c
-		r.handler.handle(src, dst, c)
+	if c != nil {
+		return c
+	}
+	client, ok := r.inferClient(src, dst, tcp)
+	if !ok {
+		return nil
 	}
+	server := dst
+	if !client.equals(src) {
+		server = src
+	}
+
+	c = newTCPConnection(key, client, server, r.chanSize, r.processResp, r.budget)
+	c.iface, c.tunnel = iface, tunnel
+	c.midStream = !tcp.SYN
+	// the capture starts with a response, whose request is not captured
+	c.orphanResponse = len(tcp.Payload) > 0 && server.equals(src)
+	r.connections[key] = c
+	r.handler.handle(client, server, c)
 	return c
 }
 
+// inferClient infers the client of a new connection by its first packet, ok is false if the packet does not start one.
+// The SYN and the SYN-ACK tell the roles, so do the request and the response start lines, which may be in the middle
+// of the payload when the capture starts on a connection already established, like the pooled keep-alive ones.
+// A start line sent in the direction against the well-known or the listening ports is taken as a part of a body.
+func (r *TCPAssembler) inferClient(src, dst Endpoint, tcp *layers.TCP) (client Endpoint, ok bool) {
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		r.servers[dst.port] = true
+		return src, true
+	case tcp.SYN:
+		r.servers[src.port] = true
+		return dst, true
+	case len(tcp.Payload) == 0:
+		return client, false
+	}
+
+	if !(r.isServer(src) && !r.isServer(dst)) && util.IndexRequestTitle(tcp.Payload) >= 0 {
+		r.servers[dst.port] = true
+		return src, true
+	}
+	if !(r.isServer(dst) && !r.isServer(src)) && util.IndexResponseTitle(tcp.Payload) >= 0 {
+		r.servers[src.port] = true
+		return dst, true
+	}
+	return client, false
+}
+
+// isServer tells whether the port of the endpoint is a well-known one or learned to be listening.
+func (r *TCPAssembler) isServer(p Endpoint) bool { return p.port < 1024 || r.servers[p.port] }
+
 // deleteConnection removes connection (when is closed or timeout).
 func (r *TCPAssembler) deleteConnection(key string) {
 	defer r.lock.LockDeferUnlock()()
@@ -95,7 +180,7 @@ func (r *TCPAssembler) FlushOlderThan(time time.Time) {
 
 	r.lock.Lock()
 	for _, c := range r.connections {
-		if c.lastTimestamp.Before(time) {
+		if c.lastTimestamp.Before(time) || c.evicted.Load() {
 			connections = append(connections, c)
 			delete(r.connections, c.key)
 		}
@@ -127,6 +212,12 @@ type TCPConnection struct {
 	lastReqTimestamp time.Time // timestamp receive last packet
 	lastRspTimestamp time.Time // timestamp receive last packet
 	isHTTP           bool
+	iface            int    // the index of util.Interface where the first packet captured
+	tunnel           string // the outermost tunnel like vxlan:100, empty if not encapsulated
+	timing           *ConnTiming
+	orphanResponse   bool // the first message captured is a response, whose request is not captured
+	midStream        bool // the connection is picked up in the middle, without its handshake
+	evicted          atomic.Bool
 }
 
 // Endpoint is one endpoint of a tcp connection
@@ -136,17 +227,19 @@ type Endpoint struct {
 }
 
 func (p Endpoint) equals(v Endpoint) bool { return p.ip == v.ip && p.port == v.port }
-func (p Endpoint) String() string         { return p.ip + ":" + strconv.Itoa(int(p.port)) }
+func (p Endpoint) String() string         { return net.JoinHostPort(p.ip, strconv.Itoa(int(p.port))) }
 
-// create tcp connection, by the first tcp packet. this packet should from client to server
-func newTCPConnection(key string, src, dst Endpoint, chanSize uint, processResp int) *TCPConnection {
+// create tcp connection, by the client and the server inferred from the first tcp packet.
+func newTCPConnection(key string, src, dst Endpoint, chanSize uint, processResp int, budget *MemoryBudget) *TCPConnection {
 	t := &TCPConnection{
 		key:           key,
-		requestStream: newNetworkStream(src, dst, true, chanSize),
+		clientID:      src,
+		requestStream: newNetworkStream(src, dst, true, chanSize, budget),
+		timing:        newConnTiming(src),
 	}
 
 	if processResp > 0 {
-		t.responseStream = newNetworkStream(src, dst, false, chanSize)
+		t.responseStream = newNetworkStream(src, dst, false, chanSize, budget)
 	} else {
 		t.responseStream = &FakeStream{}
 	}
@@ -157,21 +250,36 @@ func newTCPConnection(key string, src, dst Endpoint, chanSize uint, processResp
 // when receive tcp packet
 func (c *TCPConnection) onReceive(src Endpoint, tcp *layers.TCP, timestamp time.Time) {
 	c.lastTimestamp = timestamp
+	c.timing.onPacket(src, tcp, timestamp)
 	var (
 		isReq bool
 		isRsp bool
 	)
 
 	if !c.isHTTP {
-		isReq = isHTTPRequestData(tcp.Payload)
-		if !isReq {
-			_, isRsp = util.ParseResponseTitle(tcp.Payload)
+		// the first message may start in the middle of the payload, when the capture starts on an established connection,
+		// or its start line may be split over the packets, when the payload only starts with it
+		var off int
+		if c.clientID.equals(src) {
+			if off = util.IndexRequestTitle(tcp.Payload); off < 0 && isHTTPRequestData(tcp.Payload) {
+				off = 0
+			}
+			isReq = off >= 0
+		} else {
+			if off = util.IndexResponseTitle(tcp.Payload); off < 0 && bytes.HasPrefix(tcp.Payload, []byte("HTTP/1.")) {
+				off = 0
+			}
+			isRsp = off >= 0
 		}
 		if !isReq && !isRsp {
 			return // skip no-http data
 		}
+		if off > 0 {
+			t := *tcp
+			t.Payload, t.Seq = tcp.Payload[off:], tcp.Seq+uint32(off)
+			tcp = &t
+		}
 		// receive first valid http data packet
-		c.clientID = src
 		c.isHTTP = true
 	}
 
@@ -191,7 +299,7 @@ func (c *TCPConnection) onReceive(src Endpoint, tcp *layers.TCP, timestamp time.
 		c.lastRspTimestamp = c.lastTimestamp
 	}
 
-	send.AppendPacket(tcp)
+	send.AppendPacket(tcp, c.lastTimestamp)
 
 	// if tcp.SYN { /* do nothing*/ }
 
@@ -216,6 +324,22 @@ func (c *TCPConnection) flushOlderThan() {
 	c.finish()
 }
 
+// buffered returns the payload bytes buffered for the connection.
+func (c *TCPConnection) buffered() int {
+	return c.requestStream.Buffered() + c.responseStream.Buffered()
+}
+
+// evict drops the buffered bytes of the connection from the budget, false if it is already evicted.
+// It is called by any shard, and the connection is closed by its own one.
+func (c *TCPConnection) evict() bool {
+	if !c.evicted.CompareAndSwap(false, true) {
+		return false
+	}
+	c.requestStream.Evict()
+	c.responseStream.Evict()
+	return true
+}
+
 func (c *TCPConnection) closed() bool {
 	return c.requestStream.IsClosed() && c.responseStream.IsClosed()
 }
@@ -228,70 +352,186 @@ func (c *TCPConnection) finish() {
 // NetworkStream tread one-direction tcp data as stream. impl reader closer
 type NetworkStream struct {
 	window *ReceiveWindow
-	c      chan *layers.TCP
+	c      chan StreamPacket
 	ignore bool
 	closed bool
 
 	src, dst  Endpoint
 	isRequest bool
+
+	budget   *MemoryBudget
+	lock     sync.Mutex
+	buffered int    // payload bytes in the window, the channel and the message buffer of the reader
+	evicted  bool   // the buffered bytes are not counted in the budget any more
+	overflow string // why the buffered bytes were dropped, taken by the reader
 }
 
 func (s *NetworkStream) SetClosed(closed bool) { s.closed = closed }
 func (s *NetworkStream) IsClosed() bool        { return s.closed }
 
 type Stream interface {
-	AppendPacket(tcp *layers.TCP)
+	AppendPacket(tcp *layers.TCP, t time.Time)
 	ConfirmPacket(ack uint32)
 	SetClosed(closed bool)
 	IsClosed() bool
 	Finish()
-	Packets() chan *layers.TCP
+	Packets() chan StreamPacket
 	Close() error
 	DiscardAll()
+
+	// Release releases the payload bytes consumed by the reader from the memory budget.
+	Release(n int)
+	// Buffered returns the payload bytes buffered for the stream.
+	Buffered() int
+	// Evict drops the buffered bytes from the memory budget.
+	Evict()
+	// Overflow returns and clears the reason why the buffered bytes were dropped.
+	Overflow() string
+	// Stats returns the loss and retransmission counts, read after the packets channel is closed.
+	Stats() StreamStats
+}
+
+// StreamPacket is a tcp packet of the stream in order, with the bytes lost before it.
+type StreamPacket struct {
+	*layers.TCP
+	Gap       int       // bytes not captured between the previous packet and this one
+	Timestamp time.Time // when the packet is captured
+}
+
+// StreamStats is the loss and retransmission counts of a stream.
+type StreamStats struct {
+	Gaps          int // times of the data lost
+	LostBytes     int // bytes lost in the gaps
+	Retransmitted int // packets with the data already received
+}
+
+// IsZero tells whether there is neither loss nor retransmission.
+func (s StreamStats) IsZero() bool { return s == StreamStats{} }
+
+// String returns the counts like lost 1460 bytes in 1 gaps, 2 retransmitted.
+func (s StreamStats) String() string {
+	return fmt.Sprintf("lost %d bytes in %d gaps, %d retransmitted", s.LostBytes, s.Gaps, s.Retransmitted)
+}
+
+// tcpStats sums the StreamStats of all streams.
+var tcpStats struct {
+	gaps, lostBytes, retransmitted atomic.Uint64
+}
+
+// TCPStats returns the loss and retransmission counts of all streams since the start.
+func TCPStats() StreamStats {
+	return StreamStats{
+		Gaps:          int(tcpStats.gaps.Load()),
+		LostBytes:     int(tcpStats.lostBytes.Load()),
+		Retransmitted: int(tcpStats.retransmitted.Load()),
+	}
 }
 
 type FakeStream struct {
 	closed bool
 }
 
-func (*FakeStream) GetLastUUID() []byte         { panic("should not be called") }
-func (*FakeStream) Close() error                { panic("should not be called") }
-func (f *FakeStream) Packets() chan *layers.TCP { panic("should not be called") }
-func (*FakeStream) AppendPacket(*layers.TCP)    {}
-func (*FakeStream) ConfirmPacket(uint32)        {}
-func (f *FakeStream) SetClosed(closed bool)     { f.closed = closed }
-func (f *FakeStream) IsClosed() bool            { return f.closed }
-func (*FakeStream) Finish()                     {}
-func (*FakeStream) DiscardAll()                 {}
-
-func newNetworkStream(src, dst Endpoint, isRequest bool, chanSize uint) Stream {
+func (*FakeStream) GetLastUUID() []byte                 { panic("should not be called") }
+func (*FakeStream) Close() error                        { panic("should not be called") }
+func (f *FakeStream) Packets() chan StreamPacket        { panic("should not be called") }
+func (*FakeStream) AppendPacket(*layers.TCP, time.Time) {}
+func (*FakeStream) ConfirmPacket(uint32)                {}
+func (f *FakeStream) SetClosed(closed bool)             { f.closed = closed }
+func (f *FakeStream) IsClosed() bool                    { return f.closed }
+func (*FakeStream) Finish()                             {}
+func (*FakeStream) DiscardAll()                         {}
+func (*FakeStream) Release(int)                         {}
+func (*FakeStream) Buffered() int                       { return 0 }
+func (*FakeStream) Evict()                              {}
+func (*FakeStream) Overflow() string                    { return "" }
+func (*FakeStream) Stats() StreamStats                  { return StreamStats{} }
+
+func newNetworkStream(src, dst Endpoint, isRequest bool, chanSize uint, budget *MemoryBudget) Stream {
 	return &NetworkStream{
 		window:    newReceiveWindow(64),
-		c:         make(chan *layers.TCP, chanSize),
+		c:         make(chan StreamPacket, chanSize),
 		src:       src,
 		dst:       dst,
 		isRequest: isRequest,
+		budget:    budget,
 	}
 }
 
-func (s *NetworkStream) AppendPacket(tcp *layers.TCP) {
+func (s *NetworkStream) AppendPacket(tcp *layers.TCP, t time.Time) {
 	if s.ignore {
 		return
 	}
-	s.window.insert(tcp)
+	if s.window.insert(tcp, t) {
+		s.acquire(len(tcp.Payload))
+	}
+
+	// the window grows without acknowledgements, like the other direction is not captured
+	if s.budget.exceedsStream(s.window.bytes) {
+		n := s.window.drop()
+		s.Release(n)
+		s.budget.truncate()
+		s.setOverflow(fmt.Sprintf("%d bytes not acknowledged exceed the stream buffer, truncated", n))
+	}
 }
 
 func (s *NetworkStream) ConfirmPacket(ack uint32) {
 	if s.ignore {
 		return
 	}
-	s.window.confirm(ack, s.c)
+	s.Release(s.window.confirm(ack, s.c))
+}
+
+func (s *NetworkStream) Finish() {
+	s.Release(s.window.drop())
+	close(s.c)
+}
+
+func (s *NetworkStream) acquire(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.buffered += n
+	if !s.evicted {
+		s.budget.add(int64(n))
+	}
 }
 
-func (s *NetworkStream) Finish() { close(s.c) }
+func (s *NetworkStream) Release(n int) { s.acquire(-n) }
+
+func (s *NetworkStream) Buffered() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buffered
+}
+
+func (s *NetworkStream) Evict() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.evicted {
+		s.evicted = true
+		s.budget.add(-int64(s.buffered))
+		s.overflow = fmt.Sprintf("%d bytes buffered, evicted by the memory budget", s.buffered)
+	}
+}
+
+func (s *NetworkStream) setOverflow(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.overflow = reason
+}
+
+func (s *NetworkStream) Overflow() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reason := s.overflow
+	s.overflow = ""
+	return reason
+}
 
 // UUID returns the UUID of a TCP request and its response.
-func (s NetworkStream) UUID(p *layers.TCP) []byte {
+func (s *NetworkStream) UUID(p *layers.TCP) []byte {
 	l, r := s.src, s.dst
 	streamID := uint64(l.port)<<48 | uint64(r.port)<<32 | uint64(ip2int(l.ip))
 	id := make([]byte, 12)
@@ -321,10 +561,13 @@ func ip2int(v string) uint32 {
 	return binary.BigEndian.Uint32(ip)
 }
 
-func (s *NetworkStream) Packets() chan *layers.TCP { return s.c }
+func (s *NetworkStream) Packets() chan StreamPacket { return s.c }
+
+func (s *NetworkStream) Stats() StreamStats { return s.window.stats }
 
 func (s *NetworkStream) DiscardAll() {
-	for range s.c {
+	for p := range s.c {
+		s.Release(len(p.Payload))
 	}
 }
 
@@ -338,13 +581,15 @@ func (s *NetworkStream) Close() error {
 type ReceiveWindow struct {
 	size        int
 	start       int
-	buffer      []*layers.TCP
+	buffer      []StreamPacket
 	lastAck     uint32
 	expectBegin uint32
+	bytes       int // payload bytes in the window
+	stats       StreamStats
 }
 
 func newReceiveWindow(initialSize int) *ReceiveWindow {
-	buffer := make([]*layers.TCP, initialSize)
+	buffer := make([]StreamPacket, initialSize)
 	return &ReceiveWindow{buffer: buffer}
 }
 
@@ -354,13 +599,15 @@ func (w *ReceiveWindow) destroy() {
 	w.buffer = nil
 }
 
-func (w *ReceiveWindow) insert(packet *layers.TCP) {
+// insert inserts the packet captured at t in the order of seq, returns false if it is empty, dropped or duplicated.
+func (w *ReceiveWindow) insert(packet *layers.TCP, t time.Time) bool {
 	if len(packet.Payload) == 0 {
-		return // ignore empty data packet
+		return false // ignore empty data packet
 	}
 
 	if w.expectBegin != 0 && compareTCPSeq(w.expectBegin, packet.Seq+uint32(len(packet.Payload))) >= 0 {
-		return // dropped
+		w.retransmitted()
+		return false // dropped
 	}
 
 	idx := w.size
@@ -369,7 +616,8 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 		prev := w.buffer[index]
 		result := compareTCPSeq(prev.Seq, packet.Seq)
 		if result == 0 { // duplicated
-			return
+			w.retransmitted()
+			return false
 		}
 		if result < 0 { // insert at index
 			break
@@ -382,7 +630,7 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 
 	if idx == w.size { // append at last
 		index := (idx + w.start) % len(w.buffer)
-		w.buffer[index] = packet
+		w.buffer[index] = StreamPacket{TCP: packet, Timestamp: t}
 	} else { // insert at index
 		for i := w.size - 1; i >= idx; i-- {
 			next := (i + w.start + 1) % len(w.buffer)
@@ -390,14 +638,32 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 			w.buffer[next] = w.buffer[current]
 		}
 		index := (idx + w.start) % len(w.buffer)
-		w.buffer[index] = packet
+		w.buffer[index] = StreamPacket{TCP: packet, Timestamp: t}
 	}
 
 	w.size++
+	w.bytes += len(packet.Payload)
+	return true
+}
+
+// drop drops the packets in the window, returns their payload bytes.
+func (w *ReceiveWindow) drop() int {
+	for i := 0; i < w.size; i++ {
+		w.buffer[(i+w.start)%len(w.buffer)] = StreamPacket{}
+	}
+	n := w.bytes
+	w.start, w.size, w.bytes = 0, 0, 0
+	return n
+}
+
+func (w *ReceiveWindow) retransmitted() {
+	w.stats.Retransmitted++
+	tcpStats.retransmitted.Add(1)
 }
 
-// send confirmed packets to reader, when receive ack
-func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
+// send confirmed packets to reader, when receive ack, returns the payload bytes of the duplicated data dropped.
+// The bytes not captured before a packet are sent with it as a gap.
+func (w *ReceiveWindow) confirm(ack uint32, c chan StreamPacket) (dropped int) {
 	idx := 0
 	for ; idx < w.size; idx++ {
 		index := (idx + w.start) % len(w.buffer)
@@ -405,8 +671,10 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 		if result := compareTCPSeq(packet.Seq, ack); result >= 0 {
 			break
 		}
-		w.buffer[index] = nil
+		w.buffer[index] = StreamPacket{}
+		w.bytes -= len(packet.Payload)
 		newExpect := packet.Seq + uint32(len(packet.Payload))
+		gap := 0
 		if w.expectBegin != 0 {
 			diff := compareTCPSeq(w.expectBegin, packet.Seq)
 			if diff > 0 {
@@ -414,14 +682,22 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 				if duplicatedSize < 0 {
 					duplicatedSize += maxTCPSeq
 				}
+				w.retransmitted()
 				if duplicatedSize >= uint32(len(packet.Payload)) {
+					dropped += len(packet.Payload)
 					continue
 				}
 				packet.Payload = packet.Payload[duplicatedSize:]
-			} else if diff < 0 {
-				// TODO: we lose packet here
+				dropped += int(duplicatedSize)
+			} else if diff < 0 { // the packets between are not captured
+				gap = -compareTCPSeq(w.expectBegin, packet.Seq)
+				w.stats.Gaps++
+				w.stats.LostBytes += gap
+				tcpStats.gaps.Add(1)
+				tcpStats.lostBytes.Add(uint64(gap))
 			}
 		}
+		packet.Gap = gap
 		c <- packet
 		w.expectBegin = newExpect
 	}
@@ -430,10 +706,11 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 	if compareTCPSeq(w.lastAck, ack) < 0 || w.lastAck == 0 {
 		w.lastAck = ack
 	}
+	return dropped
 }
 
 func (w *ReceiveWindow) expand() {
-	buffer := make([]*layers.TCP, len(w.buffer)*2)
+	buffer := make([]StreamPacket, len(w.buffer)*2)
 	end := w.start + w.size
 	if end < len(w.buffer) {
 		copy(buffer, w.buffer[w.start:w.start+w.size])
@@ -1,9 +1,22 @@
 package handler
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/bingoohuang/httpdump/httpport"
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,28 +24,324 @@ func TestReceiveWindow(t *testing.T) {
 	window := newReceiveWindow(4)
 
 	// started insert
-	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}})
-	window.insert(&layers.TCP{Seq: 10000, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
-	window.insert(&layers.TCP{Seq: 10010, BaseLayer: layers.BaseLayer{Payload: []byte{2, 3, 4, 5}}})
-	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}})
+	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}}, time.Time{})
+	window.insert(&layers.TCP{Seq: 10000, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, time.Time{})
+	window.insert(&layers.TCP{Seq: 10010, BaseLayer: layers.BaseLayer{Payload: []byte{2, 3, 4, 5}}}, time.Time{})
+	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}}, time.Time{})
 	assert.Equal(t, 3, window.size)
 	assert.Equal(t, 0, window.start)
 	assert.Equal(t, uint32(10000), window.buffer[0].Seq)
 	assert.Equal(t, uint32(10005), window.buffer[1].Seq)
 	assert.Equal(t, uint32(10010), window.buffer[2].Seq)
 
-	window.insert(&layers.TCP{Seq: 10009, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
+	window.insert(&layers.TCP{Seq: 10009, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, time.Time{})
 	assert.Equal(t, uint32(10000), window.buffer[0].Seq)
 	assert.Equal(t, uint32(10005), window.buffer[1].Seq)
 
 	// expand
-	window.insert(&layers.TCP{Seq: 10030, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
+	window.insert(&layers.TCP{Seq: 10030, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, time.Time{})
 	assert.Equal(t, 5, window.size)
 	assert.Equal(t, 0, window.start)
 
-	c := make(chan *layers.TCP, 1000)
+	c := make(chan StreamPacket, 1000)
 	// confirm
 	window.confirm(10020, c)
 	assert.Equal(t, 1, window.size)
 	assert.Equal(t, 4, window.start)
 }
+
+func TestReceiveWindowGap(t *testing.T) {
+	window := newReceiveWindow(4)
+	window.insert(&layers.TCP{Seq: 1000, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2, 3, 4}}}, time.Time{})
+	window.insert(&layers.TCP{Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte{5, 6, 7, 8}}}, time.Time{})
+
+	c := make(chan StreamPacket, 10)
+	window.confirm(1014, c)
+	assert.Equal(t, 0, (<-c).Gap)
+	p := <-c
+	assert.Equal(t, uint32(1010), p.Seq)
+	assert.Equal(t, 6, p.Gap)
+
+	window.insert(&layers.TCP{Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte{5, 6, 7, 8}}}, time.Time{})
+	window.insert(&layers.TCP{Seq: 1012, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 10}}}, time.Time{})
+	window.confirm(1016, c)
+	p = <-c
+	assert.Equal(t, []byte{9, 10}, p.Payload)
+	assert.Equal(t, 0, p.Gap)
+	assert.Equal(t, StreamStats{Gaps: 1, LostBytes: 6, Retransmitted: 2}, window.stats)
+}
+
+// recordSender records the messages sent.
+type recordSender struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (s *recordSender) Send(msg string, _ bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.msgs = append(s.msgs, msg)
+}
+
+func (s *recordSender) Close() error { return nil }
+
+func (s *recordSender) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return strings.Join(s.msgs, "\n")
+}
+
+// newTestAssembler creates the TCPAssembler of the fast handler, whose output is recorded by the sender,
+// the option passes all the messages if its filter is not set.
+func newTestAssembler(option *Option) (*TCPAssembler, *recordSender) {
+	if option.filter.Load() == nil {
+		option.SetFilter(&Filter{SrcRatio: 1})
+	}
+	sender := &recordSender{}
+	h := &ConnectionHandlerFast{Context: context.Background(), Option: option, Sender: sender}
+	return NewTCPAssembler(h, 10, option.Resp, nil), sender
+}
+
+// assembleTest assembles the packet with the payload captured at t, sent by the client 10.0.0.1 or the server 10.0.0.2.
+// The ports of the tcp are the client one and the server one, 5001 and 80 if not set, swapped for the server.
+func assembleTest(r *TCPAssembler, fromClient bool, tcp *layers.TCP, payload string, t time.Time) {
+	if tcp.SrcPort == 0 {
+		tcp.SrcPort = 5001
+	}
+	if tcp.DstPort == 0 {
+		tcp.DstPort = 80
+	}
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	if !fromClient {
+		tcp.SrcPort, tcp.DstPort, flow = tcp.DstPort, tcp.SrcPort, flow.Reverse()
+	}
+	tcp.Payload = []byte(payload)
+	r.Assemble(flow, tcp, gopacket.CaptureInfo{Timestamp: t})
+}
+
+// assembleGap assembles a request cut by a gap of 5 bytes, and the next request.
+func assembleGap() string {
+	r, sender := newTestAssembler(&Option{Level: "all", Eof: true})
+
+	post := "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\n01234"
+	assembleTest(r, true, &layers.TCP{Seq: 1000}, post, time.Now())
+	// 56789 is lost
+	get := "GET /b HTTP/1.1\r\n\r\n"
+	assembleTest(r, true, &layers.TCP{Seq: 1000 + uint32(len(post)+5)}, get, time.Now())
+	assembleTest(r, false, &layers.TCP{Seq: 5000, ACK: true, Ack: 1000 + uint32(len(post)+5+len(get))}, "", time.Now())
+	r.FinishAll()
+	return sender.String()
+}
+
+func TestGapEvent(t *testing.T) {
+	out := assembleGap()
+	assert.Contains(t, out, "POST /a HTTP/1.1")
+	assert.Contains(t, out, "// incomplete: 5 bytes lost in a gap of the stream")
+	assert.Contains(t, out, "### GAP#1 REQ 10.0.0.1:5001-10.0.0.2:80")
+	assert.Contains(t, out, ", 5 bytes lost")
+	assert.Contains(t, out, "### #2 REQ")
+	assert.Contains(t, out, "GET /b HTTP/1.1")
+	assert.Contains(t, out, "### EOF#2 REQ")
+	assert.Contains(t, out, "lost 5 bytes in 1 gaps, 0 retransmitted")
+	assert.True(t, strings.Index(out, "// incomplete") < strings.Index(out, "### GAP#1"))
+
+	t.Setenv("PRINT_JSON", "y")
+	out = assembleGap()
+	assert.Contains(t, out, `"event":"GAP","tag":"REQ","detail":"5 bytes lost"`)
+	assert.Contains(t, out, `"event":"EOF","tag":"REQ","detail":"lost 5 bytes in 1 gaps, 0 retransmitted"`)
+}
+
+func TestMidStreamPickup(t *testing.T) {
+	r, sender := newTestAssembler(&Option{Level: "all", Resp: 1})
+
+	// the capture starts at the end of a response on a keep-alive connection, and a request body
+	rsp1 := "lo\r\n0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	req2 := "a=1GET /next HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	rsp2 := "HTTP/1.1 204 No Content\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(req2)), 7000+uint32(len(rsp1)+len(rsp2))
+	assembleTest(r, false, &layers.TCP{SrcPort: 40000, DstPort: 8080, ACK: true, Seq: 7000, Ack: 1000}, rsp1, time.Now())
+	assembleTest(r, true, &layers.TCP{SrcPort: 40000, DstPort: 8080, ACK: true, Seq: 1000, Ack: 7000 + uint32(len(rsp1))}, req2, time.Now())
+	assembleTest(r, false, &layers.TCP{SrcPort: 40000, DstPort: 8080, ACK: true, Seq: 7000 + uint32(len(rsp1)), Ack: reqEnd}, rsp2, time.Now())
+	assembleTest(r, true, &layers.TCP{SrcPort: 40000, DstPort: 8080, ACK: true, Seq: reqEnd, Ack: rspEnd}, "", time.Now())
+	// a request line in the body sent from a well-known port does not start a connection
+	assembleTest(r, false, &layers.TCP{SrcPort: 40001, DstPort: 80, ACK: true, Seq: 9000, Ack: 100}, "xx GET / HTTP/1.1\r\n\r\n", time.Now())
+	r.FinishAll()
+
+	out := sender.String()
+	assert.Contains(t, out, "### #1 RSP 10.0.0.1:40000-10.0.0.2:8080")
+	assert.Contains(t, out, "HTTP/1.1 200 OK")
+	assert.Contains(t, out, "### #2 REQ 10.0.0.1:40000-10.0.0.2:8080")
+	assert.Contains(t, out, "GET /next HTTP/1.1")
+	assert.Contains(t, out, "### #2 RSP 10.0.0.1:40000-10.0.0.2:8080")
+	assert.Contains(t, out, "HTTP/1.1 204 No Content")
+	assert.NotContains(t, out, "ERR#")
+	assert.NotContains(t, out, "40001")
+}
+
+func TestRawHeaders(t *testing.T) {
+	r, sender := newTestAssembler(&Option{Level: "all"})
+	req := "POST /a HTTP/1.1\r\nhost: a.com\r\nX-B: 1\r\nx-a: 2\r\nX-B: 3\r\nX-Fold: a\r\n  b\r\nContent-Length: 2\r\n\r\nok"
+	assembleTest(r, true, &layers.TCP{Seq: 1000}, req, time.Time{})
+	assembleTest(r, false, &layers.TCP{ACK: true, Ack: 1000 + uint32(len(req))}, "", time.Time{})
+	r.FinishAll()
+
+	assert.Contains(t, sender.String(), "POST /a HTTP/1.1\r\nhost: a.com\r\nX-B: 1\r\nx-a: 2\r\nX-B: 3\r\nX-Fold: a\r\n  b\r\nContent-Length: 2\r\n\r\nok")
+
+	hr, err := httpport.ReadRequest(bufio.NewReader(strings.NewReader(req)))
+	assert.Nil(t, err)
+	assert.Equal(t, []httpport.RawHeader{
+		{Name: "host", Value: "a.com", Line: 2},
+		{Name: "X-B", Value: "1", Line: 3},
+		{Name: "x-a", Value: "2", Line: 4},
+		{Name: "X-B", Value: "3", Line: 5},
+		{Name: "X-Fold", Value: "a b", Line: 6, Folds: 1, Raw: "X-Fold: a\r\n  b"},
+		{Name: "Content-Length", Value: "2", Line: 8},
+	}, hr.RawHeaders)
+}
+
+type nopConnectionHandler struct{ conns []*TCPConnection }
+
+func (h *nopConnectionHandler) handle(_, _ Endpoint, c *TCPConnection) { h.conns = append(h.conns, c) }
+func (h *nopConnectionHandler) finish()                                {}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(100, 60)
+	s := newNetworkStream(Endpoint{}, Endpoint{}, true, 10, budget)
+	s.AppendPacket(&layers.TCP{Seq: 1000, BaseLayer: layers.BaseLayer{Payload: make([]byte, 40)}}, time.Time{})
+	assert.Equal(t, int64(40), budget.Stats().Used)
+	s.AppendPacket(&layers.TCP{Seq: 1040, BaseLayer: layers.BaseLayer{Payload: make([]byte, 40)}}, time.Time{})
+	assert.Equal(t, BudgetStats{Used: 0, Truncated: 1}, budget.Stats())
+	assert.Contains(t, s.Overflow(), "80 bytes not acknowledged")
+	assert.Equal(t, "", s.Overflow())
+
+	h := &nopConnectionHandler{}
+	r := NewTCPAssembler(h, 10, 1, budget)
+	assembleTest(r, true, &layers.TCP{SrcPort: 5001, Seq: 1000}, "GET /a HTTP/1.1\r\nX: "+strings.Repeat("a", 30), time.Now())
+	assembleTest(r, true, &layers.TCP{SrcPort: 5002, Seq: 1000}, "GET /b HTTP/1.1\r\nX: "+strings.Repeat("b", 10), time.Now())
+	assert.Equal(t, int64(80), budget.Stats().Used)
+	assembleTest(r, true, &layers.TCP{SrcPort: 5003, Seq: 1000}, "GET /c HTTP/1.1\r\nX: "+strings.Repeat("c", 20), time.Now())
+
+	// the largest connection is evicted
+	assert.Equal(t, BudgetStats{Used: 70, Truncated: 1, Evicted: 1}, budget.Stats())
+	assert.Len(t, r.connections, 2)
+	assert.Contains(t, h.conns[0].requestStream.Overflow(), "evicted by the memory budget")
+	assert.Equal(t, 0, h.conns[0].requestStream.Buffered())
+
+	r.FinishAll()
+	assert.Equal(t, int64(0), budget.Stats().Used)
+}
+
+func TestMemoryBudgetShards(t *testing.T) {
+	budget := NewMemoryBudget(100, 0)
+	h1, h2 := &nopConnectionHandler{}, &nopConnectionHandler{}
+	r1, r2 := NewTCPAssembler(h1, 10, 1, budget), NewTCPAssembler(h2, 10, 1, budget)
+	assembleTest(r1, true, &layers.TCP{SrcPort: 5001, Seq: 1000}, "GET /a HTTP/1.1\r\nX: "+strings.Repeat("a", 50), time.Now())
+	assembleTest(r2, true, &layers.TCP{SrcPort: 5002, Seq: 1000}, "GET /b HTTP/1.1\r\nX: "+strings.Repeat("b", 20), time.Now())
+
+	// the largest connection of the other shard is evicted, and closed by its own shard
+	assert.Equal(t, BudgetStats{Used: 40, Evicted: 1}, budget.Stats())
+	assert.Len(t, r1.connections, 1)
+	assert.Contains(t, h1.conns[0].requestStream.Overflow(), "evicted by the memory budget")
+	r1.FlushOlderThan(time.Time{})
+	assert.Len(t, r1.connections, 0)
+	assert.Len(t, r2.connections, 1)
+
+	r1.FinishAll()
+	r2.FinishAll()
+	assert.Equal(t, int64(0), budget.Stats().Used)
+}
+
+type discardSender struct{}
+
+func (discardSender) Send(string, bool) {}
+func (discardSender) Close() error      { return nil }
+
+// writeConnectionsPcap writes a pcap of n http connections from distinct clients, each with a request,
+// a response and the FINs of both directions.
+func writeConnectionsPcap(b *testing.B, file string, n int) {
+	f, err := os.Create(file)
+	assert.Nil(b, err)
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	assert.Nil(b, w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+
+	req := []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	rsp := []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	ts := time.Now()
+	write := func(src, dst net.IP, srcPort, dstPort uint16, tcp *layers.TCP, payload []byte) {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}, DstMAC: net.HardwareAddr{6, 5, 4, 3, 2, 1}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp.SrcPort, tcp.DstPort, tcp.ACK = layers.TCPPort(srcPort), layers.TCPPort(dstPort), true
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+
+		buf := gopacket.NewSerializeBuffer()
+		assert.Nil(b, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, tcp, gopacket.Payload(payload)))
+		ts = ts.Add(time.Microsecond)
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		assert.Nil(b, w.WritePacket(ci, buf.Bytes()))
+	}
+
+	server := net.IP{10, 0, 0, 1}
+	for i := 0; i < n; i++ {
+		client := net.IP{10, 1, byte(i >> 8), byte(i)}
+		port := uint16(10000 + i%50000)
+		reqSeq, rspSeq := uint32(1000), uint32(5000)
+		write(client, server, port, 80, &layers.TCP{Seq: reqSeq, Ack: rspSeq, PSH: true}, req)
+		write(server, client, 80, port, &layers.TCP{Seq: rspSeq, Ack: reqSeq + uint32(len(req)), PSH: true}, rsp)
+		write(client, server, port, 80, &layers.TCP{Seq: reqSeq + uint32(len(req)), Ack: rspSeq + uint32(len(rsp)), FIN: true}, nil)
+		write(server, client, 80, port, &layers.TCP{Seq: rspSeq + uint32(len(rsp)), Ack: reqSeq + uint32(len(req)) + 1, FIN: true}, nil)
+	}
+}
+
+// BenchmarkShardedAssembler assembles the http connections of a synthetic pcap by the shards.
+func BenchmarkShardedAssembler(b *testing.B) {
+	file := filepath.Join(b.TempDir(), "conns.pcap")
+	const conns = 20000
+	writeConnectionsPcap(b, file, conns)
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			option := &Option{Level: LevelUrl, Resp: 1}
+			option.SetFilter(&Filter{SrcRatio: 1})
+			for i := 0; i < b.N; i++ {
+				packets, err := util.OpenPcapFiles([]string{file}, nil)
+				assert.Nil(b, err)
+				assembler := util.NewShardedAssembler(shards, 1024, func() util.Assembler {
+					h := &ConnectionHandlerFast{Context: context.Background(), Option: option, Sender: discardSender{}}
+					return NewTCPAssembler(h, 1024, option.Resp, nil)
+				})
+				util.LoopPackets(context.Background(), []chan gopacket.Packet{packets}, assembler, time.Minute, nil)
+			}
+			b.ReportMetric(float64(conns*b.N)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
+
+func TestSplitStartLine(t *testing.T) {
+	option := &Option{Level: "all", Resp: 1}
+	option.SetFilter(&Filter{Method: "GET", SrcRatio: 1})
+	r, sender := newTestAssembler(option)
+
+	// both start lines are split over two packets
+	req1, req2 := "GET /split HT", "TP/1.1\r\nHost: a.com\r\n\r\n"
+	rsp1, rsp2 := "HTTP/1.", "1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	reqEnd, rspEnd := 1000+uint32(len(req1+req2)), 5000+uint32(len(rsp1+rsp2))
+	assembleTest(r, true, &layers.TCP{SYN: true, Seq: 999}, "", time.Now())
+	assembleTest(r, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000}, "", time.Now())
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000}, req1, time.Now())
+	assembleTest(r, true, &layers.TCP{ACK: true, Seq: 1000 + uint32(len(req1)), Ack: 5000}, req2, time.Now())
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000, Ack: reqEnd}, rsp1, time.Now())
+	assembleTest(r, false, &layers.TCP{ACK: true, Seq: 5000 + uint32(len(rsp1)), Ack: reqEnd}, rsp2, time.Now())
+	assembleTest(r, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd}, "", time.Now())
+	assembleTest(r, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd + 1}, "", time.Now())
+	r.FinishAll()
+
+	out := sender.String()
+	assert.Contains(t, out, "### #1 REQ 10.0.0.1:5001-10.0.0.2:80")
+	assert.Contains(t, out, "GET /split HTTP/1.1\r\nHost: a.com")
+	assert.Contains(t, out, "### #1 RSP 10.0.0.1:5001-10.0.0.2:80")
+	assert.Contains(t, out, "HTTP/1.1 200 OK")
+	assert.NotContains(t, out, "ERR#")
+	assert.NotContains(t, out, "count-mismatch")
+}
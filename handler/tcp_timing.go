@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxPendingExchanges limits the exchanges waiting for their responses to be dealt,
+// like when the responses are not processed at all.
+const maxPendingExchanges = 16
+
+// ConnTiming records the lifecycle and the network timing of a tcp connection by its packets.
+// It is written by the assembler, and read by the handlers of the messages.
+type ConnTiming struct {
+	lock sync.Mutex
+
+	client           Endpoint // who sent the SYN or the first request
+	syn, synAck, ack time.Time
+	first, last      time.Time
+	next             [2]uint32 // the seq after the payload seen of the client and the server
+	seen             [2]bool
+
+	exchanges     int
+	current       *ExchangeTiming   // of the last request
+	pending       []*ExchangeTiming // responded, waiting for the response to be dealt
+	retransmitted int
+	zeroWindows   int
+	closedBy      string // like client FIN
+}
+
+// ExchangeTiming is the network timing of a request and its response.
+type ExchangeTiming struct {
+	RTT           time.Duration `json:",omitempty"` // of the tcp handshake, 0 if it is not captured
+	TTFB          time.Duration // from the first byte of the request to the first byte of the response
+	Server        time.Duration // from the last byte of the request to the first byte of the response, minus the RTT if captured at the client
+	Transfer      time.Duration // of the bytes of the request and the response on the network
+	Retransmitted int           `json:",omitempty"`
+	ZeroWindows   int           `json:",omitempty"`
+
+	reqFirst, reqLast, rspFirst, rspLast time.Time
+	rspSeq                               uint32 // seq of the first byte of the response
+}
+
+// ConnSummary is the lifecycle of a tcp connection.
+type ConnSummary struct {
+	RTT           time.Duration
+	Exchanges     int
+	Retransmitted int
+	ZeroWindows   int
+	Duration      time.Duration
+	ClosedBy      string // like client FIN or server RST, empty if not closed
+	End           time.Time
+}
+
+func newConnTiming(client Endpoint) *ConnTiming { return &ConnTiming{client: client} }
+
+// onPacket records the packet sent by src captured at t.
+func (c *ConnTiming) onPacket(src Endpoint, tcp *layers.TCP, t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.first.IsZero() {
+		c.first = t
+	}
+	c.last = t
+
+	side := 0
+	if tcp.SYN && !tcp.ACK {
+		c.client = src
+	} else if !c.client.equals(src) {
+		side = 1
+	}
+
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if c.synAck.IsZero() { // the last one of the retransmitted SYNs
+			c.syn = t
+		}
+	case tcp.SYN:
+		if !c.syn.IsZero() && c.ack.IsZero() {
+			c.synAck = t
+		}
+	case side == 0 && tcp.ACK && !c.synAck.IsZero() && c.ack.IsZero():
+		c.ack = t
+	}
+
+	if tcp.ACK && tcp.Window == 0 && !tcp.SYN && !tcp.FIN && !tcp.RST {
+		c.zeroWindows++
+		if c.current != nil {
+			c.current.ZeroWindows++
+		}
+	}
+
+	if (tcp.FIN || tcp.RST) && c.closedBy == "" {
+		c.closedBy = "client"
+		if side == 1 {
+			c.closedBy = "server"
+		}
+		if tcp.RST {
+			c.closedBy += " RST"
+		} else {
+			c.closedBy += " FIN"
+		}
+	}
+
+	if len(tcp.Payload) > 0 {
+		c.onPayload(side, tcp, t)
+	}
+}
+
+func (c *ConnTiming) onPayload(side int, tcp *layers.TCP, t time.Time) {
+	end := tcp.Seq + uint32(len(tcp.Payload))
+	if c.seen[side] && compareTCPSeq(end, c.next[side]) <= 0 {
+		c.retransmitted++
+		if c.current != nil {
+			c.current.Retransmitted++
+		}
+		return
+	}
+	c.seen[side], c.next[side] = true, end
+
+	x := c.current
+	if side == 0 {
+		if x == nil || !x.rspFirst.IsZero() { // a new request after the response
+			x = &ExchangeTiming{reqFirst: t}
+			c.current = x
+			c.exchanges++
+		}
+		x.reqLast = t
+		return
+	}
+
+	if x == nil {
+		return // the response of the request not captured
+	}
+	if x.rspFirst.IsZero() {
+		x.rspFirst, x.rspSeq = t, tcp.Seq
+		if c.pending = append(c.pending, x); len(c.pending) > maxPendingExchanges {
+			c.pending = c.pending[1:]
+		}
+	}
+	x.rspLast = t
+}
+
+// rtt returns the round trip time of the handshake, 0 if it is not captured.
+func (c *ConnTiming) rtt() time.Duration {
+	if c.syn.IsZero() || c.ack.IsZero() {
+		return 0
+	}
+	return c.ack.Sub(c.syn)
+}
+
+// capturedAtClient tells whether the connection is captured at the client, where the SYN-ACK comes a round trip
+// after the SYN, otherwise at the server the ACK comes a round trip after the SYN-ACK.
+func (c *ConnTiming) capturedAtClient() bool {
+	return c.rtt() > 0 && c.synAck.Sub(c.syn) > c.ack.Sub(c.synAck)
+}
+
+// take returns the timing of the exchange whose response starts at the seq, nil if not found.
+// The exchanges before it are dropped.
+func (c *ConnTiming) take(rspSeq uint32) *ExchangeTiming {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, x := range c.pending {
+		if x.rspSeq != rspSeq {
+			continue
+		}
+		c.pending = c.pending[i+1:]
+
+		t := *x
+		t.RTT = c.rtt()
+		t.TTFB = x.rspFirst.Sub(x.reqFirst)
+		if t.Server = x.rspFirst.Sub(x.reqLast); c.capturedAtClient() {
+			t.Server = max(t.Server-t.RTT, 0)
+		}
+		t.Transfer = x.reqLast.Sub(x.reqFirst) + x.rspLast.Sub(x.rspFirst)
+		return &t
+	}
+	return nil
+}
+
+// Summary returns the lifecycle of the connection.
+func (c *ConnTiming) Summary() ConnSummary {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return ConnSummary{
+		RTT:           c.rtt(),
+		Exchanges:     c.exchanges,
+		Retransmitted: c.retransmitted,
+		ZeroWindows:   c.zeroWindows,
+		Duration:      c.last.Sub(c.first),
+		ClosedBy:      c.closedBy,
+		End:           c.last,
+	}
+}
+
+// String returns the timing like rtt 1.2ms, ttfb 25ms, server 23.1ms, transfer 700µs, 1 retransmitted.
+func (t *ExchangeTiming) String() string {
+	var b strings.Builder
+	if t.RTT > 0 {
+		fmt.Fprintf(&b, "rtt %s, ", roundDuration(t.RTT))
+	}
+	fmt.Fprintf(&b, "ttfb %s, server %s, transfer %s", roundDuration(t.TTFB), roundDuration(t.Server), roundDuration(t.Transfer))
+	if t.Retransmitted > 0 {
+		fmt.Fprintf(&b, ", %d retransmitted", t.Retransmitted)
+	}
+	if t.ZeroWindows > 0 {
+		fmt.Fprintf(&b, ", %d zero windows", t.ZeroWindows)
+	}
+	return b.String()
+}
+
+// String returns the summary like rtt 1.2ms, 3 exchanges, 0 retransmitted, 0 zero windows, lasted 2.5s, closed by client FIN.
+func (s ConnSummary) String() string {
+	var b strings.Builder
+	if s.RTT > 0 {
+		fmt.Fprintf(&b, "rtt %s, ", roundDuration(s.RTT))
+	}
+	fmt.Fprintf(&b, "%d exchanges, %d retransmitted, %d zero windows, lasted %s, ",
+		s.Exchanges, s.Retransmitted, s.ZeroWindows, roundDuration(s.Duration))
+	if s.ClosedBy != "" {
+		b.WriteString("closed by " + s.ClosedBy)
+	} else {
+		b.WriteString("not closed")
+	}
+	return b.String()
+}
+
+func roundDuration(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// assembleTiming assembles a connection with its handshake, an exchange and the close, the SYN-ACK is captured
+// synAck ms after the SYN, 20 at the client and 0 at the server.
+func assembleTiming(synAck int) string {
+	r, sender := newTestAssembler(&Option{Level: "all", Resp: 1, Timing: true})
+	start := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	assemble := func(ms int, fromClient bool, tcp *layers.TCP, payload string) {
+		assembleTest(r, fromClient, tcp, payload, start.Add(time.Duration(ms)*time.Millisecond))
+	}
+
+	req := "GET /a HTTP/1.1\r\nHost: a.com\r\n\r\n"
+	head := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"
+	reqEnd, rspEnd := 1000+uint32(len(req)), 5000+uint32(len(head)+5)
+	assemble(0, true, &layers.TCP{SYN: true, Seq: 999, Window: 65535}, "")
+	assemble(synAck, false, &layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000, Window: 65535}, "")
+	assemble(20, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000, Window: 65535}, "")
+	assemble(21, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000, Window: 65535}, req)
+	assemble(25, true, &layers.TCP{ACK: true, Seq: 1000, Ack: 5000, Window: 65535}, req) // retransmitted
+	assemble(30, false, &layers.TCP{ACK: true, Seq: 5000, Ack: reqEnd, Window: 65535}, "")
+	assemble(121, false, &layers.TCP{ACK: true, Seq: 5000, Ack: reqEnd, Window: 65535}, head)
+	assemble(125, false, &layers.TCP{ACK: true, Seq: 5000 + uint32(len(head)), Ack: reqEnd, Window: 65535}, "hello")
+	assemble(126, true, &layers.TCP{ACK: true, Seq: reqEnd, Ack: rspEnd}, "") // zero window
+	assemble(200, true, &layers.TCP{FIN: true, ACK: true, Seq: reqEnd, Ack: rspEnd, Window: 65535}, "")
+	assemble(201, false, &layers.TCP{FIN: true, ACK: true, Seq: rspEnd, Ack: reqEnd + 1, Window: 65535}, "")
+	r.FinishAll()
+	return sender.String()
+}
+
+func TestConnTiming(t *testing.T) {
+	out := assembleTiming(20)
+	assert.Contains(t, out, "HTTP/1.1 200 OK")
+	assert.Contains(t, out, "// timing: rtt 20ms, ttfb 100ms, server 80ms, transfer 4ms, 1 retransmitted, 1 zero windows")
+	assert.Contains(t, out, "### CONN#1 TCP 10.0.0.1:5001-10.0.0.2:80 2024-04-01T10:00:00.201Z, "+
+		"rtt 20ms, 1 exchanges, 1 retransmitted, 1 zero windows, lasted 201ms, closed by client FIN")
+
+	// at the server, the time between the request and the response is not on the network
+	out = assembleTiming(0)
+	assert.Contains(t, out, "// timing: rtt 20ms, ttfb 100ms, server 100ms, transfer 4ms, 1 retransmitted, 1 zero windows")
+
+	t.Setenv("PRINT_JSON", "y")
+	out = assembleTiming(20)
+	assert.Contains(t, out, `"timing":{`)
+	assert.Contains(t, out, `"event":"CONN","tag":"TCP"`)
+	assert.Contains(t, out, `"connection":{"rtt":"20000000","exchanges":1,"retransmitted":1,"zeroWindows":1,`+
+		`"duration":"201000000","closedBy":"client FIN"`)
+}
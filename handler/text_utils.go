@@ -2,11 +2,7 @@ package handler
 
 import (
 	"io"
-	"io/ioutil"
 	"strings"
-
-	"golang.org/x/text/encoding/htmlindex"
-	"golang.org/x/text/transform"
 )
 
 // MimeType type struct
@@ -39,8 +35,6 @@ func ParseMimeType(contentTypeStr string) MimeType {
 	return MimeType{contentTypeStr[:idx], subType, scope}
 }
 
-// TODO: multipart/form-data
-
 var textTypes = map[string]bool{"text": true}
 
 var textSubTypes = map[string]bool{
@@ -135,18 +129,11 @@ func (ct MimeType) isBinaryContent() bool {
 
 // ReadWithCharset read reader content to string, using charset specified
 func ReadWithCharset(reader io.Reader, charset string) ([]byte, error) {
-	charset = strings.ToUpper(charset)
-	switch charset {
-	case "UTF-8", "UTF8":
-		return ioutil.ReadAll(reader)
-	case "GBK", "GB2312":
-		charset = "GB18030"
-	}
-	encoder, err := htmlindex.Get(charset)
-	if err != nil {
+	if _, err := charsetEncoding(charset); err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(transform.NewReader(reader, encoder.NewDecoder()))
+	r, _ := textReader(reader, charset)
+	return io.ReadAll(r)
 }
 
 // ParseContentType parse content type to MimeType and charset
@@ -171,10 +158,10 @@ func ParseContentType(contentType string) (string, string) {
 
 // LikeJSON tells if sting 'looks like' a json string.
 func LikeJSON(s string) bool {
+	s = strings.TrimSpace(s)
 	if len(s) < 2 {
 		return false
 	}
-	s = strings.TrimSpace(s)
 	return s[0] == '[' && s[len(s)-1] == ']' || s[0] == '{' && s[len(s)-1] == '}'
 }
 
@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// The types of the thrift binary protocol.
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftByte   = 3
+	thriftDouble = 4
+	thriftI16    = 6
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftMap    = 13
+	thriftSet    = 14
+	thriftList   = 15
+)
+
+var thriftMessageTypes = map[byte]string{1: "call", 2: "reply", 3: "exception", 4: "oneway"}
+
+// maxThriftDepth limits the nested structs and containers.
+const maxThriftDepth = 64
+
+// decodeThrift decodes the message or the struct of the thrift binary protocol without the IDL,
+// whose fields are keyed by their ids.
+func decodeThrift(body []byte, _ map[string]string) ([]byte, error) {
+	r := &thriftReader{b: body}
+	v, err := r.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.b) > 0 {
+		return nil, fmt.Errorf("%d bytes of extra data", len(r.b))
+	}
+	return json.Marshal(v)
+}
+
+type thriftReader struct {
+	b []byte
+}
+
+func (r *thriftReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, errors.New("unexpected end of thrift data")
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p, nil
+}
+
+func (r *thriftReader) readI32() (int32, error) {
+	p, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(p)), nil
+}
+
+// readMessage reads the message, in the strict or the old format, or just the struct if there is no message header.
+func (r *thriftReader) readMessage() (any, error) {
+	if len(r.b) < 4 {
+		return r.readStruct(0)
+	}
+
+	var name string
+	var typ byte
+	if version := binary.BigEndian.Uint32(r.b); version&0xffff0000 == 0x80010000 { // strict
+		typ = byte(version)
+		r.b = r.b[4:]
+		n, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		name = n
+	} else if n := int(version); n > 0 && n+5 <= len(r.b)-4 && thriftMessageTypes[r.b[4+n]] != "" && utf8.Valid(r.b[4:4+n]) { // old
+		name, typ = string(r.b[4:4+n]), r.b[4+n]
+		r.b = r.b[5+n:]
+	} else {
+		return r.readStruct(0)
+	}
+
+	seq, err := r.readI32()
+	if err != nil {
+		return nil, err
+	}
+	s, err := r.readStruct(0)
+	if err != nil {
+		return nil, err
+	}
+	return jsonObject{{"method", name}, {"type", thriftMessageTypes[typ]}, {"seqid", seq}, {"struct", s}}, nil
+}
+
+func (r *thriftReader) readString() (string, error) {
+	n, err := r.readI32()
+	if err != nil {
+		return "", err
+	}
+	p, err := r.next(int(n))
+	return string(p), err
+}
+
+func (r *thriftReader) readStruct(depth int) (jsonObject, error) {
+	o := jsonObject{}
+	for {
+		typ, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		if typ[0] == thriftStop {
+			return o, nil
+		}
+		id, err := r.next(2)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.readValue(typ[0], depth)
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, jsonField{Key: fmt.Sprint(int16(binary.BigEndian.Uint16(id))), Value: v})
+	}
+}
+
+func (r *thriftReader) readValue(typ byte, depth int) (any, error) {
+	if depth > maxThriftDepth {
+		return nil, errors.New("thrift data nested too deep")
+	}
+	switch typ {
+	case thriftBool, thriftByte:
+		p, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		if typ == thriftBool {
+			return p[0] != 0, nil
+		}
+		return int8(p[0]), nil
+	case thriftI16:
+		p, err := r.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return int16(binary.BigEndian.Uint16(p)), nil
+	case thriftI32:
+		return r.readI32()
+	case thriftI64, thriftDouble:
+		p, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		if typ == thriftI64 {
+			return int64(binary.BigEndian.Uint64(p)), nil
+		}
+		return jsonValue(math.Float64frombits(binary.BigEndian.Uint64(p))), nil
+	case thriftString: // string or binary
+		n, err := r.readI32()
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		if utf8.Valid(p) && isPrintable(p) {
+			return string(p), nil
+		}
+		return hex.EncodeToString(p), nil
+	case thriftStruct:
+		return r.readStruct(depth + 1)
+	case thriftMap:
+		p, err := r.next(2)
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.readI32()
+		if err != nil {
+			return nil, err
+		}
+		o := jsonObject{}
+		for i := int32(0); i < n; i++ {
+			k, err := r.readValue(p[0], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.readValue(p[1], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, jsonField{Key: thriftKey(k), Value: v})
+		}
+		return o, nil
+	case thriftSet, thriftList:
+		p, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.readI32()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || int(n) > len(r.b) { // each element takes at least one byte
+			return nil, errors.New("invalid thrift list size")
+		}
+		l := make([]any, 0, n)
+		for i := int32(0); i < n; i++ {
+			v, err := r.readValue(p[0], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown thrift type %d", typ)
+	}
+}
+
+// thriftKey returns the json key of the map key, the struct keys are in json.
+func thriftKey(k any) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	if o, ok := k.(jsonObject); ok {
+		data, _ := json.Marshal(o)
+		return string(data)
+	}
+	return fmt.Sprint(k)
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// verdictWait is how long a response waits for the verdict of its request, which is processed in the other stream.
+const verdictWait = time.Second
+
+// maxVerdicts is the number of the verdicts of the requests kept for their responses not processed yet.
+const maxVerdicts = 1024
+
+// exchangeVerdict is the verdict of the filters on a request, which its response inherits, like the anomaly filter,
+// so the exchange is output as a whole when the request is flagged, though its response is clean.
+type exchangeVerdict struct {
+	anomalies bool // the request passes the anomaly filter
+	auth      bool // the request passes the auth filter
+	target    bool // the request passes the host and the uri filters, so the connection of its response is matched
+}
+
+// exchangeVerdicts pairs the verdicts of the requests of a connection to the responses by the numbers of their start lines.
+type exchangeVerdicts struct {
+	lock     sync.Mutex
+	verdicts map[int32]chan exchangeVerdict
+}
+
+func newExchangeVerdicts() *exchangeVerdicts {
+	return &exchangeVerdicts{verdicts: make(map[int32]chan exchangeVerdict)}
+}
+
+func (v *exchangeVerdicts) slot(seq int32) chan exchangeVerdict {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	c, ok := v.verdicts[seq]
+	if !ok {
+		c = make(chan exchangeVerdict, 1)
+		v.verdicts[seq] = c
+	}
+	return c
+}
+
+// put records the verdict of the request seq, and forgets the ones whose responses never come.
+func (v *exchangeVerdicts) put(seq int32, verdict exchangeVerdict) {
+	v.slot(seq) <- verdict
+
+	v.lock.Lock()
+	delete(v.verdicts, seq-maxVerdicts)
+	v.lock.Unlock()
+}
+
+// take returns the verdict of the request seq, waiting for it to be processed, the zero one if it is not in time.
+func (v *exchangeVerdicts) take(seq int32) exchangeVerdict {
+	c := v.slot(seq)
+	defer func() {
+		v.lock.Lock()
+		delete(v.verdicts, seq)
+		v.lock.Unlock()
+	}()
+
+	select {
+	case verdict := <-c:
+		return verdict
+	case <-time.After(verdictWait):
+		return exchangeVerdict{}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/httpdump/util"
+)
+
+// Exchange is a request and its response, paired by the connection and the sequence.
+type Exchange struct {
+	ID   uint64
+	Time time.Time
+	Req  *HTTPEvent
+	Rsp  *HTTPEvent
+
+	key  string
+	size uint64
+}
+
+// exchangeOverhead is the estimated memory of an Exchange besides its payloads.
+const exchangeOverhead = 512
+
+// History is a bounded ring buffer of recent exchanges, limited by count and by memory.
+type History struct {
+	lock    sync.Mutex
+	maxNum  int
+	maxSize uint64
+
+	ring  []*Exchange
+	start int
+	num   int
+	size  uint64
+	index map[string]*Exchange
+
+	exchangeID uint64
+	eventID    uint64
+}
+
+// NewHistory creates a History, keeping at most maxNum exchanges of maxSize bytes in total.
+func NewHistory(maxNum int, maxSize uint64) *History {
+	if maxNum <= 0 {
+		maxNum = 1
+	}
+	return &History{
+		maxNum:  maxNum,
+		maxSize: maxSize,
+		ring:    make([]*Exchange, maxNum),
+		index:   make(map[string]*Exchange),
+	}
+}
+
+// Add assigns the event an ID and records it in the exchange it belongs to.
+// The events of the streams, like EOF, are not recorded, but still get an ID.
+func (h *History) Add(e *HTTPEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.eventID++
+	e.ID = h.eventID
+	if e.Event != "" || !e.Req && !e.Rsp {
+		return
+	}
+
+	key := e.Connection + "." + strconv.Itoa(e.Seq)
+	x := h.index[key]
+	if x == nil || e.Req && x.Req != nil || e.Rsp && x.Rsp != nil {
+		x = &Exchange{key: key, Time: e.ParseTimestamp()}
+		h.exchangeID++
+		x.ID = h.exchangeID
+		h.push(x)
+	}
+
+	if e.Req {
+		x.Req = e
+	} else {
+		x.Rsp = e
+	}
+
+	size := uint64(len(e.Payload))
+	x.size += size
+	h.size += size
+	h.evict()
+}
+
+func (h *History) push(x *Exchange) {
+	if h.num == len(h.ring) {
+		h.removeOldest()
+	}
+
+	h.ring[(h.start+h.num)%len(h.ring)] = x
+	h.num++
+	h.index[x.key] = x
+	h.size += exchangeOverhead
+	x.size += exchangeOverhead
+}
+
+// evict removes the oldest exchanges until the memory limit is met, the newest one is always kept.
+func (h *History) evict() {
+	for h.maxSize > 0 && h.size > h.maxSize && h.num > 1 {
+		h.removeOldest()
+	}
+}
+
+func (h *History) removeOldest() {
+	x := h.ring[h.start]
+	h.ring[h.start] = nil
+	h.start = (h.start + 1) % len(h.ring)
+	h.num--
+	h.size -= x.size
+	if h.index[x.key] == x {
+		delete(h.index, x.key)
+	}
+}
+
+// each iterates the exchanges from the newest to the oldest, until fn returns false.
+func (h *History) each(fn func(x *Exchange) bool) {
+	for i := h.num - 1; i >= 0; i-- {
+		if !fn(h.ring[(h.start+i)%len(h.ring)]) {
+			return
+		}
+	}
+}
+
+// HistoryQuery filters the exchanges in the History, empty fields match all.
+type HistoryQuery struct {
+	Method    string
+	Path      string // sub string of the path
+	Host      string // sub string of the host
+	Interface string
+	Tunnel    string
+	Anomaly   string // sub string of any anomaly, like cl-te-conflict or error
+	Status    *util.IntSet
+	From      time.Time
+	To        time.Time
+
+	Offset int
+	Limit  int
+}
+
+func (q *HistoryQuery) matches(x *Exchange) bool {
+	if !q.From.IsZero() && x.Time.Before(q.From) || !q.To.IsZero() && x.Time.After(q.To) {
+		return false
+	}
+
+	if q.Method != "" || q.Path != "" || q.Host != "" {
+		if x.Req == nil ||
+			q.Method != "" && !strings.EqualFold(x.Req.Method, q.Method) ||
+			!strings.Contains(x.Req.Path, q.Path) ||
+			!strings.Contains(x.Req.Host, q.Host) {
+			return false
+		}
+	}
+
+	if q.Interface != "" && x.Summary().Interface != q.Interface {
+		return false
+	}
+
+	if q.Tunnel != "" && x.Summary().Tunnel != q.Tunnel {
+		return false
+	}
+
+	if q.Anomaly != "" && !containsSubstring(x.Summary().Anomalies, q.Anomaly) {
+		return false
+	}
+
+	if q.Status != nil {
+		if x.Rsp == nil || !q.Status.Contains(x.Rsp.Status) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsSubstring(items []string, sub string) bool {
+	for _, s := range items {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the total number of matched exchanges, and a page of them from the newest to the oldest.
+func (h *History) Query(q HistoryQuery) (total int, page []Exchange) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.each(func(x *Exchange) bool {
+		if q.matches(x) {
+			if total >= q.Offset && (q.Limit <= 0 || len(page) < q.Limit) {
+				page = append(page, *x)
+			}
+			total++
+		}
+		return true
+	})
+
+	return total, page
+}
+
+// Get returns the exchange by its ID.
+func (h *History) Get(id uint64) (x Exchange, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.each(func(e *Exchange) bool {
+		if e.ID == id {
+			x, ok = *e, true
+		}
+		return !ok && e.ID > id
+	})
+
+	return x, ok
+}
+
+// EventsAfter returns the recorded events whose ID is greater than id, in the order of their IDs.
+func (h *History) EventsAfter(id uint64) (events []*HTTPEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.each(func(x *Exchange) bool {
+		for _, e := range []*HTTPEvent{x.Req, x.Rsp} {
+			if e != nil && e.ID > id {
+				events = append(events, e)
+			}
+		}
+		return true
+	})
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
+
+// ExchangeStore is where the exchanges can be queried from, the in-memory History or the SQLiteStore.
+type ExchangeStore interface {
+	// List returns the total number of matched exchanges, and a page of them from the newest to the oldest.
+	List(q HistoryQuery) (total int, items []ExchangeSummary, err error)
+	// Detail returns the exchange with its full headers and bodies.
+	Detail(id uint64) (d ExchangeDetail, found bool, err error)
+}
+
+func (h *History) List(q HistoryQuery) (int, []ExchangeSummary, error) {
+	total, page := h.Query(q)
+	items := make([]ExchangeSummary, 0, len(page))
+	for _, x := range page {
+		items = append(items, x.Summary())
+	}
+	return total, items, nil
+}
+
+func (h *History) Detail(id uint64) (ExchangeDetail, bool, error) {
+	x, ok := h.Get(id)
+	if !ok {
+		return ExchangeDetail{}, false, nil
+	}
+	return x.Detail(), true, nil
+}
+
+// ExchangeSummary is an item of the exchanges list API.
+type ExchangeSummary struct {
+	ID          uint64
+	Time        time.Time
+	Connection  string
+	Interface   string `json:",omitempty"`
+	Tunnel      string `json:",omitempty"`
+	Seq         int
+	Method      string
+	Host        string
+	Path        string
+	Status      int
+	ContentType string
+	ReqSize     int
+	RspSize     int
+	Latency     string
+	Anomalies   []string `json:",omitempty"` // of the request and the response
+}
+
+// Summary summarizes the exchange, without payloads.
+func (x Exchange) Summary() ExchangeSummary {
+	s := ExchangeSummary{ID: x.ID, Time: x.Time}
+	if x.Req != nil {
+		s.Connection, s.Seq, s.Interface, s.Tunnel = x.Req.Connection, x.Req.Seq, x.Req.Interface, x.Req.Tunnel
+		s.Method, s.Host, s.Path = x.Req.Method, x.Req.Host, x.Req.Path
+		s.ReqSize = len(x.Req.Payload)
+		s.Anomalies = append(s.Anomalies, x.Req.Anomalies...)
+	}
+	if x.Rsp != nil {
+		s.Connection, s.Seq, s.Interface, s.Tunnel = x.Rsp.Connection, x.Rsp.Seq, x.Rsp.Interface, x.Rsp.Tunnel
+		s.Status, s.ContentType = x.Rsp.Status, x.Rsp.ContentType
+		s.RspSize = len(x.Rsp.Payload)
+		s.Anomalies = append(s.Anomalies, x.Rsp.Anomalies...)
+	}
+	if x.Req != nil && x.Rsp != nil {
+		s.Latency = x.Rsp.ParseTimestamp().Sub(x.Req.ParseTimestamp()).String()
+	}
+	return s
+}
+
+// MessageDetail is the full request or response of an exchange.
+type MessageDetail struct {
+	Timestamp string
+	Title     string
+	Header    []string
+	Body      string
+	Truncated bool `json:",omitempty"` // the body is cut, like by MAX_BODY_SIZE or by the body limit of the sqlite output
+}
+
+// ExchangeDetail is the result of the exchange detail API.
+type ExchangeDetail struct {
+	ExchangeSummary
+	Req *MessageDetail
+	Rsp *MessageDetail
+}
+
+// Detail returns the exchange with its full headers and bodies.
+func (x Exchange) Detail() ExchangeDetail {
+	d := ExchangeDetail{ExchangeSummary: x.Summary()}
+	if x.Req != nil {
+		d.Req = parseMessageDetail(x.Req)
+	}
+	if x.Rsp != nil {
+		d.Rsp = parseMessageDetail(x.Rsp)
+	}
+	return d
+}
+
+// parseMessageDetail splits the printed message into the title line, header lines and the body.
+func parseMessageDetail(e *HTTPEvent) *MessageDetail {
+	if e.detail != nil {
+		d := *e.detail
+		return &d
+	}
+
+	d := &MessageDetail{Timestamp: e.Timestamp}
+	s := strings.TrimLeft(e.Payload, "\r\n")
+	if strings.HasPrefix(s, "###") { // skip the ### #1 REQ ... line
+		if p := strings.Index(s, "\n"); p >= 0 {
+			s = s[p+1:]
+		} else {
+			s = ""
+		}
+	}
+
+	head, body, found := strings.Cut(s, "\r\n\r\n")
+	if !found {
+		head, body, _ = strings.Cut(s, "\n\n")
+	}
+	d.Body = cutAnnotations(body)
+
+	for i, line := range strings.Split(head, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if i == 0 {
+			d.Title = line
+		} else if n := len(d.Header); n > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			d.Header[n-1] += "\r\n" + line // the obs-fold continuation line
+		} else if line != "" {
+			d.Header = append(d.Header, line)
+		}
+	}
+
+	return d
+}
+
+// messageAnnotations are the prefixes of the annotation lines printed after the body, or instead of it,
+// like // timing: ..., which are not a part of the body.
+var messageAnnotations = []string{
+	"// anomaly: ", "// timing: ", "// decoded: ", "// charset: ", "// body: ", "// incomplete: ", "// auth: ",
+	"// dump body to file:", "// body size:",
+}
+
+// cutAnnotations cuts the annotation lines at the end of the printed body, with the line breaks before them.
+func cutAnnotations(body string) string {
+	for {
+		trimmed := strings.TrimRight(body, "\r\n")
+		i := strings.LastIndexByte(trimmed, '\n') + 1
+		if !hasAnyPrefix(trimmed[i:], messageAnnotations) {
+			return body
+		}
+		body = strings.TrimSuffix(strings.TrimSuffix(trimmed[:i], "\n"), "\r")
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(2, 0)
+	for _, msg := range []string{
+		"\n### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\nGET /a HTTP/1.1\r\nHost: a.com\r\n\r\n",
+		"\n### #1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505464+08:00\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nhello",
+		"\n### #2 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.505447+08:00\r\nPOST /b HTTP/1.1\r\nHost: b.com\r\n\r\n",
+		"\n### #2 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.505464+08:00\r\nHTTP/1.1 500 Internal Server Error\r\n\r\n",
+		"\n### #3 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:11.505447+08:00\r\nGET /c HTTP/1.1\r\nHost: a.com\r\n\r\n",
+	} {
+		e := ParseHTTPEvent(msg)
+		h.Add(&e)
+	}
+
+	total, page := h.Query(HistoryQuery{})
+	assert.Equal(t, 2, total) // #1 is evicted by count
+	assert.Equal(t, "/c", page[0].Req.Path)
+	assert.Equal(t, "/b", page[1].Req.Path)
+
+	status, _ := util.ParseIntSet("500-599")
+	total, page = h.Query(HistoryQuery{Status: status})
+	assert.Equal(t, 1, total)
+	assert.Equal(t, "POST", page[0].Summary().Method)
+
+	x, ok := h.Get(page[0].ID)
+	assert.True(t, ok)
+	d := x.Detail()
+	assert.Equal(t, "POST /b HTTP/1.1", d.Req.Title)
+	assert.Equal(t, []string{"Host: b.com"}, d.Req.Header)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", d.Rsp.Title)
+
+	e := ParseHTTPEvent("\n### GAP#3 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:11.505447+08:00, 5 bytes lost\n")
+	assert.Equal(t, "GAP", e.Event)
+	assert.Equal(t, 3, e.Seq)
+	assert.Equal(t, "2022-04-17T10:58:11.505447+08:00", e.Timestamp)
+	assert.Equal(t, "", e.Interface)
+	h.Add(&e)
+	total, _ = h.Query(HistoryQuery{})
+	assert.Equal(t, 2, total) // events are not recorded
+
+	events := h.EventsAfter(3)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, uint64(4), events[0].ID)
+	assert.Equal(t, uint64(5), events[1].ID)
+}
+
+func TestHistoryMemoryLimit(t *testing.T) {
+	h := NewHistory(100, 2*(exchangeOverhead+200)) // about 2 exchanges
+	for i := 0; i < 3; i++ {
+		e := ParseHTTPEvent("\n### #" + string(rune('1'+i)) + " REQ 127.0.0.1:1-127.0.0.1:2 2022-04-17T10:58:09.505447+08:00\r\n" +
+			"GET /a HTTP/1.1\r\n\r\n" + strings.Repeat("x", 40))
+		h.Add(&e)
+	}
+
+	total, _ := h.Query(HistoryQuery{})
+	assert.Equal(t, 2, total)
+}
+
+func TestParseHTTPEventAnomalies(t *testing.T) {
+	e := ParseHTTPEvent("\n### #1 REQ 127.0.0.1:1-127.0.0.1:2 2022-04-17T10:58:09.505447+08:00\r\nGET /a HTTP/1.1\r\n\r\n" +
+		"\n// anomaly: warn obs-fold: the header X-Fold is folded\r\n\n// anomaly: error bare-lf: bare LF line endings\r\n")
+	assert.Equal(t, []string{"warn obs-fold: the header X-Fold is folded", "error bare-lf: bare LF line endings"}, e.Anomalies)
+
+	e = ParseHTTPEvent("\n### ANOMALY#1 TCP 127.0.0.1:1-127.0.0.1:2 2022-04-17T10:58:09.505447+08:00, warn count-mismatch: 2 requests, 1 responses\r\n")
+	assert.Equal(t, []string{"warn count-mismatch: 2 requests, 1 responses"}, e.Anomalies)
+}
@@ -33,6 +33,7 @@ type Cookie struct {
 	MaxAge   int
 	Secure   bool
 	HttpOnly bool
+	SameSite string // Strict, Lax or None, empty if not specified
 	Raw      string
 	Unparsed []string // Raw text of unparsed attribute-value pairs
 }
@@ -116,6 +117,9 @@ func readSetCookies(h Header) []*Cookie {
 			case "path":
 				c.Path = val
 				continue
+			case "samesite":
+				c.SameSite = val
+				continue
 			}
 			c.Unparsed = append(c.Unparsed, parts[i])
 		}
@@ -176,9 +180,18 @@ func (c *Cookie) String() string {
 	if c.Secure {
 		fmt.Fprintf(&b, "; Secure")
 	}
+	if c.SameSite != "" {
+		fmt.Fprintf(&b, "; SameSite=%s", c.SameSite)
+	}
 	return b.String()
 }
 
+// ReadSetCookies parses all "Set-Cookie" values of the header h.
+func ReadSetCookies(h Header) []*Cookie { return readSetCookies(h) }
+
+// ReadCookies parses all "Cookie" values of the header h.
+func ReadCookies(h Header) []*Cookie { return readCookies(h, "") }
+
 // readCookies parses all "Cookie" values from the header h and
 // returns the successfully parsed Cookies.
 //
@@ -5,6 +5,7 @@
 package httpport
 
 import (
+	"bytes"
 	"io"
 	"net/textproto"
 	"sort"
@@ -16,6 +17,42 @@ import (
 // A Header represents the key-value pairs in an HTTP header.
 type Header map[string][]string
 
+// RawHeader is a header field as it is sent, in the order of the message, with the duplicates kept.
+type RawHeader struct {
+	Name  string // as sent, not canonicalized
+	Value string // without the leading and trailing spaces, the folded lines are joined by a space
+	Line  int    // the line number in the message, the start line is 1, 0 if unknown
+	Folds int    `json:",omitempty"` // the obs-fold continuation lines of the value
+	Raw   string `json:",omitempty"` // the lines as they are sent, joined by CRLF, only if they differ from Name: Value
+}
+
+// newRawHeader parses the header field line kv, which is Name: Value, or a line without colon,
+// raw is the lines as they are sent, with the folds and the spaces.
+func newRawHeader(kv, raw []byte, line, folds int) RawHeader {
+	h := RawHeader{Line: line, Folds: folds}
+	i := bytes.IndexByte(kv, ':')
+	if i < 0 {
+		h.Name = string(kv)
+	} else {
+		h.Name, h.Value = string(kv[:i]), string(trim(kv[i+1:]))
+	}
+	if s := string(raw); s != h.String() {
+		h.Raw = s
+	}
+	return h
+}
+
+// String returns the field like Name: Value.
+func (h RawHeader) String() string { return h.Name + ": " + h.Value }
+
+// RawString returns the field lines as they are sent, with the obs-fold continuation lines and the spaces.
+func (h RawHeader) RawString() string {
+	if h.Raw != "" {
+		return h.Raw
+	}
+	return h.String()
+}
+
 // Add adds the key, value pair to the header.
 // It appends to any existing values associated with key.
 func (h Header) Add(key, value string) {
@@ -20,6 +20,9 @@ type Reader struct {
 	R   *bufio.Reader
 	dot *dotReader
 	buf []byte // a re-usable buffer for readContinuedLineSlice
+
+	folds int    // the continuation lines joined by the last readContinuedLineSlice
+	raw   []byte // the lines read by the last readContinuedLineSlice as they are, joined by CRLF
 }
 
 // NewReader returns a new Reader reading from r.
@@ -119,6 +122,7 @@ func (r *Reader) ReadContinuedLineBytes() ([]byte, error) {
 }
 
 func (r *Reader) readContinuedLineSlice() ([]byte, error) {
+	r.folds = 0
 	// Read the first line.
 	line, err := r.readLineSlice()
 	if err != nil {
@@ -136,6 +140,7 @@ func (r *Reader) readContinuedLineSlice() ([]byte, error) {
 	if r.R.Buffered() > 1 {
 		peek, err := r.R.Peek(1)
 		if err == nil && isASCIILetter(peek[0]) {
+			r.raw = line
 			return trim(line), nil
 		}
 	}
@@ -143,37 +148,25 @@ func (r *Reader) readContinuedLineSlice() ([]byte, error) {
 	// ReadByte or the next readLineSlice will flush the read buffer;
 	// copy the slice into buf.
 	r.buf = append(r.buf[:0], trim(line)...)
+	r.raw = append(r.raw[:0:0], line...)
 
-	// Read continuation lines.
-	for r.skipSpace() > 0 {
+	// Read continuation lines, which start with the spaces kept in raw.
+	for {
+		if peek, err := r.R.Peek(1); err != nil || peek[0] != ' ' && peek[0] != '\t' {
+			break
+		}
 		line, err := r.readLineSlice()
 		if err != nil {
 			break
 		}
 		r.buf = append(r.buf, ' ')
 		r.buf = append(r.buf, trim(line)...)
+		r.raw = append(append(r.raw, "\r\n"...), line...)
+		r.folds++
 	}
 	return r.buf, nil
 }
 
-// skipSpace skips R over all spaces and returns the number of bytes skipped.
-func (r *Reader) skipSpace() int {
-	n := 0
-	for {
-		c, err := r.R.ReadByte()
-		if err != nil {
-			// Bufio will keep err until next read.
-			break
-		}
-		if c != ' ' && c != '\t' {
-			r.R.UnreadByte()
-			break
-		}
-		n++
-	}
-	return n
-}
-
 func (r *Reader) readCodeLine(expectCode int) (code int, continued bool, message string, err error) {
 	line, err := r.ReadLine()
 	if err != nil {
@@ -466,7 +459,10 @@ func (r *Reader) ReadDotLines() ([]string, error) {
 //		"My-Key": {"Value 1", "Value 2"},
 //		"Long-Key": {"Even Longer Value"},
 //	}
-func (r *Reader) ReadMIMEHeader() (textproto.MIMEHeader, []string, error) {
+//
+// The header fields are also returned as they are sent in order, the first one is at the line 2,
+// after the start line of the message.
+func (r *Reader) ReadMIMEHeader() (textproto.MIMEHeader, []RawHeader, error) {
 	// Avoid lots of small slice allocations later by allocating one
 	// large one ahead of time which we'll cut up into smaller
 	// slices. If this isn't big enough later, we allocate small ones.
@@ -476,7 +472,8 @@ func (r *Reader) ReadMIMEHeader() (textproto.MIMEHeader, []string, error) {
 		strs = make([]string, hint)
 	}
 
-	rawHeaders := []string{}
+	rawHeaders := make([]RawHeader, 0, hint)
+	line := 2
 
 	m := make(textproto.MIMEHeader, hint)
 	for {
@@ -484,7 +481,8 @@ func (r *Reader) ReadMIMEHeader() (textproto.MIMEHeader, []string, error) {
 		if len(kv) == 0 {
 			return m, rawHeaders, err
 		}
-		rawHeaders = append(rawHeaders, string(kv))
+		rawHeaders = append(rawHeaders, newRawHeader(kv, r.raw, line, r.folds))
+		line += 1 + r.folds
 
 		// Key ends at first colon; should not have spaces but
 		// they appear in the wild, violating specs, so we
@@ -74,8 +74,8 @@ var reqWriteExcludeHeader = map[string]bool{
 type Request struct {
 	// the first request line
 	RequestLine string
-	// raw header line
-	RawHeaders []string
+	// the header fields as they are sent
+	RawHeaders []RawHeader
 
 	// Method specifies the HTTP method (GET, POST, PUT, etc.).
 	// For client requests an empty string means GET.
@@ -255,14 +255,15 @@ type Request struct {
 	Cancel <-chan struct{}
 }
 
-func (r *Request) GetBody() io.ReadCloser  { return r.Body }
-func (r *Request) GetHost() string         { return r.Host }
-func (r *Request) GetRequestURI() string   { return r.RequestURI }
-func (r *Request) GetPath() string         { return r.URL.Path }
-func (r *Request) GetMethod() string       { return r.Method }
-func (r *Request) GetProto() string        { return r.Proto }
-func (r *Request) GetHeader() http.Header  { return http.Header(r.Header) }
-func (r *Request) GetContentLength() int64 { return r.ContentLength }
+func (r *Request) GetBody() io.ReadCloser     { return r.Body }
+func (r *Request) GetHost() string            { return r.Host }
+func (r *Request) GetRequestURI() string      { return r.RequestURI }
+func (r *Request) GetPath() string            { return r.URL.Path }
+func (r *Request) GetMethod() string          { return r.Method }
+func (r *Request) GetProto() string           { return r.Proto }
+func (r *Request) GetHeader() http.Header     { return http.Header(r.Header) }
+func (r *Request) GetContentLength() int64    { return r.ContentLength }
+func (r *Request) GetRawHeaders() []RawHeader { return r.RawHeaders }
 
 // ProtoAtLeast reports whether the HTTP protocol used
 // in the request is at least major.minor.
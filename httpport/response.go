@@ -27,7 +27,7 @@ var respExcludeHeader = map[string]bool{
 // Response represents the response from an HTTP request.
 type Response struct {
 	StatusLine string
-	RawHeaders []string
+	RawHeaders []RawHeader
 
 	Status     string // e.g. "200 OK"
 	StatusCode int    // e.g. 200
@@ -100,12 +100,12 @@ type Response struct {
 	TLS *tls.ConnectionState
 }
 
-func (r *Response) GetBody() io.ReadCloser  { return r.Body }
-func (r *Response) GetStatusLine() string   { return r.StatusLine }
-func (r *Response) GetRawHeaders() []string { return r.RawHeaders }
-func (r *Response) GetContentLength() int64 { return r.ContentLength }
-func (r *Response) GetHeader() http.Header  { return http.Header(r.Header) }
-func (r *Response) GetStatusCode() int      { return r.StatusCode }
+func (r *Response) GetBody() io.ReadCloser     { return r.Body }
+func (r *Response) GetStatusLine() string      { return r.StatusLine }
+func (r *Response) GetRawHeaders() []RawHeader { return r.RawHeaders }
+func (r *Response) GetContentLength() int64    { return r.ContentLength }
+func (r *Response) GetHeader() http.Header     { return http.Header(r.Header) }
+func (r *Response) GetStatusCode() int         { return r.StatusCode }
 
 // Cookies parses and returns the cookies set in the Set-Cookie headers.
 func (r *Response) Cookies() []*Cookie {
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/bingoohuang/gg/pkg/codec"
 	"github.com/bingoohuang/gg/pkg/flagparse"
+	"github.com/bingoohuang/gg/pkg/man"
 	"github.com/bingoohuang/gg/pkg/netx/freeport"
 	"github.com/bingoohuang/gg/pkg/osx"
 	"github.com/bingoohuang/gg/pkg/rest"
@@ -27,6 +30,7 @@ import (
 	"github.com/bingoohuang/httpdump/util"
 	"github.com/bingoohuang/jj"
 	"github.com/google/gopacket/tcpassembly"
+	"golang.org/x/term"
 	"golang.org/x/time/rate"
 )
 
@@ -34,6 +38,11 @@ import (
 func (App) VersionInfo() string { return v.Version() }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		runQuery(os.Args[2:])
+		return
+	}
+
 	app := &App{}
 	flagparse.Parse(app, flagparse.AutoLoadYaml("c", ""),
 		flagparse.ProcessInit(&initAssets))
@@ -46,29 +55,77 @@ func main() {
 
 	app.print()
 	app.handlerOption = &handler.Option{
-		Resp:     app.Resp,
-		Host:     app.Host,
-		Uri:      app.URI,
-		Method:   app.Method,
-		Status:   app.Status,
-		Level:    app.Level,
-		DumpBody: app.DumpBody,
-		DumpMax:  app.dumpMax,
-		Force:    app.Force,
-		Curl:     app.Curl,
-		Eof:      app.Eof,
-		Debug:    app.Debug,
-		N:        app.N,
-		Num:      app.N,
-		SrcRatio: app.SrcRatio,
-	}
-
-	if app.Rate > 0 {
-		app.handlerOption.RateLimiter = rate.NewLimiter(rate.Every(time.Duration(1e6/(app.Rate))*time.Microsecond), 1)
+		Resp:        app.Resp,
+		Level:       app.Level,
+		DumpBody:    app.DumpBody,
+		DumpMax:     app.dumpMax,
+		Force:       app.Force,
+		Curl:        app.Curl,
+		Eof:         app.Eof,
+		Timing:      app.Timing,
+		Pretty:      app.Pretty,
+		InspectAuth: app.InspectAuth,
+		ShowSecret:  app.ShowSecret,
+		Hexdump:     app.Hexdump,
+		StreamAfter: app.StreamAfter,
+		Debug:       app.Debug,
+		N:           app.N,
+		Num:         app.N,
+		RateLimiter: rate.NewLimiter(rateLimit(app.Rate), 1),
+		Budget:      handler.NewMemoryBudget(app.MemBudget, app.StreamBuffer),
+	}
+	if app.BodyStore != "" {
+		s, err := handler.NewBodyStore(app.BodyStore, app.BodyStoreSize)
+		if err != nil {
+			log.Fatalf("E! invalid -body-store %s: %v", app.BodyStore, err)
+		}
+		app.handlerOption.BodyStore = s
+	}
+	ipFilter, err := util.ParseIPFilter(app.IP)
+	if err != nil {
+		log.Fatalf("E! invalid -ip %s: %v", app.IP, err)
 	}
+	if app.decap, err = util.ParseDecapsulator(app.Decap); err != nil {
+		log.Fatalf("E! invalid -decap %s: %v", app.Decap, err)
+	}
+	if app.filter, err = util.NewPacketFilter(app.Bpf, ipFilter, app.Port, app.decap); err != nil {
+		log.Fatalf("E! %v", err)
+	}
+	anomaly, err := handler.ParseAnomalyFilter(app.Anomaly)
+	if err != nil {
+		log.Fatalf("E! invalid -anomaly %s: %v", app.Anomaly, err)
+	}
+	auth, err := handler.ParseAuthFilter(app.Auth)
+	if err != nil {
+		log.Fatalf("E! invalid -auth %s: %v", app.Auth, err)
+	}
+	if app.Bpf == "" && app.decap != nil { // the -ip is compiled into the bpf, and applied to the inner packets of tunnels
+		app.decap.IPs, app.decap.Ports, ipFilter = ipFilter, app.filter.Ports, nil
+	}
+	app.handlerOption.SetFilter(&handler.Filter{
+		Interface: app.Interface,
+		Tunnel:    app.Tunnel,
+		IP:        ipFilter,
+		Host:      app.Host,
+		Uri:       app.URI,
+		Method:    app.Method,
+		Status:    app.Status,
+		SrcRatio:  app.SrcRatio,
+		Anomaly:   anomaly,
+		Auth:      auth,
+	})
+
 	app.run()
 }
 
+// rateLimit converts the output rate per second to a rate.Limit, non-positive means no limit.
+func rateLimit(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Every(time.Duration(1e6/perSecond) * time.Microsecond)
+}
+
 //go:embed initassets
 var initAssets embed.FS
 
@@ -78,16 +135,25 @@ type App struct {
 	Init      bool   `usage:"init example httpdump.yml/ctl and then exit"`
 	Daemonize bool   `usage:"daemonize and then exit"`
 	Level     string `val:"all" usage:"Output level, url: only url, header: http headers, all: headers and text http body"`
-	Input     string `flag:"i" val:"any" usage:"Interface name or pcap file. If not set, If is any, capture all interface traffics"`
+	Input     string `flag:"i" val:"any" usage:"Interface name, or pcap/pcapng file (.gz/.zst/.xz supported), directory or glob (** supported) of them, - for stdin. If not set, If is any, capture all interface traffics"`
 
-	IP   string `usage:"Filter by ip, or ip range like 1.1.1.1-1.1.1.3, or multiple ip like 1.1.1.1,1.1.1.3, if either src or dst ip is matched, the packet will be processed"`
+	IP   string `usage:"Filter by IPv4/IPv6 ip, CIDR like 10.0.0.0/8, ip range like 1.1.1.1-1.1.1.3, exclusion like !10.1.2.3, or multiple of them like 1.1.1.1,2001:db8::/32, if either src or dst ip is matched and none is excluded, the packet will be processed"`
 	Port string `usage:"Filter by port, or port range like 8001-8003, or multiple ports like 8001,8003, if either source or target port is matched, the packet will be processed"`
 	N    int32  `usage:"Max Requests and Responses captured, and then exits"`
-	Bpf  string `usage:"Customized bpf, if it is set, -ip -port will be suppressed, e.g. tcp and ((dst host 1.2.3.4 and port 80) || (src host 1.2.3.4 and src port 80))"`
+	Bpf  string `usage:"Customized bpf, if it is set, -port will be suppressed and -ip is applied in user space, e.g. tcp and ((dst host 1.2.3.4 and port 80) || (src host 1.2.3.4 and src port 80))"`
 
 	Chan    uint `val:"10240" usage:"Channel size to buffer tcp packets"`
+	Shards  int  `val:"1" usage:"Number of tcp assembler shards, each in its own goroutine, the connections are spread over them by the hash of the 4-tuple, 0 for the number of CPUs, the packets are decoded before by one goroutine for each capture socket, see -fanout"`
 	OutChan uint `val:"40960" usage:"Output channel size to buffer tcp packets"`
 
+	Interface string `usage:"Filter by the capture interface name of devices or pcapng files, using wildcard match(*, ?)"`
+	Decap     string `val:"none" usage:"Decapsulate the tunnels to assemble the inner tcp, all, none, or some of vlan,gre,erspan,geneve,vxlan:4789/8472 (VXLAN on the UDP ports), the capture filter is widened to the tunnels given"`
+	Capture   string `usage:"Capture source of devices, pcap (libpcap, cgo builds only) or afpacket (linux AF_PACKET TPACKET_V3, no libpcap), the default is pcap if available"`
+	Fanout    int    `val:"1" usage:"Number of AF_PACKET sockets in the fanout group of each device, the packets are distributed by the flow hash, each socket is decoded in its own goroutine and -shards is raised to the number of sockets"`
+	RingSize  uint64 `size:"true" val:"64MiB" usage:"Memory mapped ring buffer size of each AF_PACKET socket"`
+
+	Tunnel string `usage:"Filter by the outermost tunnel like vxlan:100, vlan:20, gre:*, erspan:*, geneve:*, using wildcard match(*, ?)"`
+
 	Host    string `usage:"Filter by request host, using wildcard match(*, ?)"`
 	URI     string `usage:"Filter by request url path, using wildcard match(*, ?)"`
 	Method  string `usage:"Filter by request method, multiple by comma"`
@@ -95,21 +161,46 @@ type App struct {
 
 	Status util.IntSetFlag `usage:"Filter by response status code. Can use range. eg: 200, 200-300 or 200:300-400"`
 
-	Web        bool   `usage:"Start web server for HTTP requests and responses event"`
-	WebPort    int    `usage:"Web server port if web is enable"`
-	WebContext string `usage:"Web server context path if web is enable"`
-	Resp       int    `flag:"r" count:"true" usage:"-r: print response, -rr: print response after relative request "`
-	Force      bool   `usage:"Force print unknown content-type http body even if it seems not to be text content"`
-	Curl       bool   `usage:"Output an equivalent curl command for each http request"`
-	Version    bool   `flag:"v" usage:"Print version info and exit"`
-	Eof        bool   `usage:"Output EOF connection info or not."`
-	Debug      bool   `usage:"Enable debugging."`
+	Anomaly string `usage:"Filter by the protocol anomalies (fast mode), kinds or severities by comma, eg: error, warn, cl-te-conflict,bare-lf or * for any"`
+	Auth    string `usage:"Filter by the auth material decoded, all of the conditions by comma, eg: jwt.sub=alice, jwt.iss=*example.com,jwt.expired=false, basic.user=admin, cookie.session or jwt for any"`
+
+	Web         bool   `usage:"Start web server for HTTP requests and responses event"`
+	WebPort     int    `usage:"Web server port if web is enable"`
+	WebContext  string `usage:"Web server context path if web is enable"`
+	Resp        int    `flag:"r" count:"true" usage:"-r: print response, -rr: print response after relative request "`
+	Force       bool   `usage:"Force print unknown content-type http body even if it seems not to be text content"`
+	Curl        bool   `usage:"Output an equivalent curl command for each http request"`
+	Version     bool   `flag:"v" usage:"Print version info and exit"`
+	Eof         bool   `usage:"Output EOF connection info or not."`
+	Timing      bool   `usage:"Output the network timing of each response and a summary of each connection closed, fast mode only, rejected in std mode"`
+	Pretty      bool   `usage:"Pretty print the bodies, indent json and xml, decode x-www-form-urlencoded into key value lines"`
+	Color       string `val:"auto" usage:"Colorize the pretty bodies and the auth material, auto: only when the output is stdout of a terminal, always or never"`
+	InspectAuth bool   `usage:"Output the Basic credentials, the JWT headers and claims, and the cookies with their attributes decoded from the headers"`
+	ShowSecret  bool   `usage:"Show the passwords of the Basic credentials decoded by -inspect-auth instead of masking them"`
+	Hexdump     int    `val:"256" usage:"Bytes of the binary bodies previewed in hexdump -C format, 0 for the length only"`
+	Debug       bool   `usage:"Enable debugging."`
+
+	ProtoSet  string `usage:"Protobuf descriptor set files by comma, generated by protoc --include_imports --descriptor_set_out, to decode the protobuf bodies typed"`
+	ProtoType string `usage:"Message type of the protobuf bodies whose Content-Type has no proto or messageType parameter, like pkg.Message, with -proto-set"`
 
 	DumpBody string   `usage:"Prefix file of dump http request/response body, empty for no dump, like solr, solr:10 (max 10)"`
 	Mode     string   `val:"fast" usage:"std/fast"`
 	Output   []string `usage:"\n        File output, like dump-yyyy-MM-dd-HH-mm.http, suffix like :32m for max size, suffix :append for append mode\n        Or Relay http address, eg http://127.0.0.1:5002\n        Or any of stdout/stderr/stdout:log"`
 
-	Idle time.Duration `val:"4m" usage:"Idle time to remove connection if no package received"`
+	BodyStore     string `usage:"Directory to store the bodies content-addressed by sha256 like dir/ab/ab12...ef.json, deduplicated, and referenced by the output"`
+	BodyStoreSize uint64 `size:"true" val:"1GiB" usage:"Max total size of the bodies in -body-store, the least recently stored are removed when exceeded, 0 for no limit"`
+
+	Idle        time.Duration `val:"4m" usage:"Idle time to remove connection if no package received"`
+	StreamAfter time.Duration `usage:"Emit the chunked responses not ended in the duration chunk by chunk as they are captured, like 10s, 0 for none of them, the text/event-stream ones are always emitted event by event at once, fast mode only"`
+
+	MemBudget    uint64 `size:"true" val:"512MiB" usage:"Max payload bytes buffered for the reassembly of all connections, the connections buffering the most are evicted when exceeded, 0 for no limit"`
+	StreamBuffer uint64 `size:"true" val:"16MiB" usage:"Max payload bytes buffered for each direction of a connection, the message or the unacknowledged data exceeding it is truncated, 0 for no limit"`
+
+	OutputPcap     string `usage:"Pcap file to write the raw packets of the connections which pass the filters, suffix like :100M for max size to rotate"`
+	PcapConnBuffer uint64 `size:"true" val:"1MiB" usage:"Max packets bytes buffered for each connection before it passes the filters for -output-pcap"`
+
+	HistoryNum  int    `val:"1000" usage:"Max number of recent exchanges kept in memory for the web history API"`
+	HistorySize uint64 `size:"true" val:"64MiB" usage:"Max memory of recent exchanges kept for the web history API"`
 
 	dumpMax uint32
 
@@ -126,11 +217,15 @@ type App struct {
 
 	Pprof string `usage:"pprof address to listen on, not activate pprof if empty, eg. :6060"`
 
+	ControlToken string `usage:"Bearer token of the runtime control API {web-context}/api/control, empty to disable the API"`
+
 	Rate        float64 `usage:"rate limit output per second"`
 	SrcRatio    float64 `val:"1" usage:"source ratio, e.g. 0.1 should be (0,1]"`
 	ReplayRatio float64 `val:"1" usage:"replay ratio, e.g. 2 to double replay, 0.1 to replay only 10% requests"`
 
 	handlerOption *handler.Option
+	decap         *util.Decapsulator
+	filter        *util.PacketFilter
 
 	ReplayN        int     `flag:"-"`
 	ReplayFraction float64 `flag:"-"`
@@ -145,17 +240,20 @@ func (o *App) run() {
 	if len(o.Output) == 0 {
 		o.Output = []string{"stdout:log"}
 	}
+	o.handlerOption.Color = (o.Pretty || o.InspectAuth) && o.useColor()
 
-	senders := make(handler.Senders, 0, len(o.Output))
+	outputs := newOutputs(func(out string) (handler.Sender, error) { return o.createSender(ctx, wg, out) })
 	for _, out := range o.Output {
-		if addr, ok := rest.MaybeURL(out); ok {
-			sender := replay.CreateSender(ctx, wg, o.Method, o.File, o.Verbose, addr, o.OutChan, o.ReplayN, o.ReplayFraction)
-			senders = append(senders, sender)
-		} else {
-			senders = append(senders, rotate.NewQueueWriter(out,
-				rotate.WithContext(ctx), rotate.WithOutChanSize(int(o.OutChan)), rotate.WithAppend(true)))
+		if err := outputs.Add(out); err != nil {
+			log.Fatalf("E! %v", err)
 		}
 	}
+	senders := handler.Senders{outputs}
+
+	ctl := &Controller{app: o, outputs: outputs, token: o.ControlToken}
+	if o.Config != "" {
+		go ctl.WatchConfig(ctx, o.Config)
+	}
 
 	if o.Web {
 		var port int
@@ -165,12 +263,16 @@ func (o *App) run() {
 			port = freeport.Port()
 		}
 
-		stream := NewSSEStream()
 		contextPath := path.Join("/", o.WebContext)
 		log.Printf("contextPath: %s", contextPath)
 
-		http.Handle("/", http.HandlerFunc(SSEWebHandler(contextPath, stream)))
-		senders = append(senders, &SSESender{stream: stream})
+		history := NewHistory(o.HistoryNum, o.HistorySize)
+		sseSender := NewSSESender(history, o.Debug)
+		http.Handle("/", http.HandlerFunc(SSEWebHandler(contextPath, sseSender, history, outputs.SQLiteStore)))
+		if ctl.token != "" {
+			http.Handle(path.Join(contextPath, "/api/control"), ctl)
+		}
+		senders = append(senders, sseSender)
 		log.Printf("start to listen on %d", port)
 		go func() {
 			addr := fmt.Sprintf(":%d", port)
@@ -184,14 +286,27 @@ func (o *App) run() {
 	var isPcapFile bool
 	var waitLoop sync.WaitGroup
 	if o.File == "" {
-		pcapFile, packets, err := util.CreatePacketsChan(o.Input, o.Bpf, o.Host, o.IP, o.Port)
+		if o.handlerOption.Budget != nil {
+			go o.reportBudget(ctx)
+		}
+		conf := util.CaptureConfig{Source: o.Capture, Fanout: o.Fanout, RingSize: o.RingSize}
+		pcapFile, sources, err := util.CreatePacketsChan(ctx, o.Input, o.Host, o.filter, conf)
 		if err != nil {
 			panic(err)
 		}
+		assembler := o.createAssembler(ctx, senders, len(sources))
+		if o.OutputPcap != "" {
+			w, err := handler.NewPcapWriter(o.OutputPcap, o.PcapConnBuffer, o.handlerOption, assembler)
+			if err != nil {
+				panic(err)
+			}
+			o.handlerOption.OnMatch = w.Match
+			assembler = w
+		}
 		waitLoop.Add(1)
 		go func() {
 			defer waitLoop.Done()
-			util.LoopPackets(ctx, packets, o.createAssembler(ctx, senders), o.Idle)
+			util.LoopPackets(ctx, sources, assembler, o.Idle, o.decap)
 		}()
 		isPcapFile = pcapFile
 	}
@@ -204,25 +319,94 @@ func (o *App) run() {
 		time.Sleep(3 * time.Second)
 	}
 
+	if st := handler.TCPStats(); !st.IsZero() {
+		log.Printf("W! tcp reassembly %s", st)
+	}
+
 	_ = senders.Close()
 	wg.Wait()
 }
 
-func (o *App) createAssembler(ctx context.Context, sender handler.Sender) util.Assembler {
-	switch o.Mode {
-	case "fast":
-		h := &handler.ConnectionHandlerFast{Context: ctx, Option: o.handlerOption, Sender: sender}
-		return handler.NewTCPAssembler(h, o.Chan, o.Resp)
-	default:
-		return o.createTCPStdAssembler(ctx, sender)
+func (o *App) createSender(ctx context.Context, wg *sync.WaitGroup, out string) (handler.Sender, error) {
+	if IsSQLiteOutput(out) {
+		return NewSQLiteSender(wg, out, o.OutChan)
+	}
+	if addr, ok := rest.MaybeURL(out); ok {
+		return replay.CreateSender(ctx, wg, o.Method, o.File, o.Verbose, addr, o.OutChan, o.ReplayN, o.ReplayFraction), nil
+	}
+
+	return rotate.NewQueueWriter(out,
+		rotate.WithContext(ctx), rotate.WithOutChanSize(int(o.OutChan)), rotate.WithAppend(true)), nil
+}
+
+// createAssembler creates the assembler of the shards, at least one shard for each of the sources,
+// which are decoded concurrently, like the sockets of a fanout group.
+func (o *App) createAssembler(ctx context.Context, sender handler.Sender, sources int) util.Assembler {
+	shards := o.Shards
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+	if shards < sources {
+		shards = sources
 	}
+	return util.NewShardedAssembler(shards, o.Chan, func() util.Assembler {
+		switch o.Mode {
+		case "fast":
+			h := &handler.ConnectionHandlerFast{Context: ctx, Option: o.handlerOption, Sender: sender}
+			return handler.NewTCPAssembler(h, o.Chan, o.Resp, o.handlerOption.Budget)
+		default:
+			return o.createTCPStdAssembler(ctx, sender, shards)
+		}
+	})
 }
 
-func (o *App) createTCPStdAssembler(ctx context.Context, printer handler.Sender) *handler.TcpStdAssembler {
+func (o *App) createTCPStdAssembler(ctx context.Context, printer handler.Sender, shards int) *handler.TcpStdAssembler {
 	f := handler.NewFactory(ctx, o.handlerOption, printer)
 	p := tcpassembly.NewStreamPool(f)
 	assembler := tcpassembly.NewAssembler(p)
-	return &handler.TcpStdAssembler{Assembler: assembler}
+	// the std mode buffers the out of order packets in the pages of about 1900 bytes, limited in each shard,
+	// so the budget is divided by the shards
+	const pageBytes = 1900
+	if o.MemBudget > 0 {
+		assembler.MaxBufferedPagesTotal = max(int(o.MemBudget/pageBytes/uint64(shards)), 1)
+	}
+	assembler.MaxBufferedPagesPerConnection = int(o.StreamBuffer / pageBytes)
+	return &handler.TcpStdAssembler{Assembler: assembler, Factory: f}
+}
+
+// reportBudget logs how often the memory budget truncates the streams and evicts the connections.
+func (o *App) reportBudget(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var last handler.BudgetStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st := o.handlerOption.Budget.Stats()
+			if st.Truncated != last.Truncated || st.Evicted != last.Evicted {
+				log.Printf("W! memory budget: %s buffered, %d truncated, %d evicted in the last minute",
+					man.IBytes(uint64(st.Used)), st.Truncated-last.Truncated, st.Evicted-last.Evicted)
+			}
+			last = st
+		}
+	}
+}
+
+// useColor tells whether to colorize by -color, auto only when the only output is stdout of a terminal,
+// as the colors are noise in the files, relays and the web UI.
+func (o *App) useColor() bool {
+	switch o.Color {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return !o.Web && len(o.Output) == 1 && strings.HasPrefix(o.Output[0], "stdout") &&
+			term.IsTerminal(int(os.Stdout.Fd()))
+	}
 }
 
 // PostProcess does some post processes.
@@ -233,6 +417,22 @@ func (o *App) PostProcess() {
 	if o.ReplayRatio <= 0 {
 		log.Fatalf("SrcRatio %f is invalid, should be (0,∞)", o.ReplayRatio)
 	}
+	if o.Color != "auto" && o.Color != "always" && o.Color != "never" {
+		log.Fatalf("-color %s is invalid, should be auto, always or never", o.Color)
+	}
+	if o.Timing && o.Mode != "fast" {
+		log.Fatalf("-timing requires -mode fast, the std mode does not see the tcp packets of the messages")
+	}
+	if o.Hexdump < 0 {
+		log.Fatalf("-hexdump %d is invalid, should be >= 0", o.Hexdump)
+	}
+	if o.ProtoSet != "" {
+		if err := handler.LoadProtoTypes(strings.Split(o.ProtoSet, ","), o.ProtoType); err != nil {
+			log.Fatalf("-proto-set %s is invalid: %v", o.ProtoSet, err)
+		}
+	} else if o.ProtoType != "" {
+		log.Fatalf("-proto-type %s requires -proto-set", o.ProtoType)
+	}
 	o.ReplayN = int(o.ReplayRatio)
 	o.ReplayFraction = o.ReplayRatio - float64(o.ReplayN)
 
@@ -259,6 +459,9 @@ func (o *App) processDumpBody() {
 }
 
 func (o App) print() {
+	if o.ControlToken != "" { // masked in the copy printed only, not to leak the token to the log
+		o.ControlToken = "******"
+	}
 	s := codec.Json(o)
 	s, _ = jj.SetBytes(s, "Idle", o.Idle.String())
 	log.Printf("Options: %s", s)
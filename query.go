@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bingoohuang/httpdump/util"
+)
+
+// runQuery implements the query subcommand, which reads the database written by a sqlite output, e.g.
+// httpdump query -db capture.db -path /api -status 500-599 -from 2024-04-01T00:00:00Z
+// httpdump query -db capture.db -id 42
+// httpdump query -db capture.db -sql "SELECT template, COUNT(*), AVG(latency_ms) FROM exchange GROUP BY template"
+func runQuery(args []string) {
+	f := flag.NewFlagSet("httpdump query", flag.ExitOnError)
+	db := f.String("db", "capture.db", "sqlite database file written by -output sqlite:///path/capture.db")
+	method := f.String("method", "", "Filter by request method")
+	urlPath := f.String("path", "", "Filter by sub string of the request path")
+	host := f.String("host", "", "Filter by sub string of the request host")
+	iface := f.String("interface", "", "Filter by the capture interface")
+	tunnel := f.String("tunnel", "", "Filter by the outermost tunnel, like vxlan:100")
+	anomaly := f.String("anomaly", "", "Filter by sub string of the anomalies, like cl-te-conflict or error")
+	status := f.String("status", "", "Filter by response status code, like 200, 200-300 or 200,300-400")
+	from := f.String("from", "", "Filter by time from, RFC3339 or a duration ago like 1h")
+	to := f.String("to", "", "Filter by time to, RFC3339 or a duration ago like 10m")
+	offset := f.Int("offset", 0, "Offset of the result")
+	limit := f.Int("limit", 100, "Max number of the result, 0 for no limit")
+	id := f.Uint64("id", 0, "Print the full request and response of the exchange with the ID")
+	rawSQL := f.String("sql", "", "Run the raw sql against the exchange table and print the rows")
+	asJSON := f.Bool("json", false, "Print in json")
+	_ = f.Parse(args)
+
+	if err := query(*db, *method, *urlPath, *host, *iface, *tunnel, *anomaly, *status, *from, *to, *offset, *limit, *id, *rawSQL, *asJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "query failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func query(db, method, urlPath, host, iface, tunnel, anomaly, status, from, to string, offset, limit int, id uint64, rawSQL string, asJSON bool) error {
+	if _, err := os.Stat(db); err != nil {
+		return err
+	}
+
+	s, err := OpenSQLiteReader(db)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	switch {
+	case rawSQL != "":
+		return s.printSQL(rawSQL, asJSON)
+	case id > 0:
+		d, ok, err := s.Detail(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("exchange %d not found", id)
+		}
+		if asJSON {
+			return printJSON(d)
+		}
+		printDetail(d)
+		return nil
+	}
+
+	q := HistoryQuery{Method: method, Path: urlPath, Host: host, Interface: iface, Tunnel: tunnel, Anomaly: anomaly,
+		Offset: offset, Limit: limit}
+	if status != "" {
+		if q.Status, err = util.ParseIntSet(status); err != nil {
+			return fmt.Errorf("invalid status %q: %w", status, err)
+		}
+	}
+	if q.From, err = parseQueryTime(from); err != nil {
+		return fmt.Errorf("invalid from %q: %w", from, err)
+	}
+	if q.To, err = parseQueryTime(to); err != nil {
+		return fmt.Errorf("invalid to %q: %w", to, err)
+	}
+
+	total, items, err := s.List(q)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(map[string]any{"Total": total, "Offset": offset, "Limit": limit, "Items": items})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tMETHOD\tSTATUS\tLATENCY\tHOST\tURL")
+	for _, x := range items {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			x.ID, x.Time.Format(time.RFC3339Nano), x.Method, x.Status, x.Latency, x.Host, x.Path)
+	}
+	_ = w.Flush()
+	fmt.Printf("%d of %d exchanges\n", len(items), total)
+	return nil
+}
+
+// parseQueryTime parses RFC3339 time, or a duration like 1h as the time of that long ago.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printDetail(d ExchangeDetail) {
+	for _, a := range d.Anomalies {
+		fmt.Printf("// anomaly: %s\n", a)
+	}
+	for _, m := range []*MessageDetail{d.Req, d.Rsp} {
+		if m == nil {
+			continue
+		}
+		fmt.Printf("### #%d %s %s\n%s\n", d.ID, d.Connection, m.Timestamp, m.Title)
+		for _, h := range m.Header {
+			fmt.Println(h)
+		}
+		fmt.Printf("\n%s\n\n", m.Body)
+	}
+}
+
+// printSQL runs the raw sql and prints the rows, tab separated with a header line, or as json objects.
+func (s *SQLiteStore) printSQL(query string, asJSON bool) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !asJSON {
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		if asJSON {
+			m := make(map[string]any, len(columns))
+			for i, c := range columns {
+				if b, ok := values[i].([]byte); ok {
+					values[i] = string(b)
+				}
+				m[c] = values[i]
+			}
+			if err := json.NewEncoder(os.Stdout).Encode(m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		cells := make([]string, len(values))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			cells[i] = fmt.Sprint(v)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+
+	_ = w.Flush()
+	return rows.Err()
+}
@@ -60,7 +60,10 @@ func (c *Config) StartReplay(ctx context.Context, payloadCh <-chan string) error
 		select {
 		case <-ctx.Done():
 			return nil
-		case payload := <-payloadCh:
+		case payload, ok := <-payloadCh:
+			if !ok { // sender closed
+				return nil
+			}
 			if err := options.ReadPayloads(strings.NewReader(payload)); err != nil {
 				log.Printf("E! failed to read payloads, error: %v", err)
 			}
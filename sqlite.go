@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bingoohuang/gg/pkg/man"
+	"github.com/bingoohuang/httpdump/handler"
+	"github.com/bingoohuang/httpdump/httpport"
+	"github.com/bingoohuang/httpdump/util"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS exchange (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	connection  TEXT    NOT NULL,
+	interface   TEXT,
+	tunnel      TEXT,             -- the outermost tunnel like vxlan:100
+	seq         INTEGER NOT NULL,
+	time        INTEGER NOT NULL, -- unix nano of the first message
+	req_time    INTEGER,
+	rsp_time    INTEGER,
+	method      TEXT,
+	host        TEXT,
+	url         TEXT,
+	path        TEXT,
+	template    TEXT,             -- path with the variable segments normalized, like /users/{int}
+	status      INTEGER,
+	latency_ms  REAL,
+	content_type TEXT,
+	req_header  TEXT,             -- json array of the header fields as they are sent in order, like [{"Name":"Host","Value":"a.com","Line":2}]
+	rsp_header  TEXT,
+	req_body    BLOB,
+	rsp_body    BLOB,
+	req_size    INTEGER,
+	rsp_size    INTEGER,
+	anomalies   TEXT,             -- of the request and the response, one per line
+	req_title   TEXT,             -- the start lines as they are sent, like GET /users/123 HTTP/1.1
+	rsp_title   TEXT,
+	req_truncated INTEGER,        -- 1 if the body stored is cut
+	rsp_truncated INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_exchange_time ON exchange(time);
+CREATE INDEX IF NOT EXISTS idx_exchange_path ON exchange(path);
+CREATE INDEX IF NOT EXISTS idx_exchange_template ON exchange(template);
+CREATE INDEX IF NOT EXISTS idx_exchange_status ON exchange(status);
+`
+
+// SQLiteStore persists the exchanges into an embedded SQLite database, like -output sqlite:///path/capture.db,
+// so that they can be queried later by the web UI or by the httpdump query subcommand.
+type SQLiteStore struct {
+	db   *sql.DB
+	file string
+
+	bodyMax int
+	maxAge  time.Duration
+	maxSize uint64
+
+	ch        chan *HTTPEvent
+	done      chan struct{}
+	discarded atomic.Uint64
+
+	// pending maps the connection.seq of the requests to their row ids waiting for the responses,
+	// only accessed by the writer goroutine.
+	pending map[string]pendingRow
+}
+
+type pendingRow struct {
+	id        int64
+	reqTime   time.Time
+	anomalies []string
+}
+
+// pendingTimeout is how long a request waits for its response before it is forgotten.
+const pendingTimeout = 5 * time.Minute
+
+// IsSQLiteOutput tells whether the output is a sqlite database, like sqlite:///path/capture.db.
+func IsSQLiteOutput(out string) bool {
+	return strings.HasPrefix(out, "sqlite://")
+}
+
+// NewSQLiteSender creates a SQLiteStore by the output spec, like sqlite:///path/capture.db?body=64KiB&maxAge=72h&maxSize=1GiB,
+// body is the max bytes of each body stored, maxAge and maxSize are the retention limits, zero means no limit.
+func NewSQLiteSender(wg *sync.WaitGroup, out string, queueSize uint) (*SQLiteStore, error) {
+	u, err := url.Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("parse sqlite output %s: %w", out, err)
+	}
+
+	s, err := OpenSQLiteStore(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.bodyMax = 64 * 1024
+	q := u.Query()
+	if v := q.Get("body"); v != "" {
+		n, err := man.ParseBytes(v)
+		if err != nil {
+			_ = s.db.Close()
+			return nil, fmt.Errorf("invalid body %q of %s: %w", v, out, err)
+		}
+		s.bodyMax = int(n)
+	}
+	if v := q.Get("maxAge"); v != "" {
+		if s.maxAge, err = time.ParseDuration(v); err != nil {
+			_ = s.db.Close()
+			return nil, fmt.Errorf("invalid maxAge %q of %s: %w", v, out, err)
+		}
+	}
+	if v := q.Get("maxSize"); v != "" {
+		if s.maxSize, err = man.ParseBytes(v); err != nil {
+			_ = s.db.Close()
+			return nil, fmt.Errorf("invalid maxSize %q of %s: %w", v, out, err)
+		}
+	}
+
+	s.ch = make(chan *HTTPEvent, queueSize)
+	s.done = make(chan struct{})
+	s.pending = make(map[string]pendingRow)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.loop()
+	}()
+
+	return s, nil
+}
+
+// OpenSQLiteStore opens (or creates) the database file with its schema, without starting to write into it.
+func OpenSQLiteStore(file string) (*SQLiteStore, error) {
+	s, err := openSQLite(file, "_pragma=journal_mode(WAL)&_pragma=auto_vacuum(INCREMENTAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec(sqliteSchema); err != nil {
+		_ = s.db.Close()
+		return nil, fmt.Errorf("create sqlite schema %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// OpenSQLiteReader opens the database file written by a sqlite output read-only, like for the query subcommand.
+func OpenSQLiteReader(file string) (*SQLiteStore, error) {
+	return openSQLite(file, "mode=ro")
+}
+
+func openSQLite(file, params string) (*SQLiteStore, error) {
+	if file == "" {
+		return nil, fmt.Errorf("sqlite database file is required")
+	}
+
+	db, err := sql.Open("sqlite", "file:"+file+"?_pragma=busy_timeout(5000)&"+params)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", file, err)
+	}
+	// one connection serializes the writes and the queries of this process, other processes wait by busy_timeout.
+	db.SetMaxOpenConns(1)
+	return &SQLiteStore{db: db, file: file}, nil
+}
+
+// Send stores the requests, the responses and the stream events of the responses, in the text or the json format,
+// the other events like EOF are not stored.
+func (s *SQLiteStore) Send(msg string, _ bool) {
+	e := ParseHTTPEvent(msg)
+	if !e.Req && !e.Rsp || e.Event != "" && !e.IsStreamEvent() {
+		return
+	}
+
+	select {
+	case s.ch <- &e:
+	default:
+		s.discarded.Add(1)
+	}
+}
+
+func (s *SQLiteStore) Close() error {
+	if s.ch != nil {
+		close(s.ch)
+		<-s.done
+	}
+	return s.db.Close()
+}
+
+var _ handler.Sender = (*SQLiteStore)(nil)
+
+// maxBatch is the max number of events written in one transaction.
+const maxBatch = 256
+
+// loop writes the events in batches until the store is closed, so the messages in flight are still written on exit.
+func (s *SQLiteStore) loop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-s.ch:
+			if !ok {
+				return
+			}
+
+			batch, closed := []*HTTPEvent{e}, false
+		drain:
+			for len(batch) < maxBatch {
+				select {
+				case e, ok := <-s.ch:
+					if !ok {
+						closed = true
+						break drain
+					}
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+
+			if err := s.write(batch); err != nil {
+				log.Printf("E! write sqlite %s failed: %v", s.file, err)
+			}
+			if closed {
+				return
+			}
+		case <-ticker.C:
+			s.expirePending()
+			if err := s.retain(); err != nil {
+				log.Printf("E! sqlite %s retention failed: %v", s.file, err)
+			}
+			if n := s.discarded.Swap(0); n > 0 {
+				log.Printf("W! sqlite %s discarded %d messages, the writing is too slow", s.file, n)
+			}
+		}
+	}
+}
+
+func (s *SQLiteStore) write(batch []*HTTPEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range batch {
+		if err := s.writeEvent(tx, e); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) writeEvent(tx *sql.Tx, e *HTTPEvent) error {
+	d := parseMessageDetail(e)
+	if e.IsStreamEvent() {
+		return s.writeStreamEvent(tx, e, d)
+	}
+
+	t := e.ParseTimestamp()
+	header, err := json.Marshal(rawHeaders(d.Header))
+	if err != nil {
+		return err
+	}
+	body, truncated := truncateBody(d.Body, s.bodyMax)
+	truncated = truncated || d.Truncated
+
+	key := e.Connection + "." + strconv.Itoa(e.Seq)
+	if e.Req {
+		r, err := tx.Exec(`INSERT INTO exchange(connection, interface, tunnel, seq, time, req_time, method, host, url, path,
+			template, req_title, req_header, req_body, req_size, req_truncated, anomalies)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Connection, e.Interface, e.Tunnel, e.Seq, t.UnixNano(), t.UnixNano(), e.Method, e.Host, e.Path, urlPath(e.Path),
+			util.PathTemplate(e.Path), d.Title, string(header), []byte(body), len(d.Body), truncated,
+			anomaliesColumn(e.Anomalies))
+		if err != nil {
+			return err
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			return err
+		}
+		s.pending[key] = pendingRow{id: id, reqTime: t, anomalies: e.Anomalies}
+		return nil
+	}
+
+	if p, ok := s.pending[key]; ok {
+		delete(s.pending, key)
+		latency := float64(t.Sub(p.reqTime)) / float64(time.Millisecond)
+		_, err := tx.Exec(`UPDATE exchange SET rsp_time = ?, status = ?, latency_ms = ?, content_type = ?, rsp_title = ?,
+			rsp_header = ?, rsp_body = ?, rsp_size = ?, rsp_truncated = ?, anomalies = ? WHERE id = ?`,
+			t.UnixNano(), e.Status, latency, e.ContentType, d.Title, string(header), []byte(body), len(d.Body), truncated,
+			anomaliesColumn(append(p.anomalies, e.Anomalies...)), p.id)
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO exchange(connection, interface, tunnel, seq, time, rsp_time, status, content_type,
+		rsp_title, rsp_header, rsp_body, rsp_size, rsp_truncated, anomalies) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Connection, e.Interface, e.Tunnel, e.Seq, t.UnixNano(), t.UnixNano(), e.Status, e.ContentType, d.Title,
+		string(header), []byte(body), len(d.Body), truncated, anomaliesColumn(e.Anomalies))
+	return err
+}
+
+// writeStreamEvent appends the body of the stream event to the response emitted incrementally,
+// and sets the size of the response by the summary of the stream.
+func (s *SQLiteStore) writeStreamEvent(tx *sql.Tx, e *HTTPEvent, d *MessageDetail) error {
+	var id int64
+	var stored []byte
+	var truncated sql.NullBool
+	err := tx.QueryRow(`SELECT id, rsp_body, rsp_truncated FROM exchange WHERE connection = ? AND seq = ?
+		AND rsp_time IS NOT NULL ORDER BY id DESC LIMIT 1`, e.Connection, e.Seq).Scan(&id, &stored, &truncated)
+	if err == sql.ErrNoRows { // the head of the response is not stored, like it is discarded for the slow writing
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if e.Event == EventStream {
+		_, err = tx.Exec(`UPDATE exchange SET rsp_size = ?, rsp_truncated = ? WHERE id = ?`,
+			e.StreamSize, truncated.Bool || int64(len(stored)) < e.StreamSize, id)
+		return err
+	}
+
+	body := d.Body
+	if e.Event == EventSSE && body != "" {
+		body += "\n\n" // the blank line ending the event, trimmed in the output
+	}
+	body, cut := truncateBody(string(stored)+body, s.bodyMax)
+	_, err = tx.Exec(`UPDATE exchange SET rsp_body = ?, rsp_size = COALESCE(rsp_size, 0) + ?, rsp_truncated = ?
+		WHERE id = ?`, []byte(body), e.StreamSize, truncated.Bool || cut, id)
+	return err
+}
+
+// truncateBody cuts the body to at most limit bytes, not in the middle of a UTF-8 sequence, negative for no limit.
+func truncateBody(body string, limit int) (string, bool) {
+	if limit < 0 || len(body) <= limit {
+		return body, false
+	}
+	n := limit
+	for n > 0 && n > limit-utf8.UTFMax && !utf8.RuneStart(body[n]) {
+		n--
+	}
+	if !utf8.RuneStart(body[n]) { // not a UTF-8 text
+		n = limit
+	}
+	return body[:n], true
+}
+
+// anomaliesColumn joins the anomalies one per line, NULL if none.
+func anomaliesColumn(anomalies []string) any {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	return strings.Join(anomalies, "\n")
+}
+
+func (s *SQLiteStore) expirePending() {
+	deadline := time.Now().Add(-pendingTimeout)
+	for key, p := range s.pending {
+		if p.reqTime.Before(deadline) {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// retain deletes the oldest exchanges exceeding the max age or the max size, and then gives back the free pages.
+func (s *SQLiteStore) retain() error {
+	deleted := false
+	if s.maxAge > 0 {
+		r, err := s.db.Exec(`DELETE FROM exchange WHERE time < ?`, time.Now().Add(-s.maxAge).UnixNano())
+		if err != nil {
+			return err
+		}
+		n, _ := r.RowsAffected()
+		deleted = n > 0
+	}
+
+	// delete 10% of the oldest at a time, until the size is under the limit.
+	for i := 0; s.maxSize > 0 && i < 10; i++ {
+		size, err := s.size()
+		if err != nil {
+			return err
+		}
+		if size <= s.maxSize {
+			break
+		}
+		r, err := s.db.Exec(`DELETE FROM exchange WHERE id IN
+			(SELECT id FROM exchange ORDER BY id LIMIT (SELECT COUNT(*) / 10 + 1 FROM exchange))`)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n == 0 {
+			break
+		}
+		deleted = true
+	}
+
+	if deleted {
+		_, err := s.db.Exec(`PRAGMA incremental_vacuum`)
+		return err
+	}
+	return nil
+}
+
+// size returns the bytes used by the data, excluding the free pages.
+func (s *SQLiteStore) size() (uint64, error) {
+	var pageCount, freeCount, pageSize uint64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`PRAGMA freelist_count`).Scan(&freeCount); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return (pageCount - freeCount) * pageSize, nil
+}
+
+// rawHeaders parses the header lines as they are sent into the header fields in order,
+// keeping the casing, the duplicates and the obs-fold continuation lines.
+func rawHeaders(lines []string) []httpport.RawHeader {
+	headers := make([]httpport.RawHeader, 0, len(lines))
+	line := 2
+	for _, l := range lines {
+		_, fields, _ := httpport.NewReader(bufio.NewReader(strings.NewReader(l + "\r\n\r\n"))).ReadMIMEHeader()
+		for _, h := range fields {
+			h.Line = line
+			line += 1 + h.Folds
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// headerLines converts the json header fields back to the header lines as they are sent.
+func headerLines(header string) []string {
+	var headers []httpport.RawHeader
+	if json.Unmarshal([]byte(header), &headers) != nil {
+		return nil
+	}
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		lines = append(lines, h.RawString())
+	}
+	return lines
+}
+
+func urlPath(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+const exchangeColumns = `id, connection, COALESCE(interface, ''), COALESCE(tunnel, ''), seq, time, COALESCE(req_time, 0), COALESCE(rsp_time, 0), COALESCE(method, ''),
+	COALESCE(host, ''), COALESCE(url, ''), COALESCE(status, 0), latency_ms, COALESCE(content_type, ''),
+	COALESCE(req_size, 0), COALESCE(rsp_size, 0), COALESCE(anomalies, '')`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// sqliteExchange is a row of the exchange table.
+type sqliteExchange struct {
+	ExchangeSummary
+	URL     string
+	ReqTime int64
+	RspTime int64
+}
+
+func scanExchange(r rowScanner, x *sqliteExchange, extra ...any) error {
+	var t int64
+	var latency sql.NullFloat64
+	var anomalies string
+	dest := []any{
+		&x.ID, &x.Connection, &x.Interface, &x.Tunnel, &x.Seq, &t, &x.ReqTime, &x.RspTime, &x.Method,
+		&x.Host, &x.URL, &x.Status, &latency, &x.ContentType, &x.ReqSize, &x.RspSize, &anomalies,
+	}
+	if err := r.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+
+	x.Time = time.Unix(0, t)
+	x.Path = x.URL
+	if anomalies != "" {
+		x.Anomalies = strings.Split(anomalies, "\n")
+	}
+	if latency.Valid {
+		x.Latency = time.Duration(latency.Float64 * float64(time.Millisecond)).String()
+	}
+	return nil
+}
+
+// where builds the sql condition of the query.
+func (q *HistoryQuery) where() (string, []any) {
+	var conds []string
+	var args []any
+	if q.Method != "" {
+		conds, args = append(conds, "method = ? COLLATE NOCASE"), append(args, q.Method)
+	}
+	if q.Path != "" {
+		conds, args = append(conds, "instr(path, ?) > 0"), append(args, q.Path)
+	}
+	if q.Host != "" {
+		conds, args = append(conds, "instr(host, ?) > 0"), append(args, q.Host)
+	}
+	if q.Interface != "" {
+		conds, args = append(conds, "interface = ?"), append(args, q.Interface)
+	}
+	if q.Tunnel != "" {
+		conds, args = append(conds, "tunnel = ?"), append(args, q.Tunnel)
+	}
+	if q.Anomaly != "" {
+		conds, args = append(conds, "instr(anomalies, ?) > 0"), append(args, q.Anomaly)
+	}
+	if q.Status != nil {
+		var ranges []string
+		for _, r := range q.Status.Ranges() {
+			ranges, args = append(ranges, "status BETWEEN ? AND ?"), append(args, r.Start, r.End)
+		}
+		if len(ranges) == 0 {
+			ranges = append(ranges, "status IS NOT NULL")
+		}
+		conds = append(conds, "("+strings.Join(ranges, " OR ")+")")
+	}
+	if !q.From.IsZero() {
+		conds, args = append(conds, "time >= ?"), append(args, q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		conds, args = append(conds, "time <= ?"), append(args, q.To.UnixNano())
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (s *SQLiteStore) List(q HistoryQuery) (total int, items []ExchangeSummary, err error) {
+	where, args := q.where()
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM exchange`+where, args...).Scan(&total); err != nil {
+		return 0, nil, err
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT `+exchangeColumns+` FROM exchange`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, q.Offset)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var x sqliteExchange
+		if err := scanExchange(rows, &x); err != nil {
+			return 0, nil, err
+		}
+		items = append(items, x.ExchangeSummary)
+	}
+
+	return total, items, rows.Err()
+}
+
+func (s *SQLiteStore) Detail(id uint64) (d ExchangeDetail, found bool, err error) {
+	var x sqliteExchange
+	var reqHeader, rspHeader, reqTitle, rspTitle sql.NullString
+	var reqBody, rspBody []byte
+	var reqTruncated, rspTruncated sql.NullBool
+	row := s.db.QueryRow(`SELECT `+exchangeColumns+`, req_header, req_body, rsp_header, rsp_body,
+		req_title, rsp_title, req_truncated, rsp_truncated FROM exchange WHERE id = ?`, id)
+	if err := scanExchange(row, &x, &reqHeader, &reqBody, &rspHeader, &rspBody,
+		&reqTitle, &rspTitle, &reqTruncated, &rspTruncated); err != nil {
+		if err == sql.ErrNoRows {
+			return d, false, nil
+		}
+		return d, false, err
+	}
+
+	d.ExchangeSummary = x.ExchangeSummary
+	if reqHeader.Valid {
+		d.Req = &MessageDetail{
+			Timestamp: time.Unix(0, x.ReqTime).Format(time.RFC3339Nano),
+			Title:     reqTitle.String,
+			Header:    headerLines(reqHeader.String),
+			Body:      string(reqBody),
+			Truncated: reqTruncated.Bool,
+		}
+	}
+	if rspHeader.Valid {
+		d.Rsp = &MessageDetail{
+			Timestamp: time.Unix(0, x.RspTime).Format(time.RFC3339Nano),
+			Title:     rspTitle.String,
+			Header:    headerLines(rspHeader.String),
+			Body:      string(rspBody),
+			Truncated: rspTruncated.Bool,
+		}
+	}
+
+	return d, true, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bingoohuang/httpdump/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.db")
+	var wg sync.WaitGroup
+	s, err := NewSQLiteSender(&wg, "sqlite://"+file+"?body=3", 10)
+	assert.Nil(t, err)
+
+	for _, msg := range []string{
+		"\n### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\nGET /users/123?x=1 HTTP/1.1\r\nHost: a.com\r\n\r\n",
+		"\n### #1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.515447+08:00\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nhello",
+		"\n### #2 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.505447+08:00\r\nPOST /b HTTP/1.1\r\nHost: b.com\r\n\r\n",
+		"\n### #2 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.505464+08:00\r\nHTTP/1.1 500 Internal Server Error\r\n\r\n",
+	} {
+		s.Send(msg, true)
+	}
+	assert.Nil(t, s.Close())
+	wg.Wait()
+
+	s, err = OpenSQLiteReader(file)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	total, items, err := s.List(HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "/b", items[0].Path)
+	assert.Equal(t, "/users/123?x=1", items[1].Path)
+	assert.Equal(t, "10ms", items[1].Latency)
+
+	status, _ := util.ParseIntSet("500-599")
+	total, items, err = s.List(HistoryQuery{Status: status, Method: "post"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+
+	d, ok, err := s.Detail(items[0].ID - 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "GET /users/123?x=1 HTTP/1.1", d.Req.Title)
+	assert.Equal(t, []string{"Content-Type: text/plain"}, d.Rsp.Header)
+	assert.Equal(t, "hel", d.Rsp.Body)
+
+	var template string
+	assert.Nil(t, s.db.QueryRow(`SELECT template FROM exchange WHERE id = ?`, d.ID).Scan(&template))
+	assert.Equal(t, "/users/{int}", template)
+}
+
+func TestSQLiteStoreMessages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.db")
+	var wg sync.WaitGroup
+	s, err := NewSQLiteSender(&wg, "sqlite://"+file+"?body=4", 10)
+	assert.Nil(t, err)
+
+	for _, msg := range []string{
+		// the text format, the body cut on the rune boundary, and the streaming response with its events
+		"\n### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\nPOST /chat HTTP/1.0\r\n\r\nab中文",
+		"\n### #1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.515447+08:00\r\nHTTP/1.0 200 Fine\r\nContent-Type: text/event-stream\r\n\r\n",
+		"\n### SSE#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.515447+08:00, #1 +1s 9 bytes\r\ndata: a\r\n",
+		"\n### EOF#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.515447+08:00\r\n",
+		"\n### STREAM#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:11.515447+08:00, 1 events 9 bytes in 2s, max interval 1s, ended by closed\r\n",
+		// the json format of PRINT_JSON=Y
+		`{"seq":2,"src":"127.0.0.1:54386","dest":"127.0.0.1:5003","timestamp":"2022-04-17T10:58:12.505447+08:00","requestUri":"/j","method":"GET","host":"a.com","proto":"HTTP/1.1","rawHeaders":[{"name":"host","value":"a.com","line":2}],"body":""}` + "\n",
+		`{"seq":2,"src":"127.0.0.1:54386","dest":"127.0.0.1:5003","timestamp":"2022-04-17T10:58:12.515447+08:00","proto":"HTTP/1.1","header":{"Content-Type":["application/json"]},"rawHeaders":[{"name":"Content-Type","value":"application/json","line":2}],"body":{"a":1},"statusCode":201}` + "\n",
+	} {
+		s.Send(msg, !strings.Contains(msg, "SSE#") && !strings.Contains(msg, "STREAM#") && !strings.Contains(msg, "EOF#"))
+	}
+	assert.Nil(t, s.Close())
+	wg.Wait()
+
+	s, err = OpenSQLiteReader(file)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	total, items, err := s.List(HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+
+	d, _, err := s.Detail(items[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "POST /chat HTTP/1.0", d.Req.Title)
+	assert.Equal(t, "ab", d.Req.Body)
+	assert.True(t, d.Req.Truncated)
+	assert.Equal(t, "HTTP/1.0 200 Fine", d.Rsp.Title)
+	assert.Equal(t, "data", d.Rsp.Body)
+	assert.True(t, d.Rsp.Truncated)
+	assert.Equal(t, 9, items[1].RspSize)
+
+	d, _, err = s.Detail(items[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /j HTTP/1.1", d.Req.Title)
+	assert.Equal(t, []string{"host: a.com"}, d.Req.Header)
+	assert.Equal(t, "HTTP/1.1 201 Created", d.Rsp.Title)
+	assert.Equal(t, `{"a"`, d.Rsp.Body)
+	assert.Equal(t, 201, d.Status)
+	assert.Equal(t, "application/json", d.ContentType)
+}
+
+func TestSQLiteStoreRawMessages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.db")
+	var wg sync.WaitGroup
+	s, err := NewSQLiteSender(&wg, "sqlite://"+file, 10)
+	assert.Nil(t, err)
+
+	// the headers in the wire order with the casing, the duplicates and the folds, and the annotations after the body
+	s.Send("\n### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\nPOST /a HTTP/1.1\r\n"+
+		"host: a.com\r\nX-B: 2\r\nX-A: 1\r\nX-B: 3\r\nX-Fold: a\r\n  b\r\nAuthorization: Basic ******\r\n\r\nhello\r\n"+
+		"\n// body: sha256 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 size 5 stored bodies/2c/2c.txt\r\n"+
+		"\n// anomaly: warn obs-fold: the header X-Fold is folded\r\n\r\n// auth: basic user a\r\n", true)
+	s.Send("\n### #1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.515447+08:00\r\nHTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/json\r\nContent-Encoding: gzip\r\n\r\n{\"a\":1}\n// charset: GBK\r\n\n// decoded: gzip 10 bytes\r\n"+
+		"\n// timing: rtt 1ms server 2ms\r\n", true)
+	s.Send("\n### #2 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:10.505447+08:00\r\nPOST /b HTTP/1.1\r\n\r\n"+
+		"\n// dump body to file: dump.1.REQ size: 5\r\n", true)
+	assert.Nil(t, s.Close())
+	wg.Wait()
+
+	s, err = OpenSQLiteReader(file)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	_, items, err := s.List(HistoryQuery{})
+	assert.Nil(t, err)
+	d, _, err := s.Detail(items[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host: a.com", "X-B: 2", "X-A: 1", "X-B: 3", "X-Fold: a\r\n  b", "Authorization: Basic ******"},
+		d.Req.Header)
+	assert.Equal(t, "hello\r\n", d.Req.Body)
+	assert.Equal(t, `{"a":1}`, d.Rsp.Body)
+	assert.Equal(t, []string{"warn obs-fold: the header X-Fold is folded"}, d.Anomalies)
+
+	d, _, err = s.Detail(items[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "", d.Req.Body)
+
+	var header string
+	assert.Nil(t, s.db.QueryRow(`SELECT req_header FROM exchange WHERE id = ?`, items[1].ID).Scan(&header))
+	assert.Contains(t, header, `{"Name":"X-Fold","Value":"a b","Line":6,"Folds":1,"Raw":"X-Fold: a\r\n  b"}`)
+
+	// the reader does not write
+	_, err = s.db.Exec(`DELETE FROM exchange`)
+	assert.NotNil(t, err)
+}
@@ -3,18 +3,25 @@ package main
 import (
 	"bufio"
 	"embed"
+	"encoding/json"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/AndrewBurian/eventsource"
 	"github.com/bingoohuang/gg/pkg/codec"
 	"github.com/bingoohuang/gg/pkg/man"
 	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/httpdump/handler"
+	"github.com/bingoohuang/httpdump/httpport"
 	"github.com/bingoohuang/httpdump/replay"
 	"github.com/bingoohuang/httpdump/util"
 )
@@ -39,7 +46,7 @@ var webTemplate = func() *template.Template {
 	return subTemplate
 }()
 
-func SSEWebHandler(contextPath string, stream *eventsource.Stream) func(w http.ResponseWriter, r *http.Request) {
+func SSEWebHandler(contextPath string, stream http.Handler, history *History, db func() ExchangeStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		p := path.Join("/", strings.TrimPrefix(r.URL.Path, contextPath))
 		if contextPath == "/" {
@@ -55,35 +62,205 @@ func SSEWebHandler(contextPath string, stream *eventsource.Stream) func(w http.R
 			}
 		case "/sse":
 			SSEHandler(stream).ServeHTTP(w, r)
+		case "/api/exchanges":
+			ExchangesHandler(history).ServeHTTP(w, r)
+		case "/api/db/exchanges":
+			if store := db(); store != nil {
+				ExchangesHandler(store).ServeHTTP(w, r)
+			} else {
+				http.Error(w, "no sqlite output", http.StatusNotFound)
+			}
 		default:
+			if id, ok := strings.CutPrefix(p, "/api/exchanges/"); ok {
+				ExchangeHandler(history, id).ServeHTTP(w, r)
+				return
+			}
+			if id, ok := strings.CutPrefix(p, "/api/db/exchanges/"); ok {
+				if store := db(); store != nil {
+					ExchangeHandler(store, id).ServeHTTP(w, r)
+				} else {
+					http.Error(w, "no sqlite output", http.StatusNotFound)
+				}
+				return
+			}
+
 			http.StripPrefix(contextPath, http.FileServer(http.FS(webRoot))).ServeHTTP(w, r)
 		}
 	}
 }
 
 type SSESender struct {
-	stream *eventsource.Stream
+	lock    sync.Mutex
+	clients map[*sseClient]bool
+	history *History
+	debug   bool // logs the events sent
+}
+
+// sseClientQueue is the number of the events queued for a client of the event stream, the client falling behind
+// more is disconnected, to resume by the Last-Event-ID.
+const sseClientQueue = 1024
+
+// sseClient queues the events for a client of the event stream, which are written by its own handler,
+// so a slow client never blocks the output.
+type sseClient struct {
+	events chan sseWire
+	replay []*HTTPEvent // the events in the history after the Last-Event-ID, written before the queued ones
+}
+
+// sseWire is an event encoded in the wire format of the event stream.
+type sseWire struct {
+	id   uint64
+	data []byte
+}
+
+func NewSSESender(history *History, debug bool) *SSESender {
+	return &SSESender{clients: make(map[*sseClient]bool), history: history, debug: debug}
 }
 
 func (s *SSESender) Send(msg string, _ bool) {
 	e := ParseHTTPEvent(msg)
-	d := string(codec.Json(e))
-	log.Printf("Send sse data: %s", d)
-	s.stream.Broadcast(eventsource.DataEvent(d))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.history.Add(&e)
+	d := codec.Json(e)
+	if s.debug {
+		log.Printf("Send sse data: %s", d)
+	}
+	w := sseWire{id: e.ID, data: encodeSSEEvent(sseEvent(e.ID, d))}
+	for c := range s.clients {
+		select {
+		case c.events <- w:
+		default: // falls behind, disconnected to resume by the Last-Event-ID
+			s.remove(c)
+		}
+	}
+}
+
+func toSSEEvent(e *HTTPEvent) *eventsource.Event { return sseEvent(e.ID, codec.Json(e)) }
+
+// sseEvent is the event of the HTTPEvent encoded in json, with its ID for the resuming by Last-Event-ID.
+func sseEvent(id uint64, data []byte) *eventsource.Event {
+	return eventsource.DataEvent(string(data)).ID(strconv.FormatUint(id, 10))
+}
+
+// encodeSSEEvent returns the event in the wire format.
+func encodeSSEEvent(e *eventsource.Event) []byte {
+	b, _ := io.ReadAll(e)
+	return b
+}
+
+// ServeHTTP serves the event stream to the client until it is disconnected, or falls behind.
+func (s *SSESender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Accept") != "text/event-stream" {
+		http.Error(w, "This is an EventStream endpoint", http.StatusNotAcceptable)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "EventStream not supported for this connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	f.Flush()
+
+	c := s.resume(r)
+	defer s.unregister(c)
+
+	write := func(data []byte) bool {
+		if _, err := w.Write(data); err != nil {
+			return false
+		}
+		f.Flush()
+		return true
+	}
+
+	var last uint64 // the id of the last event replayed
+	for _, e := range c.replay {
+		if !write(encodeSSEEvent(toSSEEvent(e))) {
+			return
+		}
+		last = e.ID
+	}
+	c.replay = nil
+
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				return
+			}
+			if e.id <= last { // replayed already
+				continue
+			}
+			if !write(e.data) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
+// resume registers the client with the events in the history after the Last-Event-ID to be replayed, the query
+// parameter lastEventId=0 can be used to load all the history on the first connection. Both are done under the lock
+// of Send, so no event is duplicated, lost or reordered across the reconnection, and the replay is written after.
+func (s *SSESender) resume(r *http.Request) *sseClient {
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+
+	c := &sseClient{events: make(chan sseWire, sseClientQueue)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id, err := strconv.ParseUint(last, 10, 64); err == nil {
+		c.replay = s.history.EventsAfter(id)
+	}
+	s.clients[c] = true
+	return c
+}
+
+func (s *SSESender) unregister(c *sseClient) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remove(c)
+}
+
+// remove closes the queue of the client, under the lock.
+func (s *SSESender) remove(c *sseClient) {
+	if s.clients[c] {
+		delete(s.clients, c)
+		close(c.events)
+	}
+}
+
+// streamBytesRe matches the bytes of the stream events, like #2 +1.5s 27 bytes, or 3 events 42 bytes in 10s.
+var streamBytesRe = regexp.MustCompile(`(\d+) bytes`)
+
+// ParseHTTPEvent parses the message output, in the text format, or the json format of PRINT_JSON=Y.
 func ParseHTTPEvent(msg string) HTTPEvent {
+	if strings.HasPrefix(msg, "{") {
+		return parseJSONEvent(msg)
+	}
+
 	e := HTTPEvent{Payload: msg}
 
 	scanner := bufio.NewScanner(strings.NewReader(msg))
 	scanner.Split(replay.ScanLines)
 
 	for scanner.Scan() {
-		line := string(scanner.Bytes())
+		line := strings.TrimRight(string(scanner.Bytes()), "\r\n")
 		// ### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00
 		// ### #1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505464+08:00
 		// ### EOF#1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00
 		// ### EOF#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505499+08:00
+		// ### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00 eth0 (with the capture interface)
+		// ### #1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00 eth0 vxlan:100 (and the tunnel)
 		if strings.HasPrefix(line, "###") {
 			fields := strings.Fields(line)
 			field1 := FieldsN(fields, 1)
@@ -93,12 +270,35 @@ func ParseHTTPEvent(msg string) HTTPEvent {
 			e.Connection = FieldsN(fields, 3)
 			e.Timestamp = FieldsN(fields, 4)
 			e.Size = man.IBytes(uint64(len(msg)))
-			if strings.HasPrefix(field1, "EOF") {
-				e.EOF = true
-				e.Seq = ss.ParseInt(field1[4:])
+			if i := strings.IndexByte(field1, '#'); i > 0 {
+				// ### GAP#1 REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00, 6 bytes lost
+				e.Event = field1[:i]
+				e.EOF = e.Event == "EOF"
+				e.Seq = ss.ParseInt(field1[i+1:])
+				e.Timestamp = strings.TrimSuffix(e.Timestamp, ",")
+				if e.Event == "ANOMALY" {
+					// ### ANOMALY#1 TCP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00, warn count-mismatch: 2 requests, 1 responses
+					_, a, _ := strings.Cut(line, ", ")
+					e.Anomalies = append(e.Anomalies, a)
+				}
+				if e.IsStreamEvent() {
+					// ### SSE#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00, #2 +1.5s 27 bytes
+					// ### STREAM#1 RSP 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:19.505447+08:00, 3 events 42 bytes in 10s, ...
+					if m := streamBytesRe.FindStringSubmatch(line); m != nil {
+						e.StreamSize, _ = strconv.ParseInt(m[1], 10, 64)
+					}
+					_, body, _ := strings.Cut(strings.TrimLeft(msg, "\r\n"), "\n")
+					e.detail = &MessageDetail{Timestamp: e.Timestamp, Body: strings.TrimSuffix(body, "\r\n")}
+				}
 				break
 			}
 
+			e.Interface = FieldsN(fields, 5)
+			if e.Interface == "-" {
+				e.Interface = ""
+			}
+			e.Tunnel = FieldsN(fields, 6)
+
 			e.Seq = ss.ParseInt(field1[1:])
 			switch field2 {
 			case "REQ":
@@ -112,7 +312,9 @@ func ParseHTTPEvent(msg string) HTTPEvent {
 			continue
 		}
 
-		if strings.HasPrefix(line, "Host:") {
+		if a, ok := strings.CutPrefix(line, "// anomaly: "); ok {
+			e.Anomalies = append(e.Anomalies, a)
+		} else if strings.HasPrefix(line, "Host:") {
 			e.Host = ss.FieldsN(line, 2)[1]
 		} else if e.Rsp && strings.HasPrefix(line, "Content-Type:") {
 			e.ContentType = ss.FieldsN(line, 2)[1]
@@ -123,22 +325,33 @@ func ParseHTTPEvent(msg string) HTTPEvent {
 }
 
 func FieldsN(fields []string, seq int) string {
-	return ss.If(seq < len(fields), fields[seq], "")
+	if seq < len(fields) {
+		return fields[seq]
+	}
+	return ""
 }
 
 func (s *SSESender) Close() error {
-	s.stream.Shutdown()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.clients {
+		s.remove(c)
+	}
 	return nil
 }
 
 var _ handler.Sender = (*SSESender)(nil)
 
 type HTTPEvent struct {
+	ID          uint64
+	Event       string // EOF, ERR, OVERFLOW, GAP, CONN or ANOMALY for the events, empty for the messages
 	EOF         bool
 	Req         bool
 	Rsp         bool
 	Seq         int
 	Connection  string // // like 192.168.217.54:53933-192.168.126.182:9090
+	Interface   string
+	Tunnel      string
 	Method      string
 	Host        string
 	Path        string
@@ -146,16 +359,107 @@ type HTTPEvent struct {
 	Status      int
 	Time        string
 	Size        string
+	Anomalies   []string `json:",omitempty"` // like error cl-te-conflict: both Content-Length 5 and Transfer-Encoding chunked are sent
+
+	StreamSize int64 `json:",omitempty"` // bytes of the stream event, or of the whole stream by the STREAM summary
 
 	Timestamp string
 	Payload   string
+
+	detail *MessageDetail // parsed already from the json message or the stream event
+}
+
+// The events of the streaming responses emitted incrementally.
+const (
+	EventSSE    = "SSE"    // a server-sent event
+	EventChunk  = "CHUNK"  // a chunk of the chunked response
+	EventStream = "STREAM" // the summary of the streaming response
+)
+
+// IsStreamEvent tells whether the event is a part or the summary of a streaming response.
+func (e *HTTPEvent) IsStreamEvent() bool {
+	return e.Event == EventSSE || e.Event == EventChunk || e.Event == EventStream
 }
 
-func NewSSEStream() *eventsource.Stream {
-	return eventsource.NewStream()
+// jsonStreamEvents are the stream events by the Stream field of the json output.
+var jsonStreamEvents = map[string]string{
+	handler.StreamSSE: EventSSE, handler.StreamChunk: EventChunk, handler.StreamEnd: EventStream,
 }
 
-func SSEHandler(stream *eventsource.Stream) http.HandlerFunc {
+// parseJSONEvent parses the message output by PRINT_JSON=Y, a request, a response, a stream event, or an event
+// of the stream or the connection.
+func parseJSONEvent(msg string) HTTPEvent {
+	e := HTTPEvent{Payload: msg}
+	var m struct {
+		Seq                                     int
+		Src, Dest, Interface, Tunnel, Timestamp string
+		RequestURI, Method, Host, Proto         string
+		StatusCode                              int
+		Header                                  http.Header
+		RawHeaders                              []httpport.RawHeader
+		Body                                    json.RawMessage
+		Truncated                               bool
+		Anomalies                               []handler.Anomaly
+		Stream                                  string
+		Size, Bytes                             json.Number
+		Data                                    string
+		Event, Tag                              string
+	}
+	if err := json.Unmarshal([]byte(msg), &m); err != nil {
+		return e
+	}
+
+	e.Seq, e.Interface, e.Tunnel, e.Timestamp = m.Seq, m.Interface, m.Tunnel, m.Timestamp
+	e.Connection = m.Src + "-" + m.Dest
+	e.Size = man.IBytes(uint64(len(msg)))
+	for _, a := range m.Anomalies {
+		e.Anomalies = append(e.Anomalies, a.String())
+	}
+	d := &MessageDetail{Timestamp: m.Timestamp, Truncated: m.Truncated}
+	e.detail = d
+
+	if event, ok := jsonStreamEvents[m.Stream]; ok {
+		e.Event, e.Rsp, d.Body = event, true, m.Data
+		size := m.Size
+		if event == EventStream {
+			size = m.Bytes
+		}
+		e.StreamSize, _ = size.Int64()
+		return e
+	}
+	if m.Tag != "" { // the event of the stream or the connection, like GAP
+		e.Event, e.EOF = m.Event, m.Event == "EOF"
+		e.Req, e.Rsp = m.Tag == string(handler.TagRequest), m.Tag == string(handler.TagResponse)
+		e.detail = nil
+		return e
+	}
+
+	if m.Method != "" {
+		e.Req, e.Method, e.Host, e.Path = true, m.Method, m.Host, m.RequestURI
+		d.Title = strings.TrimSpace(m.Method + " " + m.RequestURI + " " + m.Proto)
+	} else if m.StatusCode != 0 {
+		e.Rsp, e.Status, e.ContentType = true, m.StatusCode, m.Header.Get("Content-Type")
+		d.Title = strings.TrimSpace(m.Proto + " " + strconv.Itoa(m.StatusCode) + " " + http.StatusText(m.StatusCode))
+	}
+	for _, h := range m.RawHeaders {
+		d.Header = append(d.Header, h.RawString())
+	}
+	// the json body is output as it is, and the others are quoted
+	if err := json.Unmarshal(m.Body, &d.Body); err != nil {
+		d.Body = string(m.Body)
+	}
+	return e
+}
+
+// ParseTimestamp parses the Timestamp, or returns now if it is not parsable.
+func (e *HTTPEvent) ParseTimestamp() time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, e.Timestamp); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+func SSEHandler(stream http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -169,3 +473,79 @@ func SSEHandler(stream *eventsource.Stream) http.HandlerFunc {
 		}
 	}
 }
+
+// ExchangesHandler lists the exchanges in the history, newest first, filtered by the query parameters:
+// method, path, host, interface, tunnel, anomaly, status (like 200,400-599), from and to (RFC3339), offset and limit.
+func ExchangesHandler(store ExchangeStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		q := HistoryQuery{
+			Method:    v.Get("method"),
+			Path:      v.Get("path"),
+			Host:      v.Get("host"),
+			Interface: v.Get("interface"),
+			Tunnel:    v.Get("tunnel"),
+			Anomaly:   v.Get("anomaly"),
+			Offset:    ss.ParseInt(v.Get("offset")),
+			Limit:     ss.ParseInt(v.Get("limit")),
+		}
+		if q.Limit <= 0 || q.Limit > 1000 {
+			q.Limit = 100
+		}
+
+		var err error
+		if status := v.Get("status"); status != "" {
+			if q.Status, err = util.ParseIntSet(status); err != nil {
+				http.Error(w, "bad status: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, t := range []struct {
+			name string
+			p    *time.Time
+		}{{"from", &q.From}, {"to", &q.To}} {
+			if val := v.Get(t.name); val != "" {
+				if *t.p, err = time.Parse(time.RFC3339Nano, val); err != nil {
+					http.Error(w, "bad "+t.name+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		total, items, err := store.List(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{"Total": total, "Offset": q.Offset, "Limit": q.Limit, "Items": items})
+	}
+}
+
+// ExchangeHandler returns one exchange with its full headers and bodies.
+func ExchangeHandler(store ExchangeStore, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "bad exchange id", http.StatusBadRequest)
+			return
+		}
+
+		d, ok, err := store.Detail(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "exchange not found", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, d)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
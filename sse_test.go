@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sendRequestEvent(s *SSESender, seq int) {
+	s.Send(fmt.Sprintf("\n### #%d REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\n"+
+		"GET /%d HTTP/1.1\r\nHost: a.com\r\n\r\n", seq, seq), true)
+}
+
+// readEventIDs reads the ids of the first n events from the event stream.
+func readEventIDs(t *testing.T, url, lastEventID string, n int) (ids []uint64) {
+	r, _ := http.NewRequest(http.MethodGet, url, nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Last-Event-ID", lastEventID)
+	rsp, err := http.DefaultClient.Do(r)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+
+	scanner := bufio.NewScanner(rsp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for len(ids) < n && scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			id, _ := strconv.ParseUint(v, 10, 64)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestSSESenderResume(t *testing.T) {
+	s := NewSSESender(NewHistory(1000, 0), false)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer s.Close()
+
+	for i := 1; i <= 3; i++ {
+		sendRequestEvent(s, i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // the events are sent concurrently while the clients are replayed and registered
+		defer wg.Done()
+		for i := 4; i <= 200; i++ {
+			sendRequestEvent(s, i)
+		}
+	}()
+
+	for _, last := range []uint64{1, 2} {
+		ids := readEventIDs(t, server.URL, strconv.FormatUint(last, 10), 100)
+		assert.Len(t, ids, 100)
+		for i, id := range ids {
+			if !assert.Equal(t, last+1+uint64(i), id) {
+				break
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestSSESenderSlowClient(t *testing.T) {
+	s := NewSSESender(NewHistory(10000, 0), false)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer s.Close()
+
+	body := strings.Repeat("x", 16<<10)
+	for i := 1; i <= 1000; i++ {
+		s.Send(fmt.Sprintf("\n### #%d REQ 127.0.0.1:54386-127.0.0.1:5003 2022-04-17T10:58:09.505447+08:00\r\n"+
+			"POST /%d HTTP/1.1\r\nHost: a.com\r\n\r\n%s", i, i, body), true)
+	}
+
+	// the client loads all the history, but never reads it
+	r, _ := http.NewRequest(http.MethodGet, server.URL+"?lastEventId=0", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	rsp, err := http.DefaultClient.Do(r)
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1001; i <= 1000+2*sseClientQueue; i++ {
+			sendRequestEvent(s, i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the output is blocked by the client never reading")
+	}
+
+	// it falls behind, and is disconnected to resume later
+	s.lock.Lock()
+	assert.Empty(t, s.clients)
+	s.lock.Unlock()
+}
@@ -0,0 +1,398 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// PacketFilter is the kernel filter of the captured packets, by the customized -bpf,
+// or by the -ip and -port filters extended to the tunnels of -decap.
+type PacketFilter struct {
+	BPF   string // customized bpf expression of libpcap, overrides the others
+	IPs   *IPFilter
+	Ports *IntSet
+	Decap *Decapsulator
+}
+
+// NewPacketFilter creates the PacketFilter, ports is like 80,8001-8003.
+func NewPacketFilter(bpfExpr string, ips *IPFilter, ports string, decap *Decapsulator) (*PacketFilter, error) {
+	f := &PacketFilter{BPF: bpfExpr, IPs: ips, Decap: decap}
+	if ports = strings.ReplaceAll(ports, " ", ""); ports != "" {
+		var err error
+		if f.Ports, err = ParseIntSet(ports); err != nil {
+			return nil, fmt.Errorf("invalid ports %s: %w", ports, err)
+		}
+		for _, r := range f.Ports.Ranges() {
+			if r.Start <= 0 || r.End > 65535 {
+				return nil, fmt.Errorf("invalid ports %s, out of 1-65535", ports)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Expr returns the bpf expression in the syntax of libpcap.
+func (f *PacketFilter) Expr() string {
+	if f == nil {
+		return ""
+	}
+	if f.BPF != "" {
+		return f.BPF
+	}
+
+	expr := "tcp"
+	if ip := f.IPs.BPF(); ip != "" {
+		expr += " and " + ip
+	}
+	if f.Ports != nil {
+		var ports []string
+		for _, r := range f.Ports.Ranges() {
+			if r.Start == r.End {
+				ports = append(ports, fmt.Sprintf("port %d", r.Start))
+			} else {
+				ports = append(ports, fmt.Sprintf("portrange %d-%d", r.Start, r.End))
+			}
+		}
+		expr += " and (" + strings.Join(ports, " or ") + ")"
+	}
+
+	if f.Decap != nil {
+		return f.Decap.BPF(expr)
+	}
+	return expr
+}
+
+// ErrCustomBPF tells that the customized bpf expression can not be compiled without libpcap.
+var ErrCustomBPF = errors.New("customized bpf requires libpcap, which is not available in this build")
+
+var (
+	// libpcapCompile compiles the bpf expression by libpcap, set only in the cgo builds.
+	libpcapCompile func(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error)
+	// libpcapMatcher matches the packets by the bpf expression of libpcap, set only in the cgo builds.
+	libpcapMatcher func(linkType layers.LinkType, expr string) (func(ci gopacket.CaptureInfo, data []byte) bool, error)
+)
+
+// Program compiles the filter to a classic BPF program for the link type in pure Go,
+// the customized bpf expression is compiled by libpcap if it is available.
+func (f *PacketFilter) Program(linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	return f.program(linkType, false)
+}
+
+// SocketProgram compiles the filter like Program for an AF_PACKET socket, where the kernel strips the vlan tag
+// out of the frame before the filter, so the tagged frames are told by SKF_AD_VLAN_TAG_PRESENT instead.
+func (f *PacketFilter) SocketProgram(linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	return f.program(linkType, true)
+}
+
+func (f *PacketFilter) program(linkType layers.LinkType, vlanStripped bool) ([]bpf.RawInstruction, error) {
+	if f.BPF != "" {
+		if libpcapCompile == nil {
+			return nil, ErrCustomBPF
+		}
+		return libpcapCompile(linkType, f.BPF)
+	}
+
+	var cond bpfCond
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		cond = f.etherFrame(12, 14, true)
+		switch {
+		case f.Decap == nil:
+		case vlanStripped:
+			cond = bpfOr(bpfAnd(bpfNot(bpfVLANTagPresent()), cond), bpfAnd(bpfVLANTagPresent(), f.etherFrame(12, 14, false)))
+		default:
+			cond = bpfOr(cond, bpfAnd(bpfLoad(12, 2, uint32(layers.EthernetTypeDot1Q)), f.etherFrame(16, 18, false)))
+		}
+	case layers.LinkTypeLinuxSLL:
+		cond = f.etherFrame(14, 16, true)
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		cond = f.ipFrame(0)
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		cond = f.ipFrame(4)
+	default:
+		return nil, fmt.Errorf("unsupported link type %s", linkType)
+	}
+
+	c := &bpfCompiler{}
+	accept, reject := c.newLabel(), c.newLabel()
+	cond(c, accept, reject)
+	c.mark(accept)
+	c.ins = append(c.ins, bpf.RetConstant{Val: 262144})
+	c.mark(reject)
+	c.ins = append(c.ins, bpf.RetConstant{Val: 0})
+	return c.assemble()
+}
+
+// Matcher returns the function to tell whether the packet data of the link type passes the filter.
+func (f *PacketFilter) Matcher(linkType layers.LinkType) (func(ci gopacket.CaptureInfo, data []byte) bool, error) {
+	if f == nil || f.BPF == "" && f.IPs == nil && f.Ports == nil && f.Decap == nil {
+		return func(gopacket.CaptureInfo, []byte) bool { return true }, nil
+	}
+	if f.BPF != "" && libpcapMatcher != nil {
+		return libpcapMatcher(linkType, f.BPF)
+	}
+
+	raw, err := f.Program(linkType)
+	if err != nil {
+		return nil, err
+	}
+	ins := make([]bpf.Instruction, len(raw))
+	for i, r := range raw {
+		ins[i] = r.Disassemble()
+	}
+	vm, err := bpf.NewVM(ins)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ gopacket.CaptureInfo, data []byte) bool {
+		n, err := vm.Run(data)
+		return err == nil && n > 0
+	}, nil
+}
+
+// etherFrame matches the frame by the ether type at the offset and the network layer following it,
+// the tunnels are not matched in vlan, like the expression.
+func (f *PacketFilter) etherFrame(typeOffset, l3 uint32, tunnels bool) bpfCond {
+	return bpfOr(
+		bpfAnd(bpfLoad(typeOffset, 2, uint32(layers.EthernetTypeIPv4)), f.ipv4(l3, tunnels)),
+		bpfAnd(bpfLoad(typeOffset, 2, uint32(layers.EthernetTypeIPv6)), f.ipv6(l3, tunnels)),
+	)
+}
+
+// ipFrame matches the frame of the network layer at the offset, by its ip version.
+func (f *PacketFilter) ipFrame(l3 uint32) bpfCond {
+	return bpfOr(
+		bpfAnd(bpfLoadMasked(l3, 1, 0xF0, 0x40), f.ipv4(l3, true)),
+		bpfAnd(bpfLoadMasked(l3, 1, 0xF0, 0x60), f.ipv6(l3, true)),
+	)
+}
+
+func (f *PacketFilter) ipv4(l3 uint32, tunnels bool) bpfCond {
+	proto := func(p layers.IPProtocol) bpfCond { return bpfLoad(l3+9, 1, uint32(p)) }
+	notFragment := bpfLoadMasked(l3+6, 2, 0x1FFF, 0)
+	port := func(offset uint32, test bpf.JumpTest, val uint32) bpfCond {
+		return func(c *bpfCompiler, t, f bpfLabel) {
+			c.ins = append(c.ins, bpf.LoadMemShift{Off: l3}, bpf.LoadIndirect{Off: l3 + offset, Size: 2})
+			c.branch(test, val, t, f)
+		}
+	}
+
+	conds := []bpfCond{bpfAnd(proto(layers.IPProtocolTCP), notFragment, f.ipCond(l3+12, l3+16, true), bpfPorts(f.Ports, port))}
+	if tunnels && f.Decap != nil {
+		if f.Decap.GRE || f.Decap.ERSPAN {
+			conds = append(conds, proto(layers.IPProtocolGRE))
+		}
+		if ports := f.Decap.udpPorts(); ports != nil {
+			conds = append(conds, bpfAnd(proto(layers.IPProtocolUDP), notFragment, bpfPorts(ports, port)))
+		}
+	}
+	return bpfOr(conds...)
+}
+
+func (f *PacketFilter) ipv6(l3 uint32, tunnels bool) bpfCond {
+	proto := func(p layers.IPProtocol) bpfCond { return bpfLoad(l3+6, 1, uint32(p)) }
+	port := func(offset uint32, test bpf.JumpTest, val uint32) bpfCond {
+		return func(c *bpfCompiler, t, f bpfLabel) {
+			c.ins = append(c.ins, bpf.LoadAbsolute{Off: l3 + 40 + offset, Size: 2})
+			c.branch(test, val, t, f)
+		}
+	}
+
+	conds := []bpfCond{bpfAnd(proto(layers.IPProtocolTCP), f.ipCond(l3+8, l3+24, false), bpfPorts(f.Ports, port))}
+	if tunnels && f.Decap != nil {
+		if f.Decap.GRE || f.Decap.ERSPAN {
+			conds = append(conds, proto(layers.IPProtocolGRE))
+		}
+		if ports := f.Decap.udpPorts(); ports != nil {
+			conds = append(conds, bpfAnd(proto(layers.IPProtocolUDP), bpfPorts(ports, port)))
+		}
+	}
+	return bpfOr(conds...)
+}
+
+// udpPorts returns the UDP ports of the enabled tunnels, nil if none.
+func (d *Decapsulator) udpPorts() *IntSet {
+	var ranges []IntRange
+	if d.Geneve {
+		ranges = append(ranges, NewIntRange(6081, 6081))
+	}
+	for _, p := range d.VXLANPorts {
+		ranges = append(ranges, NewIntRange(int(p), int(p)))
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	return NewIntSet(ranges...)
+}
+
+// ipCond matches the ips of the family at the src and dst offsets by the ip filter.
+func (f *PacketFilter) ipCond(src, dst uint32, ipv4 bool) bpfCond {
+	if f.IPs == nil {
+		return bpfAnd()
+	}
+
+	family := func(prefixes []netip.Prefix) bpfCond {
+		var conds []bpfCond
+		for _, p := range prefixes {
+			if p.Addr().Is4() == ipv4 {
+				conds = append(conds, bpfPrefix(src, p), bpfPrefix(dst, p))
+			}
+		}
+		return bpfOr(conds...)
+	}
+
+	include := bpfAnd()
+	if len(f.IPs.Include) > 0 {
+		include = family(f.IPs.Include)
+	}
+	return bpfAnd(include, bpfNot(family(f.IPs.Exclude)))
+}
+
+// bpfPorts matches either the src or the dst port, which are loaded by the port function at the offsets 0 and 2.
+func bpfPorts(ports *IntSet, port func(offset uint32, test bpf.JumpTest, val uint32) bpfCond) bpfCond {
+	if ports == nil {
+		return bpfAnd()
+	}
+
+	var conds []bpfCond
+	for _, r := range ports.Ranges() {
+		for _, offset := range []uint32{0, 2} {
+			if r.Start == r.End {
+				conds = append(conds, port(offset, bpf.JumpEqual, uint32(r.Start)))
+			} else {
+				conds = append(conds, bpfAnd(port(offset, bpf.JumpGreaterOrEqual, uint32(r.Start)),
+					port(offset, bpf.JumpLessOrEqual, uint32(r.End))))
+			}
+		}
+	}
+	return bpfOr(conds...)
+}
+
+// bpfPrefix matches the ip at the offset by the prefix, word by word.
+func bpfPrefix(offset uint32, p netip.Prefix) bpfCond {
+	addr := p.Addr().AsSlice()
+	var conds []bpfCond
+	for w := 0; w*32 < p.Bits(); w++ {
+		val := binary.BigEndian.Uint32(addr[w*4:])
+		mask := ^uint32(0)
+		if n := p.Bits() - w*32; n < 32 {
+			mask <<= 32 - n
+		}
+		if mask == ^uint32(0) {
+			conds = append(conds, bpfLoad(offset+uint32(w*4), 4, val))
+		} else {
+			conds = append(conds, bpfLoadMasked(offset+uint32(w*4), 4, mask, val&mask))
+		}
+	}
+	return bpfAnd(conds...)
+}
+
+// bpfLabel is a position in the program to jump to, resolved when the program is assembled.
+type bpfLabel int
+
+// bpfCond emits the instructions jumping to t if the condition is true, otherwise to f.
+type bpfCond func(c *bpfCompiler, t, f bpfLabel)
+
+// bpfCompiler emits the instructions of bpfConds, all jumps are forward to the labels, by the unconditional jumps
+// which have no 255 limit of the conditional ones.
+type bpfCompiler struct {
+	ins    []bpf.Instruction
+	labels []int            // the instruction index of each label
+	jumps  map[int]bpfLabel // the instruction index of the unconditional jumps to their labels
+}
+
+func (c *bpfCompiler) newLabel() bpfLabel {
+	c.labels = append(c.labels, -1)
+	return bpfLabel(len(c.labels) - 1)
+}
+
+func (c *bpfCompiler) mark(l bpfLabel) { c.labels[l] = len(c.ins) }
+
+func (c *bpfCompiler) jump(l bpfLabel) {
+	if c.jumps == nil {
+		c.jumps = map[int]bpfLabel{}
+	}
+	c.jumps[len(c.ins)] = l
+	c.ins = append(c.ins, bpf.Jump{})
+}
+
+// branch tests the register A and jumps to t or f.
+func (c *bpfCompiler) branch(test bpf.JumpTest, val uint32, t, f bpfLabel) {
+	c.ins = append(c.ins, bpf.JumpIf{Cond: test, Val: val, SkipTrue: 0, SkipFalse: 1})
+	c.jump(t)
+	c.jump(f)
+}
+
+func (c *bpfCompiler) assemble() ([]bpf.RawInstruction, error) {
+	for i, l := range c.jumps {
+		c.ins[i] = bpf.Jump{Skip: uint32(c.labels[l] - i - 1)}
+	}
+	return bpf.Assemble(c.ins)
+}
+
+// bpfAnd is true if all the conditions are true, true if there is no condition.
+func bpfAnd(conds ...bpfCond) bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) {
+		if len(conds) == 0 {
+			c.jump(t)
+			return
+		}
+		for _, cond := range conds[:len(conds)-1] {
+			next := c.newLabel()
+			cond(c, next, f)
+			c.mark(next)
+		}
+		conds[len(conds)-1](c, t, f)
+	}
+}
+
+// bpfOr is true if any of the conditions is true, false if there is no condition.
+func bpfOr(conds ...bpfCond) bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) {
+		if len(conds) == 0 {
+			c.jump(f)
+			return
+		}
+		for _, cond := range conds[:len(conds)-1] {
+			next := c.newLabel()
+			cond(c, t, next)
+			c.mark(next)
+		}
+		conds[len(conds)-1](c, t, f)
+	}
+}
+
+func bpfNot(cond bpfCond) bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) { cond(c, f, t) }
+}
+
+// bpfLoad tests the value of the size at the offset equals to val.
+func bpfLoad(offset, size, val uint32) bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) {
+		c.ins = append(c.ins, bpf.LoadAbsolute{Off: offset, Size: int(size)})
+		c.branch(bpf.JumpEqual, val, t, f)
+	}
+}
+
+// bpfVLANTagPresent tests the vlan tag stripped by the kernel, by the SKF_AD_VLAN_TAG_PRESENT extension.
+func bpfVLANTagPresent() bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) {
+		c.ins = append(c.ins, bpf.LoadExtension{Num: bpf.ExtVLANTagPresent})
+		c.branch(bpf.JumpNotEqual, 0, t, f)
+	}
+}
+
+// bpfLoadMasked tests the value of the size at the offset and the mask equals to val.
+func bpfLoadMasked(offset, size, mask, val uint32) bpfCond {
+	return func(c *bpfCompiler, t, f bpfLabel) {
+		c.ins = append(c.ins, bpf.LoadAbsolute{Off: offset, Size: int(size)}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		c.branch(bpf.JumpEqual, val, t, f)
+	}
+}
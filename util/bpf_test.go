@@ -0,0 +1,82 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/bpf"
+)
+
+func ipv6Packet(t *testing.T) []byte {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}, DstMAC: net.HardwareAddr{6, 5, 4, 3, 2, 1}, EthernetType: layers.EthernetTypeIPv6}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	tcp := &layers.TCP{SrcPort: 5000, DstPort: 8080}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	assert.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")))
+	return buf.Bytes()
+}
+
+func TestPacketFilter(t *testing.T) {
+	v4, v6 := encapsulate(t).Data(), ipv6Packet(t)
+	vxlan := encapsulate(t, outerUDP(DefaultVXLANPort)...).Data()
+
+	matches := func(f *PacketFilter, linkType layers.LinkType, data []byte) bool {
+		m, err := f.Matcher(linkType)
+		assert.Nil(t, err)
+		return m(gopacket.CaptureInfo{}, data)
+	}
+	newFilter := func(ip, ports string, decap *Decapsulator) *PacketFilter {
+		ips, err := ParseIPFilter(ip)
+		assert.Nil(t, err)
+		f, err := NewPacketFilter("", ips, ports, decap)
+		assert.Nil(t, err)
+		return f
+	}
+
+	f := newFilter("10.1.0.0/16,2001:db8::/32,!10.1.0.9", "80,8000-8080", nil)
+	assert.Equal(t, "tcp and (net 10.1.0.0/16 or net 2001:db8::/32) and not (host 10.1.0.9) and (port 80 or portrange 8000-8080)", f.Expr())
+	assert.True(t, matches(f, layers.LinkTypeEthernet, v4))
+	assert.True(t, matches(f, layers.LinkTypeEthernet, v6))
+	assert.True(t, matches(f, layers.LinkTypeRaw, v4[14:]))
+	assert.True(t, matches(f, layers.LinkTypeRaw, v6[14:]))
+	assert.False(t, matches(f, layers.LinkTypeEthernet, vxlan))
+
+	assert.False(t, matches(newFilter("", "443", nil), layers.LinkTypeEthernet, v4))
+	assert.False(t, matches(newFilter("!10.1.0.2", "", nil), layers.LinkTypeEthernet, v4))
+	assert.False(t, matches(newFilter("10.2.0.0/16", "", nil), layers.LinkTypeRaw, v4[14:]))
+	assert.False(t, matches(newFilter("2001:db9::/32", "", nil), layers.LinkTypeEthernet, v6))
+
+	decap, err := ParseDecapsulator("vxlan")
+	assert.Nil(t, err)
+	f = newFilter("10.1.0.0/16", "80", decap)
+	assert.True(t, matches(f, layers.LinkTypeEthernet, vxlan))
+	assert.True(t, matches(f, layers.LinkTypeEthernet, v4))
+
+	// the kernel strips the vlan tag before the filter of AF_PACKET sockets
+	program, err := f.SocketProgram(layers.LinkTypeEthernet)
+	assert.Nil(t, err)
+	var tagPresent, dot1Q bool
+	for _, raw := range program {
+		switch ins := raw.Disassemble().(type) {
+		case bpf.LoadExtension:
+			tagPresent = tagPresent || ins.Num == bpf.ExtVLANTagPresent
+		case bpf.JumpIf:
+			dot1Q = dot1Q || ins.Val == uint32(layers.EthernetTypeDot1Q)
+		}
+	}
+	assert.True(t, tagPresent)
+	assert.False(t, dot1Q)
+
+	_, err = NewPacketFilter("", nil, "0-80", nil)
+	assert.NotNil(t, err)
+
+	if libpcapCompile == nil {
+		_, err = (&PacketFilter{BPF: "tcp port 80"}).Program(layers.LinkTypeEthernet)
+		assert.Equal(t, ErrCustomBPF, err)
+	}
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+// CaptureSource captures the packets of a network device, like libpcap or AF_PACKET.
+type CaptureSource interface {
+	// Open starts to capture the packets passing the filter on the device until the ctx is done,
+	// the packets are marked with the index of the registered Interface.
+	// Each socket of a fanout group has its own channel, where the packets of a connection stay in.
+	Open(ctx context.Context, device string, filter *PacketFilter) ([]chan gopacket.Packet, error)
+}
+
+// CaptureConfig configures the capture source.
+type CaptureConfig struct {
+	Source   string // the name of the capture source, like pcap or afpacket, empty for the default one
+	Fanout   int    // the number of sockets in the fanout group for each device, AF_PACKET only
+	RingSize uint64 // the memory mapped ring buffer size of each socket, AF_PACKET only
+}
+
+var captureSources = map[string]func(conf CaptureConfig) CaptureSource{}
+
+// RegisterCaptureSource registers the capture source, libpcap only exists in the cgo builds, AF_PACKET only in linux.
+func RegisterCaptureSource(name string, create func(conf CaptureConfig) CaptureSource) {
+	captureSources[name] = create
+}
+
+// CaptureSources returns the names of the available capture sources.
+func CaptureSources() []string {
+	names := make([]string, 0, len(captureSources))
+	for name := range captureSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCaptureSource creates the capture source by the config, the default one is pcap if available.
+func NewCaptureSource(conf CaptureConfig) (CaptureSource, error) {
+	name := conf.Source
+	if name == "" {
+		if name = "pcap"; captureSources[name] == nil {
+			name = "afpacket"
+		}
+	}
+
+	create := captureSources[name]
+	if create == nil {
+		return nil, fmt.Errorf("capture source %q is not available in this build, available: %s",
+			name, strings.Join(CaptureSources(), ","))
+	}
+	return create(conf), nil
+}
@@ -0,0 +1,312 @@
+package util
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	RegisterCaptureSource("afpacket", func(conf CaptureConfig) CaptureSource { return &afpacketSource{conf: conf} })
+}
+
+const (
+	tpacketBlockSize    = 1 << 20 // a multiple of the page size, holds many frames
+	tpacketFrameSize    = 1 << 11
+	tpacketBlockTimeout = 10  // milliseconds before a block not full is retired to the user space
+	tpacketPollTimeout  = 100 // milliseconds to wait for a block before checking the shutdown
+	// DefaultRingSize is the default memory mapped ring buffer size of each AF_PACKET socket.
+	DefaultRingSize = 64 << 20
+)
+
+// fanoutGroups generates the ids of the fanout groups, one group for each device.
+var fanoutGroups = atomic.Uint32{}
+
+// afpacketSource captures the packets by the memory mapped TPACKET_V3 ring of AF_PACKET sockets,
+// without libpcap, the bpf is compiled by PacketFilter.Program.
+type afpacketSource struct{ conf CaptureConfig }
+
+func (s *afpacketSource) Open(ctx context.Context, device string, filter *PacketFilter) ([]chan gopacket.Packet, error) {
+	fanout := s.conf.Fanout
+	if fanout < 1 {
+		fanout = 1
+	}
+	group := uint16(os.Getpid()) + uint16(fanoutGroups.Add(1))
+
+	var channels []chan gopacket.Packet
+	for i := 0; i < fanout; i++ {
+		t, err := openTPacket(device, filter, s.conf.RingSize)
+		if err == nil && fanout > 1 {
+			err = t.setFanout(group)
+		}
+		if err != nil {
+			if t != nil {
+				t.Close()
+			}
+			if len(channels) > 0 { // the started ones are left to the reading goroutines
+				log.Printf("open %d of %d fanout sockets on %s, error: %v", i, fanout, device, err)
+				break
+			}
+			return nil, err
+		}
+		channels = append(channels, t.packets(ctx))
+	}
+	return channels, nil
+}
+
+// tpacket is an AF_PACKET socket with its TPACKET_V3 rx ring.
+type tpacket struct {
+	fd       int
+	ring     []byte
+	blockNr  int
+	device   string
+	linkType layers.LinkType
+	index    int           // the registered interface index of the device, 0 for any
+	ifaces   map[int32]int // kernel ifindex to the registered interface index, for any
+}
+
+// openTPacket opens the socket on the device, any for all devices. The ethernet devices are captured with
+// their link layer headers, others, like tun and the any device, without them.
+func openTPacket(device string, filter *PacketFilter, ringSize uint64) (*tpacket, error) {
+	t := &tpacket{fd: -1, device: device, linkType: layers.LinkTypeRaw}
+	sockType, ifindex := unix.SOCK_DGRAM, 0
+	if device != "any" {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return nil, err
+		}
+		ifindex = iface.Index
+		if deviceLinkType(device) == layers.LinkTypeEthernet {
+			sockType, t.linkType = unix.SOCK_RAW, layers.LinkTypeEthernet
+		}
+		t.index = RegisterInterface(Interface{Name: device, LinkType: t.linkType})
+	} else {
+		t.ifaces = map[int32]int{}
+	}
+
+	// protocol 0 receives nothing before the filter and the ring are ready, until the bind with ETH_P_ALL
+	fd, err := unix.Socket(unix.AF_PACKET, sockType|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open AF_PACKET socket: %w", err)
+	}
+	t.fd = fd
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return t, fmt.Errorf("set TPACKET_V3: %w", err)
+	}
+	if err := t.attachFilter(filter); err != nil {
+		return t, err
+	}
+	if err := t.mapRing(ringSize); err != nil {
+		return t, err
+	}
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}
+	if err := unix.Bind(fd, sa); err != nil {
+		return t, fmt.Errorf("bind AF_PACKET socket to %s: %w", device, err)
+	}
+	return t, nil
+}
+
+// deviceLinkType returns the link type of the device by its ARPHRD type in sysfs,
+// LinkTypeRaw for the ones captured without link layer headers.
+func deviceLinkType(device string) layers.LinkType {
+	b, err := os.ReadFile("/sys/class/net/" + device + "/type")
+	if err != nil {
+		return layers.LinkTypeRaw
+	}
+	switch arphrd, _ := strconv.Atoi(strings.TrimSpace(string(b))); arphrd {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return layers.LinkTypeEthernet
+	default:
+		return layers.LinkTypeRaw
+	}
+}
+
+func (t *tpacket) attachFilter(filter *PacketFilter) error {
+	if filter.Expr() == "" {
+		return nil
+	}
+	program, err := filter.SocketProgram(t.linkType)
+	if err != nil {
+		return err
+	}
+	if len(program) > unix.BPF_MAXINSNS {
+		return fmt.Errorf("bpf of %d instructions exceeds the kernel limit %d, narrow the -ip and -port filters",
+			len(program), unix.BPF_MAXINSNS)
+	}
+	log.Printf("BPF on %s: %s", t.device, filter.Expr())
+
+	ins := make([]unix.SockFilter, len(program))
+	for i, v := range program {
+		ins[i] = unix.SockFilter{Code: v.Op, Jt: v.Jt, Jf: v.Jf, K: v.K}
+	}
+	prog := &unix.SockFprog{Len: uint16(len(ins)), Filter: &ins[0]}
+	if err := unix.SetsockoptSockFprog(t.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		return fmt.Errorf("attach bpf: %w", err)
+	}
+	return nil
+}
+
+func (t *tpacket) mapRing(ringSize uint64) error {
+	if ringSize == 0 {
+		ringSize = DefaultRingSize
+	}
+	if t.blockNr = int(ringSize / tpacketBlockSize); t.blockNr < 1 {
+		t.blockNr = 1
+	}
+
+	req := &unix.TpacketReq3{
+		Block_size:     tpacketBlockSize,
+		Block_nr:       uint32(t.blockNr),
+		Frame_size:     tpacketFrameSize,
+		Frame_nr:       uint32(t.blockNr * tpacketBlockSize / tpacketFrameSize),
+		Retire_blk_tov: tpacketBlockTimeout,
+	}
+	if err := unix.SetsockoptTpacketReq3(t.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, req); err != nil {
+		return fmt.Errorf("set rx ring of %d blocks: %w", t.blockNr, err)
+	}
+
+	ring, err := unix.Mmap(t.fd, 0, t.blockNr*tpacketBlockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap rx ring: %w", err)
+	}
+	t.ring = ring
+	return nil
+}
+
+// setFanout joins the socket to the fanout group, the packets are distributed by the hash of the flow,
+// and the fragments are defragmented to go to the same socket.
+func (t *tpacket) setFanout(group uint16) error {
+	// the flags in the high 16 bits overflow int on the 32-bit targets, so the bits are passed as int32
+	arg := uint32(group) | uint32(unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16
+	if err := unix.SetsockoptInt(t.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(int32(arg))); err != nil {
+		return fmt.Errorf("join fanout group %d: %w", group, err)
+	}
+	return nil
+}
+
+func (t *tpacket) Close() error {
+	if t.ring != nil {
+		_ = unix.Munmap(t.ring)
+		t.ring = nil
+	}
+	return unix.Close(t.fd)
+}
+
+// packets reads the blocks of the ring in order until the ctx is done,
+// each block is returned to the kernel after its packets are copied.
+func (t *tpacket) packets(ctx context.Context) chan gopacket.Packet {
+	packets := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(packets)
+		defer t.Close()
+
+		pfd := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN | unix.POLLERR}}
+		for block := 0; ; block = (block + 1) % t.blockNr {
+			b := t.ring[block*tpacketBlockSize : (block+1)*tpacketBlockSize]
+			// struct tpacket_block_desc { __u32 version; __u32 offset_to_priv; union tpacket_bd_header_u hdr; }
+			hdr := (*unix.TpacketHdrV1)(unsafe.Pointer(&b[8]))
+			for atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+				if ctx.Err() != nil {
+					return
+				}
+				if _, err := unix.Poll(pfd, tpacketPollTimeout); err != nil && err != unix.EINTR {
+					log.Printf("poll AF_PACKET socket of %s error: %v", t.device, err)
+					return
+				}
+			}
+
+			t.readBlock(ctx, b, hdr, packets)
+			atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return packets
+}
+
+// sizeofTpacket3Hdr is TPACKET_ALIGN(sizeof(struct tpacket3_hdr)), where the sockaddr_ll follows.
+const sizeofTpacket3Hdr = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+
+func (t *tpacket) readBlock(ctx context.Context, b []byte, hdr *unix.TpacketHdrV1, packets chan gopacket.Packet) {
+	off := hdr.Offset_to_first_pkt
+	for i := uint32(0); i < hdr.Num_pkts; i++ {
+		ph := (*unix.Tpacket3Hdr)(unsafe.Pointer(&b[off]))
+		start := off + uint32(ph.Mac)
+		frame := b[start : start+ph.Snaplen]
+		ci := gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(ph.Sec), int64(ph.Nsec)),
+			CaptureLength:  int(ph.Snaplen),
+			Length:         int(ph.Len),
+			InterfaceIndex: t.index,
+		}
+
+		var data []byte
+		if ph.Status&unix.TP_STATUS_VLAN_VALID != 0 && t.linkType == layers.LinkTypeEthernet && len(frame) >= 12 {
+			// the kernel strips the vlan tag into the header, put it back for the Decapsulator
+			tpid := uint16(layers.EthernetTypeDot1Q)
+			if ph.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+				tpid = ph.Hv1.Vlan_tpid
+			}
+			data = make([]byte, len(frame)+4)
+			copy(data, frame[:12])
+			binary.BigEndian.PutUint16(data[12:], tpid)
+			binary.BigEndian.PutUint16(data[14:], uint16(ph.Hv1.Vlan_tci))
+			copy(data[16:], frame[12:])
+			ci.CaptureLength += 4
+			ci.Length += 4
+		} else {
+			data = append([]byte(nil), frame...)
+		}
+
+		if t.ifaces != nil {
+			// struct sockaddr_ll { unsigned short sll_family; __be16 sll_protocol; int sll_ifindex; ... }
+			ifindex := *(*int32)(unsafe.Pointer(&b[off+sizeofTpacket3Hdr+4]))
+			ci.InterfaceIndex = t.interfaceIndex(ifindex)
+		}
+
+		p := gopacket.NewPacket(data, t.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = ci
+		select {
+		case packets <- p:
+		case <-ctx.Done():
+			return
+		}
+
+		off += ph.Next_offset
+	}
+}
+
+// interfaceIndex registers the device of the kernel ifindex captured by the any device.
+func (t *tpacket) interfaceIndex(ifindex int32) int {
+	if index, ok := t.ifaces[ifindex]; ok {
+		return index
+	}
+	name := strconv.Itoa(int(ifindex))
+	if iface, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+		name = iface.Name
+	}
+	index := RegisterInterface(Interface{Name: name, LinkType: layers.LinkTypeRaw})
+	t.ifaces[ifindex] = index
+	return index
+}
+
+// htons converts the short from the host to the network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
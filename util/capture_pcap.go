@@ -0,0 +1,98 @@
+//go:build cgo
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+func init() {
+	RegisterCaptureSource("pcap", func(CaptureConfig) CaptureSource { return libpcapSource{} })
+
+	libpcapCompile = func(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+		ins, err := pcap.CompileBPFFilter(linkType, 65536, expr)
+		if err != nil {
+			return nil, err
+		}
+		raw := make([]bpf.RawInstruction, len(ins))
+		for i, v := range ins {
+			raw[i] = bpf.RawInstruction{Op: v.Code, Jt: v.Jt, Jf: v.Jf, K: v.K}
+		}
+		return raw, nil
+	}
+
+	libpcapMatcher = func(linkType layers.LinkType, expr string) (func(ci gopacket.CaptureInfo, data []byte) bool, error) {
+		b, err := pcap.NewBPF(linkType, 65536, expr)
+		if err != nil {
+			return nil, fmt.Errorf("compile bpf %q for %s: %w", expr, linkType, err)
+		}
+		return b.Matches, nil
+	}
+}
+
+// libpcapSource captures the packets by libpcap.
+type libpcapSource struct{}
+
+func (libpcapSource) Open(_ context.Context, device string, filter *PacketFilter) ([]chan gopacket.Packet, error) {
+	packets, err := OpenSingleDevice(device, filter)
+	if err != nil {
+		return nil, err
+	}
+	return []chan gopacket.Packet{packets}, nil
+}
+
+func OpenSingleDevice(device string, filter *PacketFilter) (localPackets chan gopacket.Packet, err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			switch x := msg.(type) {
+			case string:
+				err = errors.New(x)
+			case error:
+				err = x
+			default:
+				err = fmt.Errorf("%v", msg)
+			}
+			localPackets = nil
+		}
+	}()
+	handle, err := pcap.OpenLive(device, 65536, false, pcap.BlockForever)
+	if err != nil {
+		return
+	}
+
+	if err = setDeviceFilter(handle, filter); err != nil {
+		return
+	}
+	index := RegisterInterface(Interface{Name: device, LinkType: handle.LinkType()})
+	localPackets = listenOneSource(handle, index)
+	return
+}
+
+// listenOneSource reads the packets of the handle, marking them with the interface index.
+func listenOneSource(handle *pcap.Handle, index int) chan gopacket.Packet {
+	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+	packets := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(packets)
+		for p := range ps.Packets() {
+			p.Metadata().InterfaceIndex = index
+			packets <- p
+		}
+	}()
+	return packets
+}
+
+// set packet capture filter, by ip and port
+func setDeviceFilter(handle *pcap.Handle, filter *PacketFilter) error {
+	expr := filter.Expr()
+	log.Printf("BPF: %s", expr)
+	return handle.SetBPFFilter(expr)
+}
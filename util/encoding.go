@@ -0,0 +1,185 @@
+package util
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxDecodeRatio is the max ratio of the decoded bytes to the encoded ones, above it the body is a decompression bomb.
+	maxDecodeRatio = 1000
+	// minBombSize is the decoded bytes, below which the ratio is not checked, like the small bodies of repeated bytes.
+	minBombSize = 1 << 20
+)
+
+// ErrDecompressionBomb is returned when the body decodes to far more bytes than it is encoded.
+var ErrDecompressionBomb = errors.New("decompression bomb")
+
+// BodyDecoder decodes the body by its Content-Encoding as it is read, like gzip, or the stacked ones like gzip, br.
+type BodyDecoder struct {
+	Encodings []string // in the order they are applied, like gzip, br
+	Encoded   int64    // bytes of the encoded body, known after the decoder is closed
+	Decoded   int64    // bytes of the body decoded
+	Truncated bool     // the decoded body exceeds the limit
+
+	limit   int64
+	encoded *countingReader
+	r       io.Reader
+	closers []io.Closer
+	err     error
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewBodyDecoder creates the decoder of the body by the Content-Encoding of the header, whose decoded bytes
+// are limited by limit if it is positive. It returns nil if the body is not encoded, or it is empty,
+// or any of its encodings is not supported like compress, then the body is read as it is from body.
+// The Content-Encoding and Content-Length are removed from the header, as they do not apply to the decoded body.
+func NewBodyDecoder(header http.Header, body io.Reader, limit int64) (*BodyDecoder, error) {
+	var encodings []string
+	for _, v := range header.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+				if !supportedEncodings[e] {
+					return nil, nil
+				}
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	if len(encodings) == 0 {
+		return nil, nil
+	}
+	br := bufio.NewReader(body)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil, nil
+	}
+
+	d := &BodyDecoder{Encodings: encodings, limit: limit, encoded: &countingReader{r: br}}
+	d.r = d.encoded
+	for i := len(encodings) - 1; i >= 0; i-- { // the last applied is the first to be decoded
+		if err := d.push(encodings[i]); err != nil {
+			d.closeDecoders()
+			return nil, fmt.Errorf("decode %s: %w", encodings[i], err)
+		}
+	}
+
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return d, nil
+}
+
+// supportedEncodings are the content encodings decoded.
+var supportedEncodings = map[string]bool{"gzip": true, "x-gzip": true, "deflate": true, "br": true, "zstd": true}
+
+func (d *BodyDecoder) push(encoding string) error {
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(d.r)
+		if err != nil {
+			return err
+		}
+		d.r, d.closers = r, append(d.closers, r)
+	case "deflate":
+		// it should be zlib wrapped, but some servers send the raw deflate.
+		br := bufio.NewReader(d.r)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			r, err := zlib.NewReader(br)
+			if err != nil {
+				return err
+			}
+			d.r, d.closers = r, append(d.closers, r)
+		} else {
+			r := flate.NewReader(br)
+			d.r, d.closers = r, append(d.closers, r)
+		}
+	case "br":
+		d.r = brotli.NewReader(d.r)
+	case "zstd":
+		r, err := zstd.NewReader(d.r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return err
+		}
+		d.r, d.closers = r, append(d.closers, r.IOReadCloser())
+	default:
+		return errors.New("unsupported content encoding")
+	}
+	return nil
+}
+
+// Read reads the decoded body, io.EOF is returned at the limit.
+func (d *BodyDecoder) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if d.limit > 0 {
+		if d.Decoded >= d.limit {
+			var one [1]byte
+			if n, _ := io.ReadFull(d.r, one[:]); n > 0 {
+				d.Truncated = true
+			}
+			d.err = io.EOF
+			return 0, d.err
+		}
+		if remain := d.limit - d.Decoded; int64(len(p)) > remain {
+			p = p[:remain]
+		}
+	}
+
+	n, err := d.r.Read(p)
+	d.Decoded += int64(n)
+	if d.Decoded > minBombSize && d.Decoded > maxDecodeRatio*d.encoded.n {
+		err = fmt.Errorf("%w: %d bytes decoded from %d bytes", ErrDecompressionBomb, d.Decoded, d.encoded.n)
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// Close closes the decoders, and reads the rest of the encoded body to count its size.
+func (d *BodyDecoder) Close() error {
+	d.closeDecoders()
+	_, _ = io.Copy(io.Discard, d.encoded)
+	d.Encoded = d.encoded.n
+	return nil
+}
+
+func (d *BodyDecoder) closeDecoders() {
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		_ = d.closers[i].Close()
+	}
+	d.closers = nil
+}
+
+// String returns the sizes like gzip, br 10240 bytes decoded from 1024 bytes, truncated at 4096 bytes.
+func (d *BodyDecoder) String() string {
+	s := fmt.Sprintf("%s %d bytes decoded from %d bytes", strings.Join(d.Encodings, ", "), d.Decoded, d.Encoded)
+	if d.Truncated {
+		s += fmt.Sprintf(", truncated at %d bytes", d.limit)
+	}
+	if d.err != nil && d.err != io.EOF {
+		s += ", " + d.err.Error()
+	}
+	return s
+}
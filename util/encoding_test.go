@@ -0,0 +1,77 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyDecoder(t *testing.T) {
+	body := strings.Repeat("hello world\n", 100)
+	var gz, br, zs bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(body))
+	_ = gw.Close()
+	bw := brotli.NewWriter(&br)
+	_, _ = bw.Write(gz.Bytes())
+	_ = bw.Close()
+	zw, _ := zstd.NewWriter(&zs)
+	_, _ = zw.Write([]byte(body))
+	_ = zw.Close()
+
+	decode := func(encoding string, encoded []byte, limit int64) (*BodyDecoder, string, error) {
+		header := http.Header{"Content-Encoding": {encoding}, "Content-Length": {"1"}}
+		d, err := NewBodyDecoder(header, bytes.NewReader(encoded), limit)
+		if err != nil || d == nil {
+			return d, "", err
+		}
+		assert.Empty(t, header.Get("Content-Encoding"))
+		decoded, err := io.ReadAll(d)
+		_ = d.Close()
+		return d, string(decoded), err
+	}
+
+	d, decoded, err := decode("gzip, br", br.Bytes(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, body, decoded)
+	assert.Equal(t, "gzip, br 1200 bytes decoded from "+strconv.Itoa(br.Len())+" bytes", d.String())
+
+	d, decoded, err = decode("zstd", zs.Bytes(), 100)
+	assert.Nil(t, err)
+	assert.Equal(t, body[:100], decoded)
+	assert.True(t, d.Truncated)
+	assert.Equal(t, int64(zs.Len()), d.Encoded)
+
+	d, _, err = decode("identity", []byte(body), 0)
+	assert.Nil(t, d)
+	assert.Nil(t, err)
+	// the body of the unsupported encoding is read as it is, and the empty one is not decoded
+	d, _, err = decode("gzip, compress", []byte(body), 0)
+	assert.Nil(t, d)
+	assert.Nil(t, err)
+	d, _, err = decode("gzip", nil, 0)
+	assert.Nil(t, d)
+	assert.Nil(t, err)
+
+	var inner, bomb bytes.Buffer // 16MiB zeros gzipped twice to about 100 bytes
+	gw = gzip.NewWriter(&inner)
+	for i := 0; i < 16; i++ {
+		_, _ = gw.Write(make([]byte, 1<<20))
+	}
+	_ = gw.Close()
+	gw = gzip.NewWriter(&bomb)
+	_, _ = gw.Write(inner.Bytes())
+	_ = gw.Close()
+	_, decoded, err = decode("gzip, gzip", bomb.Bytes(), 0)
+	assert.True(t, errors.Is(err, ErrDecompressionBomb))
+	assert.Less(t, len(decoded), 16<<20)
+}
@@ -2,9 +2,6 @@ package util
 
 import (
 	"bytes"
-	"compress/gzip"
-	"compress/zlib"
-	"io"
 	"net/http"
 	"strings"
 	"unsafe"
@@ -32,6 +29,42 @@ func HasRequestTitle(payload []byte) bool {
 	return yes
 }
 
+// IndexRequestTitle returns the index of the first HTTP/1 request title in the payload, -1 if none.
+// The title may follow the end of the previous message directly, like a body without a line break.
+func IndexRequestTitle(payload []byte) int {
+	for i := 0; ; {
+		n := bytes.Index(payload[i:], []byte(" HTTP/1."))
+		if n < 0 {
+			return -1
+		}
+		version := i + n
+		// the title is the method, the uri without spaces and the version
+		if sp := bytes.LastIndexByte(payload[:version], ' '); sp > 0 {
+			for method := range Methods {
+				start := sp - len(method)
+				if start >= 0 && string(payload[start:sp]) == method && HasRequestTitle(payload[start:]) {
+					return start
+				}
+			}
+		}
+		i = version + 1
+	}
+}
+
+// IndexResponseTitle returns the index of the first HTTP/1 response title in the payload, -1 if none.
+func IndexResponseTitle(payload []byte) int {
+	for i := 0; ; {
+		n := bytes.Index(payload[i:], []byte("HTTP/1."))
+		if n < 0 {
+			return -1
+		}
+		if HasResponseTitle(payload[i+n:]) {
+			return i + n
+		}
+		i += n + 1
+	}
+}
+
 // ParseRequestTitle reports whether this payload has an HTTP/1 request title
 func ParseRequestTitle(payload []byte) (method string, yes bool) {
 	s := SliceToString(payload)
@@ -343,20 +376,3 @@ var hexTable = [128]byte{
 	'0': 0, '1': 1, '2': 2, '3': 3, '4': 4, '5': 5, '6': 6, '7': 7, '8': 8, '9': 9, 'A': 10, 'a': 10,
 	'B': 11, 'b': 11, 'C': 12, 'c': 12, 'D': 13, 'd': 13, 'E': 14, 'e': 14, 'F': 15, 'f': 15,
 }
-
-func TryDecompress(header http.Header, reader io.ReadCloser) (io.ReadCloser, bool) {
-	var err error
-	nr := reader
-	switch c := header.Get("Content-Encoding"); c {
-	case "gzip":
-		nr, err = gzip.NewReader(reader)
-		header.Del("Content-Encoding")
-		header.Del("Content-Length")
-	case "deflate":
-		nr, err = zlib.NewReader(reader)
-		header.Del("Content-Encoding")
-		header.Del("Content-Length")
-	}
-
-	return nr, err == nil
-}
@@ -132,6 +132,32 @@ func TestHasRequestTitle(t *testing.T) {
 	}
 }
 
+func TestIndexTitle(t *testing.T) {
+	req := map[string]int{
+		"GET / HTTP/1.1\r\n": 0,
+		"name=a&age=1\r\nPOST /post HTTP/1.1\r\nHost: a\r\n": 14,
+		"{\"a\":1}GET / HTTP/1.1\r\n":                        7,
+		"GET  HTTP/1.1\r\n":                                  -1,
+		"HTTP/1.1 200 OK\r\n\r\n":                            -1,
+		"":                                                   -1,
+	}
+	for k, v := range req {
+		assert.Equal(t, v, IndexRequestTitle([]byte(k)), k)
+	}
+
+	rsp := map[string]int{
+		"HTTP/1.1 200 OK\r\n":                      0,
+		"0\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n": 5,
+		"helloHTTP/1.1 200 OK\r\n":                 5,
+		"GET / HTTP/1.1\r\n":                       -1,
+		"HTTP/1.1 2\r\n":                           -1,
+		"hello":                                    -1,
+	}
+	for k, v := range rsp {
+		assert.Equal(t, v, IndexResponseTitle([]byte(k)), k)
+	}
+}
+
 func TestHasFullPayload(t *testing.T) {
 	var m string
 	var got, expected bool
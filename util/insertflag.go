@@ -2,7 +2,7 @@ package util
 
 type IntSetFlag IntSet
 
-func (i *IntSetFlag) String() string { return "" }
+func (i *IntSetFlag) String() string { return (*IntSet)(i).String() }
 
 func (i *IntSetFlag) Set(value string) error {
 	set, err := ParseIntSet(value)
@@ -77,6 +77,9 @@ func (s IntSet) Contains(value int) bool {
 	return false
 }
 
+// Ranges returns the ranges of the set, empty means all values.
+func (s IntSet) Ranges() []IntRange { return s.ranges }
+
 // IntRange is a ange of int value.
 type IntRange struct {
 	Start, End int // inclusive
@@ -0,0 +1,183 @@
+package util
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IPFilter filters the packets by IPv4/IPv6 addresses, CIDR blocks and ranges, with exclusions, like
+// 10.0.0.0/8,2001:db8::/32,192.168.1.1-192.168.1.100,!10.1.2.3.
+// A packet passes when either of its src and dst is included (or there is no inclusion),
+// and none of them is excluded.
+type IPFilter struct {
+	Include []netip.Prefix
+	Exclude []netip.Prefix
+}
+
+// ParseIPFilter parses the comma separated ip filters, returns nil if s is empty.
+func ParseIPFilter(s string) (*IPFilter, error) {
+	f := &IPFilter{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		exclude := strings.HasPrefix(item, "!")
+		if item = strings.TrimSpace(strings.TrimPrefix(item, "!")); item == "" {
+			continue
+		}
+
+		prefixes, err := parseIPPrefixes(item)
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			f.Exclude = append(f.Exclude, prefixes...)
+		} else {
+			f.Include = append(f.Include, prefixes...)
+		}
+	}
+
+	if len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// parseIPPrefixes parses an ip, a CIDR block, or an ip range which is split into the fewest CIDR blocks.
+func parseIPPrefixes(s string) ([]netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s: %w", s, err)
+		}
+		return []netip.Prefix{p.Masked()}, nil
+	}
+
+	from, to, isRange := strings.Cut(s, "-")
+	a, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %s: %w", from, err)
+	}
+	a = a.Unmap()
+	if !isRange {
+		return []netip.Prefix{netip.PrefixFrom(a, a.BitLen())}, nil
+	}
+
+	b, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %s: %w", to, err)
+	}
+	b = b.Unmap()
+	if a.Is4() != b.Is4() {
+		return nil, fmt.Errorf("invalid ip range %s, mixed IPv4 and IPv6", s)
+	}
+	if b.Less(a) {
+		return nil, fmt.Errorf("invalid ip range %s, %s > %s", s, a, b)
+	}
+	return rangePrefixes(a, b), nil
+}
+
+// rangePrefixes splits the ip range [a, b] into the fewest CIDR blocks.
+func rangePrefixes(a, b netip.Addr) (prefixes []netip.Prefix) {
+	for {
+		bits := a.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(a, bits-1).Masked()
+			if p.Addr() != a || b.Less(lastAddr(p)) {
+				break
+			}
+			bits--
+		}
+
+		p := netip.PrefixFrom(a, bits)
+		prefixes = append(prefixes, p)
+		last := lastAddr(p)
+		if a = last.Next(); last == b || !a.IsValid() {
+			return prefixes
+		}
+	}
+}
+
+// lastAddr returns the last address of the prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	s := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(s)*8; i++ {
+		s[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(s)
+	return a
+}
+
+// BPF returns the compact bpf expression of the filter, like (net 10.0.0.0/8 or host 2001:db8::1) and not (host 10.1.2.3).
+func (f *IPFilter) BPF() string {
+	if f == nil {
+		return ""
+	}
+
+	var expr []string
+	if len(f.Include) > 0 {
+		expr = append(expr, "("+bpfPrefixes(f.Include)+")")
+	}
+	if len(f.Exclude) > 0 {
+		expr = append(expr, "not ("+bpfPrefixes(f.Exclude)+")")
+	}
+	return strings.Join(expr, " and ")
+}
+
+func bpfPrefixes(prefixes []netip.Prefix) string {
+	terms := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		if p.IsSingleIP() {
+			terms[i] = "host " + p.Addr().String()
+		} else {
+			terms[i] = "net " + p.String()
+		}
+	}
+	return strings.Join(terms, " or ")
+}
+
+// containsIP tells whether the ip is in any of the prefixes.
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits tells whether a packet between the src and dst passes the filter, invalid addresses are neither
+// included nor excluded. A nil filter permits everything.
+func (f *IPFilter) Permits(src, dst netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	src, dst = src.Unmap(), dst.Unmap()
+	if containsIP(f.Exclude, src) || containsIP(f.Exclude, dst) {
+		return false
+	}
+	return len(f.Include) == 0 || containsIP(f.Include, src) || containsIP(f.Include, dst)
+}
+
+// String returns the filter in the form parsed by ParseIPFilter.
+func (f *IPFilter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	var items []string
+	for _, p := range f.Include {
+		items = append(items, prefixString(p))
+	}
+	for _, p := range f.Exclude {
+		items = append(items, "!"+prefixString(p))
+	}
+	return strings.Join(items, ",")
+}
+
+func prefixString(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
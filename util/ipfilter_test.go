@@ -0,0 +1,47 @@
+package util
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPFilter(t *testing.T) {
+	f, err := ParseIPFilter("10.0.0.0/8, 2001:db8::1/32, 192.168.1.0-192.168.1.130, !10.1.2.3")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8,2001:db8::/32,192.168.1.0/25,192.168.1.128/31,192.168.1.130,!10.1.2.3", f.String())
+	assert.Equal(t, "(net 10.0.0.0/8 or net 2001:db8::/32 or net 192.168.1.0/25 or net 192.168.1.128/31 or host 192.168.1.130)"+
+		" and not (host 10.1.2.3)", f.BPF())
+
+	addr := netip.MustParseAddr
+	assert.True(t, f.Permits(addr("10.2.3.4"), addr("8.8.8.8")))
+	assert.True(t, f.Permits(addr("8.8.8.8"), addr("2001:db8:1::1")))
+	assert.True(t, f.Permits(addr("::ffff:192.168.1.129"), addr("8.8.8.8")))
+	assert.False(t, f.Permits(addr("192.168.1.131"), addr("8.8.8.8")))
+	assert.False(t, f.Permits(addr("10.2.3.4"), addr("10.1.2.3")))
+
+	f, err = ParseIPFilter("!10.1.2.3")
+	assert.Nil(t, err)
+	assert.Equal(t, "not (host 10.1.2.3)", f.BPF())
+	assert.True(t, f.Permits(addr("8.8.8.8"), addr("2001:db8::1")))
+
+	f, err = ParseIPFilter(" ")
+	assert.Nil(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.Permits(netip.Addr{}, netip.Addr{}))
+
+	_, err = ParseIPFilter("10.0.0.2-10.0.0.1")
+	assert.NotNil(t, err)
+	_, err = ParseIPFilter("10.0.0.1-2001:db8::1")
+	assert.NotNil(t, err)
+	_, err = ParseIPFilter("10.0.0.256")
+	assert.NotNil(t, err)
+}
+
+func TestRangePrefixes(t *testing.T) {
+	addr := netip.MustParseAddr
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}, rangePrefixes(addr("0.0.0.0"), addr("255.255.255.255")))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8::/127"), netip.MustParsePrefix("2001:db8::2/128")},
+		rangePrefixes(addr("2001:db8::"), addr("2001:db8::2")))
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"strings"
+)
+
+// PathTemplate normalizes the variable segments of a url path, so that the paths of the same api share one template,
+// e.g. /users/123/orders/9f1c2d3e-4b5a-6789-abcd-ef0123456789?x=1 to /users/{int}/orders/{uuid}.
+func PathTemplate(p string) string {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		switch {
+		case seg == "":
+		case isDigits(seg):
+			segments[i] = "{int}"
+		case isUUID(seg):
+			segments[i] = "{uuid}"
+		case len(seg) >= 16 && isHex(seg):
+			segments[i] = "{hex}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID checks the 8-4-4-4-12 form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for _, p := range []int{8, 13, 18, 23} {
+		if s[p] != '-' {
+			return false
+		}
+	}
+	return isHex(s[:8]) && isHex(s[9:13]) && isHex(s[14:18]) && isHex(s[19:23]) && isHex(s[24:])
+}
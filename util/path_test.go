@@ -0,0 +1,14 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathTemplate(t *testing.T) {
+	assert.Equal(t, "/users/{int}/orders", PathTemplate("/users/123/orders?x=1"))
+	assert.Equal(t, "/o/{uuid}", PathTemplate("/o/9f1c2d3e-4b5a-6789-abcd-ef0123456789"))
+	assert.Equal(t, "/t/{hex}/v1", PathTemplate("/t/fda9138b7f0000016ac0ad3e/v1"))
+	assert.Equal(t, "/", PathTemplate("/"))
+}
@@ -2,29 +2,65 @@ package util
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 type Assembler interface {
-	Assemble(flow gopacket.Flow, tcp *layers.TCP, timestamp time.Time)
+	Assemble(flow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo)
 	FlushOlderThan(time time.Time)
 	FinishAll()
 }
 
-func LoopPackets(ctx context.Context, packets chan gopacket.Packet, assembler Assembler, idle time.Duration) {
+// PacketAssembler is an Assembler which wants the whole packet besides the tcp layer, like the pcap writer.
+type PacketAssembler interface {
+	Assembler
+	AssemblePacket(p gopacket.Packet, flow gopacket.Flow, tcp *layers.TCP)
+}
+
+// LoopPackets assembles the tcp packets, the tunnel layers are peeled by the decap if it is not nil.
+// Each source, like a socket of a fanout group, is decoded in its own goroutine, as the packets of a connection
+// stay in one source, the assembler must be safe for the concurrent sources, like the ShardedAssembler.
+func LoopPackets(ctx context.Context, sources []chan gopacket.Packet, assembler Assembler, idle time.Duration, decap *Decapsulator) {
+	defer assembler.FinishAll()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, packets := range sources {
+		wg.Add(1)
+		go func(packets chan gopacket.Packet) {
+			defer wg.Done()
+			decodePackets(ctx, packets, assembler, decap)
+		}(packets)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
 	ticker := time.NewTicker(time.Second * 10)
 	defer ticker.Stop()
-	defer assembler.FinishAll()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// flush connections that haven't been activity in the idle time
+			assembler.FlushOlderThan(time.Now().Add(-idle))
+		}
+	}
+}
+
+// decodePackets assembles the tcp packets of the source until it ends or the ctx is done.
+func decodePackets(ctx context.Context, packets chan gopacket.Packet, assembler Assembler, decap *Decapsulator) {
+	pa, _ := assembler.(PacketAssembler)
 
 	for {
 		select {
@@ -33,33 +69,59 @@ func LoopPackets(ctx context.Context, packets chan gopacket.Packet, assembler As
 				return
 			}
 
-			// only assembly tcp/ip packets
-			n, t := p.NetworkLayer(), p.TransportLayer()
-			if n == nil || t == nil || t.LayerType() != layers.LayerTypeTCP {
+			flow, tcp, ok := packetTCP(p, decap)
+			if !ok { // only assembly tcp/ip packets
 				continue
 			}
 
-			assembler.Assemble(n.NetworkFlow(), t.(*layers.TCP), p.Metadata().Timestamp)
-		case <-ticker.C:
-			// flush connections that haven't been activity in the idle time
-			assembler.FlushOlderThan(time.Now().Add(-idle))
+			if pa != nil {
+				pa.AssemblePacket(p, flow, tcp)
+			} else {
+				assembler.Assemble(flow, tcp, p.Metadata().CaptureInfo)
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func CreatePacketsChan(input, bpf, host, ips, ports string) (isPcapFil bool, pc chan gopacket.Packet, err error) {
-	if v, err := os.Stat(input); err == nil && !v.IsDir() {
-		handle, err := pcap.OpenOffline(input) // read from pcap file
+func packetTCP(p gopacket.Packet, decap *Decapsulator) (flow gopacket.Flow, tcp *layers.TCP, ok bool) {
+	if decap != nil {
+		return decap.Decapsulate(p)
+	}
+
+	n, t := p.NetworkLayer(), p.TransportLayer()
+	if n == nil || t == nil || t.LayerType() != layers.LayerTypeTCP {
+		return flow, nil, false
+	}
+	return n.NetworkFlow(), t.(*layers.TCP), true
+}
+
+// CreatePacketsChan opens the packets of the input, which is a device captured by the capture source,
+// or pcap files, or - for the pcap stream from stdin. isPcapFile is false when capturing all devices of the host.
+// The devices captured by a fanout group have a channel for each socket, the others have only one.
+func CreatePacketsChan(ctx context.Context, input, host string, filter *PacketFilter, conf CaptureConfig) (isPcapFile bool, pc []chan gopacket.Packet, err error) {
+	if input == "-" { // read from the pcap/pcapng stream of stdin, like tcpdump -w - | httpdump -i -
+		packets, err := OpenPcapStream(os.Stdin, "stdin", filter)
 		if err != nil {
-			return false, nil, fmt.Errorf("open file %v error: %w", input, err)
+			return false, nil, fmt.Errorf("open stdin error: %w", err)
 		}
-		if err = setDeviceFilter(handle, bpf, ips, ports); err != nil {
-			return false, nil, fmt.Errorf("set filter %v error: %w", input, err)
+
+		return true, []chan gopacket.Packet{packets}, nil
+	}
+
+	if files := PcapFiles(input); len(files) > 0 { // read from pcap/pcapng files
+		packets, err := OpenPcapFiles(files, filter)
+		if err != nil {
+			return false, nil, fmt.Errorf("open file %v error: %w", input, err)
 		}
 
-		return true, listenOneSource(handle), nil
+		return true, []chan gopacket.Packet{packets}, nil
+	}
+
+	source, err := NewCaptureSource(conf)
+	if err != nil {
+		return false, nil, err
 	}
 
 	if input == "any" && host != "" {
@@ -70,148 +132,37 @@ func CreatePacketsChan(input, bpf, host, ips, ports string) (isPcapFil bool, pc
 			return false, nil, fmt.Errorf("find device error: %w", err)
 		}
 
-		packetsSlice := make([]chan gopacket.Packet, len(interfaces))
+		var sources [][]chan gopacket.Packet // the k-th fanout sockets of the devices are merged together
 		for _, itf := range interfaces {
-			localPackets, err := OpenSingleDevice(itf.Name, bpf, ips, ports)
+			localPackets, err := source.Open(ctx, itf.Name, filter)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Open device", itf, "error:", err)
 				continue
 			}
 			log.Printf("Open deive %s", itf.Name)
-			packetsSlice = append(packetsSlice, localPackets)
+			for k, packets := range localPackets {
+				if k == len(sources) {
+					sources = append(sources, nil)
+				}
+				sources[k] = append(sources[k], packets)
+			}
 		}
-		if len(packetsSlice) == 0 {
+		if len(sources) == 0 {
 			return false, nil, fmt.Errorf("no device available")
 		}
 
-		return false, mergeChannel(packetsSlice), nil
+		merged := make([]chan gopacket.Packet, len(sources))
+		for k, channels := range sources {
+			merged[k] = mergeChannel(channels)
+		}
+		return false, merged, nil
 	}
 
 	// capture one device
-	packets, err := OpenSingleDevice(input, bpf, ips, ports)
+	packets, err := source.Open(ctx, input, filter)
 	return true, packets, err
 }
 
-func OpenSingleDevice(device, bpf, filterIps, filterPorts string) (localPackets chan gopacket.Packet, err error) {
-	defer func() {
-		if msg := recover(); msg != nil {
-			switch x := msg.(type) {
-			case string:
-				err = errors.New(x)
-			case error:
-				err = x
-			default:
-				err = fmt.Errorf("%v", msg)
-			}
-			localPackets = nil
-		}
-	}()
-	handle, err := pcap.OpenLive(device, 65536, false, pcap.BlockForever)
-	if err != nil {
-		return
-	}
-
-	if err = setDeviceFilter(handle, bpf, filterIps, filterPorts); err != nil {
-		return
-	}
-	localPackets = listenOneSource(handle)
-	return
-}
-
-func listenOneSource(handle *pcap.Handle) chan gopacket.Packet {
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
-	return ps.Packets()
-}
-
-// set packet capture filter, by ip and port
-func setDeviceFilter(handle *pcap.Handle, bpf, filterIps, filterPorts string) error {
-	setter := func(expr string) (err error) {
-		log.Printf("BPF: %s", expr)
-		return handle.SetBPFFilter(expr)
-	}
-	if bpf != "" {
-		return setter(bpf)
-	}
-
-	bpf = "tcp"
-	ips := ss.Split(filterIps, ss.WithSeps(","), ss.WithIgnoreEmpty(true), ss.WithTrimSpace(true))
-	ipr := ""
-	for _, ipRange := range ips {
-		ipFromTo := ss.Split(ipRange, ss.WithSeps("-"), ss.WithIgnoreEmpty(true), ss.WithTrimSpace(true))
-		if len(ipFromTo) > 2 {
-			log.Fatalf("invalid ip flags %s", filterIps)
-		}
-		if len(ipFromTo) == 2 {
-			ip1, ip2 := net.ParseIP(ipFromTo[0]), net.ParseIP(ipFromTo[1])
-			if ip1.To4() == nil {
-				log.Fatalf("invalid ip flags %s, %s is not valid IPv4 ", filterIps, ipFromTo[0])
-			}
-			if ip2.To4() == nil {
-				log.Fatalf("invalid ip flags %s, %s is not valid IPv4 ", filterIps, ipFromTo[1])
-			}
-
-			ip1v4, ip2v4 := FromNetIPv4(ip1), FromNetIPv4(ip2)
-			if ip1v4 > ip2v4 {
-				log.Fatalf("invalid ip flags %s, %s < %s", filterIps, ipFromTo[0], ipFromTo[1])
-			}
-			for ; ip1v4 <= ip2v4; ip1v4++ {
-				ipr += ss.If(ipr != "", " or ", "") + fmt.Sprintf("host %s", ToNetIP(ip1v4))
-			}
-		} else if len(ipFromTo) == 1 {
-			ip1 := net.ParseIP(ipFromTo[0])
-			if ip1.To4() == nil {
-				log.Fatalf("invalid ip flags %s, %s is not valid IPv4 ", filterIps, ipFromTo[0])
-			}
-			ipr += ss.If(ipr != "", " or ", "") + fmt.Sprintf("host %s", ip1)
-		}
-	}
-	if ipr != "" {
-		bpf += " and (" + ipr + ")"
-	}
-
-	ports := ss.Split(filterPorts, ss.WithSeps(","), ss.WithIgnoreEmpty(true), ss.WithTrimSpace(true))
-	portr := ""
-	for _, portRange := range ports {
-		portFromTo := ss.Split(portRange, ss.WithSeps("-"), ss.WithIgnoreEmpty(true), ss.WithTrimSpace(true))
-		if len(portFromTo) > 2 {
-			log.Fatalf("invalid port flags %s", filterPorts)
-		}
-		if len(portFromTo) == 2 {
-			p1, p2 := ss.ParseInt(portFromTo[0]), ss.ParseInt(portFromTo[1])
-			if p1 <= 0 {
-				log.Fatalf("invalid port flags %s, %s is not valid port ", filterPorts, portFromTo[0])
-			}
-			if p2 <= 0 {
-				log.Fatalf("invalid iportp flags %s, %s is not valid port ", filterPorts, portFromTo[1])
-			}
-			if p1 > p2 {
-				log.Fatalf("invalid ip flags %s, %d < %d", filterPorts, p1, p2)
-			}
-
-			for ; p1 <= p2; p1++ {
-				portr += ss.If(portr != "", " or ", "") + fmt.Sprintf("port %d", p1)
-			}
-		} else if len(portFromTo) == 1 {
-			p1 := ss.ParseInt(portFromTo[0])
-			if p1 <= 0 {
-				log.Fatalf("invalid port flags %s, %s is not valid port ", filterPorts, portFromTo[0])
-			}
-
-			portr += ss.If(portr != "", " or ", "") + fmt.Sprintf("port %d", p1)
-		}
-	}
-
-	if portr != "" {
-		bpf += " and (" + portr + ")"
-	}
-
-	if bpf != "" {
-		return setter(bpf)
-	}
-
-	return nil
-}
-
 func ListInterfaces(host string) (ifacesHasAddr []net.Interface, err error) {
 	var ifis []net.Interface
 	ifis, err = net.Interfaces()
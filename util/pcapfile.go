@@ -0,0 +1,411 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/httpdump/globpath"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/multierr"
+)
+
+// Interface is where the packets are captured, a live device or an interface description block of pcapng.
+type Interface struct {
+	Name     string
+	LinkType layers.LinkType
+}
+
+var interfaces struct {
+	sync.RWMutex
+	list []Interface
+}
+
+// RegisterInterface returns the index of the interface to be set to the CaptureInfo.InterfaceIndex of its packets,
+// the index starts from 1, 0 means unknown.
+func RegisterInterface(i Interface) int {
+	interfaces.Lock()
+	defer interfaces.Unlock()
+
+	for j, v := range interfaces.list {
+		if v == i {
+			return j + 1
+		}
+	}
+
+	interfaces.list = append(interfaces.list, i)
+	return len(interfaces.list)
+}
+
+// InterfaceOf returns the interface by the index set in the CaptureInfo.
+func InterfaceOf(index int) (Interface, bool) {
+	interfaces.RLock()
+	defer interfaces.RUnlock()
+
+	if index <= 0 || index > len(interfaces.list) {
+		return Interface{}, false
+	}
+	return interfaces.list[index-1], true
+}
+
+// InterfaceName returns the interface name by the index set in the CaptureInfo, empty if unknown.
+func InterfaceName(index int) string {
+	i, _ := InterfaceOf(index)
+	return i.Name
+}
+
+// pcapngMagic is the block type of the section header block which starts a pcapng file.
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// compression magics of the archived pcap files, like a.pcap.gz, a.pcap.zst or a.pcap.xz.
+var (
+	gzipMagic = []byte{0x1F, 0x8B}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	xzMagic   = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
+)
+
+// decompress returns the decompressed reader of the gzip, zstd or xz stream detected by its magic,
+// or the stream itself when it is not compressed.
+func decompress(br *bufio.Reader) (io.Reader, io.Closer, error) {
+	magic, _ := br.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		r, err := gzip.NewReader(br)
+		return r, r, err
+	case bytes.HasPrefix(magic, zstdMagic):
+		r, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc := r.IOReadCloser()
+		return rc, rc, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		r, err := xz.NewReader(br)
+		return r, io.NopCloser(nil), err
+	default:
+		return br, io.NopCloser(nil), nil
+	}
+}
+
+// packetReader reads packets of a pcap or pcapng stream, which may be compressed by gzip, zstd or xz.
+type packetReader struct {
+	file string
+	rc   io.Closer
+	dc   io.Closer
+	pcap *pcapgo.Reader
+	ng   *pcapgo.NgReader
+
+	ifaces   map[int]int // the interface id in the file to the registered index
+	filter   *PacketFilter
+	matchers map[layers.LinkType]func(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+func openPacketReader(file string, filter *PacketFilter) (*packetReader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPacketReader(f, file, filter)
+}
+
+// newPacketReader reads the packets from rc, which is closed when the reader is closed or fails to create.
+func newPacketReader(rc io.ReadCloser, file string, filter *PacketFilter) (*packetReader, error) {
+	r := &packetReader{file: file, rc: rc, filter: filter, ifaces: map[int]int{},
+		matchers: map[layers.LinkType]func(ci gopacket.CaptureInfo, data []byte) bool{}}
+	d, dc, err := decompress(bufio.NewReader(rc))
+	if err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+
+	r.dc = dc
+	br := bufio.NewReader(d)
+	if magic, _ := br.Peek(4); bytes.Equal(magic, pcapngMagic) {
+		r.ng, err = pcapgo.NewNgReader(br, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	} else {
+		r.pcap, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+
+	return r, nil
+}
+
+// next returns the next packet passing the filter, with the registered interface index.
+func (r *packetReader) next() (gopacket.Packet, error) {
+	for {
+		data, ci, linkType, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok, err := r.matches(linkType, ci, data); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		p := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		p.Metadata().CaptureInfo = ci
+		return p, nil
+	}
+}
+
+func (r *packetReader) read() (data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, err error) {
+	if r.pcap != nil {
+		data, ci, err = r.pcap.ReadPacketData()
+		return data, ci, r.pcap.LinkType(), err
+	}
+
+	if data, ci, err = r.ng.ReadPacketData(); err != nil {
+		return nil, ci, 0, err
+	}
+	linkType = ci.AncillaryData[0].(layers.LinkType)
+	ci.AncillaryData = nil
+
+	index, ok := r.ifaces[ci.InterfaceIndex]
+	if !ok {
+		i, _ := r.ng.Interface(ci.InterfaceIndex)
+		name := i.Name
+		if name == "" {
+			name = i.Description
+		}
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", filepath.Base(r.file), ci.InterfaceIndex)
+		}
+		index = RegisterInterface(Interface{Name: name, LinkType: linkType})
+		r.ifaces[ci.InterfaceIndex] = index
+	}
+	ci.InterfaceIndex = index
+	return data, ci, linkType, nil
+}
+
+// matches tells whether the packet passes the filter, which is compiled for each link type.
+func (r *packetReader) matches(linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte) (bool, error) {
+	m, ok := r.matchers[linkType]
+	if !ok {
+		var err error
+		if m, err = r.filter.Matcher(linkType); err != nil {
+			return false, fmt.Errorf("compile filter %q for %s: %w", r.filter.Expr(), linkType, err)
+		}
+		r.matchers[linkType] = m
+	}
+	return m(ci, data), nil
+}
+
+func (r *packetReader) Close() error { return multierr.Append(r.dc.Close(), r.rc.Close()) }
+
+// OpenPcapStream reads the packets of a pcap/pcapng stream, like the output of tcpdump -w - from stdin.
+func OpenPcapStream(rc io.ReadCloser, name string, filter *PacketFilter) (chan gopacket.Packet, error) {
+	r, err := newPacketReader(rc, name, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &pcapMerger{filter: filter}
+	m.push(r)
+	return m.stream(), nil
+}
+
+// PcapFiles returns the files of the input, which is a file, a directory, or a glob pattern of globpath
+// like captures/**.pcap or 9200.pcap* for the files rotated by tcpdump -C. It returns nil if there is no file.
+// The files are not opened, the ones not pcap/pcapng are skipped by OpenPcapFiles.
+func PcapFiles(input string) []string {
+	g, err := globpath.Compile(input)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, m := range g.Match() {
+		s, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		if !s.IsDir() {
+			files = append(files, m)
+			continue
+		}
+
+		entries, _ := os.ReadDir(m)
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(m, e.Name()))
+			}
+		}
+	}
+
+	return files
+}
+
+// maxOpenPcapFiles is the max number of the pcap files kept open after their first packets are read,
+// the more are closed and opened again when the stream reaches their first packets.
+const maxOpenPcapFiles = 64
+
+// OpenPcapFiles merges the packets of the pcap/pcapng files, optionally compressed by gzip, zstd or xz, by timestamp
+// into one stream, keeping the interface of each packet, so that the connections spanning the files are reassembled
+// correctly. Each file is opened once to read its first packet, and kept open to be merged, unless there are more
+// than maxOpenPcapFiles files. The files not pcap/pcapng are skipped, an error is returned if none of them is.
+func OpenPcapFiles(files []string, filter *PacketFilter) (chan gopacket.Packet, error) {
+	m := &pcapMerger{filter: filter}
+	var errs error
+	for _, file := range files {
+		r, err := openPacketReader(file, filter)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		p := m.read(r)
+		if p == nil { // no packet passes the filter
+			_ = r.Close()
+			continue
+		}
+		src := pcapSource{file: file, first: p.Metadata().Timestamp, r: r, p: p}
+		if len(files) > maxOpenPcapFiles {
+			_ = r.Close()
+			src.r, src.p = nil, nil
+		}
+		m.sources = append(m.sources, src)
+	}
+	if len(m.sources) == 0 && errs != nil {
+		return nil, errs
+	}
+	if errs != nil {
+		log.Printf("W! skip the files not pcap: %v", errs)
+	}
+	sort.SliceStable(m.sources, func(i, j int) bool { return m.sources[i].first.Before(m.sources[j].first) })
+
+	return m.stream(), nil
+}
+
+// pcapSource is a pcap file to merge, with the timestamp of its first packet passing the filter.
+type pcapSource struct {
+	file  string
+	first time.Time
+	r     *packetReader   // the reader opened already, nil if it is closed after the first packet is read
+	p     gopacket.Packet // the first packet read by r
+}
+
+// pcapMerger merges the packets of pcapSources by timestamp.
+type pcapMerger struct {
+	filter  *PacketFilter
+	sources []pcapSource // not opened yet, sorted by the first timestamps
+	heads   pcapHeads
+}
+
+// pcapHead is an opened pcap file, with its next packet.
+type pcapHead struct {
+	r *packetReader
+	p gopacket.Packet
+}
+
+// pcapHeads is a min heap of pcapHead by the timestamp of the next packets.
+type pcapHeads []*pcapHead
+
+func (h pcapHeads) Len() int { return len(h) }
+func (h pcapHeads) Less(i, j int) bool {
+	return h[i].p.Metadata().Timestamp.Before(h[j].p.Metadata().Timestamp)
+}
+func (h pcapHeads) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pcapHeads) Push(x any)   { *h = append(*h, x.(*pcapHead)) }
+func (h *pcapHeads) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// next returns the earliest packet of all files, nil when all files are read.
+func (m *pcapMerger) next() gopacket.Packet {
+	for len(m.sources) > 0 && (len(m.heads) == 0 || !m.sources[0].first.After(m.heads[0].p.Metadata().Timestamp)) {
+		if err := m.open(m.sources[0]); err != nil {
+			log.Printf("E! %v", err)
+		}
+		m.sources = m.sources[1:]
+	}
+
+	if len(m.heads) == 0 {
+		return nil
+	}
+
+	h := m.heads[0]
+	p := h.p
+	if h.p = m.read(h.r); h.p == nil {
+		heap.Pop(&m.heads)
+		_ = h.r.Close()
+	} else {
+		heap.Fix(&m.heads, 0)
+	}
+	return p
+}
+
+// stream sends the merged packets to the returned channel, which is closed when all packets are sent.
+func (m *pcapMerger) stream() chan gopacket.Packet {
+	packets := make(chan gopacket.Packet, 1000)
+	go func() {
+		defer close(packets)
+
+		for {
+			p := m.next()
+			if p == nil {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	return packets
+}
+
+func (m *pcapMerger) open(s pcapSource) error {
+	if s.r != nil {
+		heap.Push(&m.heads, &pcapHead{r: s.r, p: s.p})
+		return nil
+	}
+
+	r, err := openPacketReader(s.file, m.filter)
+	if err != nil {
+		return err
+	}
+
+	m.push(r)
+	return nil
+}
+
+// push reads the first packet of the opened reader, and pushes it to the heads.
+func (m *pcapMerger) push(r *packetReader) {
+	if p := m.read(r); p != nil {
+		heap.Push(&m.heads, &pcapHead{r: r, p: p})
+	} else {
+		_ = r.Close()
+	}
+}
+
+func (m *pcapMerger) read(r *packetReader) gopacket.Packet {
+	p, err := r.next()
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("E! read %s failed: %v", r.file, err)
+		}
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func serializeTCP(t *testing.T, linkType layers.LinkType, port uint16) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 80}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	ls := []gopacket.SerializableLayer{ip, tcp}
+	if linkType == layers.LinkTypeEthernet {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}, DstMAC: net.HardwareAddr{6, 5, 4, 3, 2, 1}, EthernetType: layers.EthernetTypeIPv4}
+		ls = append([]gopacket.SerializableLayer{eth}, ls...)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	assert.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...))
+	return buf.Bytes()
+}
+
+func writePcapng(t *testing.T, file string, start time.Time) {
+	f, err := os.Create(file)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	w, err := pcapgo.NewNgWriterInterface(f, pcapgo.NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet}, pcapgo.DefaultNgWriterOptions)
+	assert.Nil(t, err)
+	tun, err := w.AddInterface(pcapgo.NgInterface{Name: "tun0", LinkType: layers.LinkTypeRaw})
+	assert.Nil(t, err)
+
+	for i, iface := range []int{0, tun} {
+		linkType := []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw}[i]
+		data := serializeTCP(t, linkType, uint16(5000+i))
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(data), Length: len(data), InterfaceIndex: iface}
+		assert.Nil(t, w.WritePacket(ci, data))
+	}
+	assert.Nil(t, w.Flush())
+}
+
+func TestOpenPcapFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writePcapng(t, filepath.Join(dir, "a.pcapng"), now.Add(500*time.Millisecond))
+	writePcapng(t, filepath.Join(dir, "b.pcapng"), now)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a pcap file"), 0o644))
+
+	files := PcapFiles(filepath.Join(dir, "*.pcapng"))
+	assert.ElementsMatch(t, []string{filepath.Join(dir, "b.pcapng"), filepath.Join(dir, "a.pcapng")}, files)
+	files = PcapFiles(dir)
+	assert.Len(t, files, 3) // the README is skipped when it is opened
+
+	_, err := OpenPcapFiles([]string{filepath.Join(dir, "README")}, nil)
+	assert.NotNil(t, err)
+
+	packets, err := OpenPcapFiles(files, nil)
+	assert.Nil(t, err)
+
+	var names []string
+	var ports []layers.TCPPort
+	var last time.Time
+	for p := range packets {
+		assert.False(t, p.Metadata().Timestamp.Before(last))
+		last = p.Metadata().Timestamp
+		names = append(names, InterfaceName(p.Metadata().InterfaceIndex))
+		ports = append(ports, p.TransportLayer().(*layers.TCP).SrcPort)
+	}
+	// merged by timestamp: b eth0, a eth0, b tun0, a tun0
+	assert.Equal(t, []string{"eth0", "eth0", "tun0", "tun0"}, names)
+	assert.Equal(t, []layers.TCPPort{5000, 5000, 5001, 5001}, ports)
+}
+
+func TestOpenCompressedPcap(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.pcapng")
+	writePcapng(t, file, time.Now())
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+
+	var gz, zs, x bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write(data)
+	assert.Nil(t, gw.Close())
+	zw, _ := zstd.NewWriter(&zs)
+	_, _ = zw.Write(data)
+	assert.Nil(t, zw.Close())
+	xw, _ := xz.NewWriter(&x)
+	_, _ = xw.Write(data)
+	assert.Nil(t, xw.Close())
+
+	for ext, b := range map[string][]byte{".gz": gz.Bytes(), ".zst": zs.Bytes(), ".xz": x.Bytes()} {
+		assert.Nil(t, os.WriteFile(file+ext, b, 0o644))
+		assert.Equal(t, []string{file + ext}, PcapFiles(file+ext), ext)
+
+		packets, err := OpenPcapStream(io.NopCloser(bytes.NewReader(b)), "stdin", nil)
+		assert.Nil(t, err)
+		n := 0
+		for range packets {
+			n++
+		}
+		assert.Equal(t, 2, n, ext)
+	}
+}
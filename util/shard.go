@@ -0,0 +1,102 @@
+package util
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ShardedAssembler spreads the tcp packets over the shards by the symmetric hash of the 4-tuple,
+// so that both directions of a connection go to the same shard in order.
+// Each shard runs its own assembler in its own goroutine, the connections and the idle flushing
+// of a shard are not shared with the others.
+// Only the assembling is sharded, the packets are decoded, decapsulated and filtered before it
+// by one goroutine for each source in LoopPackets, so the decoding of a single device or pcap file
+// is not spread, and the AF_PACKET sockets of -fanout are needed to spread it.
+type ShardedAssembler struct {
+	shards []*assemblerShard
+	wg     sync.WaitGroup
+}
+
+type assemblerShard struct {
+	Assembler
+	packets chan shardPacket
+}
+
+// shardPacket is a tcp packet to assemble, or a flush of the idle connections when tcp is nil.
+type shardPacket struct {
+	flow  gopacket.Flow
+	tcp   *layers.TCP
+	ci    gopacket.CaptureInfo
+	flush time.Time
+}
+
+// NewShardedAssembler creates n shards of the assemblers created by create, each buffers chanSize packets.
+// n <= 0 means the number of CPUs, and the assembler is returned directly without sharding when n is 1.
+func NewShardedAssembler(n int, chanSize uint, create func() Assembler) Assembler {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	if n == 1 {
+		return create()
+	}
+
+	s := &ShardedAssembler{shards: make([]*assemblerShard, n)}
+	for i := range s.shards {
+		shard := &assemblerShard{Assembler: create(), packets: make(chan shardPacket, chanSize)}
+		s.shards[i] = shard
+		s.wg.Add(1)
+		go shard.run(&s.wg)
+	}
+	return s
+}
+
+func (s *assemblerShard) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for p := range s.packets {
+		if p.tcp == nil {
+			s.Assembler.FlushOlderThan(p.flush)
+		} else {
+			s.Assembler.Assemble(p.flow, p.tcp, p.ci)
+		}
+	}
+}
+
+func (s *ShardedAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
+	shard := s.shards[shardHash(flow, tcp)%uint64(len(s.shards))]
+	shard.packets <- shardPacket{flow: flow, tcp: tcp, ci: ci}
+}
+
+// FlushOlderThan asks the shards to flush their idle connections in their own goroutines.
+func (s *ShardedAssembler) FlushOlderThan(t time.Time) {
+	for _, shard := range s.shards {
+		shard.packets <- shardPacket{flush: t}
+	}
+}
+
+// FinishAll waits for the shards to assemble the queued packets, and then finishes them.
+func (s *ShardedAssembler) FinishAll() {
+	for _, shard := range s.shards {
+		close(shard.packets)
+	}
+	s.wg.Wait()
+
+	for _, shard := range s.shards {
+		shard.FinishAll()
+	}
+}
+
+// shardHash is the hash of the 4-tuple, which is the same for both directions.
+func shardHash(flow gopacket.Flow, tcp *layers.TCP) uint64 {
+	a, b := uint64(tcp.SrcPort), uint64(tcp.DstPort)
+	if a > b {
+		a, b = b, a
+	}
+	// FastHash of the flow is symmetric, the ordered ports are mixed by the golden ratio
+	ports := (a<<16 | b) * 0x9E3779B97F4A7C15
+	return flow.FastHash() ^ ports>>32
+}
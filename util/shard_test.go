@@ -0,0 +1,73 @@
+package util
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordAssembler records the connections assembled, flushed and finished in it.
+type recordAssembler struct {
+	lock     *sync.Mutex
+	conns    map[string]int // connection to the assembler id
+	id       int
+	packets  int
+	flushed  bool
+	finished bool
+}
+
+func (r *recordAssembler) Assemble(flow gopacket.Flow, tcp *layers.TCP, _ gopacket.CaptureInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a, b := flow.Src().String()+":"+tcp.SrcPort.String(), flow.Dst().String()+":"+tcp.DstPort.String()
+	if a > b {
+		a, b = b, a
+	}
+	if id, ok := r.conns[a+"-"+b]; ok && id != r.id {
+		r.conns[a+"-"+b] = -1 // split over the shards
+	} else {
+		r.conns[a+"-"+b] = r.id
+	}
+	r.packets++
+}
+
+func (r *recordAssembler) FlushOlderThan(time.Time) { r.flushed = true }
+func (r *recordAssembler) FinishAll()               { r.finished = true }
+
+func TestShardedAssembler(t *testing.T) {
+	lock, conns := &sync.Mutex{}, map[string]int{}
+	var shards []*recordAssembler
+	s := NewShardedAssembler(4, 10, func() Assembler {
+		r := &recordAssembler{lock: lock, conns: conns, id: len(shards)}
+		shards = append(shards, r)
+		return r
+	})
+	assert.Len(t, shards, 4)
+
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	for port := 10000; port < 11000; port++ {
+		req := gopacket.NewFlow(layers.EndpointIPv4, client, server)
+		s.Assemble(req, &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 80}, gopacket.CaptureInfo{})
+		s.Assemble(req.Reverse(), &layers.TCP{SrcPort: 80, DstPort: layers.TCPPort(port)}, gopacket.CaptureInfo{})
+	}
+	s.FlushOlderThan(time.Now())
+	s.FinishAll()
+
+	assert.Len(t, conns, 1000)
+	for conn, id := range conns {
+		assert.NotEqual(t, -1, id, conn)
+	}
+	for _, r := range shards {
+		assert.True(t, r.packets > 0)
+		assert.True(t, r.flushed)
+		assert.True(t, r.finished)
+	}
+
+	assert.IsType(t, &recordAssembler{}, NewShardedAssembler(1, 10, func() Assembler { return &recordAssembler{} }))
+}
@@ -0,0 +1,213 @@
+package util
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnel is the outermost encapsulation of a packet, like vxlan:100 or vlan:20, recorded in the
+// CaptureInfo.AncillaryData of the packet by the Decapsulator.
+type Tunnel struct {
+	Type string // vlan, gre, erspan, vxlan or geneve
+	ID   uint32 // VLAN ID, GRE key, ERSPAN session ID, VXLAN/Geneve VNI
+}
+
+func (t Tunnel) String() string {
+	if t.Type == "" {
+		return ""
+	}
+	return t.Type + ":" + strconv.FormatUint(uint64(t.ID), 10)
+}
+
+// TunnelOf returns the tunnel recorded in the capture info, zero if the packet is not encapsulated.
+func TunnelOf(ci gopacket.CaptureInfo) Tunnel {
+	for _, v := range ci.AncillaryData {
+		if t, ok := v.(Tunnel); ok {
+			return t
+		}
+	}
+	return Tunnel{}
+}
+
+// DefaultVXLANPort is the IANA assigned UDP port of VXLAN, which gopacket decodes by itself.
+const DefaultVXLANPort = 4789
+
+// Decapsulator peels the tunnel layers to get the inner tcp of packets, like the traffic of mirror ports
+// or cloud packet mirroring, and filters the inner packets by ips and ports which the bpf can not see.
+// VLAN tags are always peeled.
+type Decapsulator struct {
+	GRE        bool // including GRE transparent ethernet bridging
+	ERSPAN     bool // ERSPAN type II over GRE
+	Geneve     bool // on UDP port 6081
+	VXLANPorts []uint16
+
+	IPs   *IPFilter
+	Ports *IntSet
+}
+
+// ParseDecapsulator parses the spec like all, none, or gre,erspan,geneve,vxlan:4789/8472,
+// a plain vxlan means the port 4789. It returns nil for none, so neither the capture filter is widened
+// nor the packets are decapsulated.
+func ParseDecapsulator(spec string) (*Decapsulator, error) {
+	d := &Decapsulator{}
+	enabled := false
+	for _, item := range strings.Split(spec, ",") {
+		name, ports, _ := strings.Cut(strings.TrimSpace(item), ":")
+		switch strings.ToLower(name) {
+		case "", "none":
+			continue
+		case "all":
+			d.GRE, d.ERSPAN, d.Geneve = true, true, true
+			d.addVXLANPort(DefaultVXLANPort)
+		case "vlan":
+		case "gre":
+			d.GRE = true
+		case "erspan":
+			d.ERSPAN = true
+		case "geneve":
+			d.Geneve = true
+		case "vxlan":
+			if ports == "" {
+				ports = strconv.Itoa(DefaultVXLANPort)
+			}
+			for _, p := range strings.Split(ports, "/") {
+				port, err := strconv.ParseUint(p, 10, 16)
+				if err != nil || port == 0 {
+					return nil, fmt.Errorf("invalid vxlan port %s in %s", p, item)
+				}
+				d.addVXLANPort(uint16(port))
+			}
+		default:
+			return nil, fmt.Errorf("unknown tunnel %s", item)
+		}
+		enabled = true
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return d, nil
+}
+
+func (d *Decapsulator) addVXLANPort(port uint16) {
+	for _, p := range d.VXLANPorts {
+		if p == port {
+			return
+		}
+	}
+	d.VXLANPorts = append(d.VXLANPorts, port)
+	sort.Slice(d.VXLANPorts, func(i, j int) bool { return d.VXLANPorts[i] < d.VXLANPorts[j] })
+}
+
+// BPF extends the bpf expression of the plain tcp packets to the enabled tunnels and the vlan tagged ones,
+// the inner packets of tunnels are filtered in user space.
+func (d *Decapsulator) BPF(expr string) string {
+	terms := []string{"(" + expr + ")"}
+	if d.GRE || d.ERSPAN {
+		terms = append(terms, "(ip proto 47 or ip6 proto 47)")
+	}
+	if d.Geneve {
+		terms = append(terms, "(udp port 6081)")
+	}
+	for _, p := range d.VXLANPorts {
+		terms = append(terms, fmt.Sprintf("(udp port %d)", p))
+	}
+	// vlan shifts the offsets for the rest of the expression, so it must be the last one
+	terms = append(terms, "(vlan and ("+expr+"))")
+	return strings.Join(terms, " or ")
+}
+
+// Decapsulate returns the innermost network flow and tcp layer of the packet, and records the outermost tunnel
+// in its CaptureInfo.AncillaryData. ok is false if the packet is not tcp, is in a tunnel not enabled,
+// or is filtered out by the ips and ports.
+func (d *Decapsulator) Decapsulate(p gopacket.Packet) (flow gopacket.Flow, tcp *layers.TCP, ok bool) {
+	var tunnel Tunnel
+	var network gopacket.NetworkLayer
+	ls := p.Layers()
+	for i := 0; i < len(ls); i++ {
+		var t Tunnel
+		switch l := ls[i].(type) {
+		case *layers.Dot1Q:
+			t = Tunnel{Type: "vlan", ID: uint32(l.VLANIdentifier)}
+		case *layers.GRE:
+			if l.Protocol == layers.EthernetTypeERSPAN { // recorded by the ERSPAN layer
+				break
+			}
+			if !d.GRE {
+				return flow, nil, false
+			}
+			t = Tunnel{Type: "gre", ID: l.Key}
+		case *layers.ERSPANII:
+			if !d.ERSPAN {
+				return flow, nil, false
+			}
+			t = Tunnel{Type: "erspan", ID: uint32(l.SessionID)}
+		case *layers.Geneve:
+			if !d.Geneve {
+				return flow, nil, false
+			}
+			t = Tunnel{Type: "geneve", ID: l.VNI}
+		case *layers.VXLAN:
+			if len(d.VXLANPorts) == 0 {
+				return flow, nil, false
+			}
+			t = Tunnel{Type: "vxlan", ID: l.VNI}
+		case *layers.UDP:
+			if l.NextLayerType() != gopacket.LayerTypePayload || !d.isVXLANPort(uint16(l.DstPort)) {
+				break
+			}
+			// VXLAN on a non-standard port, like 8472 of linux, decode the payload as VXLAN
+			inner := gopacket.NewPacket(l.Payload, layers.LayerTypeVXLAN, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			ls = append(ls[:i+1:i+1], inner.Layers()...)
+		case gopacket.NetworkLayer:
+			network = l
+		case *layers.TCP:
+			if network == nil {
+				return flow, nil, false
+			}
+			tcp = l
+		}
+		if tunnel.Type == "" && t.Type != "" {
+			tunnel = t
+		}
+	}
+
+	if tcp == nil {
+		return flow, nil, false
+	}
+
+	flow = network.NetworkFlow()
+	if tunnel.Type != "" {
+		md := p.Metadata()
+		md.AncillaryData = append(md.AncillaryData, tunnel)
+	}
+	return flow, tcp, d.permits(flow, tcp)
+}
+
+func (d *Decapsulator) isVXLANPort(port uint16) bool {
+	for _, p := range d.VXLANPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// permits tells whether the inner packet passes the ips and ports.
+func (d *Decapsulator) permits(flow gopacket.Flow, tcp *layers.TCP) bool {
+	if d.Ports != nil && !d.Ports.Contains(int(tcp.SrcPort)) && !d.Ports.Contains(int(tcp.DstPort)) {
+		return false
+	}
+	if d.IPs == nil {
+		return true
+	}
+
+	src, _ := netip.AddrFromSlice(flow.Src().Raw())
+	dst, _ := netip.AddrFromSlice(flow.Dst().Raw())
+	return d.IPs.Permits(src, dst)
+}
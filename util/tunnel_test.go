@@ -0,0 +1,71 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func encapsulate(t *testing.T, outer ...gopacket.SerializableLayer) gopacket.Packet {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 2, 3, 4, 5, 6}, DstMAC: net.HardwareAddr{6, 5, 4, 3, 2, 1}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 1, 0, 1}, DstIP: net.IP{10, 1, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 5000, DstPort: 80}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	ls := append(outer, eth, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+	assert.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...))
+	return gopacket.NewPacket(buf.Bytes(), ls[0].LayerType(), gopacket.Default)
+}
+
+func outerUDP(port uint16) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 1, 1, 1, 1, 1}, DstMAC: net.HardwareAddr{2, 2, 2, 2, 2, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}}
+	return []gopacket.SerializableLayer{eth, ip, &layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(port)}, &layers.VXLAN{ValidIDFlag: true, VNI: 100}}
+}
+
+func TestDecapsulate(t *testing.T) {
+	d, err := ParseDecapsulator("gre,vxlan:4789/8472")
+	assert.Nil(t, err)
+	assert.Equal(t, "(tcp) or (ip proto 47 or ip6 proto 47) or (udp port 4789) or (udp port 8472) or (vlan and (tcp))", d.BPF("tcp"))
+
+	for _, port := range []uint16{4789, 8472} {
+		p := encapsulate(t, outerUDP(port)...)
+		flow, tcp, ok := d.Decapsulate(p)
+		assert.True(t, ok)
+		assert.Equal(t, "10.1.0.1->10.1.0.2", flow.String())
+		assert.Equal(t, layers.TCPPort(80), tcp.DstPort)
+		assert.Equal(t, "vxlan:100", TunnelOf(p.Metadata().CaptureInfo).String())
+	}
+
+	_, _, ok := d.Decapsulate(encapsulate(t, outerUDP(9999)...))
+	assert.False(t, ok)
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{1, 1, 1, 1, 1, 1}, DstMAC: net.HardwareAddr{2, 2, 2, 2, 2, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}}
+	gre := &layers.GRE{KeyPresent: true, Key: 7, Protocol: layers.EthernetTypeTransparentEthernetBridging}
+	p := encapsulate(t, eth, ip, gre)
+	flow, _, ok := d.Decapsulate(p)
+	assert.True(t, ok)
+	assert.Equal(t, "10.1.0.1->10.1.0.2", flow.String())
+	assert.Equal(t, "gre:7", TunnelOf(p.Metadata().CaptureInfo).String())
+
+	d.IPs, _ = ParseIPFilter("!10.1.0.2")
+	_, _, ok = d.Decapsulate(p)
+	assert.False(t, ok)
+
+	none, err := ParseDecapsulator("none")
+	assert.Nil(t, err)
+	assert.Nil(t, none)
+	_, _, ok = packetTCP(encapsulate(t, outerUDP(4789)...), none)
+	assert.False(t, ok)
+	f, err := NewPacketFilter("", nil, "80", none)
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp and (port 80)", f.Expr()) // not widened to the vlan tagged packets
+
+	_, err = ParseDecapsulator("vxlan:abc")
+	assert.NotNil(t, err)
+}